@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	amqpRetryDelay     = 5 * time.Second
+	amqpConsumeChannel = 1
+	amqpPublishChannel = 2
+)
+
+// AMQPIngester works a queue of transcription requests (see streamRequest)
+// with at most Workers messages unacked. A message is acked only after its
+// transcript has been published and confirmed by the broker, so nothing is
+// lost if the agent dies mid-transcription.
+//
+// Results go to the message's reply_to queue (RPC style, with its
+// correlation_id) or to --amqp-result-exchange. A failed transcription is
+// requeued once; if it fails again the failure is published and the message
+// rejected, so it ends up in the queue's dead letter exchange, if any.
+type AMQPIngester struct {
+	pool *WorkerPool
+	cfg  Config
+
+	publishMu sync.Mutex
+}
+
+func NewAMQPIngester(pool *WorkerPool, cfg Config) *AMQPIngester {
+	return &AMQPIngester{pool: pool, cfg: cfg}
+}
+
+func (a *AMQPIngester) Run() {
+	for {
+		err := a.session()
+		log.Printf("AMQP connection to %s lost: %v", redactURL(a.cfg.AMQPURL), err)
+		time.Sleep(amqpRetryDelay)
+	}
+}
+
+func (a *AMQPIngester) session() error {
+	conn, err := dialAMQP(a.cfg.AMQPURL, amqpConsumeChannel, amqpPublishChannel)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.openChannel(amqpPublishChannel); err != nil {
+		return err
+	}
+	if err := conn.confirmSelect(amqpPublishChannel); err != nil {
+		return err
+	}
+	if err := conn.openChannel(amqpConsumeChannel); err != nil {
+		return err
+	}
+	if err := conn.consume(amqpConsumeChannel, a.cfg.AMQPQueue, a.cfg.Workers); err != nil {
+		return err
+	}
+	log.Printf("AMQP consuming queue %s...", a.cfg.AMQPQueue)
+
+	for delivery := range conn.Deliveries(amqpConsumeChannel) {
+		go a.handleDelivery(conn, delivery)
+	}
+	return conn.Err()
+}
+
+func (a *AMQPIngester) handleDelivery(conn *amqpConn, delivery amqpDelivery) {
+	properties := delivery.Properties
+	id := properties.MessageID
+	if id == "" {
+		id = properties.CorrelationID
+	}
+	filename, _ := properties.Headers["filename"].(string)
+
+	request, err := parseStreamRequest(delivery.Body, id, filename)
+	result := streamResult{ID: id, Status: JobFailed}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result = transcribeStreamRequest(a.pool, a.cfg, "amqp", request)
+	}
+	// Invalid requests won't get better by retrying, failed transcriptions might.
+	if result.Status == JobFailed && err == nil && !delivery.Redelivered {
+		log.Printf("AMQP message %s failed, requeueing: %s", id, result.Error)
+		conn.nack(amqpConsumeChannel, delivery.Tag, true)
+		return
+	}
+
+	if err := a.publish(conn, properties, result); err != nil {
+		log.Printf("AMQP publishing result of %s failed: %v", id, err)
+		conn.nack(amqpConsumeChannel, delivery.Tag, true)
+		return
+	}
+	if result.Status == JobCompleted {
+		conn.ack(amqpConsumeChannel, delivery.Tag)
+	} else {
+		conn.nack(amqpConsumeChannel, delivery.Tag, false)
+	}
+}
+
+func (a *AMQPIngester) publish(conn *amqpConn, request amqpProperties, result streamResult) error {
+	exchange, routingKey := a.cfg.AMQPResultExchange, a.cfg.AMQPResultRoutingKey
+	if request.ReplyTo != "" {
+		exchange, routingKey = "", request.ReplyTo
+	}
+	if exchange == "" && routingKey == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Confirms arrive in publish order, so one publish at a time keeps them
+	// matched up.
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+	return conn.publish(amqpPublishChannel, exchange, routingKey, amqpProperties{ContentType: "application/json", CorrelationID: request.CorrelationID}, data)
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+
+	amqpFrameMax  = 131072
+	amqpTimeout   = 30 * time.Second
+	amqpHeartbeat = 30 * time.Second
+)
+
+// Class and method ids, as class<<16 | method.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+)
+
+type amqpMethod struct {
+	ID   uint32
+	Args *amqpDecoder
+}
+
+type amqpProperties struct {
+	ContentType   string
+	Headers       map[string]interface{}
+	CorrelationID string
+	ReplyTo       string
+	MessageID     string
+}
+
+type amqpDelivery struct {
+	Tag         uint64
+	Redelivered bool
+	Properties  amqpProperties
+	Body        []byte
+	size        uint64
+}
+
+type amqpChannel struct {
+	rpc        chan amqpMethod
+	confirms   chan amqpMethod
+	deliveries chan amqpDelivery
+	pending    *amqpDelivery
+}
+
+// amqpConn is a minimal AMQP 0-9-1 client: channels, basic.consume with
+// manual acks, and basic.publish with publisher confirms. A goroutine reads
+// frames until the connection fails; Done is closed then and deliveries stop.
+type amqpConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	frameMax int
+	timeout  time.Duration
+
+	writeMu  sync.Mutex
+	channels map[uint16]*amqpChannel
+	err      error
+	done     chan struct{}
+}
+
+func dialAMQP(rawURL string, channels ...uint16) (*amqpConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid AMQP url")
+	}
+	addr := u.Host
+	dialer := &net.Dialer{Timeout: amqpTimeout}
+	var conn net.Conn
+	if u.Scheme == "amqps" {
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "5671")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "5672")
+		}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := &amqpConn{conn: conn, reader: bufio.NewReader(conn), channels: make(map[uint16]*amqpChannel), done: make(chan struct{})}
+	for _, id := range channels {
+		c.channels[id] = &amqpChannel{rpc: make(chan amqpMethod, 1), confirms: make(chan amqpMethod, 16), deliveries: make(chan amqpDelivery, 16)}
+	}
+	if err := c.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	go c.heartbeat()
+	return c, nil
+}
+
+func (c *amqpConn) handshake(u *url.URL) error {
+	c.conn.SetDeadline(time.Now().Add(amqpTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	c.frameMax = amqpFrameMax
+	if _, err := c.conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := c.expect(amqpConnectionStart); err != nil {
+		return err
+	}
+	user, password := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	var startOk amqpEncoder
+	startOk.table(map[string]string{"product": "whisper-transcribe-agent", "platform": "Go"})
+	startOk.shortstr("PLAIN")
+	startOk.longstr("\x00" + user + "\x00" + password)
+	startOk.shortstr("en_US")
+	if err := c.send(0, amqpConnectionStartOk, startOk.buf); err != nil {
+		return err
+	}
+
+	tune, err := c.expect(amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	channelMax := tune.Args.short()
+	frameMax := tune.Args.long()
+	heartbeat := time.Duration(tune.Args.short()) * time.Second
+	if frameMax == 0 || frameMax > amqpFrameMax {
+		frameMax = amqpFrameMax
+	}
+	if heartbeat == 0 || heartbeat > amqpHeartbeat {
+		heartbeat = amqpHeartbeat
+	}
+	c.frameMax, c.timeout = int(frameMax), heartbeat
+	var tuneOk amqpEncoder
+	tuneOk.short(channelMax)
+	tuneOk.long(frameMax)
+	tuneOk.short(uint16(heartbeat / time.Second))
+	if err := c.send(0, amqpConnectionTuneOk, tuneOk.buf); err != nil {
+		return err
+	}
+
+	vhost := strings.TrimPrefix(u.Path, "/")
+	if u.Path == "" {
+		vhost = "/"
+	}
+	if vhost, err = url.PathUnescape(vhost); err != nil {
+		return errors.WithStack(err)
+	}
+	var open amqpEncoder
+	open.shortstr(vhost)
+	open.shortstr("")
+	open.octet(0)
+	if err := c.send(0, amqpConnectionOpen, open.buf); err != nil {
+		return err
+	}
+	_, err = c.expect(amqpConnectionOpenOk)
+	return err
+}
+
+// expect reads frames during the handshake until the given method arrives.
+func (c *amqpConn) expect(id uint32) (amqpMethod, error) {
+	for {
+		frameType, _, payload, err := c.readFrame()
+		if err != nil {
+			return amqpMethod{}, err
+		}
+		if frameType != amqpFrameMethod {
+			continue
+		}
+		method := parseAMQPMethod(payload)
+		if method.ID == amqpConnectionClose {
+			return method, amqpCloseError(method)
+		}
+		if method.ID != id {
+			return method, errors.Errorf("unexpected AMQP method %d.%d", method.ID>>16, method.ID&0xFFFF)
+		}
+		return method, nil
+	}
+}
+
+func (c *amqpConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *amqpConn) Err() error {
+	return c.err
+}
+
+func (c *amqpConn) Close() error {
+	c.send(0, amqpConnectionClose, []byte{0, 200, 0, 0, 0, 0, 0, 0})
+	return c.conn.Close()
+}
+
+func (c *amqpConn) Deliveries(channel uint16) <-chan amqpDelivery {
+	return c.channels[channel].deliveries
+}
+
+func (c *amqpConn) writeFrames(frames ...[]byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(amqpTimeout))
+	for _, frame := range frames {
+		if _, err := c.conn.Write(frame); err != nil {
+			return errors.Wrap(err, "AMQP write failed")
+		}
+	}
+	return nil
+}
+
+func amqpFrame(frameType byte, channel uint16, payload []byte) []byte {
+	frame := make([]byte, 0, 8+len(payload))
+	frame = append(frame, frameType)
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	return append(frame, amqpFrameEnd)
+}
+
+func amqpMethodFrame(channel uint16, id uint32, args []byte) []byte {
+	return amqpFrame(amqpFrameMethod, channel, append(binary.BigEndian.AppendUint32(nil, id), args...))
+}
+
+func (c *amqpConn) send(channel uint16, id uint32, args []byte) error {
+	return c.writeFrames(amqpMethodFrame(channel, id, args))
+}
+
+// call sends a synchronous method and waits for its reply.
+func (c *amqpConn) call(channel uint16, id uint32, args []byte, reply uint32) (amqpMethod, error) {
+	if err := c.send(channel, id, args); err != nil {
+		return amqpMethod{}, err
+	}
+	select {
+	case method := <-c.channels[channel].rpc:
+		if method.ID != reply {
+			return method, errors.Errorf("unexpected AMQP method %d.%d", method.ID>>16, method.ID&0xFFFF)
+		}
+		return method, nil
+	case <-c.done:
+		return amqpMethod{}, c.err
+	case <-time.After(amqpTimeout):
+		return amqpMethod{}, errors.New("AMQP call timed out")
+	}
+}
+
+func (c *amqpConn) openChannel(channel uint16) error {
+	_, err := c.call(channel, amqpChannelOpen, []byte{0}, amqpChannelOpenOk)
+	return err
+}
+
+// consume starts delivering messages from queue with manual acks, at most
+// prefetch unacked at a time.
+func (c *amqpConn) consume(channel uint16, queue string, prefetch int) error {
+	var qos amqpEncoder
+	qos.long(0)
+	qos.short(uint16(prefetch))
+	qos.octet(0)
+	if _, err := c.call(channel, amqpBasicQos, qos.buf, amqpBasicQosOk); err != nil {
+		return err
+	}
+	var consume amqpEncoder
+	consume.short(0)
+	consume.shortstr(queue)
+	consume.shortstr("")
+	consume.octet(0)
+	consume.table(nil)
+	_, err := c.call(channel, amqpBasicConsume, consume.buf, amqpBasicConsumeOk)
+	return err
+}
+
+func (c *amqpConn) confirmSelect(channel uint16) error {
+	_, err := c.call(channel, amqpConfirmSelect, []byte{0}, amqpConfirmSelectOk)
+	return err
+}
+
+func (c *amqpConn) ack(channel uint16, tag uint64) error {
+	var ack amqpEncoder
+	ack.longlong(tag)
+	ack.octet(0)
+	return c.send(channel, amqpBasicAck, ack.buf)
+}
+
+func (c *amqpConn) nack(channel uint16, tag uint64, requeue bool) error {
+	var nack amqpEncoder
+	nack.longlong(tag)
+	if requeue {
+		nack.octet(2)
+	} else {
+		nack.octet(0)
+	}
+	return c.send(channel, amqpBasicNack, nack.buf)
+}
+
+// publish sends a persistent message on a channel in confirm mode and waits
+// for the broker to take responsibility for it. Callers serialize publishes
+// on a channel.
+func (c *amqpConn) publish(channel uint16, exchange, routingKey string, properties amqpProperties, body []byte) error {
+	var method amqpEncoder
+	method.short(0)
+	method.shortstr(exchange)
+	method.shortstr(routingKey)
+	method.octet(0)
+
+	var header amqpEncoder
+	header.short(60)
+	header.short(0)
+	header.longlong(uint64(len(body)))
+	// Properties: content-type, delivery-mode (2 is persistent) and, for
+	// replies, correlation-id.
+	flags := uint16(1<<15 | 1<<12)
+	if properties.CorrelationID != "" {
+		flags |= 1 << 10
+	}
+	header.short(flags)
+	header.shortstr(properties.ContentType)
+	header.octet(2)
+	if properties.CorrelationID != "" {
+		header.shortstr(properties.CorrelationID)
+	}
+
+	frames := [][]byte{amqpMethodFrame(channel, amqpBasicPublish, method.buf), amqpFrame(amqpFrameHeader, channel, header.buf)}
+	for chunk := c.frameMax - 8; len(body) > 0; {
+		n := len(body)
+		if n > chunk {
+			n = chunk
+		}
+		frames = append(frames, amqpFrame(amqpFrameBody, channel, body[:n]))
+		body = body[n:]
+	}
+	if err := c.writeFrames(frames...); err != nil {
+		return err
+	}
+
+	select {
+	case confirm := <-c.channels[channel].confirms:
+		if confirm.ID == amqpBasicNack {
+			return errors.New("AMQP broker rejected the message")
+		}
+		return nil
+	case <-c.done:
+		return c.err
+	case <-time.After(amqpTimeout):
+		return errors.New("AMQP publish confirmation timed out")
+	}
+}
+
+// heartbeat keeps an idle connection from being considered dead.
+func (c *amqpConn) heartbeat() {
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.writeFrames(amqpFrame(amqpFrameHeartbeat, 0, nil))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *amqpConn) readFrame() (byte, uint16, []byte, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, 0, nil, errors.Wrap(err, "AMQP read failed")
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if int(size) > c.frameMax {
+		return 0, 0, nil, errors.Errorf("AMQP frame of %d bytes exceeds the negotiated maximum", size)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, 0, nil, errors.Wrap(err, "AMQP read failed")
+	}
+	if payload[size] != amqpFrameEnd {
+		return 0, 0, nil, errors.New("malformed AMQP frame")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:size], nil
+}
+
+func (c *amqpConn) readLoop() {
+	c.err = c.read()
+	c.conn.Close()
+	for _, channel := range c.channels {
+		close(channel.deliveries)
+	}
+	close(c.done)
+}
+
+func (c *amqpConn) read() error {
+	for {
+		// The broker sends a heartbeat at least every timeout when idle.
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.timeout))
+		frameType, id, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		if frameType == amqpFrameHeartbeat {
+			continue
+		}
+		if id == 0 {
+			if frameType == amqpFrameMethod {
+				if method := parseAMQPMethod(payload); method.ID == amqpConnectionClose {
+					c.send(0, amqpConnectionCloseOk, nil)
+					return amqpCloseError(method)
+				}
+			}
+			continue
+		}
+		channel, ok := c.channels[id]
+		if !ok {
+			return errors.Errorf("AMQP frame on unknown channel %d", id)
+		}
+
+		switch frameType {
+		case amqpFrameMethod:
+			method := parseAMQPMethod(payload)
+			switch method.ID {
+			case amqpChannelClose:
+				c.send(id, amqpChannelCloseOk, nil)
+				return amqpCloseError(method)
+			case amqpBasicDeliver:
+				method.Args.shortstr()
+				delivery := &amqpDelivery{Tag: method.Args.longlong(), Redelivered: method.Args.octet()&1 != 0}
+				channel.pending = delivery
+			case amqpBasicAck, amqpBasicNack:
+				channel.confirms <- method
+			default:
+				channel.rpc <- method
+			}
+		case amqpFrameHeader:
+			if channel.pending == nil {
+				return errors.New("unexpected AMQP content header")
+			}
+			d := &amqpDecoder{buf: payload}
+			d.short()
+			d.short()
+			channel.pending.size = d.longlong()
+			channel.pending.Properties = d.properties()
+			if d.err != nil {
+				return d.err
+			}
+		case amqpFrameBody:
+			if channel.pending == nil {
+				return errors.New("unexpected AMQP content body")
+			}
+			channel.pending.Body = append(channel.pending.Body, payload...)
+		}
+		if delivery := channel.pending; delivery != nil && frameType != amqpFrameMethod && uint64(len(delivery.Body)) >= delivery.size {
+			channel.pending = nil
+			channel.deliveries <- *delivery
+		}
+	}
+}
+
+func parseAMQPMethod(payload []byte) amqpMethod {
+	d := &amqpDecoder{buf: payload}
+	id := d.long()
+	return amqpMethod{ID: id, Args: d}
+}
+
+func amqpCloseError(method amqpMethod) error {
+	code := method.Args.short()
+	text := method.Args.shortstr()
+	return errors.Errorf("AMQP error %d: %s", code, text)
+}
+
+type amqpEncoder struct {
+	buf []byte
+}
+
+func (e *amqpEncoder) octet(v byte)      { e.buf = append(e.buf, v) }
+func (e *amqpEncoder) short(v uint16)    { e.buf = binary.BigEndian.AppendUint16(e.buf, v) }
+func (e *amqpEncoder) long(v uint32)     { e.buf = binary.BigEndian.AppendUint32(e.buf, v) }
+func (e *amqpEncoder) longlong(v uint64) { e.buf = binary.BigEndian.AppendUint64(e.buf, v) }
+func (e *amqpEncoder) shortstr(s string) { e.octet(byte(len(s))); e.buf = append(e.buf, s...) }
+func (e *amqpEncoder) longstr(s string)  { e.long(uint32(len(s))); e.buf = append(e.buf, s...) }
+func (e *amqpEncoder) table(t map[string]string) {
+	var fields amqpEncoder
+	for key, value := range t {
+		fields.shortstr(key)
+		fields.octet('S')
+		fields.longstr(value)
+	}
+	e.long(uint32(len(fields.buf)))
+	e.buf = append(e.buf, fields.buf...)
+}
+
+// amqpDecoder reads big-endian fields, remembering the first error.
+type amqpDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *amqpDecoder) take(n int) []byte {
+	if d.err != nil || n > len(d.buf) {
+		d.err = errors.New("malformed AMQP frame")
+		// Zeroes for fixed-size fields, so callers needn't check each read.
+		if n > 8 {
+			n = 0
+		}
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *amqpDecoder) octet() byte      { return d.take(1)[0] }
+func (d *amqpDecoder) short() uint16    { return binary.BigEndian.Uint16(d.take(2)) }
+func (d *amqpDecoder) long() uint32     { return binary.BigEndian.Uint32(d.take(4)) }
+func (d *amqpDecoder) longlong() uint64 { return binary.BigEndian.Uint64(d.take(8)) }
+func (d *amqpDecoder) shortstr() string { return string(d.take(int(d.octet()))) }
+func (d *amqpDecoder) longstr() string  { return string(d.take(int(d.long()))) }
+
+// table decodes a field table. Only string, integer and boolean values are
+// kept; other values are skipped.
+func (d *amqpDecoder) table() map[string]interface{} {
+	fields := &amqpDecoder{buf: d.take(int(d.long()))}
+	table := make(map[string]interface{})
+	for len(fields.buf) > 0 && fields.err == nil {
+		key := fields.shortstr()
+		if value, ok := fields.value(); ok {
+			table[key] = value
+		}
+	}
+	if fields.err != nil && d.err == nil {
+		d.err = fields.err
+	}
+	return table
+}
+
+func (d *amqpDecoder) value() (interface{}, bool) {
+	switch d.octet() {
+	case 'S':
+		return d.longstr(), true
+	case 'x':
+		return []byte(d.longstr()), true
+	case 't':
+		return d.octet() != 0, true
+	case 'b', 'B':
+		return int64(d.octet()), true
+	case 's', 'u':
+		return int64(d.short()), true
+	case 'I', 'i':
+		return int64(int32(d.long())), true
+	case 'l', 'L', 'T':
+		return int64(d.longlong()), true
+	case 'f':
+		d.take(4)
+	case 'd':
+		d.take(8)
+	case 'D':
+		d.take(5)
+	case 'F':
+		d.table()
+	case 'A':
+		items := &amqpDecoder{buf: d.take(int(d.long()))}
+		for len(items.buf) > 0 && items.err == nil {
+			items.value()
+		}
+	case 'V':
+	default:
+		d.err = errors.New("malformed AMQP field table")
+	}
+	return nil, false
+}
+
+// properties decodes the basic class properties present in the flags.
+func (d *amqpDecoder) properties() amqpProperties {
+	var p amqpProperties
+	flags := d.short()
+	if flags&(1<<15) != 0 {
+		p.ContentType = d.shortstr()
+	}
+	if flags&(1<<14) != 0 {
+		d.shortstr()
+	}
+	if flags&(1<<13) != 0 {
+		p.Headers = d.table()
+	}
+	if flags&(1<<12) != 0 {
+		d.octet()
+	}
+	if flags&(1<<11) != 0 {
+		d.octet()
+	}
+	if flags&(1<<10) != 0 {
+		p.CorrelationID = d.shortstr()
+	}
+	if flags&(1<<9) != 0 {
+		p.ReplyTo = d.shortstr()
+	}
+	if flags&(1<<8) != 0 {
+		d.shortstr()
+	}
+	if flags&(1<<7) != 0 {
+		p.MessageID = d.shortstr()
+	}
+	return p
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAMQPConn returns a connection reading the data, with a pipe for the
+// deadlines and whatever is sent.
+func newTestAMQPConn(t *testing.T, data []byte) (*amqpConn, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	c := &amqpConn{
+		conn:     client,
+		reader:   bufio.NewReader(bytes.NewReader(data)),
+		frameMax: amqpFrameMax,
+		timeout:  amqpHeartbeat,
+		channels: map[uint16]*amqpChannel{1: {rpc: make(chan amqpMethod, 1), confirms: make(chan amqpMethod, 16), deliveries: make(chan amqpDelivery, 16)}},
+		done:     make(chan struct{}),
+	}
+	return c, server
+}
+
+func TestAMQPFrame(t *testing.T) {
+	var ack amqpEncoder
+	ack.longlong(7)
+	ack.octet(0)
+	frame := amqpMethodFrame(1, amqpBasicAck, ack.buf)
+	want := fromHex(t, "01 0001 0000000d 003c0050 0000000000000007 00 ce")
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("frame = %x, want %x", frame, want)
+	}
+
+	c, _ := newTestAMQPConn(t, frame)
+	frameType, channel, payload, err := c.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != amqpFrameMethod || channel != 1 || !bytes.Equal(payload, want[7:len(want)-1]) {
+		t.Errorf("frame read back as type %d on channel %d with %x", frameType, channel, payload)
+	}
+	method := parseAMQPMethod(payload)
+	if method.ID != amqpBasicAck || method.Args.longlong() != 7 || method.Args.octet() != 0 || method.Args.err != nil {
+		t.Errorf("method read back as %d.%d", method.ID>>16, method.ID&0xFFFF)
+	}
+}
+
+func TestAMQPMalformedFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		wantErr string
+	}{
+		{name: "over the frame max", frame: "03 0001 00020001", wantErr: "exceeds the negotiated maximum"},
+		{name: "missing frame end", frame: "03 0001 00000002 6869 00", wantErr: "malformed AMQP frame"},
+		{name: "truncated header", frame: "03 0001 0000", wantErr: "AMQP read failed"},
+		{name: "truncated payload", frame: "03 0001 00000005 6869", wantErr: "AMQP read failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestAMQPConn(t, fromHex(t, test.frame))
+			_, _, _, err := c.readFrame()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAMQPTable(t *testing.T) {
+	var e amqpEncoder
+	e.table(map[string]string{"product": "whisper-transcribe-agent", "platform": "Go"})
+	d := &amqpDecoder{buf: e.buf}
+	table := d.table()
+	want := map[string]interface{}{"product": "whisper-transcribe-agent", "platform": "Go"}
+	if d.err != nil || len(d.buf) != 0 || !reflect.DeepEqual(table, want) {
+		t.Errorf("table read back as %v (%v), want %v", table, d.err, want)
+	}
+
+	// Values that aren't strings, integers or booleans are skipped.
+	d = &amqpDecoder{buf: fromHex(t, `
+		00000035
+		01 73 53 00000001 78
+		01 69 49 fffffffe
+		01 74 74 01
+		01 6c 6c 0000000000000005
+		01 66 66 3f800000
+		01 61 41 00000006 53 00000001 79
+		01 76 56`)}
+	table = d.table()
+	want = map[string]interface{}{"s": "x", "i": int64(-2), "t": true, "l": int64(5)}
+	if d.err != nil || !reflect.DeepEqual(table, want) {
+		t.Errorf("table = %v (%v), want %v", table, d.err, want)
+	}
+}
+
+func TestAMQPMalformedTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+	}{
+		{name: "unknown type", table: "00000004 01 7a 5a 00"},
+		{name: "length past the end", table: "000000ff 01"},
+		{name: "key past the table", table: "00000003 05 6162"},
+		{name: "value past the table", table: "00000008 01 73 53 00000005 78"},
+		{name: "nested table past the end", table: "00000008 01 66 46 000000ff 00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &amqpDecoder{buf: fromHex(t, test.table)}
+			d.table()
+			if d.err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestAMQPDelivery(t *testing.T) {
+	data := bytes.Join([][]byte{
+		amqpFrame(amqpFrameHeartbeat, 0, nil),
+		amqpFrame(amqpFrameMethod, 1, fromHex(t, "003c003c 04 63746167 0000000000000009 01 00 01 71")),
+		amqpFrame(amqpFrameHeader, 1, fromHex(t, `
+			003c 0000 000000000000000a a480
+			10 6170706c69636174696f6e2f6a736f6e
+			00000013 08 66696c656e616d65 53 00000005 612e776176
+			02 6331 02 6d31`)),
+		amqpFrame(amqpFrameBody, 1, []byte("hello")),
+		amqpFrame(amqpFrameBody, 1, []byte("world")),
+	}, nil)
+	c, _ := newTestAMQPConn(t, data)
+	if err := c.read(); err == nil || !strings.Contains(err.Error(), "AMQP read failed") {
+		t.Fatalf("err = %v, want the end of the data", err)
+	}
+
+	close(c.channels[1].deliveries)
+	var deliveries []amqpDelivery
+	for delivery := range c.channels[1].deliveries {
+		deliveries = append(deliveries, delivery)
+	}
+	want := []amqpDelivery{{
+		Tag:         9,
+		Redelivered: true,
+		Properties: amqpProperties{
+			ContentType:   "application/json",
+			Headers:       map[string]interface{}{"filename": "a.wav"},
+			CorrelationID: "c1",
+			MessageID:     "m1",
+		},
+		Body: []byte("helloworld"),
+		size: 10,
+	}}
+	if !reflect.DeepEqual(deliveries, want) {
+		t.Errorf("deliveries = %+v, want %+v", deliveries, want)
+	}
+}
+
+func TestAMQPMalformedDelivery(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		wantErr string
+	}{
+		{
+			name:    "header without deliver",
+			frames:  [][]byte{amqpFrame(amqpFrameHeader, 1, fromHex(t, "003c 0000 0000000000000001 0000"))},
+			wantErr: "unexpected AMQP content header",
+		},
+		{
+			name:    "body without deliver",
+			frames:  [][]byte{amqpFrame(amqpFrameBody, 1, []byte("x"))},
+			wantErr: "unexpected AMQP content body",
+		},
+		{
+			name: "truncated header",
+			frames: [][]byte{
+				amqpFrame(amqpFrameMethod, 1, fromHex(t, "003c003c 00 0000000000000001 00 00 00")),
+				amqpFrame(amqpFrameHeader, 1, fromHex(t, "003c 0000 0000000000000001 8000 10 6170")),
+			},
+			wantErr: "malformed AMQP frame",
+		},
+		{
+			name:    "unknown channel",
+			frames:  [][]byte{amqpFrame(amqpFrameBody, 2, []byte("x"))},
+			wantErr: "unknown channel 2",
+		},
+		{
+			name:    "connection close",
+			frames:  [][]byte{amqpFrame(amqpFrameMethod, 0, fromHex(t, "000a0032 0140 0e 4143434553535f52454655534544 0000 0000"))},
+			wantErr: "AMQP error 320: ACCESS_REFUSED",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, server := newTestAMQPConn(t, bytes.Join(test.frames, nil))
+			go io.Copy(io.Discard, server)
+			err := c.read()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAMQPPublish(t *testing.T) {
+	c, server := newTestAMQPConn(t, nil)
+	c.frameMax = 16
+	c.channels[1].confirms <- amqpMethod{ID: amqpBasicAck}
+	sent := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(server)
+		sent <- data
+	}()
+
+	err := c.publish(1, "", "results", amqpProperties{ContentType: "application/json", CorrelationID: "c1"}, []byte("0123456789abcdefghij"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn.Close()
+	var data []byte
+	select {
+	case data = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent")
+	}
+
+	// Bodies are split into frames of the negotiated size.
+	want := bytes.Join([][]byte{
+		amqpFrame(amqpFrameMethod, 1, fromHex(t, "003c0028 0000 00 07 726573756c7473 00")),
+		amqpFrame(amqpFrameHeader, 1, fromHex(t, "003c 0000 0000000000000014 9400 10 6170706c69636174696f6e2f6a736f6e 02 02 6331")),
+		amqpFrame(amqpFrameBody, 1, []byte("01234567")),
+		amqpFrame(amqpFrameBody, 1, []byte("89abcdef")),
+		amqpFrame(amqpFrameBody, 1, []byte("ghij")),
+	}, nil)
+	if !bytes.Equal(data, want) {
+		t.Errorf("sent %x, want %x", data, want)
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ChatCompletionRequest struct {
+	Messages []ChatMessage `json:"messages"`
+	// WordTimestamps makes the assistant message a JSON document with the
+	// words and their start and end times instead of the plain text.
+	WordTimestamps bool `json:"word_timestamps,omitempty"`
+	// ResponseFormat makes the assistant message the transcript in an export
+	// format, e.g. "srt", instead of the plain text.
+	ResponseFormat responseFormat `json:"response_format,omitempty"`
+	// DownloadHeaders are sent when fetching the audio URL, e.g. an
+	// Authorization header for a private recording server.
+	DownloadHeaders map[string]string `json:"download_headers,omitempty"`
+}
+
+// responseFormat accepts both a format name ("srt") and OpenAI's object form
+// ({"type": "srt"}); types that aren't export formats, like "json_object",
+// leave the response as is.
+type responseFormat string
+
+func (f *responseFormat) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*f = responseFormat(name)
+		return nil
+	}
+	var object struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*f = responseFormat(object.Type)
+	return nil
+}
+
+func newAPIMux(store *JobStore, pool *WorkerPool, metrics *Metrics, models *ModelManager, keys *APIKeys, oidc *OIDC, usage *Usage, audit *AuditLog, uploads *Uploads, cfg Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", withAPIKey(keys, oidc, cfg.TenantHeader, withRole(func(w http.ResponseWriter, r *http.Request) {
+		chatCompletionsHandler(w, r, pool, cfg)
+	}, roleUploader)))
+	mux.HandleFunc("/v1/jobs", withAPIKey(keys, oidc, cfg.TenantHeader, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if !allowed(r, roleReviewer) {
+				writeForbidden(w, roleReviewer)
+				return
+			}
+			listJobsHandler(w, r, store, pool)
+			return
+		}
+		if !allowed(r, roleUploader) {
+			writeForbidden(w, roleUploader)
+			return
+		}
+		submitJobHandler(w, r, pool, cfg)
+	}))
+	mux.HandleFunc("/v1/jobs/", withAPIKey(keys, oidc, cfg.TenantHeader, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			id := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+			// Uploaders may cancel jobs; only admins delete finished ones.
+			if job, ok := store.Get(id); ok && !job.finished() {
+				if !allowed(r, roleUploader) {
+					writeForbidden(w, roleUploader)
+					return
+				}
+				cancelJobHandler(w, r, store, pool, audit, id)
+				return
+			}
+			if !allowed(r, roleAdmin) {
+				writeForbidden(w, roleAdmin)
+				return
+			}
+			deleteJobHandler(w, r, store, audit, id)
+			return
+		}
+		// Uploaders poll the jobs they submitted.
+		if !allowed(r, roleUploader, roleReviewer) {
+			writeForbidden(w, roleUploader, roleReviewer)
+			return
+		}
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/events"); ok {
+			jobProgressHandler(w, r, store, id)
+			return
+		}
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/captioned"); ok {
+			if job, ok := store.Get(id); !ok || job.Tenant != requestTenant(r) {
+				writeJSONError(w, http.StatusNotFound, "Job not found")
+				return
+			}
+			captionedVideoHandler(w, r, store, cfg, id)
+			return
+		}
+		getJobHandler(w, r, store, pool)
+	}))
+	mux.HandleFunc("/v1/audio/detect-language", withAPIKey(keys, oidc, cfg.TenantHeader, withRole(func(w http.ResponseWriter, r *http.Request) {
+		detectLanguageHandler(w, r, pool, cfg)
+	}, roleUploader)))
+	mux.HandleFunc("/v1/uploads", withAPIKey(keys, oidc, cfg.TenantHeader, withRole(func(w http.ResponseWriter, r *http.Request) {
+		uploadsHandler(w, r, uploads, pool, cfg)
+	}, roleUploader)))
+	mux.HandleFunc("/v1/uploads/", withAPIKey(keys, oidc, cfg.TenantHeader, withRole(func(w http.ResponseWriter, r *http.Request) {
+		uploadsHandler(w, r, uploads, pool, cfg)
+	}, roleUploader)))
+	mux.HandleFunc("/v1/transcripts/", withAPIKey(keys, oidc, cfg.TenantHeader, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete && !allowed(r, roleAdmin) {
+			writeForbidden(w, roleAdmin)
+			return
+		}
+		if !allowed(r, roleUploader, roleReviewer) {
+			writeForbidden(w, roleUploader, roleReviewer)
+			return
+		}
+		transcriptsHandler(w, r, store, audit)
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthHandler(w, r, cfg)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyHandler(w, r, pool, cfg)
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		openAPIHandler(w, r, cfg)
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		versionHandler(w, r, cfg)
+	})
+	if pool.results != nil {
+		mux.HandleFunc("/v1/results/", func(w http.ResponseWriter, r *http.Request) {
+			resultHandler(w, r, store, pool.results)
+		})
+	}
+	if cfg.AdminToken != "" || oidc != nil {
+		mux.HandleFunc("/drain", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			drainHandler(w, r, pool)
+		}))
+		mux.HandleFunc("/admin/usage", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			usageHandler(w, r, usage)
+		}))
+		mux.HandleFunc("/admin/erasure", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			erasureHandler(w, r, store, audit)
+		}))
+		mux.HandleFunc("/admin/maintenance", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			maintenanceHandler(w, r, pool)
+		}))
+		mux.HandleFunc("/admin/queue", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			queueHandler(w, r, pool)
+		}))
+		mux.HandleFunc("/admin/queue/cancel", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			queueCancelHandler(w, r, pool, audit)
+		}))
+		mux.HandleFunc("/admin/queue/reprioritize", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			queueReprioritizeHandler(w, r, pool)
+		}))
+	}
+	if models != nil {
+		mux.HandleFunc("/admin/models", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			modelsHandler(w, r, models)
+		}))
+		mux.HandleFunc("/admin/models/", withAdminToken(cfg.AdminToken, oidc, func(w http.ResponseWriter, r *http.Request) {
+			modelHandler(w, r, models)
+		}))
+	}
+	if cfg.ZoomWebhookSecret != "" {
+		mux.HandleFunc("/v1/webhooks/zoom", func(w http.ResponseWriter, r *http.Request) {
+			zoomWebhookHandler(w, r, pool, cfg)
+		})
+	}
+	if cfg.MeetWebhookSecret != "" {
+		mux.HandleFunc("/v1/webhooks/meet", func(w http.ResponseWriter, r *http.Request) {
+			meetWebhookHandler(w, r, pool, cfg)
+		})
+	}
+	return mux
+}
+
+func chatCompletionsHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	respond := func(text string, err error) {
+		if err != nil {
+			text = fmt.Sprintf("%s: %s", text, err.Error())
+		}
+		response := map[string]interface{}{
+			"id":      "chatcmpl-mockid",
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   cfg.WhisperModel,
+			"choices": []map[string]interface{}{
+				{
+					"index": 0,
+					"message": map[string]string{
+						"role":    "assistant",
+						"content": text,
+					},
+					"finish_reason": "stop",
+				},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		fmt.Printf("responded with: %s\n", text)
+		if err != nil {
+			fmt.Printf("stacktrace: %+v\n", err)
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		respond("Method not allowed", nil)
+		return
+	}
+
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+
+	var chatReq ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
+		respond("Invalid JSON", errors.WithStack(err))
+		return
+	}
+
+	if len(chatReq.Messages) == 0 {
+		respond("No messages provided", nil)
+		return
+	}
+
+	lastMsg := chatReq.Messages[len(chatReq.Messages)-1]
+	audioURL := extractURLFromText(lastMsg.Content)
+	if audioURL == "" {
+		respond("No audio URL found in message", nil)
+		return
+	}
+	if err := checkDownloadHeaders(chatReq.DownloadHeaders); err != nil {
+		respond(err.Error(), nil)
+		return
+	}
+
+	format := string(chatReq.ResponseFormat)
+	if format == "" {
+		format = r.URL.Query().Get("response_format")
+	}
+	content := func(transcript *Transcript, text string) string {
+		if transcript == nil {
+			return text
+		}
+		if exporter, ok := exportFormats[format]; ok {
+			if data, err := exporter.Render(transcript); err == nil {
+				return string(data)
+			}
+		}
+		if chatReq.WordTimestamps || wantsWordTimestamps(r) {
+			return wordTimestampsContent(transcript)
+		}
+		return text
+	}
+
+	fmt.Printf("new request for file: %s\n", audioURL)
+	task := &TranscriptionTask{Filename: audioURL, AudioURL: audioURL, DownloadHeaders: chatReq.DownloadHeaders, Tenant: requestTenant(r)}
+	job, repeated, err := pool.submitOnce("chat", key, "", task)
+	if err != nil {
+		fmt.Printf("rejected request for file %s: %s\n", audioURL, err)
+		writeRejected(w, pool, err)
+		return
+	}
+	if repeated {
+		w.Header().Set("Idempotent-Replayed", "true")
+		job, ok := waitForJob(r.Context(), pool.store, job.ID)
+		switch {
+		case r.Context().Err() != nil:
+			// The client went away.
+		case !ok:
+			respond("Transcription error", errors.New("job of the original request is gone"))
+		case job.Status == JobFailed || job.Status == JobCancelled:
+			respond("Transcription error", errors.New(job.Error))
+		default:
+			respond(content(job.Transcript, job.Text), nil)
+		}
+		return
+	}
+	<-task.Done
+
+	if task.Err != nil {
+		respond("Transcription error", task.Err)
+		return
+	}
+
+	respond(content(task.Transcript, task.Transcript.Text), nil)
+}
+
+const (
+	defaultJobsPageSize = 100
+	maxJobsPageSize     = 1000
+)
+
+// jobsPage is the body of GET /v1/jobs.
+type jobsPage struct {
+	Jobs       []Job  `json:"jobs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// jobRequest is the JSON body of POST /v1/jobs.
+type jobRequest struct {
+	URL         string            `json:"url"`
+	Summarize   bool              `json:"summarize"`
+	Chapters    bool              `json:"chapters"`
+	Sentiment   bool              `json:"sentiment"`
+	Entities    bool              `json:"entities"`
+	TranslateTo string            `json:"translate_to"`
+	Profanity   string            `json:"profanity"`
+	Vocabulary  []string          `json:"vocabulary"`
+	Priority    string            `json:"priority"`
+	Metadata    map[string]string `json:"metadata"`
+	RunAt       string            `json:"run_at"`
+	// DownloadHeaders are only accepted in the body, never as query
+	// parameters, since they usually carry credentials.
+	DownloadHeaders map[string]string `json:"download_headers"`
+}
+
+// submitJobHandler queues a transcription and returns immediately with the
+// pending job, or the scheduled one if run_at is a time to come. The audio is
+// either uploaded as the multipart "file" field or referenced by a JSON body
+// {"url": "..."}.
+func submitJobHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and POST supported")
+		return
+	}
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+
+	var task *TranscriptionTask
+	runAt := r.URL.Query().Get("run_at")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		upload, ok := readUploadedFile(w, r, cfg)
+		if !ok {
+			return
+		}
+		task = upload
+		applyQueryOptions(task, r)
+	} else {
+		var body jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+			writeJSONError(w, http.StatusBadRequest, "Expected a multipart file upload or a JSON body with a url")
+			return
+		}
+		task = &TranscriptionTask{
+			Filename:    body.URL,
+			AudioURL:    body.URL,
+			Summarize:   body.Summarize || wantsSummary(r),
+			Chapters:    body.Chapters || wantsChapters(r),
+			Sentiment:   body.Sentiment || wantsSentiment(r),
+			Entities:    body.Entities || wantsEntities(r),
+			TranslateTo: body.TranslateTo,
+		}
+		if task.TranslateTo == "" {
+			task.TranslateTo = translateTo(r)
+		}
+		task.Profanity = body.Profanity
+		if task.Profanity == "" {
+			task.Profanity = profanityMode(r)
+		}
+		task.Vocabulary = body.Vocabulary
+		if task.Vocabulary == nil {
+			task.Vocabulary = vocabularyParam(r)
+		}
+		task.Priority = body.Priority
+		if task.Priority == "" {
+			task.Priority = priorityParam(r)
+		}
+		task.Metadata = body.Metadata
+		if task.Metadata == nil {
+			task.Metadata = metadataParam(r)
+		}
+		task.DownloadHeaders = body.DownloadHeaders
+		if body.RunAt != "" {
+			runAt = body.RunAt
+		}
+	}
+	var err error
+	if task.RunAt, err = runAtParam(runAt); err != nil {
+		if task.Audio != nil {
+			task.Audio.Close()
+		}
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkTaskOptions(cfg, task); err != nil {
+		if task.Audio != nil {
+			task.Audio.Close()
+		}
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	task.Tenant = requestTenant(r)
+	job, repeated, err := pool.submitOnce("api", key, "", task)
+	if err != nil {
+		if task.Audio != nil {
+			task.Audio.Close()
+		}
+		writeRejected(w, pool, err)
+		return
+	}
+	if repeated {
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeJSON(w, http.StatusOK, withEstimate(pool, job))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, withEstimate(pool, job))
+}
+
+// applyQueryOptions sets the options of a task whose audio is the request
+// body from the query parameters.
+func applyQueryOptions(task *TranscriptionTask, r *http.Request) {
+	task.Summarize = wantsSummary(r)
+	task.Chapters = wantsChapters(r)
+	task.Sentiment = wantsSentiment(r)
+	task.Entities = wantsEntities(r)
+	task.TranslateTo = translateTo(r)
+	task.Profanity = profanityMode(r)
+	task.Vocabulary = vocabularyParam(r)
+	task.Priority = priorityParam(r)
+	task.Metadata = metadataParam(r)
+}
+
+// checkTaskOptions validates the options of a submitted task.
+func checkTaskOptions(cfg Config, task *TranscriptionTask) error {
+	if task.Summarize && !cfg.summarizeEnabled() {
+		return errSummarizeDisabled
+	}
+	if err := checkTranslateTo(cfg, task.TranslateTo); err != nil {
+		return err
+	}
+	if err := checkProfanityMode(task.Profanity); err != nil {
+		return err
+	}
+	if err := checkVocabulary(task.Vocabulary); err != nil {
+		return err
+	}
+	if err := checkPriority(task.Priority); err != nil {
+		return err
+	}
+	if err := checkMetadata(task.Metadata); err != nil {
+		return err
+	}
+	if task.RunAt != nil && cfg.ScheduleDir == "" {
+		return errSchedulingDisabled
+	}
+	if task.RunAt != nil && len(task.DownloadHeaders) > 0 && cfg.encryptionKey == nil {
+		return errScheduledHeaders
+	}
+	return checkDownloadHeaders(task.DownloadHeaders)
+}
+
+// listJobsHandler lists the jobs of the request's tenant matching the filters
+// of jobFilterParam, newest first, a page of limit= jobs at a time. The
+// response has the cursor= of the next page unless it's the last.
+func listJobsHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool) {
+	limit := defaultJobsPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxJobsPageSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxJobsPageSize))
+			return
+		}
+		limit = parsed
+	}
+	var after *jobCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := parseJobCursor(value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		after = &cursor
+	}
+
+	filter, err := jobFilterParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tenant := requestTenant(r)
+	jobs, next := store.Page(after, limit, func(job *Job) bool {
+		return job.Tenant == tenant && filter(job)
+	})
+	for i, job := range jobs {
+		jobs[i] = withEstimate(pool, job)
+	}
+	page := jobsPage{Jobs: jobs}
+	if next != nil {
+		page.NextCursor = next.String()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and DELETE supported")
+		return
+	}
+
+	job, ok := store.Get(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"))
+	if !ok || job.Tenant != requestTenant(r) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeJSONWithETag(w, r, withEstimate(pool, job))
+}
+
+// writeRejected rejects a request the pool didn't admit, telling the client
+// when it's worth retrying instead of letting it time out. A full queue is the
+// client's cue to slow down (429); memory pressure is the server's problem (503).
+// An exhausted quota (402) is only worth retrying once the month is over, a
+// read-only server (503) isn't worth retrying at all and one in maintenance
+// (503) when the admin expects it to be over, if they said. Anything else,
+// like a scheduled job that couldn't be saved, is an internal error (500).
+func writeRejected(w http.ResponseWriter, pool *WorkerPool, err error) {
+	if err == errReadOnly {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if maintenance, ok := err.(*maintenanceError); ok {
+		if until := maintenance.maintenance.Until; until != nil && until.After(time.Now()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*until).Seconds())+1))
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err == errQuotaExceeded {
+		reset := pool.usage.QuotaReset()
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+		w.Header().Set("X-Quota-Reset", reset.Format(time.RFC3339))
+		writeJSONError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if err == errIdempotencyMismatch {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err == errSchedulingDisabled || err == errScheduledHeaders {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var status int
+	switch err {
+	case errQueueFull:
+		status = http.StatusTooManyRequests
+	case errMemoryPressure, errDraining:
+		status = http.StatusServiceUnavailable
+	default:
+		log.Printf("Queueing a job failed: %+v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to queue the job")
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(pool.RetryAfter().Seconds())))
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(pool.QueueDepth()))
+	writeJSONError(w, status, err.Error())
+}
+
+func extractURLFromText(text string) string {
+	text = strings.TrimSpace(text)
+	tokens := strings.Fields(text)
+	for _, t := range tokens {
+		if strings.HasPrefix(t, "http://") || strings.HasPrefix(t, "https://") {
+			return t
+		}
+	}
+	return ""
+}
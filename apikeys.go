@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// APIKeys are the keys clients of the /v1 API authenticate with, by name. The
+// name is the tenant the key belongs to: what usage is accounted under and
+// what isolates its jobs from other tenants', so the key itself never shows
+// up in reports or logs. Several keys can share a name, e.g. to rotate them.
+// Tenants can have a quota of transcription minutes per month.
+type APIKeys struct {
+	keys   map[string]string
+	quotas map[string]float64
+}
+
+type tenantContextKey struct{}
+
+// validTenant keeps tenant names from headers usable as route names and in
+// CSV exports.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// loadAPIKeys reads keys from path, one "name key" per line, optionally
+// followed by the monthly quota in minutes. Without a file the API is open.
+func loadAPIKeys(path string) (*APIKeys, error) {
+	keys := &APIKeys{keys: map[string]string{}, quotas: map[string]float64{}}
+	if path == "" {
+		return keys, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, errors.Errorf("%s:%d: expected \"name key [minutes]\"", path, line)
+		}
+		keys.keys[fields[1]] = fields[0]
+		if len(fields) == 3 {
+			quota, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || quota <= 0 {
+				return nil, errors.Errorf("%s:%d: quota must be a positive number of minutes", path, line)
+			}
+			keys.quotas[fields[0]] = quota
+		}
+	}
+	return keys, errors.WithStack(scanner.Err())
+}
+
+func (k *APIKeys) Enabled() bool {
+	return len(k.keys) > 0
+}
+
+// lookup returns the name of the key, comparing against every key in
+// constant time so response times don't leak how much of a key was right.
+func (k *APIKeys) lookup(sent string) (string, bool) {
+	name, found := "", false
+	for key, keyName := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(key)) == 1 {
+			name, found = keyName, true
+		}
+	}
+	return name, found
+}
+
+// withAPIKey rejects requests without a valid key in the Authorization
+// bearer token or the X-API-Key header, if keys are configured, and passes
+// the key's name on to the handler as the tenant. Without keys, the tenant is
+// taken from tenantHeader if set, which a gateway in front of the agent must
+// then be trusted to set.
+//
+// With OIDC, a bearer token can also be an access token of the provider,
+// whose user and tenant claim are passed on instead. The API then needs
+// either, keys or not.
+func withAPIKey(keys *APIKeys, oidc *OIDC, tenantHeader string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidc != nil {
+			user, err := oidc.authenticate(r)
+			if err != nil {
+				writeJSONError(w, http.StatusUnauthorized, "Invalid access token: "+err.Error())
+				return
+			}
+			if user != nil {
+				r = withUser(r, user)
+				next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, user.Tenant)))
+				return
+			}
+			if !keys.Enabled() {
+				writeJSONError(w, http.StatusUnauthorized, "Missing access token")
+				return
+			}
+		}
+		if !keys.Enabled() {
+			tenant := ""
+			if tenantHeader != "" {
+				tenant = r.Header.Get(tenantHeader)
+			}
+			if tenant != "" && !validTenant.MatchString(tenant) {
+				writeJSONError(w, http.StatusBadRequest, "Invalid "+tenantHeader+" header")
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+			return
+		}
+		sent := r.Header.Get("X-API-Key")
+		if sent == "" {
+			sent = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		name, ok := keys.lookup(sent)
+		if sent == "" || !ok {
+			writeJSONError(w, http.StatusUnauthorized, "Missing or invalid API key")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, name)))
+	}
+}
+
+// requestTenant returns the tenant of the request, if any.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// uiAsset is an embedded UI file with the hash its URLs are versioned with.
+type uiAsset struct {
+	body        []byte
+	contentType string
+	hash        string
+}
+
+// uiAssets serves the embedded UI. The page references its stylesheet,
+// script and icon with their content hash in the query, e.g.
+// /app.js?v=1f2e3d4c, and those URLs are cached for a year: a new build
+// changes the hash and so the URL. The page itself and unversioned URLs are
+// revalidated with their ETag on every visit, which costs a 304 at most.
+type uiAssets map[string]uiAsset
+
+func loadUIAssets(files fs.FS) (uiAssets, error) {
+	assets := make(uiAssets)
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		body, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		sum := sha256.Sum256(body)
+		assets["/"+name] = uiAsset{body: body, contentType: contentType, hash: hex.EncodeToString(sum[:8])}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if page, ok := assets["/index.html"]; ok {
+		for name, asset := range assets {
+			if name != "/index.html" {
+				page.body = bytes.ReplaceAll(page.body, []byte(`"`+name+`"`), []byte(`"`+name+"?v="+asset.hash+`"`))
+			}
+		}
+		sum := sha256.Sum256(page.body)
+		page.hash = hex.EncodeToString(sum[:8])
+		assets["/index.html"] = page
+	}
+	return assets, nil
+}
+
+func (a uiAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	asset, ok := a[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if version := r.URL.Query().Get("v"); version != "" && version == asset.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.body))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const benchPollInterval = 200 * time.Millisecond
+
+type benchResult struct {
+	Latency       time.Duration
+	AudioDuration float64
+	Err           error
+}
+
+// runBench implements the bench subcommand: it sends the same audio file
+// repeatedly, either through a running agent's /v1/jobs API or straight to the
+// backend, and reports latency percentiles and throughput.
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	file := flags.String("file", "", "Sample audio file to submit")
+	requests := flags.Int("requests", 10, "Total number of transcriptions to run")
+	concurrency := flags.Int("concurrency", 4, "Number of transcriptions in flight at once")
+	agentURL := flags.String("agent-url", "http://localhost:8080", "Base URL of the running agent's API")
+	whisperURL := flags.String("whisper-server-url", "", "Benchmark this transcription service directly instead of the agent")
+	whisperModel := flags.String("whisper-model", "", "Whisper model to use with --whisper-server-url")
+	flags.Parse(args)
+
+	if *file == "" {
+		log.Fatal("Flag --file must be set")
+	}
+	if *whisperURL != "" && *whisperModel == "" {
+		log.Fatal("Flag --whisper-model must be set with --whisper-server-url")
+	}
+	if *requests < 1 || *concurrency < 1 {
+		log.Fatal("--requests and --concurrency must be at least 1")
+	}
+
+	audio, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filename := filepath.Base(*file)
+
+	run := func() (float64, error) {
+		return benchAgent(*agentURL, filename, audio)
+	}
+	target := *agentURL
+	if *whisperURL != "" {
+		target = *whisperURL
+		run = func() (float64, error) {
+			transcript, err := transcribe(context.Background(), *whisperURL, *whisperModel, "", filename, bytes.NewReader(audio), int64(len(audio)))
+			if err != nil {
+				return 0, err
+			}
+			return transcript.Duration, nil
+		}
+	}
+
+	fmt.Printf("benchmarking %s with %d requests of %s at concurrency %d\n", target, *requests, filename, *concurrency)
+
+	results := make([]benchResult, *requests)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				requestStarted := time.Now()
+				duration, err := run()
+				results[n] = benchResult{Latency: time.Since(requestStarted), AudioDuration: duration, Err: err}
+			}
+		}()
+	}
+	for n := range results {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+
+	printBenchReport(results, time.Since(started))
+}
+
+// benchAgent submits the audio as an asynchronous job and polls until it
+// finishes, returning the transcribed audio duration.
+func benchAgent(agentURL, filename string, audio []byte) (float64, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	part.Write(audio)
+	form.Close()
+
+	resp, err := http.Post(agentURL+"/v1/jobs", form.FormDataContentType(), &body)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	job, err := decodeBenchJob(resp, http.StatusAccepted)
+	if err != nil {
+		return 0, err
+	}
+
+	for !job.finished() {
+		time.Sleep(benchPollInterval)
+		resp, err := http.Get(agentURL + "/v1/jobs/" + job.ID)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if job, err = decodeBenchJob(resp, http.StatusOK); err != nil {
+			return 0, err
+		}
+	}
+
+	if job.Status == JobFailed {
+		return 0, errors.New(job.Error)
+	}
+	if job.Transcript == nil {
+		return 0, nil
+	}
+	return job.Transcript.Duration, nil
+}
+
+func decodeBenchJob(resp *http.Response, expectedStatus int) (*Job, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, errors.Errorf("agent returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, errors.Wrap(err, "invalid job response")
+	}
+	return &job, nil
+}
+
+func printBenchReport(results []benchResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	var audioSeconds float64
+	errorCounts := make(map[string]int)
+	for _, result := range results {
+		if result.Err != nil {
+			errorCounts[result.Err.Error()]++
+			continue
+		}
+		latencies = append(latencies, result.Latency)
+		audioSeconds += result.AudioDuration
+	}
+
+	fmt.Printf("\ncompleted %d, failed %d in %s\n", len(latencies), len(results)-len(latencies), elapsed.Round(time.Millisecond))
+	for message, count := range errorCounts {
+		fmt.Printf("  %dx %s\n", count, message)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+
+	fmt.Printf("throughput: %.2f requests/s\n", float64(len(latencies))/elapsed.Seconds())
+	if audioSeconds > 0 {
+		fmt.Printf("realtime factor: %.1fx (%.0fs of audio)\n", audioSeconds/elapsed.Seconds(), audioSeconds)
+	}
+	fmt.Printf("latency mean: %s\n", (total / time.Duration(len(latencies))).Round(time.Millisecond))
+	for _, p := range []float64{50, 90, 95, 99} {
+		index := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+		fmt.Printf("latency p%g: %s\n", p, latencies[index].Round(time.Millisecond))
+	}
+	fmt.Printf("latency max: %s\n", latencies[len(latencies)-1].Round(time.Millisecond))
+}
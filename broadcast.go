@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// broadcastLanguages maps the language names whisper reports, and their
+// ISO 639-1 codes, to the code for TTML's xml:lang and the EBU-STL language
+// code of EBU Tech 3264 appendix 3.
+var broadcastLanguages = map[string]struct{ iso, ebu string }{
+	"english":    {"en", "09"},
+	"german":     {"de", "08"},
+	"french":     {"fr", "0F"},
+	"spanish":    {"es", "0A"},
+	"italian":    {"it", "15"},
+	"dutch":      {"nl", "1D"},
+	"portuguese": {"pt", "21"},
+	"polish":     {"pl", "20"},
+	"swedish":    {"sv", "28"},
+	"danish":     {"da", "07"},
+	"norwegian":  {"no", "1E"},
+	"finnish":    {"fi", "27"},
+	"czech":      {"cs", "06"},
+	"slovak":     {"sk", "25"},
+	"slovenian":  {"sl", "26"},
+	"croatian":   {"hr", "04"},
+	"hungarian":  {"hu", "1B"},
+	"romanian":   {"ro", "22"},
+	"catalan":    {"ca", "03"},
+	"turkish":    {"tr", "29"},
+	"greek":      {"el", "70"},
+	"russian":    {"ru", "56"},
+	"ukrainian":  {"uk", "49"},
+}
+
+func broadcastLanguage(transcript *Transcript) (iso, ebu string) {
+	name := strings.ToLower(transcript.Language)
+	for language, codes := range broadcastLanguages {
+		if name == language || name == codes.iso {
+			return codes.iso, codes.ebu
+		}
+	}
+	if languageCodePattern.MatchString(name) {
+		return name, "00"
+	}
+	return "", "00"
+}
+
+// renderTTML produces TTML, as in EBU-TT-D: one paragraph per subtitle cue in
+// a region at the bottom, with the speakers declared as agents.
+func renderTTML(transcript *Transcript) ([]byte, error) {
+	cues := subtitleCues(transcript)
+	language, _ := broadcastLanguage(transcript)
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<tt xmlns="http://www.w3.org/ns/ttml" xmlns:tts="http://www.w3.org/ns/ttml#styling" xmlns:ttm="http://www.w3.org/ns/ttml#metadata" xmlns:ttp="http://www.w3.org/ns/ttml#parameter" ttp:timeBase="media" xml:lang="%s">`+"\n", xmlEscape(language))
+	b.WriteString("  <head>\n    <metadata>\n")
+	agents := map[string]string{}
+	for _, cue := range cues {
+		if cue.Speaker == "" || agents[cue.Speaker] != "" {
+			continue
+		}
+		agents[cue.Speaker] = fmt.Sprintf("speaker%d", len(agents)+1)
+		fmt.Fprintf(&b, `      <ttm:agent xml:id="%s" type="person"><ttm:name type="alias">%s</ttm:name></ttm:agent>`+"\n", agents[cue.Speaker], xmlEscape(cue.Speaker))
+	}
+	b.WriteString("    </metadata>\n")
+	b.WriteString(`    <styling><style xml:id="default" tts:textAlign="center" tts:color="white" tts:backgroundColor="black" tts:fontFamily="proportionalSansSerif" tts:fontSize="100%"/></styling>` + "\n")
+	b.WriteString(`    <layout><region xml:id="bottom" tts:origin="10% 10%" tts:extent="80% 80%" tts:displayAlign="after"/></layout>` + "\n")
+	b.WriteString("  </head>\n")
+	b.WriteString(`  <body region="bottom" style="default">` + "\n    <div>\n")
+	for i, cue := range cues {
+		fmt.Fprintf(&b, `      <p xml:id="sub%d" begin="%s" end="%s"`, i+1, ttmlTimestamp(cue.Start), ttmlTimestamp(cue.End))
+		if agent := agents[cue.Speaker]; agent != "" {
+			fmt.Fprintf(&b, ` ttm:agent="%s"`, agent)
+		}
+		lines := strings.Split(wrapCue(cue.Text), "\n")
+		for j := range lines {
+			lines[j] = xmlEscape(lines[j])
+		}
+		fmt.Fprintf(&b, ">%s</p>\n", strings.Join(lines, "<br/>"))
+	}
+	b.WriteString("    </div>\n  </body>\n</tt>\n")
+	return b.Bytes(), nil
+}
+
+func xmlEscape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+func ttmlTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+const (
+	stlGSISize = 1024
+	stlTTISize = 128
+	stlTextLen = 112
+	// stlFrameRate is the frame rate of the "STL25.01" disk format.
+	stlFrameRate = 25
+	// stlRow is the teletext row of the first line of a subtitle, leaving
+	// room for a second line and the double height of open subtitles.
+	stlRow = 20
+)
+
+// EBU-STL control codes in the text field.
+const (
+	stlNewline = 0x8A
+	stlUnused  = 0x8F
+)
+
+// renderEBUSTL produces an EBU-STL file (EBU Tech 3264) for open subtitling at
+// 25 fps: a GSI block followed by one TTI block per subtitle cue, the text in
+// the ISO 6937 Latin character table. Speakers are left out, since broadcast
+// subtitles mark them with colours or positions per house style instead.
+func renderEBUSTL(transcript *Transcript) ([]byte, error) {
+	cues := subtitleCues(transcript)
+	if len(cues) > 99999 {
+		return nil, errors.Errorf("too many subtitles for EBU-STL: %d", len(cues))
+	}
+	_, language := broadcastLanguage(transcript)
+	now := time.Now().UTC().Format("060102")
+
+	gsi := bytes.Repeat([]byte{' '}, stlGSISize)
+	field := func(offset, length int, value string) {
+		copy(gsi[offset:offset+length], value)
+	}
+	field(0, 3, "850")
+	field(3, 8, "STL25.01")
+	field(11, 1, "0")
+	field(12, 2, "00")
+	field(14, 2, language)
+	field(224, 6, now)
+	field(230, 6, now)
+	field(236, 2, "00")
+	field(238, 5, fmt.Sprintf("%05d", len(cues)))
+	field(243, 5, fmt.Sprintf("%05d", len(cues)))
+	field(248, 3, "001")
+	field(251, 2, fmt.Sprintf("%02d", maxLineLength))
+	field(253, 2, "23")
+	field(255, 1, "1")
+	field(256, 8, "00000000")
+	field(264, 8, "00000000")
+	field(272, 1, "1")
+	field(273, 1, "1")
+
+	out := bytes.NewBuffer(gsi)
+	for i, cue := range cues {
+		tti := make([]byte, stlTTISize)
+		tti[0] = 0
+		tti[1], tti[2] = byte((i+1)&0xFF), byte((i+1)>>8)
+		tti[3] = 0xFF
+		tti[4] = 0
+		copy(tti[5:9], stlTimecode(cue.Start))
+		copy(tti[9:13], stlTimecode(cue.End))
+		tti[13] = stlRow
+		tti[14] = 2 // centred
+		tti[15] = 0
+		text := encodeISO6937(strings.ReplaceAll(wrapCue(cue.Text), "\n", string(rune(stlNewline))))
+		if len(text) > stlTextLen {
+			text = text[:stlTextLen]
+			if last := text[len(text)-1]; last >= 0xC1 && last <= 0xCF {
+				text = text[:len(text)-1] // a diacritic without its letter
+			}
+		}
+		copy(tti[16:], text)
+		for j := 16 + len(text); j < stlTTISize; j++ {
+			tti[j] = stlUnused
+		}
+		out.Write(tti)
+	}
+	return out.Bytes(), nil
+}
+
+// stlTimecode encodes seconds as the hours, minutes, seconds and frames bytes
+// of a TTI time code.
+func stlTimecode(seconds float64) []byte {
+	frames := int64(math.Round(seconds * stlFrameRate))
+	return []byte{
+		byte(frames / (3600 * stlFrameRate)),
+		byte(frames / (60 * stlFrameRate) % 60),
+		byte(frames / stlFrameRate % 60),
+		byte(frames % stlFrameRate),
+	}
+}
+
+// iso6937Diacritics are the non-spacing diacritical marks of ISO 6937, which
+// precede the letter they go on, with the letters they're used with in
+// Unicode and the base letters those decompose to.
+var iso6937Diacritics = []struct {
+	mark     byte
+	accented string
+	base     string
+}{
+	{0xC1, "ÀÈÌÒÙàèìòù", "AEIOUaeiou"},
+	{0xC2, "ÁÉÍÓÚÝáéíóúýĆćŃńŚśŹźĹĺŔŕ", "AEIOUYaeiouyCcNnSsZzLlRr"},
+	{0xC3, "ÂÊÎÔÛâêîôûĈĉĜĝĤĥĴĵŜŝŴŵŶŷ", "AEIOUaeiouCcGgHhJjSsWwYy"},
+	{0xC4, "ÃÑÕãñõĨĩŨũ", "ANOanoIiUu"},
+	{0xC5, "ĀāĒēĪīŌōŪū", "AaEeIiOoUu"},
+	{0xC6, "ĂăĞğŬŭ", "AaGgUu"},
+	{0xC7, "ĊċĖėĠġİŻż", "CcEeGgIZz"},
+	{0xC8, "ÄËÏÖÜäëïöüÿŸ", "AEIOUaeiouyY"},
+	{0xCA, "ÅåŮů", "AaUu"},
+	{0xCB, "ÇçĢģĶķĻļŅņŖŗŞşŢţ", "CcGgKkLlNnRrSsTt"},
+	{0xCD, "ŐőŰű", "OoUu"},
+	{0xCE, "ĄąĘęĮįŲų", "AaEeIiUu"},
+	{0xCF, "ČčĎďĚěĽľŇňŘřŠšŤťŽž", "CcDdEeLlNnRrSsTtZz"},
+}
+
+// iso6937Letters are the letters ISO 6937 has a code of their own for.
+var iso6937Letters = map[rune]byte{
+	'Æ': 0xE1, 'Đ': 0xE2, 'Ħ': 0xE4, 'Ĳ': 0xE6, 'Ŀ': 0xE7, 'Ł': 0xE8, 'Ø': 0xE9, 'Œ': 0xEA, 'Þ': 0xEC, 'Ŧ': 0xED, 'Ŋ': 0xEE,
+	'æ': 0xF1, 'đ': 0xF2, 'ð': 0xF3, 'ħ': 0xF4, 'ı': 0xF5, 'ĳ': 0xF6, 'ŀ': 0xF7, 'ł': 0xF8, 'ø': 0xF9, 'œ': 0xFA, 'ß': 0xFB, 'þ': 0xFC, 'ŧ': 0xFD, 'ŋ': 0xFE,
+	'‘': 0xA9, '“': 0xAA, '’': 0xB9, '”': 0xBA, '£': 0xA3, '–': 0xD0, '—': 0xD0,
+}
+
+// encodeISO6937 encodes text in the ISO 6937 Latin character table of
+// EBU-STL. Control codes below 0x20 or from 0x80 are passed through as bytes;
+// characters the table doesn't have, like Cyrillic or Greek, become "?".
+func encodeISO6937(text string) []byte {
+	var out []byte
+	for _, r := range text {
+		out = append(out, iso6937Rune(r)...)
+	}
+	return out
+}
+
+func iso6937Rune(r rune) []byte {
+	if r < 0x7F || (r >= 0x80 && r < 0xA0) {
+		return []byte{byte(r)}
+	}
+	if code, ok := iso6937Letters[r]; ok {
+		return []byte{code}
+	}
+	for _, diacritic := range iso6937Diacritics {
+		accented := []rune(diacritic.accented)
+		for i, letter := range accented {
+			if letter == r {
+				return []byte{diacritic.mark, diacritic.base[i]}
+			}
+		}
+	}
+	return []byte{'?'}
+}
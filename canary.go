@@ -0,0 +1,26 @@
+package main
+
+import "math/rand"
+
+// canaryEnabled reports whether some of the jobs go to a canary backend.
+func (c Config) canaryEnabled() bool {
+	return (c.CanaryURL != "" || c.CanaryModel != "") && c.CanaryWeight > 0
+}
+
+// routeBackend picks the backend and model of a job that didn't ask for one:
+// the canary for --canary-weight percent of them, else the stable backend.
+// Either way the job's metrics are labeled with what it ran on, so the canary
+// can be compared to the stable backend before rolling it out.
+func (p *WorkerPool) routeBackend() (whisperURL, whisperModel string) {
+	if !p.cfg.canaryEnabled() || rand.Float64()*100 >= p.cfg.CanaryWeight {
+		return p.cfg.WhisperURL, p.cfg.WhisperModel
+	}
+	whisperURL, whisperModel = p.cfg.CanaryURL, p.cfg.CanaryModel
+	if whisperURL == "" {
+		whisperURL = p.cfg.WhisperURL
+	}
+	if whisperModel == "" {
+		whisperModel = p.cfg.WhisperModel
+	}
+	return whisperURL, whisperModel
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxCaptionRenders bounds the ffmpeg encodes running at once, since each one
+// keeps several cores busy until the whole video is encoded.
+const maxCaptionRenders = 2
+
+var captionRenders = make(chan struct{}, maxCaptionRenders)
+
+var errNoVideo = errors.New("job audio has no video stream")
+
+// captionedVideoHandler returns the job's video with the transcript burned
+// in as subtitles, encoded to MP4 by ffmpeg on request. It needs the original
+// upload, so it only works while the job still keeps its audio.
+func captionedVideoHandler(w http.ResponseWriter, r *http.Request, store *JobStore, cfg Config, id string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	job, ok := store.Get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if job.Transcript == nil {
+		writeJSONError(w, http.StatusConflict, "Job has no transcript")
+		return
+	}
+	audio, ok := store.Audio(id)
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "Job audio is no longer kept")
+		return
+	}
+
+	select {
+	case captionRenders <- struct{}{}:
+		defer func() { <-captionRenders }()
+	case <-r.Context().Done():
+		return
+	}
+	video, err := burnSubtitles(r, cfg, audio.Buffer, job.Transcript)
+	if err == errNoVideo {
+		writeJSONError(w, http.StatusConflict, "Job audio has no video stream")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer video.Close()
+
+	filename := strings.TrimSuffix(path.Base(job.Filename), path.Ext(job.Filename)) + ".captioned.mp4"
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, filename, job.CreatedAt, video.Reader())
+}
+
+// burnSubtitles renders the transcript's SRT subtitles into the video with
+// ffmpeg and returns the buffer holding the MP4, which the caller closes. The
+// MP4 is fragmented, since ffmpeg writes it to a pipe; it goes to disk
+// encrypted like any audio. ffmpeg is killed if the client goes away.
+func burnSubtitles(r *http.Request, cfg Config, audio *AudioBuffer, transcript *Transcript) (*AudioBuffer, error) {
+	input, release, err := audio.Input()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer release()
+	probe := exec.CommandContext(r.Context(), cfg.FFprobePath, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_type", "-of", "csv=p=0", input)
+	streams, err := probe.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "ffprobe failed")
+	}
+	if !strings.Contains(string(streams), "video") {
+		return nil, errNoVideo
+	}
+
+	subtitles, err := os.CreateTemp(cfg.SpillDir, "whisper-captions-*.srt")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.Remove(subtitles.Name())
+	srt, _ := renderSRT(transcript)
+	_, err = subtitles.Write(srt)
+	if closeErr := subtitles.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cmd := exec.CommandContext(r.Context(), cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-i", input,
+		"-vf", "subtitles="+ffmpegFilterEscape(subtitles.Name()),
+		"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac", "-movflags", "frag_keyframe+empty_moov", "-f", "mp4", "pipe:1")
+	video := cfg.newAudioBuffer()
+	var stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = video, &stderr
+	if err := cmd.Run(); err != nil {
+		video.Close()
+		return nil, errors.Wrapf(err, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return video, nil
+}
+
+// ffmpegFilterEscape escapes a path for use as an option value in an ffmpeg
+// filter graph, where colons, commas, quotes and backslashes are special.
+func ffmpegFilterEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\\\`, `'`, `\\\'`, `:`, `\\:`, `,`, `\,`).Replace(value)
+}
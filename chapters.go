@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// chapterLength is roughly how long chapters are; recordings shorter than
+	// two of them stay a single chapter.
+	chapterLength = 5 * 60.0
+	// chapterTitleWords is how many words of a chapter make up its title if
+	// there is no LLM to write one.
+	chapterTitleWords = 6
+	// chapterLLMText caps how much of each chapter the LLM reads to title it.
+	chapterLLMText = 4000
+)
+
+const chaptersPrompt = `You give chapters of a transcript short, descriptive titles of at most eight words, in the language of the transcript.
+You get a JSON array of chapter texts and reply with a JSON array of their titles, in the same order and with the same number of elements.
+Reply with the JSON array only.`
+
+// Chapter is a stretch of a transcript about one topic.
+type Chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// wantsChapters reads the chapters=true request parameter.
+func wantsChapters(r *http.Request) bool {
+	chapters, _ := strconv.ParseBool(r.URL.Query().Get("chapters"))
+	return chapters
+}
+
+// chapterize splits the transcript into chapters at its longest pauses, about
+// one per chapterLength, and titles them with the LLM at --llm-url if it's
+// set, else with their first words. If the LLM fails the chapters keep those
+// titles and the error is returned for logging.
+func chapterize(cfg Config, transcript *Transcript) ([]Chapter, error) {
+	segments := transcript.Segments
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	boundaries := chapterBoundaries(segments)
+
+	var chapters []Chapter
+	var texts []string
+	for i, first := range boundaries {
+		last := len(segments)
+		if i+1 < len(boundaries) {
+			last = boundaries[i+1]
+		}
+		var text []string
+		for _, segment := range segments[first:last] {
+			text = append(text, strings.TrimSpace(segment.Text))
+		}
+		texts = append(texts, strings.Join(text, " "))
+		chapters = append(chapters, Chapter{
+			Title: firstWords(texts[i], chapterTitleWords),
+			Start: segments[first].Start,
+			End:   segments[last-1].End,
+		})
+	}
+
+	if !cfg.summarizeEnabled() {
+		return chapters, nil
+	}
+	for i, text := range texts {
+		if len(text) > chapterLLMText {
+			texts[i] = strings.ToValidUTF8(text[:chapterLLMText], "")
+		}
+	}
+	titles, err := rewriteLLM(cfg, chaptersPrompt, texts)
+	if err != nil {
+		return chapters, err
+	}
+	for i, title := range titles {
+		if title = strings.TrimSpace(title); title != "" {
+			chapters[i].Title = title
+		}
+	}
+	return chapters, nil
+}
+
+// chapterBoundaries returns the index of the first segment of every chapter.
+// It cuts at the longest pauses, skipping those that would leave a chapter
+// shorter than half of the target length.
+func chapterBoundaries(segments []Segment) []int {
+	duration := segments[len(segments)-1].End - segments[0].Start
+	count := int(duration / chapterLength)
+	if count < 2 {
+		return []int{0}
+	}
+	minLength := duration / float64(count) / 2
+
+	gaps := make([]int, 0, len(segments)-1)
+	for i := 1; i < len(segments); i++ {
+		gaps = append(gaps, i)
+	}
+	gap := func(i int) float64 { return segments[i].Start - segments[i-1].End }
+	sort.SliceStable(gaps, func(a, b int) bool { return gap(gaps[a]) > gap(gaps[b]) })
+
+	starts := []float64{segments[0].Start}
+	boundaries := []int{0}
+	for _, i := range gaps {
+		if len(boundaries) == count {
+			break
+		}
+		start := segments[i].Start
+		if segments[len(segments)-1].End-start < minLength {
+			continue
+		}
+		tooClose := false
+		for _, other := range starts {
+			if start-other < minLength && other-start < minLength {
+				tooClose = true
+				break
+			}
+		}
+		if !tooClose {
+			starts = append(starts, start)
+			boundaries = append(boundaries, i)
+		}
+	}
+	sort.Ints(boundaries)
+	return boundaries
+}
+
+func firstWords(text string, n int) string {
+	words := strings.Fields(text)
+	if len(words) <= n {
+		return strings.TrimRight(strings.Join(words, " "), ".,;:!?")
+	}
+	return strings.TrimRight(strings.Join(words[:n], " "), ".,;:!?") + "…"
+}
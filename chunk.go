@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// chunkSampleRate is what chunks are resampled to, the rate whisper works at.
+const chunkSampleRate = 16000
+
+// audioChunk is a chunk of 16 kHz mono 16-bit PCM and where it starts in the
+// audio, in seconds.
+type audioChunk struct {
+	PCM   *AudioBuffer
+	Start float64
+}
+
+// splitAudio decodes the audio to 16 kHz mono PCM (the format whisper
+// resamples to anyway) with ffmpeg and cuts it into chunks of the given
+// length. The chunks are audio buffers, so they're encrypted like the audio
+// if they spill to disk; the caller closes them. ffmpeg is killed if ctx is
+// cancelled.
+func splitAudio(ctx context.Context, cfg Config, audio *AudioBuffer, seconds float64) ([]audioChunk, error) {
+	input, release, err := audio.Input()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer release()
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-i", input,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(chunkSampleRate), "-f", "s16le", "pipe:1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	pcm, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "ffmpeg failed")
+	}
+
+	chunkSize := int64(seconds*chunkSampleRate) * 2
+	chunks := []audioChunk{}
+	for err == nil {
+		chunk := audioChunk{PCM: cfg.newAudioBuffer(), Start: float64(len(chunks)) * seconds}
+		var n int64
+		n, err = io.CopyN(chunk.PCM, pcm, chunkSize)
+		if n == 0 {
+			chunk.PCM.Close()
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		// ffmpeg would block writing output nobody reads, so Wait wouldn't
+		// return.
+		cmd.Process.Kill()
+	}
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = errors.Wrapf(waitErr, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		closeChunks(chunks)
+		return nil, errors.WithStack(err)
+	}
+	return chunks, nil
+}
+
+func closeChunks(chunks []audioChunk) {
+	for _, chunk := range chunks {
+		chunk.PCM.Close()
+	}
+}
+
+// transcribeChunked transcribes audio longer than the configured chunk
+// duration by splitting it and sending up to ChunkParallelism chunks to the
+// backend at once, then stitching the results back together in order. It
+// returns ok=false if the audio is short enough to be sent as a whole, or
+// ffmpeg can't split it, in which case the backend may still decode it. Once
+// a chunk fails, the chunks still being transcribed are cancelled.
+func (p *WorkerPool) transcribeChunked(task *TranscriptionTask) (transcript *Transcript, ok bool, err error) {
+	chunks, err := splitAudio(task.ctx, p.cfg, task.Audio, p.cfg.ChunkDuration.Seconds())
+	if cause := context.Cause(task.ctx); cause != nil {
+		closeChunks(chunks)
+		return nil, true, cause
+	}
+	if err != nil {
+		log.Printf("Splitting job %s into chunks failed, sending it whole: %v", task.JobID, err)
+		return nil, false, nil
+	}
+	defer closeChunks(chunks)
+	if len(chunks) <= 1 {
+		return nil, false, nil
+	}
+
+	p.store.SetChunks(task.JobID, 0, len(chunks))
+	ctx, cancel := context.WithCancelCause(task.ctx)
+	defer cancel(nil)
+	parts := make([]*Transcript, len(chunks))
+	semaphore := make(chan struct{}, p.cfg.ChunkParallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed error
+	done := 0
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk audioChunk) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			part, err := transcribeChunk(ctx, task.WhisperURL, task.WhisperModel, task.Prompt, fmt.Sprintf("chunk%05d.wav", i), chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = errors.Wrapf(err, "chunk %d of %d failed", i+1, len(chunks))
+					cancel(failed)
+				}
+				return
+			}
+			parts[i] = part
+			done++
+			p.store.SetChunks(task.JobID, done, len(chunks))
+		}(i, chunk)
+	}
+	wg.Wait()
+	if failed != nil {
+		return nil, true, failed
+	}
+	// Chunks not started when the job was cancelled have no transcript.
+	if cause := context.Cause(task.ctx); cause != nil {
+		return nil, true, cause
+	}
+
+	offsets := make([]float64, len(chunks))
+	for i, chunk := range chunks {
+		offsets[i] = chunk.Start
+	}
+	return mergeTranscripts(parts, offsets), true, nil
+}
+
+// transcribeChunk sends a chunk to the backend as a WAV file.
+func transcribeChunk(ctx context.Context, whisperServerURL, whisperModel, prompt, filename string, chunk audioChunk) (*Transcript, error) {
+	header := wavHeader(chunkSampleRate, int(chunk.PCM.Size()/2))
+	audio := io.MultiReader(bytes.NewReader(header), chunk.PCM.Reader())
+	return transcribe(ctx, whisperServerURL, whisperModel, prompt, filename, audio, int64(len(header))+chunk.PCM.Size())
+}
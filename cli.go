@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runTranscribe implements the transcribe subcommand: it runs a single file,
+// or audio piped to stdin with "-", through the same pipeline as the server
+// and prints the result to stdout.
+func runTranscribe(args []string) {
+	var cfg Config
+	flags := flag.NewFlagSet("transcribe", flag.ExitOnError)
+	bindBackendFlags(flags, &cfg)
+	format := flags.String("format", "txt", "Output format: "+strings.Join(exportFormatNames(), ", "))
+	files := parseInterspersed(flags, args)
+
+	if len(files) != 1 {
+		log.Fatal("Usage: whisper-transcribe-agent transcribe [flags] <file|->")
+	}
+	if cfg.WhisperURL == "" || cfg.WhisperModel == "" {
+		log.Fatal("Flags --whisper-server-url and --whisper-model must be set")
+	}
+	exporter, ok := exportFormats[*format]
+	if !ok {
+		log.Fatalf("Unsupported format %q", *format)
+	}
+
+	cfg.Workers, cfg.QueueSize = 1, 1
+	pool := newLocalPool(cfg)
+	transcript, err := transcribeLocalFile(pool, cfg, files[0])
+	if err != nil {
+		log.Fatalf("%s: %v", files[0], err)
+	}
+	data, err := exporter.Render(transcript)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(data)
+}
+
+// runTranscribeDir implements the transcribe-dir subcommand: it transcribes
+// every audio file below a directory and writes each transcript under --out
+// (next to the input by default), mirroring the directory layout.
+func runTranscribeDir(args []string) {
+	var cfg Config
+	flags := flag.NewFlagSet("transcribe-dir", flag.ExitOnError)
+	bindBackendFlags(flags, &cfg)
+	format := flags.String("format", "txt", "Output format: "+strings.Join(exportFormatNames(), ", "))
+	out := flags.String("out", "", "Directory for the transcripts (defaults to next to each input)")
+	parallel := flags.Int("parallel", 1, "Number of files transcribed concurrently")
+	overwrite := flags.Bool("overwrite", false, "Transcribe files again even if their transcript already exists")
+	dirs := parseInterspersed(flags, args)
+
+	if len(dirs) != 1 {
+		log.Fatal("Usage: whisper-transcribe-agent transcribe-dir [flags] <dir>")
+	}
+	if cfg.WhisperURL == "" || cfg.WhisperModel == "" {
+		log.Fatal("Flags --whisper-server-url and --whisper-model must be set")
+	}
+	if *parallel < 1 {
+		log.Fatal("--parallel must be at least 1")
+	}
+	exporter, ok := exportFormats[*format]
+	if !ok {
+		log.Fatalf("Unsupported format %q", *format)
+	}
+	root := dirs[0]
+	if *out == "" {
+		*out = root
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && isAudioFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg.Workers, cfg.QueueSize = *parallel, *parallel
+	pool := newLocalPool(cfg)
+
+	paths := make(chan string)
+	var mu sync.Mutex
+	var done, failed int
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				started := time.Now()
+				status, err := transcribeToFile(pool, cfg, exporter, path, outputPath(root, *out, path, exporter.Extension), *overwrite)
+
+				mu.Lock()
+				done++
+				if err != nil {
+					failed++
+					fmt.Fprintf(os.Stderr, "[%d/%d] %s: %v\n", done, len(files), path, err)
+				} else {
+					fmt.Fprintf(os.Stderr, "[%d/%d] %s: %s in %s\n", done, len(files), path, status, time.Since(started).Round(time.Millisecond))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, path := range files {
+		paths <- path
+	}
+	close(paths)
+	wg.Wait()
+
+	fmt.Fprintf(os.Stderr, "transcribed %d of %d files\n", len(files)-failed, len(files))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// transcribeToFile writes the transcript of one input, skipping it if the
+// output already exists unless overwrite is set.
+func transcribeToFile(pool *WorkerPool, cfg Config, exporter exportFormat, input, output string, overwrite bool) (string, error) {
+	if !overwrite {
+		if _, err := os.Stat(output); err == nil {
+			return "skipped", nil
+		}
+	}
+
+	transcript, err := transcribeLocalFile(pool, cfg, input)
+	if err != nil {
+		return "", err
+	}
+	data, err := exporter.Render(transcript)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := os.WriteFile(output, data, 0o644); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return "done", nil
+}
+
+func outputPath(root, out, input, extension string) string {
+	rel, err := filepath.Rel(root, input)
+	if err != nil {
+		rel = filepath.Base(input)
+	}
+	return filepath.Join(out, strings.TrimSuffix(rel, filepath.Ext(rel))+"."+extension)
+}
+
+var audioExtensions = map[string]bool{
+	".aac": true, ".flac": true, ".m4a": true, ".mp3": true, ".mp4": true, ".mpeg": true,
+	".mpga": true, ".oga": true, ".ogg": true, ".opus": true, ".wav": true, ".webm": true,
+}
+
+func isAudioFile(path string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// newLocalPool builds a worker pool for the CLI subcommands. It keeps no audio
+// and its metrics are never served.
+func newLocalPool(cfg Config) *WorkerPool {
+	metrics := NewMetrics()
+	pool := NewWorkerPool(NewJobStore(cfg.Workers, 0), metrics, NewMemoryGuard(metrics, cfg), cfg)
+	vocabulary, err := loadVocabulary(cfg.Vocabulary, cfg.VocabularyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool.UseVocabulary(vocabulary)
+	return pool
+}
+
+// transcribeLocalFile transcribes the file at path, or standard input if path
+// is "-".
+func transcribeLocalFile(pool *WorkerPool, cfg Config, path string) (*Transcript, error) {
+	input, filename := io.Reader(os.Stdin), "stdin"
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer file.Close()
+		input, filename = file, filepath.Base(path)
+	}
+
+	buffer := cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, input); err != nil {
+		buffer.Close()
+		return nil, errors.Wrap(err, "failed to read audio")
+	}
+	if path == "-" {
+		extension, ok := sniffAudioExtension(buffer.Head(512))
+		if !ok {
+			buffer.Close()
+			return nil, errors.New("cannot detect the audio format of stdin")
+		}
+		filename += extension
+	}
+
+	task := &TranscriptionTask{Filename: filename, Audio: buffer, OwnsAudio: true}
+	if _, err := pool.Submit("cli", task); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	<-task.Done
+	return task.Transcript, task.Err
+}
+
+// sniffAudioExtension guesses a file extension for audio without a name, since
+// backends pick the decoder by extension.
+func sniffAudioExtension(head []byte) (string, bool) {
+	switch http.DetectContentType(head) {
+	case "audio/mpeg":
+		return ".mp3", true
+	case "audio/wave":
+		return ".wav", true
+	case "application/ogg":
+		return ".ogg", true
+	case "video/webm":
+		return ".webm", true
+	case "video/mp4":
+		return ".m4a", true
+	case "audio/aiff":
+		return ".aiff", true
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return ".flac", true
+	case len(head) > 1 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync without an ID3 tag.
+		return ".mp3", true
+	}
+	return "", false
+}
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments, e.g. "transcribe file.mp3 --format srt", and returns the
+// positional ones.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"text/",
+}
+
+// withCompression compresses JSON, HTML and other text responses with zstd or
+// gzip, whichever the client prefers. Audio and event streams pass through
+// untouched, as do responses that already set a Content-Encoding.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks zstd or gzip from an Accept-Encoding header,
+// honouring q-values, or returns "" if neither is acceptable.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "zstd" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ || (q == bestQ && name == "zstd") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	writer      io.WriteCloser
+	wroteHeader bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	header := c.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent &&
+		header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		// The compressed bytes differ from what a strong ETag promises.
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+		if c.encoding == "zstd" {
+			c.writer, _ = zstd.NewWriter(c.ResponseWriter)
+		} else {
+			c.writer = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.writer != nil {
+		return c.writer.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Flush() {
+	if flusher, ok := c.writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *compressWriter) Close() error {
+	if c.writer != nil {
+		return c.writer.Close()
+	}
+	return nil
+}
+
+func compressible(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// zstdMaxWindow caps the window a zstd frame may ask the decoder to allocate,
+// far below the library's 512 MB default; zstd uses at most 8 MB up to level
+// 19, and 16 MB still allows --long=24.
+const zstdMaxWindow = 16 << 20
+
+// withDecompression transparently decodes request bodies sent with
+// Content-Encoding gzip or zstd, so uploaders on metered links can compress
+// WAV files, which shrink 5-10x. Size limits downstream apply to the decoded
+// audio, which also keeps decompression bombs out; zstd's window and output
+// are capped in the decoder too, since a tiny frame can make it allocate
+// before any of those see a byte. Other encodings are rejected with 415.
+func withDecompression(next http.Handler, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.ReadCloser
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid gzip body")
+				return
+			}
+			body = reader
+		case "zstd":
+			decoder, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid zstd body")
+				return
+			}
+			body = decoder.IOReadCloser()
+		default:
+			w.Header().Set("Accept-Encoding", "gzip, zstd")
+			writeJSONError(w, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding "+encoding)
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	APIPort          string
+	UIPort           string
+	WhisperURL       string
+	WhisperModel     string
+	CompareURL       string
+	CompareModel     string
+	LiveSTUNServers  string
+	LiveMaxSessions  int
+	MaxAudioSize     int64
+	SpillDir         string
+	SpillThreshold   int64
+	JobHistory       int
+	AudioHistory     int
+	Workers          int
+	QueueSize        int
+	ChunkDuration    time.Duration
+	ChunkParallelism int
+	FFmpegPath       string
+	FFprobePath      string
+	TLSCert          string
+	TLSKey           string
+	H2C              bool
+	MemorySoftLimit  int64
+	MemoryHardLimit  int64
+	TelegramToken    string
+	TelegramChats    string
+	TelegramAPIURL   string
+
+	DiscordToken          string
+	DiscordChannels       string
+	DiscordDisabledGuilds string
+	DiscordGuildLimits    string
+	DiscordAPIURL         string
+
+	MatrixHomeserver string
+	MatrixToken      string
+	MatrixRooms      string
+
+	IMAPAddr         string
+	IMAPUser         string
+	IMAPPassword     string
+	IMAPMailbox      string
+	IMAPPlaintext    bool
+	IMAPPollInterval time.Duration
+	SMTPAddr         string
+	SMTPUser         string
+	SMTPPassword     string
+	EmailFrom        string
+	EmailForwardTo   string
+
+	KafkaBrokers     string
+	KafkaInputTopic  string
+	KafkaOutputTopic string
+	KafkaGroup       string
+	KafkaPartitions  string
+
+	NATSURL           string
+	NATSSubject       string
+	NATSQueueGroup    string
+	NATSStream        string
+	NATSConsumer      string
+	NATSResultSubject string
+
+	AMQPURL              string
+	AMQPQueue            string
+	AMQPResultExchange   string
+	AMQPResultRoutingKey string
+
+	MQTTURL           string
+	MQTTTopics        string
+	MQTTResponseTopic string
+	MQTTClientID      string
+
+	SIPAddr     string
+	SIPPublicIP string
+
+	ZoomWebhookSecret  string
+	MeetWebhookSecret  string
+	DriveAPIURL        string
+	RecordingResultURL string
+
+	LLMURL    string
+	LLMModel  string
+	LLMAPIKey string
+
+	DeepLAPIKey string
+	DeepLURL    string
+
+	RestorePunctuation string
+
+	Redact         string
+	RedactPatterns string
+
+	ProfanityFilter string
+	ProfanityWords  string
+
+	WatchPhrases     string
+	WatchPhrasesFile string
+	AlertWebhookURL  string
+	AlertSlackURL    string
+
+	DiarizationURL string
+
+	Vocabulary     string
+	VocabularyFile string
+
+	Pipeline      string
+	PipelinesFile string
+	WASMRuntime   string
+	WASMMaxMemory int64
+	WASMFuel      int64
+
+	AdminToken string
+	ModelsDir  string
+	ModelsURL  string
+
+	APIKeysFile  string
+	TenantHeader string
+
+	PublicURL       string
+	ResultURLSecret string
+	ResultURLTTL    time.Duration
+
+	EncryptionKeyFile    string
+	EncryptionKeyCommand string
+	encryptionKey        []byte
+
+	AuditLog string
+
+	IdempotencyTTL time.Duration
+
+	OpsAlertWebhookURL   string
+	OpsAlertSlackURL     string
+	OpsAlertPagerDutyKey string
+	AlertErrorRate       float64
+	AlertWindow          time.Duration
+	AlertQueueDepth      int
+	AlertBackendDown     time.Duration
+
+	WarmUp bool
+
+	CanaryURL    string
+	CanaryModel  string
+	CanaryWeight float64
+
+	ShadowURL      string
+	ShadowModel    string
+	ShadowFraction float64
+	ShadowLogWER   float64
+
+	DownloadAllowedHosts   string
+	DownloadBlockPrivate   bool
+	DownloadMaxRedirects   int
+	DownloadAllowDowngrade bool
+	DownloadHeadersFile    string
+
+	DownloadProxy string
+	BackendProxy  string
+
+	DownloadParallelism     int
+	DownloadParallelMinSize int64
+
+	DownloadDNSTTL time.Duration
+
+	DownloadIPFamily string
+	DownloadBind     string
+	downloadDialer   *outboundDialer
+	BackendIPFamily  string
+	BackendBind      string
+
+	DownloadUserAgent string
+	DownloadHostDelay time.Duration
+
+	DownloadCookiesFile   string
+	DownloadLoginURL      string
+	DownloadLoginFormFile string
+
+	UploadTTL time.Duration
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Prefix    string
+
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCAudience     string
+	OIDCRolesClaim   string
+	OIDCTenantClaim  string
+
+	ReadOnly bool
+
+	ScheduleDir string
+}
+
+func (c Config) compareEnabled() bool {
+	return c.CompareModel != ""
+}
+
+func (c Config) summarizeEnabled() bool {
+	return c.LLMURL != ""
+}
+
+func (c Config) translateEnabled() bool {
+	return c.DeepLAPIKey != "" || c.LLMURL != ""
+}
+
+// deepLURL picks the API host matching the key: free plan keys end in ":fx".
+func (c Config) deepLURL() string {
+	if c.DeepLURL != "" {
+		return c.DeepLURL
+	}
+	if strings.HasSuffix(c.DeepLAPIKey, ":fx") {
+		return "https://api-free.deepl.com"
+	}
+	return "https://api.deepl.com"
+}
+
+func (c Config) newAudioBuffer() *AudioBuffer {
+	return newAudioBuffer(c.SpillDir, c.SpillThreshold, c.encryptionKey)
+}
+
+// bindBackendFlags registers the flags shared by the server and the CLI
+// subcommands: where to send audio and how to prepare it.
+func bindBackendFlags(flags *flag.FlagSet, cfg *Config) {
+	flags.StringVar(&cfg.WhisperURL, "whisper-server-url", "", "Base URL of transcription service")
+	flags.StringVar(&cfg.WhisperModel, "whisper-model", "", "Whisper model to use")
+	flags.StringVar(&cfg.SpillDir, "spill-dir", os.TempDir(), "Directory for temp files holding audio larger than --spill-threshold")
+	flags.Int64Var(&cfg.SpillThreshold, "spill-threshold", 32<<20, "Audio larger than this many bytes is buffered on disk instead of in memory")
+	flags.DurationVar(&cfg.ChunkDuration, "chunk-duration", 0, "Split audio longer than this into chunks transcribed in parallel, e.g. 10m (requires ffmpeg; disabled if 0)")
+	flags.IntVar(&cfg.ChunkParallelism, "chunk-parallelism", 4, "Number of chunks of one job sent to the backend concurrently")
+	flags.StringVar(&cfg.FFmpegPath, "ffmpeg-path", "ffmpeg", "Path to the ffmpeg binary")
+	flags.StringVar(&cfg.FFprobePath, "ffprobe-path", "ffprobe", "Path to the ffprobe binary")
+	flags.StringVar(&cfg.Vocabulary, "vocabulary", "", "Comma-separated domain terms, product names and spellings whisper is prompted with")
+	flags.StringVar(&cfg.VocabularyFile, "vocabulary-file", "", "File with more vocabulary terms, one per line")
+}
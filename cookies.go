@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+)
+
+// minLoginInterval keeps a download session from logging in again and again
+// when the credentials are wrong.
+const minLoginInterval = time.Minute
+
+// downloadSession keeps the cookies audio URLs are downloaded with, for
+// sources that gate audio behind a session, like an intranet meeting
+// archive. They're loaded from --download-cookies-file and set by logging in
+// with --download-login-url, which happens whenever a download is refused or
+// sent to the login page, i.e. the session is missing or has expired.
+type downloadSession struct {
+	jar       *cookiejar.Jar
+	loginURL  *url.URL
+	loginForm url.Values
+	mu        sync.Mutex
+	lastLogin time.Time
+}
+
+// loadDownloadSession returns the session of the cookie and login flags, or
+// nil if none are set.
+func loadDownloadSession(cfg Config) (*downloadSession, error) {
+	if cfg.DownloadCookiesFile == "" && cfg.DownloadLoginURL == "" {
+		return nil, nil
+	}
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	session := &downloadSession{jar: jar}
+	if cfg.DownloadCookiesFile != "" {
+		if err := loadCookies(jar, cfg.DownloadCookiesFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DownloadLoginURL != "" {
+		if session.loginURL, err = url.Parse(cfg.DownloadLoginURL); err != nil || session.loginURL.Host == "" {
+			return nil, errors.Errorf("invalid login URL %q", cfg.DownloadLoginURL)
+		}
+		if cfg.DownloadLoginFormFile == "" {
+			return nil, errors.New("a login URL needs a login form file")
+		}
+		form, err := os.ReadFile(cfg.DownloadLoginFormFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if session.loginForm, err = url.ParseQuery(strings.TrimSpace(string(form))); err != nil {
+			return nil, errors.Wrapf(err, "%s: expected the form as name=value&name=value", cfg.DownloadLoginFormFile)
+		}
+	}
+	return session, nil
+}
+
+// loadCookies reads cookies in the Netscape cookies.txt format browser
+// extensions, curl and yt-dlp export: one cookie per line with the domain,
+// whether subdomains get it, path, whether it's https only, expiry, name and
+// value, separated by tabs.
+func loadCookies(jar *cookiejar.Jar, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		text, httpOnly := strings.CutPrefix(text, "#HttpOnly_")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return errors.Errorf("%s:%d: expected 7 tab-separated fields", path, line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return errors.Errorf("%s:%d: invalid expiry %q", path, line, fields[4])
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			HttpOnly: httpOnly,
+		}
+		if fields[1] == "TRUE" {
+			cookie.Domain = host
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+// expired reports whether the response to a download means the session is
+// missing or has expired: the source refused it or redirected to the login
+// page.
+func (s *downloadSession) expired(resp *http.Response) bool {
+	if s.loginURL == nil {
+		return false
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return resp.Request.URL.Host == s.loginURL.Host
+	}
+	location, err := resp.Location()
+	return err == nil && location.Host == s.loginURL.Host && location.Path == s.loginURL.Path
+}
+
+// login posts the login form with the client, which stores the session
+// cookies the source sets in the jar. It's skipped if another download just
+// logged in, so the session it got is used instead.
+func (s *downloadSession) login(client *http.Client, since time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastLogin.After(since) {
+		return nil
+	}
+	if time.Since(s.lastLogin) < minLoginInterval {
+		return errors.New("logged in less than a minute ago, check the login form")
+	}
+	s.lastLogin = time.Now()
+	log.Printf("Logging in to %s for downloads", s.loginURL.Redacted())
+	resp, err := client.PostForm(s.loginURL.String(), s.loginForm)
+	if err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("login returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setCookies replaces the cookies of the request with the jar's.
+func (s *downloadSession) setCookies(req *http.Request) {
+	req.Header.Del("Cookie")
+	for _, cookie := range s.jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+}
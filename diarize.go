@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const diarizationTimeout = 30 * time.Minute
+
+// diarizationTurn is a stretch of audio the diarization sidecar attributes to
+// one speaker.
+type diarizationTurn struct {
+	Start   float64      `json:"start"`
+	End     float64      `json:"end"`
+	Speaker speakerLabel `json:"speaker"`
+}
+
+// diarize sends the audio to the pyannote-compatible sidecar at
+// --diarization-url and attributes each segment to the speaker who talks the
+// most during it. The sidecar takes the audio as the multipart field "file"
+// and answers with a JSON array of {start, end, speaker} turns, or an object
+// holding them in "segments".
+func diarize(cfg Config, transcript *Transcript, filename string, audio io.Reader) error {
+	turns, err := requestDiarization(cfg.DiarizationURL, filename, audio)
+	if err != nil {
+		return err
+	}
+	for i := range transcript.Segments {
+		segment := &transcript.Segments[i]
+		overlaps := map[speakerLabel]float64{}
+		var speaker speakerLabel
+		for _, turn := range turns {
+			overlap := min(segment.End, turn.End) - max(segment.Start, turn.Start)
+			if overlap <= 0 {
+				continue
+			}
+			overlaps[turn.Speaker] += overlap
+			if speaker == "" || overlaps[turn.Speaker] > overlaps[speaker] {
+				speaker = turn.Speaker
+			}
+		}
+		segment.Speaker = speaker
+	}
+	labelSpeakers(transcript)
+	return nil
+}
+
+func requestDiarization(url, filename string, audio io.Reader) ([]diarizationTurn, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		part, err := writer.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, audio)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, url, bodyReader)
+	if err != nil {
+		bodyReader.Close()
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: diarizationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "diarization request failed")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "diarization request failed")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("diarization server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var turns []diarizationTurn
+	if err := json.Unmarshal(body, &turns); err != nil {
+		var wrapped struct {
+			Segments []diarizationTurn `json:"segments"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err != nil {
+			return nil, errors.New("invalid diarization response")
+		}
+		turns = wrapped.Segments
+	}
+	return turns, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import "strings"
+
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+const (
+	diffEqual  = "equal"
+	diffDelete = "delete"
+	diffInsert = "insert"
+)
+
+// diffWords computes a word-level diff between two transcripts with Myers'
+// algorithm. Only the explored diagonals are kept for each round, so memory
+// grows with the square of the edit distance rather than the transcript length.
+func diffWords(a, b []string) []DiffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return mergeDiffOps(backtrackDiff(trace, a, b))
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(trace [][]int, a, b []string) []DiffOp {
+	var ops []DiffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, DiffOp{Op: diffEqual, Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, DiffOp{Op: diffInsert, Text: b[y-1]})
+			} else {
+				ops = append(ops, DiffOp{Op: diffDelete, Text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func mergeDiffOps(ops []DiffOp) []DiffOp {
+	var merged []DiffOp
+	for _, op := range ops {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Op == op.Op {
+			merged[last].Text += " " + op.Text
+			continue
+		}
+		merged = append(merged, op)
+	}
+	return merged
+}
+
+func diffTranscripts(a, b string) []DiffOp {
+	return diffWords(strings.Fields(a), strings.Fields(b))
+}
+
+// wordErrorRate is the word error rate of hypothesis against reference: the
+// substituted, deleted and inserted words over the words of the reference,
+// ignoring case and punctuation. A run of deletions next to insertions counts
+// as substitutions, as many as the longer side.
+func wordErrorRate(reference, hypothesis string) float64 {
+	a := strings.Fields(normalizeForMatching(reference))
+	b := strings.Fields(normalizeForMatching(hypothesis))
+	if len(a) == 0 {
+		if len(b) == 0 {
+			return 0
+		}
+		return 1
+	}
+	errors, deleted, inserted := 0, 0, 0
+	flush := func() {
+		errors += max(deleted, inserted)
+		deleted, inserted = 0, 0
+	}
+	for _, op := range diffWords(a, b) {
+		words := len(strings.Fields(op.Text))
+		switch op.Op {
+		case diffDelete:
+			deleted += words
+		case diffInsert:
+			inserted += words
+		default:
+			flush()
+		}
+	}
+	flush()
+	return float64(errors) / float64(len(a))
+}
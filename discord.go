@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	discordPollInterval = 5 * time.Second
+	discordMessageLimit = 2000
+	discordThreadName   = 100
+)
+
+type discordAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+type discordMessage struct {
+	ID     string `json:"id"`
+	Author struct {
+		Bot bool `json:"bot"`
+	} `json:"author"`
+	Attachments []discordAttachment `json:"attachments"`
+}
+
+// DiscordBot polls the configured channels for messages with audio
+// attachments and replies to each in a thread with the transcript. Guilds can
+// be disabled or given a lower size limit than --max-audio-size.
+type DiscordBot struct {
+	token          string
+	apiURL         string
+	channels       []string
+	disabledGuilds map[string]bool
+	guildLimits    map[string]int64
+	pool           *WorkerPool
+	cfg            Config
+	client         *http.Client
+}
+
+func NewDiscordBot(pool *WorkerPool, cfg Config) (*DiscordBot, error) {
+	bot := &DiscordBot{
+		token:          cfg.DiscordToken,
+		apiURL:         strings.TrimSuffix(cfg.DiscordAPIURL, "/"),
+		disabledGuilds: make(map[string]bool),
+		guildLimits:    make(map[string]int64),
+		pool:           pool,
+		cfg:            cfg,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, channel := range strings.Split(cfg.DiscordChannels, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			bot.channels = append(bot.channels, channel)
+		}
+	}
+	if len(bot.channels) == 0 {
+		return nil, errors.New("--discord-channels must list at least one channel id")
+	}
+	for _, guild := range strings.Split(cfg.DiscordDisabledGuilds, ",") {
+		if guild = strings.TrimSpace(guild); guild != "" {
+			bot.disabledGuilds[guild] = true
+		}
+	}
+	for _, entry := range strings.Split(cfg.DiscordGuildLimits, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		guild, limit, ok := strings.Cut(entry, "=")
+		size, err := strconv.ParseInt(limit, 10, 64)
+		if !ok || err != nil {
+			return nil, errors.Errorf("invalid Discord guild limit %q, expected <guild id>=<bytes>", entry)
+		}
+		bot.guildLimits[guild] = size
+	}
+	return bot, nil
+}
+
+func (b *DiscordBot) Run() {
+	for _, channel := range b.channels {
+		go b.watchChannel(channel)
+	}
+}
+
+// watchChannel handles messages posted to the channel after the bot started.
+func (b *DiscordBot) watchChannel(channelID string) {
+	var channel struct {
+		GuildID string `json:"guild_id"`
+	}
+	var latest []discordMessage
+	for {
+		err := b.call(http.MethodGet, "/channels/"+channelID, nil, &channel)
+		if err == nil {
+			err = b.call(http.MethodGet, "/channels/"+channelID+"/messages?limit=1", nil, &latest)
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Discord channel %s unavailable: %v", channelID, err)
+		time.Sleep(discordPollInterval)
+	}
+
+	log.Printf("Discord bot watching channel %s...", channelID)
+	after := ""
+	if len(latest) > 0 {
+		after = latest[0].ID
+	}
+	for {
+		time.Sleep(discordPollInterval)
+		if b.disabledGuilds[channel.GuildID] {
+			continue
+		}
+
+		var messages []discordMessage
+		query := url.Values{"limit": {"50"}}
+		if after != "" {
+			query.Set("after", after)
+		}
+		if err := b.call(http.MethodGet, "/channels/"+channelID+"/messages?"+query.Encode(), nil, &messages); err != nil {
+			log.Printf("Discord polling channel %s failed: %v", channelID, err)
+			continue
+		}
+
+		// Messages come newest first.
+		for i := len(messages) - 1; i >= 0; i-- {
+			after = messages[i].ID
+			if !messages[i].Author.Bot {
+				go b.handleMessage(channelID, channel.GuildID, messages[i])
+			}
+		}
+	}
+}
+
+func (b *DiscordBot) handleMessage(channelID, guildID string, message discordMessage) {
+	limit := b.cfg.MaxAudioSize
+	if guildLimit, ok := b.guildLimits[guildID]; ok && guildLimit < limit {
+		limit = guildLimit
+	}
+
+	for _, attachment := range message.Attachments {
+		if !strings.HasPrefix(attachment.ContentType, "audio/") && !isAudioFile(attachment.Filename) {
+			continue
+		}
+
+		var text string
+		if attachment.Size > limit {
+			text = fmt.Sprintf("%s is too large to transcribe (limit %.1f MB).", attachment.Filename, float64(limit)/(1<<20))
+		} else {
+			text = b.transcribe(attachment)
+		}
+		if err := b.reply(channelID, message.ID, attachment.Filename, text); err != nil {
+			log.Printf("Discord reply in channel %s failed: %v", channelID, err)
+		}
+	}
+}
+
+func (b *DiscordBot) transcribe(attachment discordAttachment) string {
+	task := &TranscriptionTask{Filename: attachment.Filename, AudioURL: attachment.URL, ContentType: attachment.ContentType}
+	if _, err := b.pool.Submit("discord", task); err != nil {
+		return "Transcription failed: " + err.Error()
+	}
+	<-task.Done
+	if task.Err != nil {
+		log.Printf("Discord transcription of %s failed: %+v", attachment.Filename, task.Err)
+		return "Transcription failed: " + task.Err.Error()
+	}
+
+	text, err := renderText(task.Transcript)
+	if err != nil {
+		return "Transcription failed: " + err.Error()
+	}
+	if strings.TrimSpace(string(text)) == "" {
+		return "(no speech detected)"
+	}
+	return string(text)
+}
+
+// reply starts a thread on the message and posts the text into it.
+func (b *DiscordBot) reply(channelID, messageID, filename, text string) error {
+	name := []rune("Transcript: " + filename)
+	if len(name) > discordThreadName {
+		name = name[:discordThreadName]
+	}
+	var thread struct {
+		ID string `json:"id"`
+	}
+	err := b.call(http.MethodPost, "/channels/"+channelID+"/messages/"+messageID+"/threads",
+		map[string]interface{}{"name": string(name), "auto_archive_duration": 1440}, &thread)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range splitMessage(text, discordMessageLimit) {
+		if err := b.call(http.MethodPost, "/channels/"+thread.ID+"/messages", map[string]string{"content": chunk}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call invokes a REST API endpoint, waiting out rate limits.
+func (b *DiscordBot) call(method, path string, params interface{}, result interface{}) error {
+	var body []byte
+	if params != nil {
+		var err error
+		if body, err = json.Marshal(params); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for {
+		req, err := http.NewRequest(method, b.apiURL+path, bytes.NewReader(body))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		req.Header.Set("Authorization", "Bot "+b.token)
+		req.Header.Set("User-Agent", "DiscordBot (https://github.com/KonstantinGeist/whisper-transcribe-agent, 1.0)")
+		if params != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "discord %s %s failed", method, path)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			var rateLimit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.Unmarshal(data, &rateLimit)
+			time.Sleep(time.Duration(rateLimit.RetryAfter*float64(time.Second)) + 100*time.Millisecond)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.Errorf("discord %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+		}
+		if result == nil {
+			return nil
+		}
+		return errors.Wrapf(json.Unmarshal(data, result), "invalid discord %s response", path)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDNSCacheEntries bounds the hosts the download DNS cache remembers.
+const maxDNSCacheEntries = 256
+
+// dnsCache remembers the addresses of download hosts for a TTL, so repeated
+// downloads from the same recording host skip the lookup and connect to the
+// same addresses: a host can't switch to other addresses between the
+// requests of a download, its redirects, resumes and ranges included.
+type dnsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+// dialContext returns a DialContext connecting with the dialer to the cached
+// addresses of the host, trying them in turn. If none of them can be
+// connected to, the host is looked up again next time.
+func (c *dnsCache) dialContext(dialer *outboundDialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addresses, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addresses {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		c.forget(host)
+		return nil, err
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxDNSCacheEntries {
+		c.evict()
+	}
+	c.entries[host] = dnsEntry{addresses: addresses, expires: time.Now().Add(c.ttl)}
+	return addresses, nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, host)
+}
+
+// evict drops the expired entries, or an arbitrary one if none has expired.
+func (c *dnsCache) evict() {
+	now := time.Now()
+	for host, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, host)
+		}
+	}
+	for host := range c.entries {
+		if len(c.entries) < maxDNSCacheEntries {
+			return
+		}
+		delete(c.entries, host)
+	}
+}
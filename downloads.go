@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpguts"
+)
+
+// newDownloadClient returns the client audio URLs given by users are fetched
+// with. It follows at most --download-max-redirects redirects, none from
+// https to http unless --download-allow-downgrade, and checks the first
+// request and every redirect target against --download-allowed-hosts. With
+// --download-block-private it refuses to connect to internal addresses; that's
+// checked on the resolved address of every connection, so DNS names pointing
+// inside don't get around it; it can't be combined with a proxy, which makes
+// those connections instead. Every request gets the headers configured for
+// its host and goes through --download-proxy if set, over the IP family and
+// from the source address of --download-ip-family and --download-bind. With
+// --download-dns-ttl the addresses of hosts are cached and pinned. With a
+// session, cookies are kept and sent, logging in when needed.
+func newDownloadClient(cfg Config, headers []downloadHeader, session *downloadSession) *http.Client {
+	transport := proxiedTransport(cfg.DownloadProxy)
+	dialer := &outboundDialer{Dialer: net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}}
+	if cfg.downloadDialer != nil {
+		configured := *cfg.downloadDialer
+		dialer = &configured
+	}
+	if cfg.DownloadBlockPrivate {
+		dialer.Control = refusePrivateAddresses
+	}
+	transport.DialContext = dialer.DialContext
+	if cfg.DownloadDNSTTL > 0 {
+		transport.DialContext = newDNSCache(cfg.DownloadDNSTTL).dialContext(dialer)
+	}
+	policy := &downloadPolicy{next: transport, headers: headers, userAgent: cfg.DownloadUserAgent}
+	if cfg.DownloadHostDelay > 0 {
+		policy.throttle = &hostThrottle{delay: cfg.DownloadHostDelay, next: make(map[string]time.Time)}
+	}
+	for _, host := range strings.Split(cfg.DownloadAllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			policy.allowedHosts = append(policy.allowedHosts, host)
+		}
+	}
+	client := &http.Client{
+		Transport: policy,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.DownloadMaxRedirects {
+				return errors.Errorf("stopped after %d redirects", cfg.DownloadMaxRedirects)
+			}
+			if previous := via[len(via)-1]; previous.URL.Scheme == "https" && req.URL.Scheme != "https" && !cfg.DownloadAllowDowngrade {
+				return errors.Errorf("refusing redirect from https to %s", req.URL.Redacted())
+			}
+			// The headers given with the request are only for the host it
+			// named; other hosts get their own from --download-headers-file.
+			if req.URL.Host != via[0].URL.Host {
+				for name := range via[0].Header {
+					req.Header.Del(name)
+				}
+			}
+			return nil
+		},
+	}
+	if session != nil {
+		client.Jar = session.jar
+		policy.session = session
+		// The login's redirect is where a browser would go next, which
+		// needn't be fetched: the cookies are set by then.
+		policy.login = &http.Client{
+			Transport: policy,
+			Jar:       session.jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	return client
+}
+
+// downloadPolicy refuses requests to hosts that aren't allowed, adds the
+// configured headers of the host and the User-Agent and spaces requests to
+// the same host, including to the targets of redirects, which the client
+// sends through it as well. If the session has expired, it logs in with the
+// login client and sends the request again.
+type downloadPolicy struct {
+	next         http.RoundTripper
+	allowedHosts []string
+	headers      []downloadHeader
+	userAgent    string
+	throttle     *hostThrottle
+	session      *downloadSession
+	login        *http.Client
+}
+
+func (p *downloadPolicy) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, errors.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+	}
+	if !hostAllowed(p.allowedHosts, req.URL.Hostname()) {
+		return nil, errors.Errorf("downloads from %s aren't allowed", req.URL.Hostname())
+	}
+	var defaults []downloadHeader
+	for _, header := range p.headers {
+		if req.Header.Get(header.name) == "" && (header.host == "*" || hostAllowed([]string{header.host}, req.URL.Hostname())) {
+			defaults = append(defaults, header)
+		}
+	}
+	setUserAgent := p.userAgent != "" && req.Header.Get("User-Agent") == ""
+	if len(defaults) > 0 || setUserAgent {
+		req = req.Clone(req.Context())
+		for _, header := range defaults {
+			req.Header.Set(header.name, header.value)
+		}
+		if setUserAgent {
+			req.Header.Set("User-Agent", p.userAgent)
+		}
+	}
+	if p.throttle != nil {
+		if err := p.throttle.wait(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	sent := time.Now()
+	resp, err := p.next.RoundTrip(req)
+	// Only requests without a body can be sent again, which leaves out the
+	// login itself.
+	if err != nil || p.session == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) || !p.session.expired(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+	if err := p.session.login(p.login, sent); err != nil {
+		return nil, errors.Wrap(err, "download needs a session")
+	}
+	req = req.Clone(req.Context())
+	p.session.setCookies(req)
+	return p.next.RoundTrip(req)
+}
+
+// maxThrottledHosts is how many hosts a hostThrottle tracks before it forgets
+// the ones it may send to right away.
+const maxThrottledHosts = 1024
+
+// hostThrottle spaces requests to the same host at least delay apart, for
+// media hosts that throttle or block aggressive fetchers. Parallel ranges of
+// a download are spaced out as well.
+type hostThrottle struct {
+	delay time.Duration
+	mu    sync.Mutex
+	next  map[string]time.Time
+}
+
+// wait blocks until the next request to the host may be sent, taking its
+// turn.
+func (t *hostThrottle) wait(ctx context.Context, host string) error {
+	t.mu.Lock()
+	now := time.Now()
+	if len(t.next) >= maxThrottledHosts {
+		for other, next := range t.next {
+			if next.Before(now) {
+				delete(t.next, other)
+			}
+		}
+	}
+	turn := t.next[host]
+	if turn.Before(now) {
+		turn = now
+	}
+	t.next[host] = turn.Add(t.delay)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(turn))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maxDownloadHeaders bounds the headers a request can have audio URLs fetched
+// with.
+const maxDownloadHeaders = 20
+
+// downloadHeader is a header sent when downloading audio from host, which is
+// a host name, a "*.example.com" pattern or "*" for all.
+type downloadHeader struct {
+	host  string
+	name  string
+	value string
+}
+
+// reservedDownloadHeaders are set by the downloader itself.
+var reservedDownloadHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Range":             true,
+}
+
+// checkDownloadHeaders validates the headers a request wants its audio URL
+// fetched with, e.g. Authorization for a private recording server.
+func checkDownloadHeaders(headers map[string]string) error {
+	if len(headers) > maxDownloadHeaders {
+		return errors.Errorf("at most %d download headers are allowed", maxDownloadHeaders)
+	}
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return errors.Errorf("invalid download header %q", name)
+		}
+		if reservedDownloadHeaders[http.CanonicalHeaderKey(name)] {
+			return errors.Errorf("download header %s can't be set", name)
+		}
+	}
+	return nil
+}
+
+// loadDownloadHeaders reads the headers sent when downloading audio URLs from
+// path, one "host Name: value" per line, so private recording servers don't
+// need public presigned links. Headers given with a request take precedence.
+func loadDownloadHeaders(path string) ([]downloadHeader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	var headers []downloadHeader
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		host, field, _ := strings.Cut(text, " ")
+		name, value, ok := strings.Cut(field, ":")
+		header := downloadHeader{host: host, name: strings.TrimSpace(name), value: strings.TrimSpace(value)}
+		if !ok || checkDownloadHeaders(map[string]string{header.name: header.value}) != nil {
+			return nil, errors.Errorf("%s:%d: expected \"host Name: value\"", path, line)
+		}
+		headers = append(headers, header)
+	}
+	return headers, errors.WithStack(scanner.Err())
+}
+
+// Downloads that break off partway are resumed up to maxDownloadResumes
+// times, downloadResumeDelay apart.
+const (
+	maxDownloadResumes  = 5
+	downloadResumeDelay = 2 * time.Second
+)
+
+// resumableBody continues a download that broke off partway with a Range
+// request for the rest, so long recordings from flaky servers don't start
+// over from the beginning, only to break off again.
+type resumableBody struct {
+	client    *http.Client
+	req       *http.Request
+	body      io.ReadCloser
+	read      int64
+	size      int64
+	validator string
+	resumes   int
+}
+
+// resumable returns the body of the response to req, resumed if it breaks
+// off where the server supports ranges and has a validator for If-Range, so
+// the rest can't come from a different version of the file. Otherwise it's
+// the body as is.
+func resumable(client *http.Client, req *http.Request, resp *http.Response) io.ReadCloser {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || validator == "" {
+		return resp.Body
+	}
+	return &resumableBody{client: client, req: req, body: resp.Body, size: resp.ContentLength, validator: validator}
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if err := b.resume(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the broken body with the rest of the file.
+func (b *resumableBody) resume(cause error) error {
+	b.body.Close()
+	b.body = http.NoBody
+	for b.resumes < maxDownloadResumes {
+		b.resumes++
+		log.Printf("Download of %s broke off at %d bytes, resuming (%d/%d): %v",
+			b.req.URL.Redacted(), b.read, b.resumes, maxDownloadResumes, cause)
+		time.Sleep(downloadResumeDelay)
+
+		req := b.req.Clone(b.req.Context())
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+		req.Header.Set("If-Range", b.validator)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			cause = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			cause = errors.Errorf("resuming returned %d", resp.StatusCode)
+			continue
+		}
+		contentRange := resp.Header.Get("Content-Range")
+		if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", b.read)) ||
+			(b.size >= 0 && !strings.HasSuffix(contentRange, fmt.Sprintf("/%d", b.size))) {
+			// The file changed or the server ignored the range.
+			resp.Body.Close()
+			return errors.Wrapf(cause, "download broke off at %d bytes and can't be resumed", b.read)
+		}
+		b.body = resp.Body
+		return nil
+	}
+	return errors.Wrapf(cause, "download broke off at %d bytes, resumed %d times", b.read, maxDownloadResumes)
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// hostAllowed matches the host against a list of hosts and "*.example.com"
+// patterns, which match example.com's subdomains. An empty list allows any.
+func hostAllowed(allowed []string, host string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// refusePrivateAddresses is a dialer control that fails connections to
+// loopback, private, link-local (including cloud metadata services),
+// carrier-grade NAT and unspecified addresses.
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || carrierGradeNAT.Contains(ip) {
+		return errors.Errorf("downloads from internal address %s aren't allowed", ip)
+	}
+	return nil
+}
+
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Audio       *AudioBuffer
+}
+
+// EmailIngester polls an IMAP mailbox for unseen messages with audio
+// attachments, e.g. voicemail-to-email from a PBX, and answers each with the
+// transcripts: as a reply to the sender, or forwarded to a fixed address.
+// Messages are deduplicated by Message-ID and marked seen once answered.
+type EmailIngester struct {
+	pool      *WorkerPool
+	cfg       Config
+	processed map[string]bool
+}
+
+func NewEmailIngester(pool *WorkerPool, cfg Config) *EmailIngester {
+	return &EmailIngester{pool: pool, cfg: cfg, processed: make(map[string]bool)}
+}
+
+func (e *EmailIngester) Run() {
+	log.Printf("Polling IMAP mailbox %s on %s every %s...", e.cfg.IMAPMailbox, e.cfg.IMAPAddr, e.cfg.IMAPPollInterval)
+	for {
+		if err := e.poll(); err != nil {
+			log.Printf("IMAP poll failed: %v", err)
+		}
+		time.Sleep(e.cfg.IMAPPollInterval)
+	}
+}
+
+func (e *EmailIngester) poll() error {
+	conn, err := dialIMAP(e.cfg.IMAPAddr, e.cfg.IMAPPlaintext)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.login(e.cfg.IMAPUser, e.cfg.IMAPPassword); err != nil {
+		return err
+	}
+	if err := conn.selectMailbox(e.cfg.IMAPMailbox); err != nil {
+		return err
+	}
+
+	uids, err := conn.searchUnseen()
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		raw, err := conn.fetchMessage(uid)
+		if err != nil {
+			return err
+		}
+		done, err := e.handleMessage(raw)
+		if err != nil {
+			log.Printf("Email %s: %v", uid, err)
+		}
+		if done {
+			if err := conn.markSeen(uid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleMessage answers one message. It returns done=false if the message
+// should be retried on the next poll, e.g. because the queue was full.
+func (e *EmailIngester) handleMessage(raw []byte) (bool, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return true, errors.Wrap(err, "invalid message")
+	}
+	messageID := message.Header.Get("Message-ID")
+	if messageID != "" && e.processed[messageID] {
+		return true, nil
+	}
+
+	attachments, err := e.audioAttachments(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Body)
+	defer func() {
+		for _, attachment := range attachments {
+			attachment.Audio.Close()
+		}
+	}()
+	if err != nil {
+		return true, err
+	}
+	if len(attachments) == 0 {
+		return true, nil
+	}
+
+	var body strings.Builder
+	for _, attachment := range attachments {
+		task := &TranscriptionTask{Filename: attachment.Filename, Audio: attachment.Audio, ContentType: attachment.ContentType}
+		if _, err := e.pool.Submit("email", task); err != nil {
+			return false, err
+		}
+		<-task.Done
+
+		fmt.Fprintf(&body, "%s:\n\n", attachment.Filename)
+		if task.Err != nil {
+			fmt.Fprintf(&body, "Transcription failed: %v\n\n", task.Err)
+			continue
+		}
+		text, err := renderText(task.Transcript)
+		if err != nil {
+			return true, err
+		}
+		body.Write(text)
+		body.WriteString("\n")
+		if link := e.pool.resultURL(task.JobID); link != "" {
+			fmt.Fprintf(&body, "Full transcript: %s\n\n", link)
+		}
+	}
+
+	if err := e.reply(message.Header, body.String()); err != nil {
+		return false, err
+	}
+	if messageID != "" {
+		e.processed[messageID] = true
+	}
+	return true, nil
+}
+
+// audioAttachments walks the MIME tree and buffers every audio part.
+func (e *EmailIngester) audioAttachments(contentType, encoding string, body io.Reader) ([]emailAttachment, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var attachments []emailAttachment
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return attachments, nil
+			}
+			if err != nil {
+				return attachments, errors.Wrap(err, "invalid multipart message")
+			}
+			nested, err := e.audioAttachments(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			attachments = append(attachments, nested...)
+			if err != nil {
+				return attachments, err
+			}
+		}
+	}
+
+	filename := params["name"]
+	if part, ok := body.(*multipart.Part); ok && part.FileName() != "" {
+		filename = part.FileName()
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	if !strings.HasPrefix(mediaType, "audio/") && !isAudioFile(filename) {
+		return nil, nil
+	}
+	if filename == "" {
+		extensions, _ := mime.ExtensionsByType(mediaType)
+		filename = "voicemail"
+		if len(extensions) > 0 {
+			filename += extensions[0]
+		}
+	}
+
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	buffer := e.cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, limitReader(io.NopCloser(body), e.cfg.MaxAudioSize)); err != nil {
+		buffer.Close()
+		return nil, errors.Wrapf(err, "failed to read attachment %s", filename)
+	}
+	return []emailAttachment{{Filename: filename, ContentType: mediaType, Audio: buffer}}, nil
+}
+
+func (e *EmailIngester) reply(header mail.Header, body string) error {
+	to := e.cfg.EmailForwardTo
+	if to == "" {
+		to = header.Get("Reply-To")
+	}
+	if to == "" {
+		to = header.Get("From")
+	}
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil || len(recipients) == 0 {
+		return errors.Errorf("no valid recipient in %q", to)
+	}
+
+	subject := header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", e.cfg.EmailFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if messageID := header.Get("Message-ID"); messageID != "" {
+		fmt.Fprintf(&message, "In-Reply-To: %s\r\nReferences: %s\r\n", messageID, messageID)
+	}
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if e.cfg.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(e.cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", e.cfg.SMTPUser, e.cfg.SMTPPassword, host)
+	}
+	addresses := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		addresses[i] = recipient.Address
+	}
+	from, err := mail.ParseAddress(e.cfg.EmailFrom)
+	if err != nil {
+		return errors.Wrap(err, "invalid --email-from")
+	}
+	return errors.Wrap(smtp.SendMail(e.cfg.SMTPAddr, auth, from.Address, addresses, message.Bytes()), "failed to send reply")
+}
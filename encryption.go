@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadEncryptionKey reads the AES-256 key audio is encrypted with on disk
+// from a file, or from the output of a command, which is how a KMS or a vault
+// hands out keys, e.g. "vault kv get -field=key secret/whisper". The key is 32
+// bytes, raw or hex or base64 encoded. Without either, nothing is encrypted.
+func loadEncryptionKey(file, command string) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case file != "" && command != "":
+		return nil, errors.New("only one of --encryption-key-file and --encryption-key-command can be set")
+	case file != "":
+		data, err = os.ReadFile(file)
+	case command != "":
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the encryption key")
+	}
+	return parseEncryptionKey(data)
+}
+
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption key must be 32 bytes, raw, hex or base64 encoded")
+}
+
+// fileCipher encrypts a file with AES-CTR, which unlike an AEAD can decrypt
+// from any offset, so encrypted audio can still be read in parallel and
+// seeked in for playback. Every file gets its own random nonce in the first
+// half of the IV; the second half counts blocks from 0.
+type fileCipher struct {
+	block cipher.Block
+	nonce [8]byte
+}
+
+func newFileCipher(key []byte) (*fileCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &fileCipher{block: block}
+	if _, err := io.ReadFull(rand.Reader, c.nonce[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return c, nil
+}
+
+// xorAt encrypts or decrypts p in place as the bytes at offset.
+func (c *fileCipher) xorAt(p []byte, offset int64) {
+	var iv [aes.BlockSize]byte
+	copy(iv[:8], c.nonce[:])
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(c.block, iv[:])
+	if skip := int(offset % aes.BlockSize); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// writeAt encrypts p and writes it to file at offset.
+func (c *fileCipher) writeAt(file *os.File, p []byte, offset int64) (int, error) {
+	encrypted := bytes.Clone(p)
+	c.xorAt(encrypted, offset)
+	return file.WriteAt(encrypted, offset)
+}
+
+// decryptingReader reads the plaintext of an encrypted file.
+type decryptingReader struct {
+	file   io.ReaderAt
+	cipher *fileCipher
+}
+
+func (r *decryptingReader) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.file.ReadAt(p, offset)
+	r.cipher.xorAt(p[:n], offset)
+	return n, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+// testAudio is audio sized so reads and writes at its offsets cross AES
+// blocks at every possible position.
+func testAudio() []byte {
+	audio := make([]byte, 1000)
+	for i := range audio {
+		audio[i] = byte(i * 7)
+	}
+	return audio
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "raw", data: key},
+		{name: "hex", data: []byte(hex.EncodeToString(key) + "\n")},
+		{name: "base64", data: []byte(base64.StdEncoding.EncodeToString(key) + "\n")},
+		{name: "too short", data: key[:16], wantErr: true},
+		{name: "short hex", data: []byte(hex.EncodeToString(key[:20])), wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseEncryptionKey(test.data)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("key = %x, want an error", parsed)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(parsed, key) {
+				t.Errorf("key = %x (%v), want %x", parsed, err, key)
+			}
+		})
+	}
+}
+
+func TestFileCipherAt(t *testing.T) {
+	c, err := newFileCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := testAudio()
+	encrypted := bytes.Clone(audio)
+	c.xorAt(encrypted, 0)
+	if bytes.Equal(encrypted, audio) {
+		t.Fatal("audio not encrypted")
+	}
+
+	// Any range decrypts on its own, whether or not it starts on a block.
+	for _, r := range [][2]int{{0, 1000}, {0, 16}, {5, 11}, {16, 32}, {17, 200}, {999, 1000}} {
+		part := bytes.Clone(encrypted[r[0]:r[1]])
+		c.xorAt(part, int64(r[0]))
+		if !bytes.Equal(part, audio[r[0]:r[1]]) {
+			t.Errorf("bytes %d to %d decrypted wrong", r[0], r[1])
+		}
+	}
+
+	// Files get their own nonces, so the same audio encrypts differently.
+	other, err := newFileCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedAgain := bytes.Clone(audio)
+	other.xorAt(encryptedAgain, 0)
+	if bytes.Equal(encryptedAgain, encrypted) {
+		t.Error("two files share a key stream")
+	}
+}
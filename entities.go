@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const entitiesPrompt = `You extract named entities from transcripts. Reply with a JSON object with four fields, each a list of strings as they appear in the transcript, without duplicates:
+"people": names of persons;
+"organizations": companies, institutions and other organizations;
+"dates": dates, days and times;
+"amounts": amounts of money, quantities and percentages.
+Reply with the JSON object only.`
+
+var (
+	entityMonths  = `(?:January|February|March|April|May|June|July|August|September|October|November|December|Jan|Feb|Mar|Apr|Jun|Jul|Aug|Sep|Sept|Oct|Nov|Dec)`
+	entityDates   = regexp.MustCompile(`\b(?:\d{1,2}(?:st|nd|rd|th)? (?:of )?` + entityMonths + `(?:,? \d{4})?|` + entityMonths + ` \d{1,2}(?:st|nd|rd|th)?(?:,? \d{4})?|\d{4}-\d{2}-\d{2}|\d{1,2}[./]\d{1,2}[./]\d{2,4}|(?:next |last |this )?(?:Monday|Tuesday|Wednesday|Thursday|Friday|Saturday|Sunday)|(?:yesterday|today|tomorrow))\b`)
+	entityAmounts = regexp.MustCompile(`(?i)(?:[$€£¥]\s?\d[\d,.]*(?:\s?(?:thousand|million|billion|k|m|bn))?|\b\d[\d,.]*\s?(?:%|percent|dollars?|euros?|pounds?|USD|EUR|GBP|thousand|million|billion)\b)`)
+	// entityNames are runs of capitalized words, the candidates for people
+	// and organizations.
+	entityNames = regexp.MustCompile(`\b(?:(?:Mr|Mrs|Ms|Dr)\.?\s)?\p{Lu}[\p{L}'&-]+(?:\s(?:of\s|&\s)?\p{Lu}[\p{L}'&-]+)*`)
+	// entityOrganization marks a name as an organization rather than a person.
+	entityOrganization = regexp.MustCompile(`\b(?:Inc|Ltd|LLC|GmbH|AG|Corp|Corporation|Company|Bank|University|Group|Holdings|Foundation|Agency|Ministry|Department)\b`)
+	entityHonorific    = regexp.MustCompile(`^(?:Mr|Mrs|Ms|Dr)\.?\s`)
+)
+
+// entityStopwords are capitalized words that start sentences or name days and
+// months rather than people.
+var entityStopwords = wordSet(`I I'm I'll I've I'd The A An And But So Yes No Okay OK Well Hello Hi Thanks Thank This That These Those
+It It's We We're You You're He She They There Here What When Where Why How Who Please Sure Right Oh Let Let's
+If Then Also Now Just Our My Your His Her Their Monday Tuesday Wednesday Thursday Friday Saturday Sunday
+January February March April May June July August September October November December`)
+
+// Entities are the people, organizations, dates and amounts mentioned in a
+// transcript. A failed LLM extraction falls back to rules; Error says why.
+type Entities struct {
+	People        []string `json:"people"`
+	Organizations []string `json:"organizations"`
+	Dates         []string `json:"dates"`
+	Amounts       []string `json:"amounts"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// wantsEntities reads the entities=true request parameter.
+func wantsEntities(r *http.Request) bool {
+	entities, _ := strconv.ParseBool(r.URL.Query().Get("entities"))
+	return entities
+}
+
+// extractEntities has the LLM at --llm-url extract the entities if it's set,
+// else finds them with rules: regexes for dates and amounts, and runs of
+// capitalized words for names, which is decent for English and German and
+// misses lowercase names.
+func extractEntities(cfg Config, transcript *Transcript) *Entities {
+	if cfg.summarizeEnabled() {
+		text, err := renderText(transcript)
+		if err == nil {
+			var entities Entities
+			if err = completeLLMJSON(cfg, entitiesPrompt, string(text), &entities); err == nil {
+				return &entities
+			}
+		}
+		entities := extractEntitiesRules(transcript.Text)
+		entities.Error = err.Error()
+		return entities
+	}
+	return extractEntitiesRules(transcript.Text)
+}
+
+func extractEntitiesRules(text string) *Entities {
+	entities := &Entities{
+		Dates:   uniqueEntities(entityDates.FindAllString(text, -1)),
+		Amounts: uniqueEntities(entityAmounts.FindAllString(text, -1)),
+	}
+	var people, organizations []string
+	for _, name := range entityNames.FindAllString(text, -1) {
+		name = strings.TrimSpace(name)
+		if entityStopwords[strings.Fields(name)[0]] {
+			_, rest, ok := strings.Cut(name, " ")
+			if !ok {
+				continue
+			}
+			name = rest
+		}
+		switch {
+		case entityOrganization.MatchString(name):
+			organizations = append(organizations, name)
+		case entityHonorific.MatchString(name) || len(strings.Fields(name)) >= 2:
+			people = append(people, name)
+		}
+	}
+	entities.People = uniqueEntities(people)
+	entities.Organizations = uniqueEntities(organizations)
+	return entities
+}
+
+func uniqueEntities(found []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, entity := range found {
+		entity = strings.TrimSpace(entity)
+		if entity != "" && !seen[strings.ToLower(entity)] {
+			seen[strings.ToLower(entity)] = true
+			unique = append(unique, entity)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditLog records erasures, as JSON lines in --audit-log if set, and in the
+// log either way, to show what was deleted when and on whose request. It
+// never records what the transcripts said, nor the filenames, text or
+// metadata values an erasure was looking for, which identify the very person
+// whose data is being erased.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type auditEntry struct {
+	Time       time.Time    `json:"time"`
+	Action     string       `json:"action"`
+	Actor      string       `json:"actor"`
+	RemoteAddr string       `json:"remote_addr"`
+	Filter     *auditFilter `json:"filter,omitempty"`
+	JobIDs     []string     `json:"job_ids"`
+}
+
+// auditFilter is what the audit log keeps of an ErasureFilter: the tenant,
+// source and dates as they were, and only which of filename, text and
+// metadata keys were matched on.
+type auditFilter struct {
+	Tenant   string     `json:"tenant,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	Filename bool       `json:"filename,omitempty"`
+	Text     bool       `json:"text,omitempty"`
+	Metadata []string   `json:"metadata,omitempty"`
+	Before   *time.Time `json:"before,omitempty"`
+	After    *time.Time `json:"after,omitempty"`
+}
+
+func newAuditFilter(filter *ErasureFilter) *auditFilter {
+	if filter == nil {
+		return nil
+	}
+	audited := &auditFilter{Tenant: filter.Tenant, Source: filter.Source, Filename: filter.Filename != "", Text: filter.Text != "", Before: filter.Before, After: filter.After}
+	for key := range filter.Metadata {
+		audited.Metadata = append(audited.Metadata, key)
+	}
+	sort.Strings(audited.Metadata)
+	return audited
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	audit := &AuditLog{}
+	if path == "" {
+		return audit, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	audit.file = file
+	return audit, nil
+}
+
+func (a *AuditLog) Record(r *http.Request, action, actor string, filter *ErasureFilter, jobIDs []string) {
+	entry := auditEntry{Time: time.Now().UTC(), Action: action, Actor: actor, RemoteAddr: r.RemoteAddr, Filter: newAuditFilter(filter), JobIDs: jobIDs}
+	log.Printf("Audit: %s by %s from %s: %d jobs %s", action, actor, r.RemoteAddr, len(jobIDs), strings.Join(jobIDs, ","))
+	if a.file == nil {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Writing the audit log failed: %v", err)
+	}
+}
+
+// ErasureFilter selects the jobs a bulk erasure deletes. All criteria that
+// are set must match; Text matches transcripts containing it, ignoring case,
+// to find everything mentioning a person, and Metadata jobs having all of
+// the keys with those values, e.g. everything of a customer.
+type ErasureFilter struct {
+	Tenant   string            `json:"tenant,omitempty"`
+	Source   string            `json:"source,omitempty"`
+	Filename string            `json:"filename,omitempty"`
+	Text     string            `json:"text,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Before   *time.Time        `json:"before,omitempty"`
+	After    *time.Time        `json:"after,omitempty"`
+	DryRun   bool              `json:"dry_run,omitempty"`
+}
+
+func (f ErasureFilter) empty() bool {
+	return f.Tenant == "" && f.Source == "" && f.Filename == "" && f.Text == "" && len(f.Metadata) == 0 && f.Before == nil && f.After == nil
+}
+
+func (f ErasureFilter) matches(job Job) bool {
+	switch {
+	case f.Tenant != "" && job.Tenant != f.Tenant,
+		f.Source != "" && job.Source != f.Source,
+		f.Filename != "" && job.Filename != f.Filename,
+		f.Before != nil && !job.CreatedAt.Before(*f.Before),
+		f.After != nil && !job.CreatedAt.After(*f.After):
+		return false
+	}
+	for key, value := range f.Metadata {
+		if job.Metadata[key] != value {
+			return false
+		}
+	}
+	if f.Text != "" {
+		return job.Transcript != nil && strings.Contains(strings.ToLower(job.Transcript.Text), strings.ToLower(f.Text))
+	}
+	return true
+}
+
+// eraseJob deletes a finished job with its transcript and audio. Jobs still
+// queued or running can't be, since the worker would bring them back.
+func eraseJob(store *JobStore, id string) error {
+	job, ok := store.Get(id)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !job.finished() {
+		return errors.New("job is still " + string(job.Status))
+	}
+	store.Remove(id)
+	return nil
+}
+
+// deleteJobHandler erases a job of the request's tenant, for DELETE
+// /v1/jobs/{id} and /v1/transcripts/{id}.
+func deleteJobHandler(w http.ResponseWriter, r *http.Request, store *JobStore, audit *AuditLog, id string) {
+	if job, ok := store.Get(id); !ok || job.Tenant != requestTenant(r) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if err := eraseJob(store, id); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	audit.Record(r, "delete", apiActor(r), nil, []string{id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiActor is who the audit log records for an API request.
+func apiActor(r *http.Request) string {
+	if tenant := requestTenant(r); tenant != "" {
+		return "tenant:" + tenant
+	}
+	return "api"
+}
+
+// erasureHandler deletes all finished jobs matching the filter in the body,
+// or with dry_run only lists them. Unfinished matches are reported as skipped
+// for the caller to retry.
+func erasureHandler(w http.ResponseWriter, r *http.Request, store *JobStore, audit *AuditLog) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var filter ErasureFilter
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&filter); err != nil || filter.empty() {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with at least one of tenant, source, filename, text, metadata, before and after")
+		return
+	}
+	matched, deleted, skipped := []string{}, []string{}, []string{}
+	for _, listed := range store.List() {
+		job, ok := store.Get(listed.ID)
+		if !ok || !filter.matches(job) {
+			continue
+		}
+		matched = append(matched, job.ID)
+		if filter.DryRun {
+			continue
+		}
+		if err := eraseJob(store, job.ID); err != nil {
+			skipped = append(skipped, job.ID)
+			continue
+		}
+		deleted = append(deleted, job.ID)
+	}
+	if filter.DryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"matched": matched})
+		return
+	}
+	audit.Record(r, "erase", "admin", &filter, deleted)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": deleted, "skipped": skipped})
+}
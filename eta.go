@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultJobEstimate is how long a job is assumed to take before any has
+// finished, the same guess RetryAfter starts with.
+const defaultJobEstimate = 10 * time.Second
+
+// Speeds learns how fast each backend and model transcribes from the jobs
+// finished so far: the seconds taken per megabyte of audio, to estimate jobs
+// whose size is known, and per job for those downloaded only once they run.
+// Both are moving averages weighted towards recent jobs, like avgDuration.
+type Speeds struct {
+	mu     sync.Mutex
+	perMB  map[string]float64
+	perJob map[string]time.Duration
+}
+
+func NewSpeeds() *Speeds {
+	return &Speeds{perMB: make(map[string]float64), perJob: make(map[string]time.Duration)}
+}
+
+func (s *Speeds) Record(backend, model string, size int64, took time.Duration) {
+	key := backend + " " + model
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if perJob, ok := s.perJob[key]; ok {
+		s.perJob[key] = (perJob*4 + took) / 5
+	} else {
+		s.perJob[key] = took
+	}
+	if size <= 0 {
+		return
+	}
+	perMB := took.Seconds() / (float64(size) / (1 << 20))
+	if average, ok := s.perMB[key]; ok {
+		s.perMB[key] = (average*4 + perMB) / 5
+	} else {
+		s.perMB[key] = perMB
+	}
+}
+
+// Estimate returns how long a job of size bytes (or -1 if not known yet)
+// should take on the backend and model, or false if none finished yet.
+func (s *Speeds) Estimate(backend, model string, size int64) (time.Duration, bool) {
+	key := backend + " " + model
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if perMB, ok := s.perMB[key]; ok && size > 0 {
+		return time.Duration(perMB * float64(size) / (1 << 20) * float64(time.Second)), true
+	}
+	perJob, ok := s.perJob[key]
+	return perJob, ok
+}
+
+// estimate returns how long the task should take. The caller holds p.mu.
+func (p *WorkerPool) estimate(task *TranscriptionTask) time.Duration {
+	if took, ok := p.speeds.Estimate(task.WhisperURL, task.WhisperModel, task.size); ok {
+		return took
+	}
+	if p.avgDuration > 0 {
+		return p.avgDuration
+	}
+	return defaultJobEstimate
+}
+
+// EstimatedCompletion estimates when a queued or running job finishes, by
+// playing the queue ahead of it through the workers: each takes the next job
+// once the one it runs is estimated to be done. It returns false if the job
+// isn't queued or running. It's rounded to the second, so the ETag of a job
+// doesn't change with every poll.
+func (p *WorkerPool) EstimatedCompletion(id string) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	task, ok := p.tasks[id]
+	if !ok {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	if !task.started.IsZero() {
+		return maxTime(task.started.Add(p.estimate(task)), now).Round(time.Second), true
+	}
+
+	if p.cfg.Workers < 1 {
+		return time.Time{}, false
+	}
+	// When each worker is free next, and the jobs queued ahead of the task.
+	free := make([]time.Time, p.cfg.Workers)
+	for i := range free {
+		free[i] = now
+	}
+	worker := 0
+	ahead := []*TranscriptionTask{}
+	rank := priorityRank(task.Priority)
+	for _, other := range p.tasks {
+		switch {
+		case !other.started.IsZero():
+			if worker < len(free) {
+				free[worker] = maxTime(other.started.Add(p.estimate(other)), now)
+				worker++
+			}
+		case priorityRank(other.Priority) < rank,
+			priorityRank(other.Priority) == rank && other.seq < task.seq:
+			ahead = append(ahead, other)
+		}
+	}
+	sort.Slice(ahead, func(i, j int) bool {
+		if a, b := priorityRank(ahead[i].Priority), priorityRank(ahead[j].Priority); a != b {
+			return a < b
+		}
+		return ahead[i].seq < ahead[j].seq
+	})
+	for _, other := range append(ahead, task) {
+		next := 0
+		for i := range free {
+			if free[i].Before(free[next]) {
+				next = i
+			}
+		}
+		free[next] = free[next].Add(p.estimate(other))
+		if other == task {
+			return free[next].Round(time.Second), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// withEstimate sets when the job is estimated to finish, if it's queued or
+// running.
+func withEstimate(pool *WorkerPool, job Job) Job {
+	if job.finished() {
+		return job
+	}
+	if eta, ok := pool.EstimatedCompletion(job.ID); ok {
+		job.EstimatedCompletionAt = &eta
+	}
+	return job
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type exportFormat struct {
+	Extension   string
+	ContentType string
+	Render      func(transcript *Transcript) ([]byte, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"txt":  {Extension: "txt", ContentType: "text/plain; charset=utf-8", Render: renderText},
+	"text": {Extension: "txt", ContentType: "text/plain; charset=utf-8", Render: renderText},
+	"json": {Extension: "json", ContentType: "application/json", Render: renderJSON},
+	"srt":  {Extension: "srt", ContentType: "application/x-subrip; charset=utf-8", Render: renderSRT},
+	"vtt":  {Extension: "vtt", ContentType: "text/vtt; charset=utf-8", Render: renderVTT},
+
+	"ttml":    {Extension: "ttml", ContentType: "application/ttml+xml; charset=utf-8", Render: renderTTML},
+	"ebu-stl": {Extension: "stl", ContentType: "application/octet-stream", Render: renderEBUSTL},
+
+	"segments": {Extension: "json", ContentType: "application/json", Render: renderSegments},
+
+	"md":            {Extension: "md", ContentType: "text/markdown; charset=utf-8", Render: renderMarkdown(false)},
+	"markdown":      {Extension: "md", ContentType: "text/markdown; charset=utf-8", Render: renderMarkdown(false)},
+	"md-timestamps": {Extension: "md", ContentType: "text/markdown; charset=utf-8", Render: renderMarkdown(true)},
+}
+
+const (
+	// paragraphPause is how long a pause between segments has to be to start
+	// a new paragraph in Markdown.
+	paragraphPause = 2.0
+	// paragraphWords is how long a paragraph may grow before it's ended at the
+	// next sentence, for monologues without pauses.
+	paragraphWords = 120
+)
+
+// renderText produces plain text, split into "Speaker N:" blocks when speakers are known.
+func renderText(transcript *Transcript) ([]byte, error) {
+	if !transcript.hasSpeakers() {
+		return []byte(strings.TrimSpace(transcript.Text) + "\n"), nil
+	}
+
+	var b strings.Builder
+	for i, turn := range speakerTurns(transcript) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		speaker := turn.Speaker
+		if speaker == "" {
+			speaker = "Unknown speaker"
+		}
+		fmt.Fprintf(&b, "%s:\n%s\n", speaker, turn.Text)
+	}
+	return []byte(b.String()), nil
+}
+
+func renderJSON(transcript *Transcript) ([]byte, error) {
+	return json.MarshalIndent(transcript, "", "  ")
+}
+
+// renderSRT produces a subtitle cue per segment, or per line of the words or
+// text if the backend returned no segments, prefixed with the speaker when
+// known.
+func renderSRT(transcript *Transcript) ([]byte, error) {
+	var b strings.Builder
+	for i, cue := range subtitleCues(transcript) {
+		text := cue.Text
+		if cue.Speaker != "" {
+			text = fmt.Sprintf("%s: %s", cue.Speaker, text)
+		}
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, srtTimestamp(cue.Start), srtTimestamp(cue.End), wrapCue(text))
+	}
+	return []byte(b.String()), nil
+}
+
+// renderMarkdown splits the transcript into paragraphs at long pauses, speaker
+// changes and, in monologues, after about paragraphWords words. With
+// timestamps every paragraph gets a heading with its start time.
+func renderMarkdown(timestamps bool) func(transcript *Transcript) ([]byte, error) {
+	return func(transcript *Transcript) ([]byte, error) {
+		var b strings.Builder
+		speaker := ""
+		for i, paragraph := range markdownParagraphs(transcript) {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			switch {
+			case timestamps && paragraph.Speaker != "":
+				fmt.Fprintf(&b, "### %s — %s\n\n", markdownTimestamp(paragraph.Start), paragraph.Speaker)
+			case timestamps:
+				fmt.Fprintf(&b, "### %s\n\n", markdownTimestamp(paragraph.Start))
+			case paragraph.Speaker != "" && paragraph.Speaker != speaker:
+				fmt.Fprintf(&b, "**%s:** ", paragraph.Speaker)
+			}
+			speaker = paragraph.Speaker
+			b.WriteString(paragraph.Text + "\n")
+		}
+		return []byte(b.String()), nil
+	}
+}
+
+func markdownParagraphs(transcript *Transcript) []SpeakerTurn {
+	segments := transcript.Segments
+	if len(segments) == 0 {
+		segments = []Segment{{Start: 0, End: transcript.Duration, Text: transcript.Text}}
+	}
+
+	var paragraphs []SpeakerTurn
+	var text []string
+	words := 0
+	for i, segment := range segments {
+		segmentText := strings.TrimSpace(segment.Text)
+		if segmentText == "" {
+			continue
+		}
+		newParagraph := len(paragraphs) == 0
+		if !newParagraph {
+			last := paragraphs[len(paragraphs)-1]
+			newParagraph = string(segment.Speaker) != last.Speaker ||
+				segment.Start-segments[i-1].End >= paragraphPause ||
+				words >= paragraphWords && endsSentence(text[len(text)-1])
+		}
+		if newParagraph {
+			if len(paragraphs) > 0 {
+				paragraphs[len(paragraphs)-1].Text = strings.Join(text, " ")
+			}
+			paragraphs = append(paragraphs, SpeakerTurn{Speaker: string(segment.Speaker), Start: segment.Start})
+			text, words = nil, 0
+		}
+		paragraphs[len(paragraphs)-1].End = segment.End
+		text = append(text, segmentText)
+		words += len(strings.Fields(segmentText))
+	}
+	if len(paragraphs) > 0 {
+		paragraphs[len(paragraphs)-1].Text = strings.Join(text, " ")
+	}
+	if len(transcript.Segments) == 0 && len(paragraphs) == 1 {
+		return splitSentences(paragraphs[0])
+	}
+	return paragraphs
+}
+
+// splitSentences breaks a long text without segments into paragraphs of about
+// paragraphWords words, ending each at a sentence.
+func splitSentences(turn SpeakerTurn) []SpeakerTurn {
+	var paragraphs []SpeakerTurn
+	var current []string
+	for _, word := range strings.Fields(turn.Text) {
+		current = append(current, word)
+		if len(current) >= paragraphWords && endsSentence(word) {
+			paragraphs = append(paragraphs, SpeakerTurn{Speaker: turn.Speaker, Start: turn.Start, End: turn.End, Text: strings.Join(current, " ")})
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, SpeakerTurn{Speaker: turn.Speaker, Start: turn.Start, End: turn.End, Text: strings.Join(current, " ")})
+	}
+	return paragraphs
+}
+
+func endsSentence(text string) bool {
+	return strings.HasSuffix(text, ".") || strings.HasSuffix(text, "?") || strings.HasSuffix(text, "!")
+}
+
+// markdownTimestamp formats seconds as "1:02:03", or "2:03" under an hour.
+func markdownTimestamp(seconds float64) string {
+	total := int64(seconds)
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total/60%60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+func srtTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	healthTimeout     = 5 * time.Second
+	drainPollInterval = 100 * time.Millisecond
+)
+
+var healthClient = &http.Client{Timeout: healthTimeout}
+
+// checkBackend reports whether the transcription service is up. Any response
+// below 500 counts, since not every backend implements /health.
+func checkBackend(whisperURL string) error {
+	resp, err := healthClient.Get(whisperURL + "/health")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		return errors.Errorf("backend returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if err := checkBackend(cfg.WhisperURL); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unhealthy", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyHandler fails while draining, while the backend is down or, with
+// --warm-up, not warmed up yet, so the load balancer stops routing new work
+// here without the pod being restarted. A read-only agent or one in
+// maintenance is ready without a backend, since it only serves what's
+// already transcribed.
+func readyHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	if cfg.ReadOnly {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "read_only"})
+		return
+	}
+	if pool.Maintenance().Enabled {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "maintenance"})
+		return
+	}
+	if pool.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if pool.warmup != nil {
+		if state, err := pool.warmup.Status(); state != warmupWarm {
+			body := map[string]string{"status": "warming_up", "warmup": state}
+			if err != nil {
+				body["error"] = err.Error()
+			}
+			writeJSON(w, http.StatusServiceUnavailable, body)
+			return
+		}
+	}
+	healthHandler(w, r, cfg)
+}
+
+// drainHandler stops accepting new jobs and blocks until the queued and
+// running ones have finished, e.g. as a preStop hook during rolling updates.
+// With ?wait=false it returns immediately. There's no undoing it, so it's
+// only served with an admin token or OIDC configured, and requires them.
+func drainHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	pool.Drain()
+
+	if r.URL.Query().Get("wait") != "false" {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		for pool.InFlight() > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	status := "drained"
+	if pool.InFlight() > 0 {
+		status = "draining"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": status, "in_flight": pool.InFlight()})
+}
+
+// runHealthcheck implements the healthcheck subcommand for container
+// healthchecks: it exits non-zero unless the local API reports itself and the
+// backend healthy.
+func runHealthcheck(args []string) {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8080", "Base URL of the agent's API")
+	flags.Parse(args)
+
+	resp, err := healthClient.Get(strings.TrimSuffix(*url, "/") + "/healthz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "unhealthy: %d %s\n", resp.StatusCode, strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const maxIdempotencyKeyLength = 255
+
+var errIdempotencyMismatch = errors.New("Idempotency-Key was already used for a different request")
+
+// Idempotency remembers the job submitted with each Idempotency-Key, so a
+// client, bot or webhook sender retrying a submission gets the original job
+// back instead of transcribing the audio twice. Keys are per tenant and
+// forgotten after the TTL, when the job is no longer in the store, or when
+// the submission failed and a retry should go through. A key is bound to the
+// fingerprint of the request that first used it (see requestFingerprint), so
+// reusing it for a different request is an error rather than a replay.
+type Idempotency struct {
+	mu    sync.Mutex
+	store *JobStore
+	ttl   time.Duration
+	keys  map[string]*idempotentRequest
+}
+
+type idempotentRequest struct {
+	done        chan struct{}
+	fingerprint string
+	jobID       string
+	failed      bool
+	expires     time.Time
+}
+
+func NewIdempotency(store *JobStore, ttl time.Duration) *Idempotency {
+	return &Idempotency{store: store, ttl: ttl, keys: map[string]*idempotentRequest{}}
+}
+
+// Do calls submit unless a request with the same key was submitted before,
+// and returns the ID of the job submit queued, or of the original one if
+// repeated. Submissions that queue the job asynchronously, like recording
+// webhooks, return an empty ID. A repeated request arriving while the first
+// is still being submitted waits for it; one with another fingerprint gets
+// errIdempotencyMismatch.
+func (i *Idempotency) Do(tenant, key, fingerprint string, submit func() (string, error)) (jobID string, repeated bool, err error) {
+	key = tenant + "\x00" + key
+	i.mu.Lock()
+	now := time.Now()
+	for k, request := range i.keys {
+		if !request.expires.IsZero() && now.After(request.expires) {
+			delete(i.keys, k)
+		}
+	}
+	for {
+		request, ok := i.keys[key]
+		if !ok {
+			break
+		}
+		i.mu.Unlock()
+		<-request.done
+		if _, exists := i.store.Get(request.jobID); !request.failed && (exists || request.jobID == "") {
+			if request.fingerprint != fingerprint {
+				return "", false, errIdempotencyMismatch
+			}
+			return request.jobID, true, nil
+		}
+		i.mu.Lock()
+		if i.keys[key] == request {
+			delete(i.keys, key)
+		}
+	}
+	request := &idempotentRequest{done: make(chan struct{}), fingerprint: fingerprint}
+	i.keys[key] = request
+	i.mu.Unlock()
+
+	jobID, err = submit()
+	i.mu.Lock()
+	if err != nil {
+		request.failed = true
+		delete(i.keys, key)
+	} else {
+		request.jobID = jobID
+		request.expires = time.Now().Add(i.ttl)
+	}
+	i.mu.Unlock()
+	close(request.done)
+	return jobID, false, err
+}
+
+// Replay returns the job a request with the key submitted before, waiting
+// for it if it's still being submitted, or false if there's none. It's for
+// requests that can't be repeated once they went through, like completing
+// an upload, whose parts are gone by then.
+func (i *Idempotency) Replay(tenant, key, fingerprint string) (jobID string, ok bool, err error) {
+	i.mu.Lock()
+	request, ok := i.keys[tenant+"\x00"+key]
+	i.mu.Unlock()
+	if !ok {
+		return "", false, nil
+	}
+	<-request.done
+	if _, exists := i.store.Get(request.jobID); request.failed || !exists {
+		return "", false, nil
+	}
+	if request.fingerprint != fingerprint {
+		return "", false, errIdempotencyMismatch
+	}
+	return request.jobID, true, nil
+}
+
+// requestFingerprint identifies what a submission asks for: the task's
+// options and audio URL, and its audio, or identity instead if set, like the
+// upload the audio is assembled from. Download headers are left out, since a
+// retry may come with a fresh token.
+func requestFingerprint(task *TranscriptionTask, identity string) (string, error) {
+	options, err := json.Marshal(struct {
+		AudioURL    string
+		Summarize   bool
+		Chapters    bool
+		Sentiment   bool
+		Entities    bool
+		TranslateTo string
+		Profanity   string
+		Vocabulary  []string
+		Prompt      string
+		Priority    string
+		Metadata    map[string]string
+		RunAt       *time.Time
+	}{task.AudioURL, task.Summarize, task.Chapters, task.Sentiment, task.Entities, task.TranslateTo,
+		task.Profanity, task.Vocabulary, task.Prompt, task.Priority, task.Metadata, task.RunAt})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	hash := sha256.New()
+	hash.Write(options)
+	hash.Write([]byte(identity))
+	if identity == "" && task.Audio != nil {
+		if _, err := io.Copy(hash, task.Audio.Reader()); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// idempotencyKey returns the request's Idempotency-Key header, or false after
+// rejecting a key too long to be one.
+func idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		writeJSONError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+		return "", false
+	}
+	return key, true
+}
+
+// submitOnce submits the task, or only returns the job submitted with the
+// same key before if key is set. Repeated requests don't own their audio.
+// identity is passed on to requestFingerprint.
+func (p *WorkerPool) submitOnce(source, key, identity string, task *TranscriptionTask) (job Job, repeated bool, err error) {
+	if key == "" {
+		job, err = p.Submit(source, task)
+		return job, false, err
+	}
+	fingerprint, err := requestFingerprint(task, identity)
+	if err != nil {
+		return Job{}, false, err
+	}
+	jobID, repeated, err := p.idempotency.Do(task.Tenant, key, fingerprint, func() (string, error) {
+		job, err := p.Submit(source, task)
+		return job.ID, err
+	})
+	if err != nil {
+		return Job{}, false, err
+	}
+	if repeated {
+		p.metrics.Inc("whisper_agent_idempotent_replays_total")
+		if task.Audio != nil {
+			task.Audio.Close()
+		}
+	}
+	job, _ = p.store.Get(jobID)
+	return job, repeated, nil
+}
+
+// waitForJob blocks until the job finishes or ctx is done, returning the job
+// as it is then, or false if it's gone.
+func waitForJob(ctx context.Context, store *JobStore, id string) (Job, bool) {
+	changed, unsubscribe := store.Subscribe()
+	defer unsubscribe()
+	for {
+		job, ok := store.Get(id)
+		if !ok || job.finished() {
+			return job, ok
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return job, ok
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const imapTimeout = 2 * time.Minute
+
+// imapConn is a minimal IMAP4rev1 client covering what mailbox polling needs:
+// LOGIN, SELECT, UID SEARCH, UID FETCH and UID STORE.
+type imapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+}
+
+// imapResponse is one untagged response line with its literals, e.g. the
+// message body of a FETCH.
+type imapResponse struct {
+	Text     string
+	Literals [][]byte
+}
+
+func dialIMAP(addr string, plaintext bool) (*imapConn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if plaintext {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := &imapConn{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := c.reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read IMAP greeting")
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, errors.Errorf("unexpected IMAP greeting: %s", strings.TrimSpace(greeting))
+	}
+	return c, nil
+}
+
+// command sends a command and returns its untagged responses, failing unless
+// the server completes it with OK.
+func (c *imapConn) command(format string, args ...interface{}) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var responses []imapResponse
+	for {
+		response, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if status, ok := strings.CutPrefix(response.Text, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return nil, errors.Errorf("IMAP %s failed: %s", strings.Fields(format)[0], status)
+			}
+			return responses, nil
+		}
+		responses = append(responses, response)
+	}
+}
+
+// readResponse reads one response line, pulling in any {n} literals it
+// announces.
+func (c *imapConn) readResponse() (imapResponse, error) {
+	var response imapResponse
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return response, errors.Wrap(err, "failed to read IMAP response")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		response.Text += line
+
+		open := strings.LastIndexByte(line, '{')
+		if !strings.HasSuffix(line, "}") || open < 0 {
+			return response, nil
+		}
+		size, err := strconv.Atoi(line[open+1 : len(line)-1])
+		if err != nil {
+			return response, nil
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, literal); err != nil {
+			return response, errors.Wrap(err, "failed to read IMAP literal")
+		}
+		response.Literals = append(response.Literals, literal)
+	}
+}
+
+func (c *imapConn) login(user, password string) error {
+	_, err := c.command("LOGIN %s %s", imapQuote(user), imapQuote(password))
+	return err
+}
+
+func (c *imapConn) selectMailbox(mailbox string) error {
+	_, err := c.command("SELECT %s", imapQuote(mailbox))
+	return err
+}
+
+func (c *imapConn) searchUnseen() ([]string, error) {
+	responses, err := c.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, response := range responses {
+		if rest, ok := strings.CutPrefix(response.Text, "* SEARCH"); ok {
+			uids = append(uids, strings.Fields(rest)...)
+		}
+	}
+	return uids, nil
+}
+
+// fetchMessage returns the raw RFC 822 message without marking it seen.
+func (c *imapConn) fetchMessage(uid string) ([]byte, error) {
+	responses, err := c.command("UID FETCH %s (BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range responses {
+		if strings.Contains(response.Text, "FETCH") && len(response.Literals) > 0 {
+			return response.Literals[0], nil
+		}
+	}
+	return nil, errors.Errorf("message %s not found", uid)
+}
+
+func (c *imapConn) markSeen(uid string) error {
+	_, err := c.command(`UID STORE %s +FLAGS.SILENT (\Seen)`, uid)
+	return err
+}
+
+func (c *imapConn) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type JobStatus string
+
+const (
+	JobScheduled JobStatus = "scheduled"
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+type Job struct {
+	ID         string            `json:"id"`
+	Source     string            `json:"source"`
+	Filename   string            `json:"filename"`
+	Status     JobStatus         `json:"status"`
+	Priority   string            `json:"priority"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Owner      string            `json:"-"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Progress   float64           `json:"progress"`
+	Percent    int               `json:"percent"`
+	Chunks     *JobChunks        `json:"chunks,omitempty"`
+	Text       string            `json:"text,omitempty"`
+	Transcript *Transcript       `json:"transcript,omitempty"`
+	HasAudio   bool              `json:"has_audio"`
+	Error      string            `json:"error,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	RunAt      *time.Time        `json:"run_at,omitempty"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	// EstimatedCompletionAt is set by the API for queued and running jobs,
+	// not kept in the store.
+	EstimatedCompletionAt *time.Time `json:"estimated_completion_at,omitempty"`
+}
+
+// JobChunks is how far a job transcribed in chunks got.
+type JobChunks struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobCompleted || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+type JobAudio struct {
+	Buffer      *AudioBuffer
+	ContentType string
+}
+
+// JobStore keeps jobs in memory in creation order. Only the last maxFinished
+// completed/failed jobs are retained so the store doesn't grow unbounded, and
+// audio is kept only for the last maxAudio jobs since it's much larger.
+type JobStore struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	audio       map[string]JobAudio
+	order       []string
+	maxFinished int
+	maxAudio    int
+	subscribers map[chan struct{}]struct{}
+}
+
+func NewJobStore(maxFinished, maxAudio int) *JobStore {
+	return &JobStore{
+		jobs:        make(map[string]*Job),
+		audio:       make(map[string]JobAudio),
+		maxFinished: maxFinished,
+		maxAudio:    maxAudio,
+		subscribers: make(map[chan struct{}]struct{}),
+	}
+}
+
+func (s *JobStore) Create(source, filename, priority, tenant, owner string, metadata map[string]string) Job {
+	job := &Job{
+		ID:        newJobID(),
+		Source:    source,
+		Filename:  filename,
+		Status:    JobPending,
+		Priority:  priority,
+		Tenant:    tenant,
+		Owner:     owner,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	snapshot := *job
+	s.mu.Unlock()
+
+	s.notify()
+	return snapshot
+}
+
+// CreateEphemeral creates a job that only Get sees: it's left out of the
+// listings and doesn't count towards the finished jobs kept, so it never
+// pushes out anyone's history. It's for work like a live session's partial
+// transcripts, whose caller removes the job once done with it.
+func (s *JobStore) CreateEphemeral(source, filename, tenant, owner string) Job {
+	job := &Job{
+		ID:        newJobID(),
+		Source:    source,
+		Filename:  filename,
+		Status:    JobPending,
+		Priority:  priorityNormal,
+		Tenant:    tenant,
+		Owner:     owner,
+		CreatedAt: time.Now(),
+	}
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	s.mu.Unlock()
+	return *job
+}
+
+// Restore adds a job kept elsewhere across restarts, like a scheduled one.
+// Jobs have to be restored oldest first, before any are created.
+func (s *JobStore) Restore(job Job) {
+	s.mu.Lock()
+	s.jobs[job.ID] = &job
+	s.order = append(s.order, job.ID)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// Remove drops a job that never got to run, e.g. because the queue was full,
+// or one nobody should see listed, like a live session's partial transcript.
+func (s *JobStore) Remove(id string) {
+	s.mu.Lock()
+	_, ok := s.jobs[id]
+	if ok {
+		delete(s.jobs, id)
+		s.deleteAudio(id)
+		for i, orderID := range s.order {
+			if orderID == id {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.notify()
+	}
+}
+
+// Schedule defers the pending job until runAt.
+func (s *JobStore) Schedule(id string, runAt time.Time) {
+	s.update(id, func(job *Job) {
+		job.Status = JobScheduled
+		job.RunAt = &runAt
+	})
+}
+
+// Enqueue makes a scheduled job pending again once its time came, returning
+// false if it's gone or no longer scheduled, e.g. because it was cancelled.
+func (s *JobStore) Enqueue(id string) (Job, bool) {
+	queued := false
+	s.update(id, func(job *Job) {
+		if job.Status == JobScheduled {
+			job.Status = JobPending
+			queued = true
+		}
+	})
+	job, _ := s.Get(id)
+	return job, queued
+}
+
+func (s *JobStore) Start(id string) {
+	s.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = JobRunning
+		if job.StartedAt == nil {
+			job.StartedAt = &now
+		}
+	})
+}
+
+func (s *JobStore) SetProgress(id string, progress float64) {
+	s.update(id, func(job *Job) {
+		job.Progress = progress
+	})
+}
+
+// SetChunks records how many of the job's chunks are transcribed, which is
+// its progress too.
+func (s *JobStore) SetChunks(id string, done, total int) {
+	s.update(id, func(job *Job) {
+		job.Chunks = &JobChunks{Done: done, Total: total}
+		job.Progress = float64(done) / float64(total)
+	})
+}
+
+func (s *JobStore) Complete(id string, transcript *Transcript) {
+	s.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = JobCompleted
+		job.Progress = 1
+		job.Text = transcript.Text
+		job.Transcript = transcript
+		job.FinishedAt = &now
+	})
+}
+
+func (s *JobStore) Fail(id string, err error) {
+	s.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = JobFailed
+		job.Error = err.Error()
+		job.FinishedAt = &now
+	})
+}
+
+func (s *JobStore) Cancel(id string, reason string) {
+	s.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = JobCancelled
+		job.Error = reason
+		job.FinishedAt = &now
+	})
+}
+
+func (s *JobStore) SetPriority(id string, priority string) {
+	s.update(id, func(job *Job) {
+		job.Priority = priority
+	})
+}
+
+func (s *JobStore) KeepsAudio() bool {
+	return s.maxAudio > 0
+}
+
+// SetAudio hands the buffer over to the store, which closes it on eviction.
+func (s *JobStore) SetAudio(id string, buffer *AudioBuffer, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok || !s.KeepsAudio() {
+		buffer.Close()
+		return
+	}
+	s.audio[id] = JobAudio{Buffer: buffer, ContentType: contentType}
+	s.jobs[id].HasAudio = true
+	s.evictAudio()
+}
+
+func (s *JobStore) Audio(id string) (JobAudio, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	audio, ok := s.audio[id]
+	return audio, ok
+}
+
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns snapshots of all jobs, newest first. Transcripts are left out
+// to keep the listing small; use Get for the full job.
+func (s *JobStore) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := *s.jobs[s.order[i]]
+		job.Transcript = nil
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// jobCursor is the position in the store after a page of jobs: the creation
+// time and ID of its last job. Pages continue with older jobs, so a cursor
+// stays valid while new jobs come in and old ones are evicted.
+type jobCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c jobCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + "." + c.ID))
+}
+
+func parseJobCursor(cursor string) (jobCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return jobCursor{}, errors.New("invalid cursor")
+	}
+	nanos, id, _ := strings.Cut(string(data), ".")
+	unix, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil || id == "" {
+		return jobCursor{}, errors.New("invalid cursor")
+	}
+	return jobCursor{CreatedAt: time.Unix(0, unix), ID: id}, nil
+}
+
+// Page returns up to limit jobs matching the filter, newest first, starting
+// after the cursor if it's not nil, and the cursor of the next page if there
+// are more. Like List, it leaves out the transcripts.
+func (s *JobStore) Page(after *jobCursor, limit int, filter func(job *Job) bool) ([]Job, *jobCursor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []Job{}
+	passed := after == nil
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := s.jobs[s.order[i]]
+		if !passed {
+			if job.CreatedAt.After(after.CreatedAt) {
+				continue
+			}
+			if job.CreatedAt.Equal(after.CreatedAt) {
+				passed = job.ID == after.ID
+				continue
+			}
+			passed = true
+		}
+		if !filter(job) {
+			continue
+		}
+		if len(jobs) == limit {
+			last := jobs[len(jobs)-1]
+			return jobs, &jobCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		}
+		snapshot := *job
+		snapshot.Transcript = nil
+		jobs = append(jobs, snapshot)
+	}
+	return jobs, nil
+}
+
+// Subscribe returns a channel which receives a signal whenever any job changes.
+// Signals are coalesced, so a slow reader only sees the latest state.
+func (s *JobStore) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+func (s *JobStore) update(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if ok {
+		fn(job)
+		job.Percent = int(job.Progress * 100)
+		if job.finished() {
+			s.evictFinished()
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.notify()
+	}
+}
+
+func (s *JobStore) evictFinished() {
+	finished := 0
+	for _, id := range s.order {
+		if s.jobs[id].finished() {
+			finished++
+		}
+	}
+
+	order := s.order[:0]
+	for _, id := range s.order {
+		if finished > s.maxFinished && s.jobs[id].finished() {
+			delete(s.jobs, id)
+			s.deleteAudio(id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	s.order = order
+}
+
+func (s *JobStore) evictAudio() {
+	kept := 0
+	for i := len(s.order) - 1; i >= 0; i-- {
+		id := s.order[i]
+		if _, ok := s.audio[id]; !ok {
+			continue
+		}
+		kept++
+		if kept > s.maxAudio {
+			s.deleteAudio(id)
+			s.jobs[id].HasAudio = false
+		}
+	}
+}
+
+func (s *JobStore) deleteAudio(id string) {
+	if audio, ok := s.audio[id]; ok {
+		audio.Buffer.Close()
+		delete(s.audio, id)
+	}
+}
+
+func (s *JobStore) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
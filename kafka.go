@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const kafkaRetryDelay = 5 * time.Second
+
+// KafkaIngester consumes transcription requests (see streamRequest) from the
+// input topic and publishes a streamResult for each to the output topic,
+// keyed like the request. Records of a fetch are transcribed concurrently,
+// as many at a time across partitions as the pool has workers and queue
+// slots; results are published and the offset committed once the whole fetch is
+// done, so delivery is at least once.
+//
+// Offsets are committed for --kafka-group without joining it, so partitions
+// aren't balanced between agents: each agent consumes the partitions given
+// by --kafka-partitions, or all of them.
+type KafkaIngester struct {
+	client     *kafkaClient
+	pool       *WorkerPool
+	cfg        Config
+	partitions []int32
+	// slots bounds the records handled at once across partitions.
+	slots chan struct{}
+}
+
+func NewKafkaIngester(pool *WorkerPool, cfg Config) (*KafkaIngester, error) {
+	var brokers []string
+	for _, broker := range strings.Split(cfg.KafkaBrokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("--kafka-brokers must list at least one broker")
+	}
+	ingester := &KafkaIngester{client: newKafkaClient(brokers), pool: pool, cfg: cfg, slots: make(chan struct{}, cfg.Workers+cfg.QueueSize)}
+	for _, partition := range strings.Split(cfg.KafkaPartitions, ",") {
+		if partition = strings.TrimSpace(partition); partition == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid Kafka partition %q", partition)
+		}
+		ingester.partitions = append(ingester.partitions, int32(id))
+	}
+	return ingester, nil
+}
+
+func (k *KafkaIngester) Run() {
+	partitions := k.partitions
+	k.retry("metadata", func() error {
+		if len(partitions) > 0 {
+			return k.client.refreshMetadata(k.cfg.KafkaInputTopic, k.cfg.KafkaOutputTopic)
+		}
+		var err error
+		partitions, err = k.client.partitions(k.cfg.KafkaInputTopic)
+		return err
+	})
+
+	log.Printf("Kafka consumer reading %s partitions %v as group %s...", k.cfg.KafkaInputTopic, partitions, k.cfg.KafkaGroup)
+	for _, partition := range partitions {
+		go k.consume(partition)
+	}
+}
+
+func (k *KafkaIngester) consume(partition int32) {
+	topic := k.cfg.KafkaInputTopic
+	var offset int64
+	k.retry("offset lookup", func() error {
+		var err error
+		if offset, err = k.client.committedOffset(k.cfg.KafkaGroup, topic, partition); err != nil || offset >= 0 {
+			return err
+		}
+		// A new group starts with records produced from now on.
+		offset, err = k.client.listOffset(topic, partition, -1)
+		return err
+	})
+
+	for {
+		records, next, err := k.client.fetch(topic, partition, offset)
+		if err == kafkaOffsetOutOfRange {
+			// The committed offset was deleted by retention; resume at the oldest record left.
+			log.Printf("Kafka offset %d of %s/%d is out of range, resetting to earliest", offset, topic, partition)
+			k.retry("offset reset", func() error {
+				offset, err = k.client.listOffset(topic, partition, -2)
+				return err
+			})
+			continue
+		}
+		if err != nil {
+			log.Printf("Kafka fetch from %s/%d failed: %v", topic, partition, err)
+			time.Sleep(kafkaRetryDelay)
+			k.client.refreshMetadata(topic)
+			continue
+		}
+		if len(records) > 0 {
+			k.process(partition, records)
+		}
+		if next > offset {
+			offset = next
+			k.retry("offset commit", func() error {
+				return k.client.commitOffset(k.cfg.KafkaGroup, topic, partition, offset)
+			})
+		}
+	}
+}
+
+// process transcribes the records and publishes their results to the output
+// partition with the same number as the input partition, modulo the number
+// of output partitions, so results of one input partition stay in order.
+func (k *KafkaIngester) process(partition int32, records []kafkaRecord) {
+	results := make([]kafkaRecord, len(records))
+	var wg sync.WaitGroup
+	for i, record := range records {
+		k.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, record kafkaRecord) {
+			defer wg.Done()
+			defer func() { <-k.slots }()
+			id := string(record.Key)
+			if id == "" {
+				id = k.cfg.KafkaInputTopic + "/" + strconv.Itoa(int(partition)) + "/" + strconv.FormatInt(record.Offset, 10)
+			}
+			request, err := parseStreamRequest(record.Value, id, record.Headers["filename"])
+			result := streamResult{ID: id, Status: JobFailed}
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result = transcribeStreamRequest(k.pool, k.cfg, "kafka", request)
+			}
+			value, _ := json.Marshal(result)
+			results[i] = kafkaRecord{Key: []byte(id), Value: value, Headers: map[string]string{"content-type": "application/json"}}
+		}(i, record)
+	}
+	wg.Wait()
+
+	k.retry("produce", func() error {
+		outputs, err := k.client.partitions(k.cfg.KafkaOutputTopic)
+		if err != nil {
+			return err
+		}
+		return k.client.produce(k.cfg.KafkaOutputTopic, partition%int32(len(outputs)), results)
+	})
+}
+
+// retry runs fn until it succeeds, refreshing metadata between attempts
+// since most failures are leadership changes.
+func (k *KafkaIngester) retry(what string, fn func() error) {
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		log.Printf("Kafka %s failed: %v", what, err)
+		time.Sleep(kafkaRetryDelay)
+		k.client.refreshMetadata(k.cfg.KafkaInputTopic, k.cfg.KafkaOutputTopic)
+	}
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// API keys and the versions used. These are the oldest versions that carry
+// v2 record batches, which every broker from 0.11 to 4.x understands.
+const (
+	kafkaProduce         int16 = 0
+	kafkaFetch           int16 = 1
+	kafkaListOffsets     int16 = 2
+	kafkaMetadata        int16 = 3
+	kafkaOffsetCommit    int16 = 8
+	kafkaOffsetFetch     int16 = 9
+	kafkaFindCoordinator int16 = 10
+)
+
+const (
+	kafkaClientID    = "whisper-transcribe-agent"
+	kafkaTimeout     = 30 * time.Second
+	kafkaFetchWait   = 10 * time.Second
+	kafkaFetchBytes  = 1 << 20
+	kafkaMaxResponse = 256 << 20
+)
+
+var (
+	kafkaCRC         = crc32.MakeTable(crc32.Castagnoli)
+	kafkaZstd        *zstd.Decoder
+	errKafkaIO       = errors.New("malformed kafka response")
+	errKafkaTooLarge = errors.New("kafka record batch decompresses to more than 256 MiB")
+)
+
+func init() {
+	kafkaZstd, _ = zstd.NewReader(nil, zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderMaxMemory(kafkaMaxResponse))
+}
+
+type kafkaError int16
+
+const kafkaOffsetOutOfRange kafkaError = 1
+
+var kafkaErrorNames = map[kafkaError]string{
+	1:  "OFFSET_OUT_OF_RANGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	14: "COORDINATOR_LOAD_IN_PROGRESS",
+	15: "COORDINATOR_NOT_AVAILABLE",
+	16: "NOT_COORDINATOR",
+	25: "UNKNOWN_MEMBER_ID",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	30: "GROUP_AUTHORIZATION_FAILED",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return "kafka error " + name
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+func kafkaErr(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return kafkaError(code)
+}
+
+type kafkaRecord struct {
+	Offset  int64
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+func (e *kafkaEncoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// varbytes writes a record field, where nil is encoded as length -1.
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder reads big-endian fields, remembering the first error so a
+// response can be decoded in one go and checked at the end.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = errKafkaIO
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errKafkaIO
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// string reads a (nullable) string; null reads as "".
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// array reads an array length and calls fn for every element. Null arrays
+// are empty.
+func (d *kafkaDecoder) array(fn func()) {
+	n := d.int32()
+	for i := int32(0); i < n && d.err == nil; i++ {
+		fn()
+	}
+}
+
+// kafkaConn is a connection to one broker. Requests on it are serialized.
+type kafkaConn struct {
+	mu            sync.Mutex
+	conn          net.Conn
+	correlationID int32
+}
+
+func (c *kafkaConn) request(apiKey, version int16, body []byte, timeout time.Duration) (*kafkaDecoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.correlationID++
+	var header kafkaEncoder
+	header.int32(0)
+	header.int16(apiKey)
+	header.int16(version)
+	header.int32(c.correlationID)
+	header.string(kafkaClientID)
+	message := append(header.buf, body...)
+	binary.BigEndian.PutUint32(message, uint32(len(message)-4))
+
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(message); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length < 4 || length > kafkaMaxResponse {
+		return nil, errKafkaIO
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if int32(binary.BigEndian.Uint32(response)) != c.correlationID {
+		return nil, errors.New("kafka response out of order")
+	}
+	return &kafkaDecoder{buf: response[4:]}, nil
+}
+
+// kafkaClient talks to a cluster: it tracks brokers and partition leaders
+// from metadata and keeps one connection per broker. It covers what a
+// consumer with committed offsets and a producer need, without group
+// membership.
+type kafkaClient struct {
+	seeds []string
+
+	mu      sync.Mutex
+	brokers map[int32]string
+	leaders map[string]map[int32]int32
+	conns   map[string]*kafkaConn
+}
+
+func newKafkaClient(seeds []string) *kafkaClient {
+	return &kafkaClient{
+		seeds:   seeds,
+		brokers: make(map[int32]string),
+		leaders: make(map[string]map[int32]int32),
+		conns:   make(map[string]*kafkaConn),
+	}
+}
+
+func (c *kafkaClient) send(addr string, apiKey, version int16, body []byte, timeout time.Duration) (*kafkaDecoder, error) {
+	return c.sendOn(addr, addr, apiKey, version, body, timeout)
+}
+
+// sendOn sends a request on the connection named key, so long polls can get
+// a connection of their own instead of holding up other requests.
+func (c *kafkaClient) sendOn(key, addr string, apiKey, version int16, body []byte, timeout time.Duration) (*kafkaDecoder, error) {
+	c.mu.Lock()
+	conn, ok := c.conns[key]
+	c.mu.Unlock()
+	if !ok {
+		netConn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		conn = &kafkaConn{conn: netConn}
+		c.mu.Lock()
+		if existing, ok := c.conns[key]; ok {
+			netConn.Close()
+			conn = existing
+		} else {
+			c.conns[key] = conn
+		}
+		c.mu.Unlock()
+	}
+
+	response, err := conn.request(apiKey, version, body, timeout)
+	if err != nil {
+		// The connection is out of sync or dead; the next request redials.
+		c.mu.Lock()
+		if c.conns[key] == conn {
+			delete(c.conns, key)
+		}
+		c.mu.Unlock()
+		conn.conn.Close()
+		return nil, errors.Wrapf(err, "kafka request to %s failed", addr)
+	}
+	return response, nil
+}
+
+// refreshMetadata updates brokers and leaders for the topics from the first
+// broker that answers.
+func (c *kafkaClient) refreshMetadata(topics ...string) error {
+	var req kafkaEncoder
+	req.int32(int32(len(topics)))
+	for _, topic := range topics {
+		req.string(topic)
+	}
+
+	c.mu.Lock()
+	addrs := append([]string(nil), c.seeds...)
+	for _, addr := range c.brokers {
+		addrs = append(addrs, addr)
+	}
+	c.mu.Unlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		d, err := c.send(addr, kafkaMetadata, 1, req.buf, kafkaTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		brokers := make(map[int32]string)
+		d.array(func() {
+			id := d.int32()
+			host := d.string()
+			port := d.int32()
+			d.string()
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		})
+		d.int32()
+		leaders := make(map[string]map[int32]int32)
+		var topicErr error
+		d.array(func() {
+			code := d.int16()
+			topic := d.string()
+			d.int8()
+			if code != 0 && topicErr == nil {
+				topicErr = errors.Wrapf(kafkaErr(code), "topic %s", topic)
+			}
+			partitions := make(map[int32]int32)
+			d.array(func() {
+				d.int16()
+				partition := d.int32()
+				partitions[partition] = d.int32()
+				d.array(func() { d.int32() })
+				d.array(func() { d.int32() })
+			})
+			leaders[topic] = partitions
+		})
+		if d.err != nil {
+			lastErr = d.err
+			continue
+		}
+
+		c.mu.Lock()
+		c.brokers = brokers
+		for topic, partitions := range leaders {
+			c.leaders[topic] = partitions
+		}
+		c.mu.Unlock()
+		return topicErr
+	}
+	return errors.Wrap(lastErr, "no kafka broker reachable")
+}
+
+func (c *kafkaClient) partitions(topic string) ([]int32, error) {
+	if err := c.refreshMetadata(topic); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var partitions []int32
+	for partition := range c.leaders[topic] {
+		partitions = append(partitions, partition)
+	}
+	if len(partitions) == 0 {
+		return nil, errors.Errorf("topic %s has no partitions", topic)
+	}
+	return partitions, nil
+}
+
+func (c *kafkaClient) leader(topic string, partition int32) (string, error) {
+	c.mu.Lock()
+	leader, ok := c.leaders[topic][partition]
+	c.mu.Unlock()
+	if !ok {
+		if err := c.refreshMetadata(topic); err != nil {
+			return "", err
+		}
+		c.mu.Lock()
+		leader, ok = c.leaders[topic][partition]
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, known := c.brokers[leader]
+	if !ok || !known {
+		return "", errors.Errorf("no leader for %s/%d", topic, partition)
+	}
+	return addr, nil
+}
+
+func (c *kafkaClient) coordinator(group string) (string, error) {
+	var req kafkaEncoder
+	req.string(group)
+
+	c.mu.Lock()
+	addr := c.seeds[0]
+	for _, broker := range c.brokers {
+		addr = broker
+		break
+	}
+	c.mu.Unlock()
+
+	d, err := c.send(addr, kafkaFindCoordinator, 0, req.buf, kafkaTimeout)
+	if err != nil {
+		return "", err
+	}
+	code := d.int16()
+	d.int32()
+	host := d.string()
+	port := d.int32()
+	if d.err != nil {
+		return "", d.err
+	}
+	if err := kafkaErr(code); err != nil {
+		return "", errors.Wrapf(err, "no coordinator for group %s", group)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// committedOffset returns the group's committed offset, or -1 if it has none.
+func (c *kafkaClient) committedOffset(group, topic string, partition int32) (int64, error) {
+	addr, err := c.coordinator(group)
+	if err != nil {
+		return 0, err
+	}
+	var req kafkaEncoder
+	req.string(group)
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+
+	d, err := c.send(addr, kafkaOffsetFetch, 1, req.buf, kafkaTimeout)
+	if err != nil {
+		return 0, err
+	}
+	offset, code := int64(-1), int16(0)
+	d.array(func() {
+		d.string()
+		d.array(func() {
+			d.int32()
+			offset = d.int64()
+			d.string()
+			code = d.int16()
+		})
+	})
+	if d.err != nil {
+		return 0, d.err
+	}
+	return offset, kafkaErr(code)
+}
+
+func (c *kafkaClient) commitOffset(group, topic string, partition int32, offset int64) error {
+	addr, err := c.coordinator(group)
+	if err != nil {
+		return err
+	}
+	var req kafkaEncoder
+	req.string(group)
+	req.int32(-1)
+	req.string("")
+	req.int64(-1)
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.int64(offset)
+	req.string("")
+
+	d, err := c.send(addr, kafkaOffsetCommit, 2, req.buf, kafkaTimeout)
+	if err != nil {
+		return err
+	}
+	code := int16(0)
+	d.array(func() {
+		d.string()
+		d.array(func() {
+			d.int32()
+			code = d.int16()
+		})
+	})
+	if d.err != nil {
+		return d.err
+	}
+	return kafkaErr(code)
+}
+
+// listOffset returns the earliest (timestamp -2) or next (timestamp -1)
+// offset of a partition.
+func (c *kafkaClient) listOffset(topic string, partition int32, timestamp int64) (int64, error) {
+	addr, err := c.leader(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	var req kafkaEncoder
+	req.int32(-1)
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.int64(timestamp)
+
+	d, err := c.send(addr, kafkaListOffsets, 1, req.buf, kafkaTimeout)
+	if err != nil {
+		return 0, err
+	}
+	offset, code := int64(0), int16(0)
+	d.array(func() {
+		d.string()
+		d.array(func() {
+			d.int32()
+			code = d.int16()
+			d.int64()
+			offset = d.int64()
+		})
+	})
+	if d.err != nil {
+		return 0, d.err
+	}
+	return offset, kafkaErr(code)
+}
+
+// fetch long-polls a partition for records from offset on. It returns the
+// offset to fetch next, which may advance even without records, e.g. past
+// transaction markers.
+func (c *kafkaClient) fetch(topic string, partition int32, offset int64) ([]kafkaRecord, int64, error) {
+	addr, err := c.leader(topic, partition)
+	if err != nil {
+		return nil, offset, err
+	}
+	var req kafkaEncoder
+	req.int32(-1)
+	req.int32(int32(kafkaFetchWait.Milliseconds()))
+	req.int32(1)
+	req.int32(kafkaMaxResponse)
+	req.int8(0)
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.int64(offset)
+	req.int32(kafkaFetchBytes)
+
+	key := fmt.Sprintf("%s fetch %s/%d", addr, topic, partition)
+	d, err := c.sendOn(key, addr, kafkaFetch, 4, req.buf, kafkaTimeout+kafkaFetchWait)
+	if err != nil {
+		return nil, offset, err
+	}
+	var code int16
+	var data []byte
+	d.int32()
+	d.array(func() {
+		d.string()
+		d.array(func() {
+			d.int32()
+			code = d.int16()
+			d.int64()
+			d.int64()
+			d.array(func() {
+				d.int64()
+				d.int64()
+			})
+			data = d.bytes()
+		})
+	})
+	if d.err != nil {
+		return nil, offset, d.err
+	}
+	if err := kafkaErr(code); err != nil {
+		return nil, offset, err
+	}
+	return decodeRecordBatches(data, offset)
+}
+
+// produce appends the records to a partition as one batch and waits for all
+// in-sync replicas to acknowledge it.
+func (c *kafkaClient) produce(topic string, partition int32, records []kafkaRecord) error {
+	addr, err := c.leader(topic, partition)
+	if err != nil {
+		return err
+	}
+	var req kafkaEncoder
+	req.int16(-1)
+	req.int16(-1)
+	req.int32(int32(kafkaTimeout.Milliseconds()))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(encodeRecordBatch(records))
+
+	d, err := c.send(addr, kafkaProduce, 3, req.buf, kafkaTimeout+5*time.Second)
+	if err != nil {
+		return err
+	}
+	code := int16(0)
+	d.array(func() {
+		d.string()
+		d.array(func() {
+			d.int32()
+			code = d.int16()
+			d.int64()
+			d.int64()
+		})
+	})
+	if d.err != nil {
+		return d.err
+	}
+	return kafkaErr(code)
+}
+
+func encodeRecordBatch(records []kafkaRecord) []byte {
+	now := time.Now().UnixMilli()
+	var body kafkaEncoder
+	body.int16(0)
+	body.int32(int32(len(records) - 1))
+	body.int64(now)
+	body.int64(now)
+	body.int64(-1)
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(int32(len(records)))
+	for i, record := range records {
+		var r kafkaEncoder
+		r.int8(0)
+		r.varint(0)
+		r.varint(int64(i))
+		r.varbytes(record.Key)
+		r.varbytes(record.Value)
+		r.varint(int64(len(record.Headers)))
+		for key, value := range record.Headers {
+			r.varbytes([]byte(key))
+			r.varbytes([]byte(value))
+		}
+		body.varint(int64(len(r.buf)))
+		body.buf = append(body.buf, r.buf...)
+	}
+
+	var batch kafkaEncoder
+	batch.int64(0)
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1)
+	batch.int8(2)
+	batch.int32(int32(crc32.Checksum(body.buf, kafkaCRC)))
+	return append(batch.buf, body.buf...)
+}
+
+// decodeRecordBatches parses the record batches of a fetch response, skipping
+// records before offset (a batch is returned whole) and a trailing partial
+// batch. Only the v2 format (Kafka 0.11+) is supported.
+func decodeRecordBatches(data []byte, offset int64) ([]kafkaRecord, int64, error) {
+	var records []kafkaRecord
+	next := offset
+	d := &kafkaDecoder{buf: data}
+	for len(d.buf) >= 12 {
+		baseOffset := d.int64()
+		length := d.int32()
+		if int(length) > len(d.buf) {
+			break
+		}
+		batch := &kafkaDecoder{buf: d.take(int(length))}
+		batch.int32()
+		if magic := batch.int8(); magic != 2 {
+			return records, next, errors.Errorf("unsupported kafka message format v%d", magic)
+		}
+		batch.int32()
+		attributes := batch.int16()
+		lastOffsetDelta := batch.int32()
+		batch.take(8 + 8 + 8 + 2 + 4)
+		count := batch.int32()
+		if batch.err != nil {
+			return records, next, batch.err
+		}
+		if batchNext := baseOffset + int64(lastOffsetDelta) + 1; batchNext > next {
+			next = batchNext
+		}
+		// Control batches mark transaction boundaries and carry no data.
+		if attributes&0x20 != 0 {
+			continue
+		}
+
+		raw, err := decompressRecords(attributes&0x07, batch.buf)
+		if err != nil {
+			return records, next, errors.Wrapf(err, "batch at offset %d", baseOffset)
+		}
+		r := &kafkaDecoder{buf: raw}
+		for i := int32(0); i < count && r.err == nil; i++ {
+			record := &kafkaDecoder{buf: r.take(int(r.varint()))}
+			record.int8()
+			record.varint()
+			recordOffset := baseOffset + record.varint()
+			key := record.varbytes()
+			value := record.varbytes()
+			headers := make(map[string]string)
+			for n := record.varint(); n > 0 && record.err == nil; n-- {
+				name := record.varbytes()
+				headers[string(name)] = string(record.varbytes())
+			}
+			if record.err != nil {
+				return records, next, record.err
+			}
+			if recordOffset >= offset {
+				records = append(records, kafkaRecord{Offset: recordOffset, Key: key, Value: value, Headers: headers})
+			}
+		}
+		if r.err != nil {
+			return records, next, r.err
+		}
+	}
+	return records, next, nil
+}
+
+// decompressRecords inflates a record batch. Output is capped at
+// kafkaMaxResponse whatever the codec, so a small batch can't expand into
+// gigabytes.
+func decompressRecords(codec int16, data []byte) ([]byte, error) {
+	switch codec {
+	case 0:
+		return data, nil
+	case 1:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		out, err := io.ReadAll(io.LimitReader(reader, kafkaMaxResponse+1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(out) > kafkaMaxResponse {
+			return nil, errKafkaTooLarge
+		}
+		return out, nil
+	case 2:
+		return decodeKafkaSnappy(data)
+	case 4:
+		return kafkaZstd.DecodeAll(data, nil)
+	}
+	return nil, errors.Errorf("unsupported kafka compression codec %d", codec)
+}
+
+// decodeKafkaSnappy handles both raw snappy and the xerial framing the Java
+// client uses: a magic header followed by length-prefixed snappy blocks.
+func decodeKafkaSnappy(data []byte) ([]byte, error) {
+	xerial := []byte("\x82SNAPPY\x00")
+	if !bytes.HasPrefix(data, xerial) {
+		return decodeKafkaSnappyBlock(data, 0)
+	}
+	if len(data) < len(xerial)+8 {
+		return nil, errKafkaIO
+	}
+	d := &kafkaDecoder{buf: data[len(xerial)+8:]}
+	var out []byte
+	for len(d.buf) > 0 && d.err == nil {
+		block, err := decodeKafkaSnappyBlock(d.bytes(), len(out))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+	}
+	return out, d.err
+}
+
+// decodeKafkaSnappyBlock decodes a snappy block unless it would take the
+// batch, decoded bytes so far, past kafkaMaxResponse.
+func decodeKafkaSnappyBlock(block []byte, decoded int) ([]byte, error) {
+	n, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if n > kafkaMaxResponse-decoded {
+		return nil, errKafkaTooLarge
+	}
+	out, err := snappy.Decode(nil, block)
+	return out, errors.WithStack(err)
+}
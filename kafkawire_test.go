@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// joinHex drops the spaces and newlines fixtures are written with.
+func joinHex(fixture string) string {
+	return strings.Join(strings.Fields(fixture), "")
+}
+
+// fromHex decodes a fixture written as hex.
+func fromHex(t *testing.T, fixture string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(joinHex(fixture))
+	if err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+	return b
+}
+
+// kafkaRequest is the fixture of a whole request: the size, the header with
+// the client id and the body.
+func kafkaRequest(apiKey, version int16, correlationID int32, body string) string {
+	header := fmt.Sprintf("%04x %04x %08x 0018 %x", apiKey, version, correlationID, "whisper-transcribe-agent")
+	message := joinHex(header + body)
+	return fmt.Sprintf("%08x", len(message)/2) + message
+}
+
+// fakeKafkaBroker answers the requests it receives with the responses queued
+// by respond, in order, and records every request as sent, size included.
+type fakeKafkaBroker struct {
+	listener  net.Listener
+	responses chan []byte
+	requests  chan []byte
+}
+
+func newFakeKafkaBroker(t *testing.T) *fakeKafkaBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &fakeKafkaBroker{listener: listener, responses: make(chan []byte, 8), requests: make(chan []byte, 8)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, 4+binary.BigEndian.Uint32(size[:]))
+		copy(request, size[:])
+		if _, err := io.ReadFull(conn, request[4:]); err != nil {
+			return
+		}
+		b.requests <- request
+		response := <-b.responses
+		message := binary.BigEndian.AppendUint32(nil, uint32(4+len(response)))
+		message = append(message, request[8:12]...)
+		if _, err := conn.Write(append(message, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeKafkaBroker) respond(response []byte) {
+	b.responses <- response
+}
+
+func (b *fakeKafkaBroker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeKafkaBroker) port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+// request returns the next request the broker received.
+func (b *fakeKafkaBroker) request(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case request := <-b.requests:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return nil
+	}
+}
+
+// newTestKafkaClient returns a client that knows the broker leads the
+// partitions of the topic.
+func newTestKafkaClient(broker *fakeKafkaBroker, topic string, partitions ...int32) *kafkaClient {
+	client := newKafkaClient([]string{broker.addr()})
+	client.brokers[1] = broker.addr()
+	client.leaders[topic] = make(map[int32]int32)
+	for _, partition := range partitions {
+		client.leaders[topic][partition] = 1
+	}
+	return client
+}
+
+func TestKafkaRequestHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		wantBody []byte
+		wantErr  bool
+	}{
+		{name: "response", response: fromHex(t, "00000005 00000001 42"), wantBody: []byte{0x42}},
+		{name: "wrong correlation id", response: fromHex(t, "00000005 00000002 42"), wantErr: true},
+		{name: "size too small", response: fromHex(t, "00000003 000000"), wantErr: true},
+		{name: "size too large", response: fromHex(t, "10000001"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				request := make([]byte, 39)
+				io.ReadFull(server, request)
+				received <- request
+				server.Write(test.response)
+			}()
+
+			conn := &kafkaConn{conn: client}
+			d, err := conn.request(kafkaMetadata, 1, []byte{0xaa}, time.Second)
+			want := fromHex(t, kafkaRequest(kafkaMetadata, 1, 1, "aa"))
+			if request := <-received; !bytes.Equal(request, want) {
+				t.Errorf("request = %x, want %x", request, want)
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d.buf, test.wantBody) {
+				t.Errorf("body = %x, want %x", d.buf, test.wantBody)
+			}
+		})
+	}
+}
+
+// kafkaTestBatch is a v2 record batch at offset 5 holding one record with key
+// "k", value "v" and a filename header.
+const kafkaTestBatch = `
+	0000000000000005 00000049 00000000 02 0eb68e61
+	0000 00000000 0000000000000000 0000000000000000 ffffffffffffffff ffff ffffffff 00000001
+	2e 00 00 00 026b 0276 02 10 66696c656e616d65 0a 612e776176`
+
+func TestKafkaFetch(t *testing.T) {
+	fetchRequest := kafkaRequest(kafkaFetch, 4, 1, `
+		ffffffff 00002710 00000001 10000000 00
+		00000001 0002 696e 00000001 00000003 0000000000000005 00100000`)
+	fetchResponse := func(code, batch string) string {
+		records := joinHex(batch)
+		return fmt.Sprintf("00000000 00000001 0002 696e 00000001 00000003 %s 0000000000000006 0000000000000006 00000000 %08x %s",
+			code, len(records)/2, records)
+	}
+	tests := []struct {
+		name        string
+		response    string
+		wantRecords []kafkaRecord
+		wantNext    int64
+		wantErr     error
+	}{
+		{
+			name:        "records",
+			response:    fetchResponse("0000", kafkaTestBatch),
+			wantRecords: []kafkaRecord{{Offset: 5, Key: []byte("k"), Value: []byte("v"), Headers: map[string]string{"filename": "a.wav"}}},
+			wantNext:    6,
+		},
+		{
+			name:     "no records",
+			response: fetchResponse("0000", ""),
+			wantNext: 5,
+		},
+		{
+			name: "partial batch",
+			// Brokers may cut the last batch short at the size limit.
+			response: fetchResponse("0000", joinHex(kafkaTestBatch)[:100]),
+			wantNext: 5,
+		},
+		{
+			name:     "offset out of range",
+			response: fetchResponse("0001", ""),
+			wantNext: 5,
+			wantErr:  kafkaOffsetOutOfRange,
+		},
+		{
+			name:     "truncated response",
+			response: "00000000 00000001 0002 69",
+			wantNext: 5,
+			wantErr:  errKafkaIO,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newFakeKafkaBroker(t)
+			broker.respond(fromHex(t, test.response))
+			client := newTestKafkaClient(broker, "in", 3)
+
+			records, next, err := client.fetch("in", 3, 5)
+			if request := broker.request(t); !bytes.Equal(request, fromHex(t, fetchRequest)) {
+				t.Errorf("request = %x, want %s", request, fetchRequest)
+			}
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(records, test.wantRecords) {
+				t.Errorf("records = %+v, want %+v", records, test.wantRecords)
+			}
+			if next != test.wantNext {
+				t.Errorf("next = %d, want %d", next, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestKafkaProduce(t *testing.T) {
+	// The timestamps, and so the CRC, of a produced batch are those of when
+	// it's sent, so they're checked apart from the rest.
+	produceRequest := kafkaRequest(kafkaProduce, 3, 1, `
+		ffff ffff 00007530 00000001 0003 6f7574 00000001 00000000 00000055
+		0000000000000000 00000049 ffffffff 02 ________
+		0000 00000000 ________________ ________________ ffffffffffffffff ffff ffffffff 00000001
+		2e 00 00 00 026b 0276 02 10 66696c656e616d65 0a 612e776176`)
+	tests := []struct {
+		name     string
+		response string
+		wantErr  error
+	}{
+		{name: "acknowledged", response: "00000001 0003 6f7574 00000001 00000000 0000 0000000000000007 ffffffffffffffff 00000000"},
+		{name: "not leader", response: "00000001 0003 6f7574 00000001 00000000 0006 ffffffffffffffff ffffffffffffffff 00000000", wantErr: kafkaError(6)},
+		{name: "truncated response", response: "00000001 0003 6f7574 000000", wantErr: errKafkaIO},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newFakeKafkaBroker(t)
+			broker.respond(fromHex(t, test.response))
+			client := newTestKafkaClient(broker, "out", 0)
+
+			before := time.Now().UnixMilli()
+			err := client.produce("out", 0, []kafkaRecord{{Key: []byte("k"), Value: []byte("v"), Headers: map[string]string{"filename": "a.wav"}}})
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+
+			request := broker.request(t)
+			want := produceRequest
+			got := []byte(hex.EncodeToString(request))
+			if len(got) != len(want) {
+				t.Fatalf("request = %s, want %s", got, want)
+			}
+			for i := range want {
+				if want[i] == '_' {
+					got[i] = '_'
+				}
+			}
+			if string(got) != want {
+				t.Errorf("request = %s, want %s", got, want)
+			}
+
+			batch := request[len(request)-0x55:]
+			if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], kafkaCRC) {
+				t.Errorf("batch CRC %08x doesn't match", crc)
+			}
+			first, max := int64(binary.BigEndian.Uint64(batch[27:])), int64(binary.BigEndian.Uint64(batch[35:]))
+			if first != max || first < before || first > time.Now().UnixMilli() {
+				t.Errorf("timestamps %d and %d aren't the time the batch was sent", first, max)
+			}
+		})
+	}
+}
+
+func TestKafkaOffsetCommit(t *testing.T) {
+	findCoordinatorRequest := kafkaRequest(kafkaFindCoordinator, 0, 1, "0001 67")
+	commitRequest := kafkaRequest(kafkaOffsetCommit, 2, 2, `
+		0001 67 ffffffff 0000 ffffffffffffffff
+		00000001 0002 696e 00000001 00000003 0000000000000007 0000`)
+	tests := []struct {
+		name     string
+		response string
+		wantErr  error
+	}{
+		{name: "committed", response: "00000001 0002 696e 00000001 00000003 0000"},
+		{name: "not coordinator", response: "00000001 0002 696e 00000001 00000003 0010", wantErr: kafkaError(16)},
+		{name: "truncated response", response: "00000001 0002 696e 00000001 0000", wantErr: errKafkaIO},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newFakeKafkaBroker(t)
+			broker.respond(fromHex(t, fmt.Sprintf("0000 00000001 0009 %x %08x", "127.0.0.1", broker.port())))
+			broker.respond(fromHex(t, test.response))
+			client := newKafkaClient([]string{broker.addr()})
+
+			err := client.commitOffset("g", "in", 3, 7)
+			if request := broker.request(t); !bytes.Equal(request, fromHex(t, findCoordinatorRequest)) {
+				t.Errorf("coordinator request = %x, want %s", request, findCoordinatorRequest)
+			}
+			if request := broker.request(t); !bytes.Equal(request, fromHex(t, commitRequest)) {
+				t.Errorf("commit request = %x, want %s", request, commitRequest)
+			}
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const alertTimeout = 30 * time.Second
+
+// KeywordMatch is a watch phrase found in one segment of a transcript.
+type KeywordMatch struct {
+	Phrase  string  `json:"phrase"`
+	Text    string  `json:"text"`
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Speaker string  `json:"speaker,omitempty"`
+}
+
+// keywordAlert is POSTed to --alert-webhook-url when a transcript contains
+// watch phrases.
+type keywordAlert struct {
+	JobID    string         `json:"job_id"`
+	Source   string         `json:"source"`
+	Filename string         `json:"filename"`
+	Matches  []KeywordMatch `json:"matches"`
+}
+
+// KeywordSpotter watches transcripts for phrases operators care about
+// ("cancel my contract", "lawyer") and alerts a webhook and/or Slack with the
+// segments they were said in. Phrases match whole words, ignoring case and
+// punctuation.
+type KeywordSpotter struct {
+	phrases    []string
+	normalized []string
+	cfg        Config
+}
+
+// NewKeywordSpotter takes comma-separated phrases plus those in phrasesFile,
+// one per line.
+func NewKeywordSpotter(phrases, phrasesFile string, cfg Config) (*KeywordSpotter, error) {
+	all := strings.Split(phrases, ",")
+	if phrasesFile != "" {
+		file, err := os.Open(phrasesFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := scanner.Text(); !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				all = append(all, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	spotter := &KeywordSpotter{cfg: cfg}
+	for _, phrase := range all {
+		normalized := normalizeForMatching(phrase)
+		if strings.TrimSpace(normalized) == "" {
+			continue
+		}
+		spotter.phrases = append(spotter.phrases, strings.TrimSpace(phrase))
+		spotter.normalized = append(spotter.normalized, normalized)
+	}
+	return spotter, nil
+}
+
+func (k *KeywordSpotter) Enabled() bool {
+	return k != nil && len(k.phrases) > 0
+}
+
+// normalizeForMatching lowercases text and turns everything but letters and
+// digits into single spaces, padded so phrases can be matched as " word ".
+func normalizeForMatching(text string) string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	return " " + strings.Join(fields, " ") + " "
+}
+
+// Match returns a match for every segment containing a watch phrase.
+func (k *KeywordSpotter) Match(transcript *Transcript) []KeywordMatch {
+	segments := transcript.Segments
+	if len(segments) == 0 {
+		segments = []Segment{{Start: 0, End: transcript.Duration, Text: transcript.Text}}
+	}
+	var matches []KeywordMatch
+	for _, segment := range segments {
+		text := normalizeForMatching(segment.Text)
+		for i, phrase := range k.normalized {
+			if strings.Contains(text, phrase) {
+				matches = append(matches, KeywordMatch{
+					Phrase:  k.phrases[i],
+					Text:    strings.TrimSpace(segment.Text),
+					Start:   segment.Start,
+					End:     segment.End,
+					Speaker: string(segment.Speaker),
+				})
+			}
+		}
+	}
+	return matches
+}
+
+// Alert sends the matches to the configured webhooks. Failures are logged;
+// there's nobody to return them to.
+func (k *KeywordSpotter) Alert(job Job, matches []KeywordMatch) {
+	if k.cfg.AlertWebhookURL != "" {
+		alert := keywordAlert{JobID: job.ID, Source: job.Source, Filename: job.Filename, Matches: matches}
+		if err := postJSON(k.cfg.AlertWebhookURL, alert); err != nil {
+			log.Printf("Keyword alert for job %s failed: %v", job.ID, err)
+		}
+	}
+	if k.cfg.AlertSlackURL != "" {
+		if err := postJSON(k.cfg.AlertSlackURL, map[string]string{"text": slackAlertText(job, matches)}); err != nil {
+			log.Printf("Slack keyword alert for job %s failed: %v", job.ID, err)
+		}
+	}
+}
+
+func slackAlertText(job Job, matches []KeywordMatch) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Watch phrases in %s* (%s, job %s)", job.Filename, job.Source, job.ID)
+	for _, match := range matches {
+		timestamp := strings.Split(srtTimestamp(match.Start), ",")[0]
+		speaker := ""
+		if match.Speaker != "" {
+			speaker = " " + match.Speaker + ":"
+		}
+		fmt.Fprintf(&b, "\n• \"%s\" at %s\n>%s %s", match.Phrase, timestamp, speaker, match.Text)
+	}
+	return b.String()
+}
+
+func postJSON(url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client := &http.Client{Timeout: alertTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
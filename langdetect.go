@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// languageSampleSeconds is the window whisper detects the language on: it
+// only looks at the first 30 seconds of audio, so that's all that's sent.
+const languageSampleSeconds = "30"
+
+// detectedLanguage is the body of POST /v1/audio/detect-language. The
+// probability is null if the backend doesn't report one.
+type detectedLanguage struct {
+	Language    string   `json:"language"`
+	Probability *float64 `json:"probability"`
+}
+
+// detectLanguageHandler detects the language of an uploaded file or an audio
+// URL, for routing audio to the right pipeline before paying for a full
+// transcription. Whisper has no detection-only API, so the backend transcribes
+// just the first 30 seconds, the window it detects the language on anyway,
+// through the pool like any other job.
+func detectLanguageHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+
+	var audio *AudioBuffer
+	filename := ""
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		upload, ok := readUploadedFile(w, r, cfg)
+		if !ok {
+			return
+		}
+		audio, filename = upload.Audio, upload.Filename
+	} else {
+		var body struct {
+			URL             string            `json:"url"`
+			DownloadHeaders map[string]string `json:"download_headers"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+			writeJSONError(w, http.StatusBadRequest, "Expected a multipart file upload or a JSON body with a url")
+			return
+		}
+		if err := checkDownloadHeaders(body.DownloadHeaders); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		downloaded, err := pool.download(r.Context(), body.URL, body.DownloadHeaders)
+		if errors.Is(err, errNotAudio) {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "Unsupported file: "+err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, "Failed to download audio: "+err.Error())
+			return
+		}
+		audio, filename = downloaded, body.URL
+	}
+	defer audio.Close()
+
+	sample, err := languageSample(cfg, audio)
+	if err != nil {
+		log.Printf("Cutting a language sample of %s failed, sending all of it: %v", filename, err)
+	} else {
+		defer sample.Close()
+		audio, filename = sample, "sample.wav"
+	}
+	task := &TranscriptionTask{Filename: filename, Audio: audio, Tenant: requestTenant(r), Owner: requestOwner(r)}
+	if _, err := pool.Submit("detect-language", task); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+	select {
+	case <-task.Done:
+	case <-r.Context().Done():
+		pool.Cancel(task.JobID, "client disconnected")
+		<-task.Done
+		return
+	}
+	if task.Err != nil {
+		writeJSONError(w, http.StatusBadGateway, "Language detection failed: "+task.Err.Error())
+		return
+	}
+	transcript := task.Transcript
+	if transcript.Language == "" {
+		writeJSONError(w, http.StatusBadGateway, "Backend didn't report a language")
+		return
+	}
+	writeJSON(w, http.StatusOK, detectedLanguage{Language: transcript.Language, Probability: transcript.LanguageProbability})
+}
+
+// languageSample cuts the first languageSampleSeconds of the audio with
+// ffmpeg, as 16 kHz mono WAV.
+func languageSample(cfg Config, audio *AudioBuffer) (*AudioBuffer, error) {
+	input, release, err := audio.Input()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer release()
+	cmd := exec.Command(cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-i", input,
+		"-t", languageSampleSeconds, "-vn", "-ac", "1", "-ar", "16000", "-f", "wav", "pipe:1")
+	sample := cfg.newAudioBuffer()
+	var stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = sample, &stderr
+	if err := cmd.Run(); err != nil {
+		sample.Close()
+		return nil, errors.Wrapf(err, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return sample, nil
+}
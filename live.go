@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pkg/errors"
+)
+
+const (
+	liveInterval    = 3 * time.Second
+	liveIdleTimeout = 2 * time.Minute
+	// liveWindow is about how much of the end of the recording a rolling
+	// transcript pass covers; what's before is kept from earlier passes.
+	liveWindow = 30 * time.Second
+	// liveChannel is the label of the data channel the browser opens to
+	// receive rolling transcripts on.
+	liveChannel = "transcript"
+)
+
+type liveUpdate struct {
+	Text     string  `json:"text"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// LiveSession receives microphone audio the browser streams over a WebRTC
+// connection. The Opus packets are written to an Ogg recording as they
+// arrive; while audio keeps coming, the end of the recording is transcribed
+// every few seconds and the rolling transcript is sent back on the
+// connection's data channel. Stopping the session submits the whole
+// recording as a regular job.
+type LiveSession struct {
+	id    string
+	owner string
+	store *JobStore
+	pool  *WorkerPool
+	cfg   Config
+	peer  *webrtc.PeerConnection
+
+	mu           sync.Mutex
+	audio        *AudioBuffer
+	channel      *webrtc.DataChannel
+	changed      bool
+	stopped      bool
+	abandoned    bool
+	full         bool
+	lastActivity time.Time
+	update       liveUpdate
+	// text is the transcript of the recording up to offset seconds, which
+	// later passes leave alone.
+	text   string
+	offset float64
+}
+
+type LiveSessions struct {
+	store *JobStore
+	pool  *WorkerPool
+	cfg   Config
+	api   *webrtc.API
+	ice   []webrtc.ICEServer
+
+	mu       sync.Mutex
+	sessions map[string]*LiveSession
+}
+
+// NewLiveSessions sets up WebRTC to take only Opus audio, which is what
+// browsers send from a microphone and what the recording is kept as.
+func NewLiveSessions(store *JobStore, pool *WorkerPool, cfg Config) (*LiveSessions, error) {
+	media := &webrtc.MediaEngine{}
+	err := media.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	live := &LiveSessions{
+		store:    store,
+		pool:     pool,
+		cfg:      cfg,
+		api:      webrtc.NewAPI(webrtc.WithMediaEngine(media)),
+		sessions: make(map[string]*LiveSession),
+	}
+	for _, url := range cfg.liveSTUNServers() {
+		live.ice = append(live.ice, webrtc.ICEServer{URLs: []string{url}})
+	}
+	return live, nil
+}
+
+// create answers the browser's offer with a new session, unless there are
+// --live-max-sessions already. The answer is returned once ICE candidates are
+// gathered, so the browser needs no trickling.
+func (l *LiveSessions) create(owner string, offer webrtc.SessionDescription) (*LiveSession, *webrtc.SessionDescription, error) {
+	peer, err := l.api.NewPeerConnection(webrtc.Configuration{ICEServers: l.ice})
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	session := &LiveSession{
+		id:           newJobID(),
+		owner:        owner,
+		store:        l.store,
+		pool:         l.pool,
+		cfg:          l.cfg,
+		peer:         peer,
+		audio:        l.cfg.newAudioBuffer(),
+		lastActivity: time.Now(),
+	}
+	peer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			session.record(track)
+		}
+	})
+	peer.OnDataChannel(func(channel *webrtc.DataChannel) {
+		if channel.Label() != liveChannel {
+			return
+		}
+		channel.OnOpen(func() {
+			session.mu.Lock()
+			session.channel = channel
+			update := session.update
+			session.mu.Unlock()
+			session.send(channel, update)
+		})
+	})
+	peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			session.abandon()
+		}
+	})
+
+	// The session takes its place before negotiating, which can take a
+	// while, so concurrent offers can't get past the limit together.
+	l.mu.Lock()
+	if len(l.sessions) >= l.cfg.LiveMaxSessions {
+		l.mu.Unlock()
+		peer.Close()
+		session.audio.Close()
+		return nil, nil, errLiveTooMany
+	}
+	l.sessions[session.id] = session
+	l.mu.Unlock()
+
+	answer, err := negotiate(peer, offer)
+	if err != nil {
+		l.mu.Lock()
+		delete(l.sessions, session.id)
+		l.mu.Unlock()
+		peer.Close()
+		session.audio.Close()
+		return nil, nil, err
+	}
+
+	go func() {
+		session.run()
+		l.mu.Lock()
+		delete(l.sessions, session.id)
+		l.mu.Unlock()
+	}()
+	return session, answer, nil
+}
+
+func negotiate(peer *webrtc.PeerConnection, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := peer.SetRemoteDescription(offer); err != nil {
+		return nil, errors.Wrap(err, "invalid offer")
+	}
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid offer")
+	}
+	gathered := webrtc.GatheringCompletePromise(peer)
+	if err := peer.SetLocalDescription(answer); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("gathering ICE candidates timed out")
+	}
+	return peer.LocalDescription(), nil
+}
+
+// liveSTUNServers lists the --live-stun-servers, which the browser is given
+// as well.
+func (c Config) liveSTUNServers() []string {
+	urls := []string{}
+	for _, url := range strings.Split(c.LiveSTUNServers, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func (l *LiveSessions) get(id string) (*LiveSession, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	session, ok := l.sessions[id]
+	return session, ok
+}
+
+// record writes the track's Opus packets to the recording until the track
+// ends or the session stops.
+func (s *LiveSession) record(track *webrtc.TrackRemote) {
+	recording, err := oggwriter.NewWith(liveRecorder{s}, track.Codec().ClockRate, track.Codec().Channels)
+	if err != nil {
+		log.Printf("Live session %s can't record: %v", s.id, err)
+		return
+	}
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := recording.WriteRTP(packet); err != nil {
+			return
+		}
+	}
+}
+
+// liveRecorder appends to the session's recording, up to MaxAudioSize: once
+// a write would take it past that, the session takes no more audio and is
+// left to be stopped.
+type liveRecorder struct {
+	session *LiveSession
+}
+
+func (r liveRecorder) Write(p []byte) (int, error) {
+	s := r.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.stopped:
+		return 0, errLiveStopped
+	case s.full:
+		return 0, errLiveTooLarge
+	case s.audio.Size()+int64(len(p)) > s.cfg.MaxAudioSize:
+		s.full = true
+		return 0, errLiveTooLarge
+	}
+	n, err := s.audio.Write(p)
+	s.changed = s.changed || n > 0
+	s.lastActivity = time.Now()
+	return n, err
+}
+
+// run re-transcribes the recording whenever it grew, until the session is
+// stopped or abandoned. Since it's what reads the recording, it's also what
+// closes it once the session is abandoned.
+func (s *LiveSession) run() {
+	ticker := time.NewTicker(liveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		idle := !s.stopped && time.Since(s.lastActivity) > liveIdleTimeout
+		s.mu.Unlock()
+		if idle {
+			s.abandon()
+		}
+
+		s.mu.Lock()
+		stopped, abandoned, changed := s.stopped, s.abandoned, s.changed
+		s.changed = false
+		s.mu.Unlock()
+		if abandoned {
+			s.audio.Close()
+		}
+		if stopped {
+			return
+		}
+		if changed {
+			s.transcribePartial()
+		}
+	}
+}
+
+// abandon ends a session nobody is going to stop; run drops the recording.
+func (s *LiveSession) abandon() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped, s.abandoned = true, true
+	s.mu.Unlock()
+	s.peer.Close()
+}
+
+// transcribePartial transcribes the recording from offset on, so a pass costs
+// about the same however long the session has run. Once that window is
+// longer than liveWindow, its segments but the last, which may be cut off
+// mid-sentence, are kept and the next window starts after them. The job is
+// ephemeral and removed from the store afterwards since only the final one
+// matters; it's queued at normal priority so live sessions don't hold up
+// other jobs.
+func (s *LiveSession) transcribePartial() {
+	s.mu.Lock()
+	recording, offset, committed := s.audio.Reader(), s.offset, s.text
+	filename := renameAudio(s.filename(), ".wav")
+	s.mu.Unlock()
+
+	update := liveUpdate{Text: committed, Duration: offset}
+	window, err := liveWindowAudio(s.cfg, recording, offset)
+	if err != nil {
+		update.Error = err.Error()
+		s.publish(update)
+		return
+	}
+	defer window.Close()
+
+	task := &TranscriptionTask{Filename: filename, Audio: window, Owner: s.owner, Ephemeral: true}
+	if _, err := s.pool.Submit("live", task); err != nil {
+		// Busy; the next tick tries again with more audio.
+		s.mu.Lock()
+		s.changed = true
+		s.mu.Unlock()
+		return
+	}
+	<-task.Done
+	s.store.Remove(task.JobID)
+
+	if task.Err != nil {
+		update.Error = task.Err.Error()
+		s.publish(update)
+		return
+	}
+	segments := task.Transcript.Segments
+	text, _ := renderText(task.Transcript)
+	update.Text = joinLiveText(committed, string(text))
+	update.Duration = offset + task.Transcript.Duration
+
+	s.mu.Lock()
+	if task.Transcript.Duration > liveWindow.Seconds() && len(segments) > 1 && s.offset == offset {
+		for _, segment := range segments[:len(segments)-1] {
+			s.text = joinLiveText(s.text, segment.Text)
+		}
+		s.offset = offset + segments[len(segments)-2].End
+	}
+	s.mu.Unlock()
+	s.publish(update)
+}
+
+// publish makes the update the session's latest and sends it to the browser
+// if the data channel is open; otherwise it's sent once it opens.
+func (s *LiveSession) publish(update liveUpdate) {
+	s.mu.Lock()
+	s.update = update
+	channel := s.channel
+	s.mu.Unlock()
+	if channel != nil {
+		s.send(channel, update)
+	}
+}
+
+func (s *LiveSession) send(channel *webrtc.DataChannel, update liveUpdate) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+	if err := channel.SendText(string(data)); err != nil {
+		log.Printf("Sending live session %s its transcript failed: %v", s.id, err)
+	}
+}
+
+func joinLiveText(text, more string) string {
+	more = strings.TrimSpace(more)
+	if text == "" || more == "" {
+		return text + more
+	}
+	return text + " " + more
+}
+
+// liveWindowAudio decodes the recording from offset seconds on into 16 kHz
+// mono WAV. ffmpeg reads the whole Ogg recording from stdin, which it can do
+// without seeking; decoding is cheap next to transcribing.
+func liveWindowAudio(cfg Config, recording io.Reader, offset float64) (*AudioBuffer, error) {
+	cmd := exec.Command(cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-i", "pipe:0",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-vn", "-ac", "1", "-ar", "16000", "-f", "wav", "pipe:1")
+	window := cfg.newAudioBuffer()
+	var stderr strings.Builder
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = recording, window, &stderr
+	if err := cmd.Run(); err != nil {
+		window.Close()
+		return nil, errors.Wrapf(err, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return window, nil
+}
+
+func (s *LiveSession) filename() string {
+	return "live-" + time.Now().Format("2006-01-02-150405") + ".ogg"
+}
+
+// stop ends the session, hanging up the connection, and submits the
+// recording as a job.
+func (s *LiveSession) stop() (*TranscriptionTask, error) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, errLiveStopped
+	}
+	s.stopped = true
+	task := &TranscriptionTask{Filename: s.filename(), Audio: s.audio, OwnsAudio: true, ContentType: "audio/ogg", Priority: priorityHigh, Owner: s.owner}
+	s.mu.Unlock()
+	s.peer.Close()
+
+	if _, err := s.pool.Submit("live", task); err != nil {
+		task.Audio.Close()
+		return nil, err
+	}
+	return task, nil
+}
+
+var (
+	errLiveStopped  = fmt.Errorf("live session has ended")
+	errLiveTooLarge = fmt.Errorf("recording too large")
+	errLiveTooMany  = fmt.Errorf("too many live sessions")
+)
+
+// liveHandler serves the live session API:
+//
+//	POST /ui/api/live            start a session from the browser's WebRTC
+//	                             offer, returns {"id": ..., "answer": ...}
+//	POST /ui/api/live/{id}/stop  transcribe the whole recording, returns the job
+//
+// Rolling transcripts come on the offer's "transcript" data channel.
+func liveHandler(w http.ResponseWriter, r *http.Request, live *LiveSessions) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ui/api/live"), "/")
+	if rest == "" {
+		liveStartHandler(w, r, live)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	session, ok := live.get(id)
+	if !ok || session.owner != requestOwner(r) {
+		writeJSONError(w, http.StatusNotFound, "Live session not found")
+		return
+	}
+	switch {
+	case action == "stop" && r.Method == http.MethodPost:
+		liveStopHandler(w, session)
+	default:
+		writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func liveStartHandler(w http.ResponseWriter, r *http.Request, live *LiveSessions) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON WebRTC offer with type and sdp")
+		return
+	}
+	if err := live.pool.Admit(); err != nil {
+		writeRejected(w, live.pool, err)
+		return
+	}
+	session, answer, err := live.create(requestOwner(r), offer)
+	if err == errLiveTooMany {
+		writeJSONError(w, http.StatusServiceUnavailable, "Too many live sessions, try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("Starting a live session failed: %v", err)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": session.id, "answer": answer})
+}
+
+func liveStopHandler(w http.ResponseWriter, session *LiveSession) {
+	task, err := session.stop()
+	if err == errLiveStopped {
+		writeJSONError(w, http.StatusGone, err.Error())
+		return
+	}
+	if err != nil {
+		writeRejected(w, session.pool, err)
+		return
+	}
+	<-task.Done
+
+	status := http.StatusOK
+	if task.Err != nil {
+		log.Printf("live %s failed: %+v", task.Filename, task.Err)
+		status = http.StatusBadGateway
+	}
+	job, _ := session.store.Get(task.JobID)
+	writeJSON(w, status, job)
+}
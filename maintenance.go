@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultMaintenanceMessage = "The transcription service is down for maintenance; existing transcripts can still be read"
+
+// Maintenance is the maintenance mode an admin put the agent into at runtime:
+// new jobs are rejected with the message, while jobs, transcripts and
+// exports are still served. Unlike draining, it can be ended again.
+type Maintenance struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// maintenanceError rejects new work during maintenance.
+type maintenanceError struct {
+	maintenance Maintenance
+}
+
+func (e *maintenanceError) Error() string {
+	return e.maintenance.Message
+}
+
+// maintenanceHandler reports the maintenance mode (GET), starts it or
+// changes its message (POST {"message": ..., "until": ...}) and ends it
+// (DELETE). The optional until is when the maintenance is expected to be
+// over, sent to rejected clients as Retry-After; it doesn't end it.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Message string     `json:"message"`
+			Until   *time.Time `json:"until"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with an optional message and until")
+				return
+			}
+		}
+		if body.Message == "" {
+			body.Message = defaultMaintenanceMessage
+		}
+		pool.StartMaintenance(body.Message, body.Until)
+		log.Printf("Maintenance mode on: %s", body.Message)
+	case http.MethodDelete:
+		if pool.EndMaintenance() {
+			log.Printf("Maintenance mode off")
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET, POST and DELETE supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Maintenance())
+}
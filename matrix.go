@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	matrixSyncTimeout = 30 * time.Second
+	matrixRetryDelay  = 5 * time.Second
+	matrixSyncFilter  = `{"room":{"timeline":{"types":["m.room.message"]},"state":{"not_types":["*"]},"ephemeral":{"not_types":["*"]},"account_data":{"not_types":["*"]}},"presence":{"not_types":["*"]},"account_data":{"not_types":["*"]}}`
+)
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+		URL     string `json:"url"`
+		Info    struct {
+			MimeType string `json:"mimetype"`
+			Size     int64  `json:"size"`
+		} `json:"info"`
+	} `json:"content"`
+}
+
+// MatrixBot joins the configured rooms and replies in a thread to every
+// m.audio message (including voice messages) with its transcript. End-to-end
+// encrypted rooms aren't supported.
+type MatrixBot struct {
+	homeserver string
+	token      string
+	userID     string
+	rooms      map[string]bool
+	pool       *WorkerPool
+	cfg        Config
+	client     *http.Client
+	txnID      int64
+}
+
+func NewMatrixBot(pool *WorkerPool, cfg Config) *MatrixBot {
+	return &MatrixBot{
+		homeserver: strings.TrimSuffix(cfg.MatrixHomeserver, "/"),
+		token:      cfg.MatrixToken,
+		rooms:      make(map[string]bool),
+		pool:       pool,
+		cfg:        cfg,
+		client:     &http.Client{Timeout: matrixSyncTimeout + 30*time.Second},
+	}
+}
+
+func (b *MatrixBot) Run() {
+	for {
+		if err := b.setup(); err != nil {
+			log.Printf("Matrix setup failed: %v", err)
+			time.Sleep(matrixRetryDelay)
+			continue
+		}
+		break
+	}
+	log.Printf("Matrix bot %s listening in %d rooms...", b.userID, len(b.rooms))
+
+	since := ""
+	for {
+		var sync struct {
+			NextBatch string `json:"next_batch"`
+			Rooms     struct {
+				Join map[string]struct {
+					Timeline struct {
+						Events []matrixEvent `json:"events"`
+					} `json:"timeline"`
+				} `json:"join"`
+			} `json:"rooms"`
+		}
+		query := url.Values{"filter": {matrixSyncFilter}, "timeout": {fmt.Sprint(matrixSyncTimeout.Milliseconds())}}
+		if since != "" {
+			query.Set("since", since)
+		}
+		if err := b.call(http.MethodGet, "/_matrix/client/v3/sync?"+query.Encode(), nil, &sync); err != nil {
+			log.Printf("Matrix sync failed: %v", err)
+			time.Sleep(matrixRetryDelay)
+			continue
+		}
+
+		// The first sync only establishes where to start; its timeline is history.
+		if since != "" {
+			for roomID, room := range sync.Rooms.Join {
+				if !b.rooms[roomID] {
+					continue
+				}
+				for _, event := range room.Timeline.Events {
+					if event.Type == "m.room.message" && event.Content.MsgType == "m.audio" && event.Sender != b.userID {
+						go b.handleEvent(roomID, event)
+					}
+				}
+			}
+		}
+		since = sync.NextBatch
+	}
+}
+
+// setup resolves the bot's own user id and joins the configured rooms, which
+// may be given as ids or aliases.
+func (b *MatrixBot) setup() error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+		return err
+	}
+	b.userID = whoami.UserID
+
+	for _, room := range strings.Split(b.cfg.MatrixRooms, ",") {
+		if room = strings.TrimSpace(room); room == "" {
+			continue
+		}
+		var joined struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := b.call(http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(room), struct{}{}, &joined); err != nil {
+			return errors.Wrapf(err, "failed to join %s", room)
+		}
+		b.rooms[joined.RoomID] = true
+	}
+	return nil
+}
+
+func (b *MatrixBot) handleEvent(roomID string, event matrixEvent) {
+	var text string
+	if event.Content.Info.Size > b.cfg.MaxAudioSize {
+		text = fmt.Sprintf("Audio is too large to transcribe (limit %.1f MB).", float64(b.cfg.MaxAudioSize)/(1<<20))
+	} else {
+		var err error
+		if text, err = b.transcribe(event); err != nil {
+			log.Printf("Matrix transcription in %s failed: %+v", roomID, err)
+			text = "Transcription failed: " + err.Error()
+		}
+	}
+
+	content := map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    text,
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        event.EventID,
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]string{"event_id": event.EventID},
+		},
+	}
+	txnID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddInt64(&b.txnID, 1))
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + txnID
+	if err := b.call(http.MethodPut, path, content, nil); err != nil {
+		log.Printf("Matrix reply in %s failed: %v", roomID, err)
+	}
+}
+
+func (b *MatrixBot) transcribe(event matrixEvent) (string, error) {
+	mediaID, ok := strings.CutPrefix(event.Content.URL, "mxc://")
+	if !ok {
+		return "", errors.Errorf("unsupported media url %q", event.Content.URL)
+	}
+	req, err := http.NewRequest(http.MethodGet, b.homeserver+"/_matrix/client/v1/media/download/"+mediaID, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download audio")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("media download returned %d", resp.StatusCode)
+	}
+
+	buffer := b.cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, limitReader(resp.Body, b.cfg.MaxAudioSize)); err != nil {
+		buffer.Close()
+		return "", errors.Wrap(err, "failed to download audio")
+	}
+
+	filename := event.Content.Body
+	if !isAudioFile(filename) {
+		extension, ok := sniffAudioExtension(buffer.Head(512))
+		if extensions, _ := mime.ExtensionsByType(event.Content.Info.MimeType); !ok && len(extensions) > 0 {
+			extension = extensions[0]
+		}
+		filename = "voice-message" + extension
+	}
+	task := &TranscriptionTask{Filename: filename, Audio: buffer, OwnsAudio: true, ContentType: event.Content.Info.MimeType}
+	if _, err := b.pool.Submit("matrix", task); err != nil {
+		buffer.Close()
+		return "", err
+	}
+	<-task.Done
+	if task.Err != nil {
+		return "", task.Err
+	}
+
+	text, err := renderText(task.Transcript)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(text)) == "" {
+		return "(no speech detected)", nil
+	}
+	return string(text), nil
+}
+
+// call invokes a client-server API endpoint and decodes the response into
+// result, if given.
+func (b *MatrixBot) call(method, path string, params interface{}, result interface{}) error {
+	var body io.Reader
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, b.homeserver+path, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if params != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "matrix %s failed", method)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("matrix %s %s returned %d: %s", method, strings.SplitN(path, "?", 2)[0], resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(data, result), "invalid matrix response")
+}
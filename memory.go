@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errMemoryPressure = errors.New("server is low on memory")
+
+const memorySampleInterval = time.Second
+
+type memoryLevel int
+
+const (
+	memoryOK memoryLevel = iota
+	memorySoft
+	memoryHard
+)
+
+func (l memoryLevel) String() string {
+	switch l {
+	case memorySoft:
+		return "soft"
+	case memoryHard:
+		return "hard"
+	}
+	return "ok"
+}
+
+// MemoryGuard samples the process RSS and Go heap so the pool can back off
+// before the container is OOM-killed. Above the soft limit workers stop taking
+// new jobs from the queue; above the hard limit new jobs are rejected outright.
+// A limit of 0 disables it.
+type MemoryGuard struct {
+	soft int64
+	hard int64
+
+	mu    sync.Mutex
+	rss   int64
+	heap  int64
+	level memoryLevel
+}
+
+func NewMemoryGuard(metrics *Metrics, cfg Config) *MemoryGuard {
+	guard := &MemoryGuard{soft: cfg.MemorySoftLimit, hard: cfg.MemoryHardLimit}
+	guard.sample()
+
+	metrics.GaugeFunc("whisper_agent_memory_rss_bytes", "Resident set size of the process.", func() float64 {
+		rss, _ := guard.Usage()
+		return float64(rss)
+	})
+	metrics.GaugeFunc("whisper_agent_memory_heap_bytes", "Bytes of Go heap in use.", func() float64 {
+		_, heap := guard.Usage()
+		return float64(heap)
+	})
+	metrics.GaugeFunc("whisper_agent_memory_pressure", "0 below the soft memory limit, 1 above it, 2 above the hard limit.", func() float64 {
+		return float64(guard.Level())
+	})
+
+	go func() {
+		for range time.Tick(memorySampleInterval) {
+			guard.sample()
+		}
+	}()
+	return guard
+}
+
+func (g *MemoryGuard) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	rss, err := readRSS()
+	if err != nil {
+		rss = int64(stats.Sys)
+	}
+
+	level := memoryOK
+	if g.hard > 0 && rss >= g.hard {
+		level = memoryHard
+	} else if g.soft > 0 && rss >= g.soft {
+		level = memorySoft
+	}
+
+	g.mu.Lock()
+	previous := g.level
+	g.rss, g.heap, g.level = rss, int64(stats.HeapInuse), level
+	g.mu.Unlock()
+
+	if level > previous {
+		// Give back what the GC can free before workers start backing off.
+		debug.FreeOSMemory()
+	}
+	if level != previous {
+		log.Printf("memory pressure %s: rss %d MB, heap %d MB", level, rss>>20, stats.HeapInuse>>20)
+	}
+}
+
+// readRSS reads the resident set size from /proc; elsewhere it fails and the
+// caller falls back to the memory the Go runtime obtained from the OS.
+func readRSS() (int64, error) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := bytes.Fields(statm)
+	if len(fields) < 2 {
+		return 0, errors.Errorf("unexpected /proc/self/statm: %q", statm)
+	}
+	pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+func (g *MemoryGuard) Usage() (rss, heap int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rss, g.heap
+}
+
+func (g *MemoryGuard) Level() memoryLevel {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.level
+}
+
+// WaitForHeadroom blocks while memory use is above the soft limit.
+func (g *MemoryGuard) WaitForHeadroom() {
+	for g.Level() != memoryOK {
+		time.Sleep(memorySampleInterval)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Jobs carry metadata of the caller's own, like a customer ID, to find them
+// by later. It's only stored with the job; nothing in the pipeline reads it.
+const (
+	metadataParamPrefix = "metadata."
+	maxMetadataKeys     = 20
+	maxMetadataValue    = 256
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// metadataParam reads metadata from metadata.<key>=<value> request
+// parameters.
+func metadataParam(r *http.Request) map[string]string {
+	var metadata map[string]string
+	for name, values := range r.URL.Query() {
+		if key, ok := strings.CutPrefix(name, metadataParamPrefix); ok {
+			if metadata == nil {
+				metadata = map[string]string{}
+			}
+			metadata[key] = values[0]
+		}
+	}
+	return metadata
+}
+
+func checkMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return errors.Errorf("at most %d metadata keys are allowed", maxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return errors.Errorf("metadata key %q must be 1 to 64 letters, digits, '_', '.' or '-'", key)
+		}
+		if len(value) > maxMetadataValue {
+			return errors.Errorf("metadata value of %q exceeds %d bytes", key, maxMetadataValue)
+		}
+	}
+	return nil
+}
+
+// jobFilterParam reads the filters of a job listing: status= (one or more,
+// comma-separated), source=, created_after= and created_before= (RFC 3339),
+// and metadata.<key>=<value>.
+func jobFilterParam(r *http.Request) (func(job *Job) bool, error) {
+	query := r.URL.Query()
+	statuses := map[JobStatus]bool{}
+	if value := query.Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			switch status := JobStatus(strings.TrimSpace(status)); status {
+			case JobScheduled, JobPending, JobRunning, JobCompleted, JobFailed, JobCancelled:
+				statuses[status] = true
+			default:
+				return nil, errors.New("status must be scheduled, pending, running, completed, failed or cancelled")
+			}
+		}
+	}
+	var createdAfter, createdBefore time.Time
+	for name, t := range map[string]*time.Time{"created_after": &createdAfter, "created_before": &createdBefore} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, errors.Errorf("%s must be an RFC 3339 time like 2024-01-02T15:04:05Z", name)
+			}
+			*t = parsed
+		}
+	}
+	source := query.Get("source")
+	metadata := metadataParam(r)
+
+	return func(job *Job) bool {
+		switch {
+		case len(statuses) > 0 && !statuses[job.Status],
+			source != "" && job.Source != source,
+			!createdAfter.IsZero() && !job.CreatedAt.After(createdAfter),
+			!createdBefore.IsZero() && !job.CreatedAt.Before(createdBefore):
+			return false
+		}
+		for key, value := range metadata {
+			if job.Metadata[key] != value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
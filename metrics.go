@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	values     map[string]float64
+	gauge      func() float64
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+// histogram is the observations of one label set: the cumulative count per
+// bucket, and the sum and count of all of them.
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// Metrics is a minimal registry rendered in the Prometheus text format.
+// Counters are keyed by their rendered label set, e.g. `reason="queue_full"`.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+func (m *Metrics) Counter(name, help string) {
+	m.register(&metricFamily{name: name, help: help, kind: "counter", values: make(map[string]float64)})
+}
+
+// Histogram registers a histogram with the given upper bucket bounds, in
+// increasing order; +Inf is implied.
+func (m *Metrics) Histogram(name, help string, buckets []float64) {
+	m.register(&metricFamily{name: name, help: help, kind: "histogram", buckets: buckets, histograms: make(map[string]*histogram)})
+}
+
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.register(&metricFamily{name: name, help: help, kind: "gauge", gauge: fn})
+}
+
+func (m *Metrics) register(family *metricFamily) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families[family.name] = family
+}
+
+// Inc increments a counter. Labels are given as name/value pairs.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family, ok := m.families[name]
+	if !ok || family.values == nil {
+		return
+	}
+	family.values[formatLabels(labels)] += value
+}
+
+// Observe adds a value to a histogram. Labels are given as name/value pairs.
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family, ok := m.families[name]
+	if !ok || family.histograms == nil {
+		return
+	}
+	key := formatLabels(labels)
+	h, ok := family.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(family.buckets))}
+		family.histograms[key] = h
+	}
+	for i, bound := range family.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		if family.gauge != nil {
+			fmt.Fprintf(w, "%s %g\n", name, family.gauge())
+			continue
+		}
+		if family.histograms != nil {
+			family.writeHistograms(w)
+			continue
+		}
+
+		labelSets := make([]string, 0, len(family.values))
+		for labels := range family.values {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			if labels == "" {
+				fmt.Fprintf(w, "%s %g\n", name, family.values[labels])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", name, labels, family.values[labels])
+			}
+		}
+	}
+}
+
+func (f *metricFamily) writeHistograms(w io.Writer) {
+	labelSets := make([]string, 0, len(f.histograms))
+	for labels := range f.histograms {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+	for _, labels := range labelSets {
+		h := f.histograms[labels]
+		prefix := ""
+		if labels != "" {
+			prefix = labels + ","
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %g\n", f.name, prefix, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %g\n", f.name, prefix, h.count)
+		if labels == "" {
+			fmt.Fprintf(w, "%s_sum %g\n%s_count %g\n", f.name, h.sum, f.name, h.count)
+		} else {
+			fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %g\n", f.name, labels, h.sum, f.name, labels, h.count)
+		}
+	}
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+}
+
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	modelReady       = "ready"
+	modelDownloading = "downloading"
+	modelFailed      = "failed"
+
+	modelPartSuffix = ".part"
+)
+
+// Model is a whisper model file in --models-dir, or one being downloaded
+// there. Progress is the fraction downloaded, if the size is known.
+type Model struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Size       int64      `json:"size,omitempty"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Downloaded int64      `json:"downloaded,omitempty"`
+	Progress   float64    `json:"progress,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type modelDownload struct {
+	url        string
+	size       int64
+	downloaded atomic.Int64
+	cancel     context.CancelFunc
+	err        error
+}
+
+// ModelManager lists, downloads and deletes the model files a local backend
+// (whisper.cpp, faster-whisper...) loads from --models-dir, so GPU nodes can
+// be provisioned through the agent. Downloads go to a .part file renamed once
+// complete, so the backend never sees a partial model.
+type ModelManager struct {
+	dir     string
+	baseURL string
+
+	mu        sync.Mutex
+	downloads map[string]*modelDownload
+}
+
+func NewModelManager(cfg Config) (*ModelManager, error) {
+	if err := os.MkdirAll(cfg.ModelsDir, 0o755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ModelManager{
+		dir:       cfg.ModelsDir,
+		baseURL:   strings.TrimSuffix(cfg.ModelsURL, "/"),
+		downloads: map[string]*modelDownload{},
+	}, nil
+}
+
+// List returns the models on disk and the downloads in progress or failed,
+// by name.
+func (m *ModelManager) List() ([]Model, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	models := []Model{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), modelPartSuffix) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if model, ok := m.Get(entry.Name()); ok {
+			models = append(models, model)
+		}
+	}
+	m.mu.Lock()
+	for name := range m.downloads {
+		if _, err := os.Stat(filepath.Join(m.dir, name)); err != nil {
+			models = append(models, m.downloadStatus(name))
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models, nil
+}
+
+// Get returns the model's download status if it's being or failed to be
+// downloaded, else the file's.
+func (m *ModelManager) Get(name string) (Model, bool) {
+	m.mu.Lock()
+	_, downloading := m.downloads[name]
+	if downloading {
+		defer m.mu.Unlock()
+		return m.downloadStatus(name), true
+	}
+	m.mu.Unlock()
+	info, err := os.Stat(filepath.Join(m.dir, name))
+	if err != nil || info.IsDir() {
+		return Model{}, false
+	}
+	modified := info.ModTime()
+	return Model{Name: name, Status: modelReady, Size: info.Size(), Modified: &modified}, true
+}
+
+// downloadStatus must be called with m.mu held.
+func (m *ModelManager) downloadStatus(name string) Model {
+	download := m.downloads[name]
+	model := Model{Name: name, Status: modelDownloading, Size: download.size, Downloaded: download.downloaded.Load(), URL: download.url}
+	if download.err != nil {
+		model.Status, model.Error = modelFailed, download.err.Error()
+	}
+	if download.size > 0 {
+		model.Progress = float64(model.Downloaded) / float64(download.size)
+	}
+	return model
+}
+
+// Download starts downloading the model from url, or from --models-url if
+// empty, in the background.
+func (m *ModelManager) Download(name, url string) (Model, error) {
+	if url == "" {
+		url = m.baseURL + "/" + name
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if download, ok := m.downloads[name]; ok && download.err == nil {
+		return Model{}, errors.Errorf("model %s is already being downloaded", name)
+	}
+	if _, err := os.Stat(filepath.Join(m.dir, name)); err == nil {
+		return Model{}, errors.Errorf("model %s already exists; delete it first", name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	download := &modelDownload{url: url, cancel: cancel}
+	m.downloads[name] = download
+	go m.download(ctx, name, download)
+	return m.downloadStatus(name), nil
+}
+
+func (m *ModelManager) download(ctx context.Context, name string, download *modelDownload) {
+	log.Printf("Downloading model %s from %s", name, download.url)
+	started := time.Now()
+	err := m.fetch(ctx, name, download)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.downloads[name] != download {
+		return // deleted meanwhile
+	}
+	if err != nil {
+		log.Printf("Downloading model %s failed: %v", name, err)
+		download.err = err
+		return
+	}
+	log.Printf("Downloaded model %s (%d bytes) in %s", name, download.downloaded.Load(), time.Since(started).Round(time.Second))
+	delete(m.downloads, name)
+}
+
+func (m *ModelManager) fetch(ctx context.Context, name string, download *modelDownload) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, download.url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("download returned %s", resp.Status)
+	}
+	m.mu.Lock()
+	download.size = resp.ContentLength
+	m.mu.Unlock()
+
+	path := filepath.Join(m.dir, name)
+	file, err := os.Create(path + modelPartSuffix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(io.MultiWriter(file, download), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + modelPartSuffix)
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(path+modelPartSuffix, path))
+}
+
+// Delete removes the model's file, or cancels its download.
+func (m *ModelManager) Delete(name string) error {
+	m.mu.Lock()
+	download, downloading := m.downloads[name]
+	if downloading {
+		download.cancel()
+		delete(m.downloads, name)
+	}
+	m.mu.Unlock()
+	err := os.Remove(filepath.Join(m.dir, name))
+	if os.IsNotExist(err) {
+		if downloading {
+			return nil
+		}
+		return os.ErrNotExist
+	}
+	if err == nil {
+		log.Printf("Deleted model %s", name)
+	}
+	return errors.WithStack(err)
+}
+
+// Write counts the bytes downloaded so far.
+func (d *modelDownload) Write(b []byte) (int, error) {
+	d.downloaded.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// validModelName accepts plain file names, so requests can't reach outside
+// --models-dir.
+func validModelName(name string) bool {
+	return name != "" && filepath.Base(name) == name && !strings.HasPrefix(name, ".") &&
+		!strings.HasSuffix(name, modelPartSuffix) && !strings.ContainsAny(name, `/\`)
+}
+
+// modelRequest is the JSON body of POST /admin/models.
+type modelRequest struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+func modelsHandler(w http.ResponseWriter, r *http.Request, models *ModelManager) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := models.List()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"models": list})
+	case http.MethodPost:
+		var body modelRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || !validModelName(body.Name) {
+			writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with the file name of the model as name, and optionally a url")
+			return
+		}
+		model, err := models.Download(body.Name, body.URL)
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.Header().Set("Location", "/admin/models/"+model.Name)
+		writeJSON(w, http.StatusAccepted, model)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and POST supported")
+	}
+}
+
+func modelHandler(w http.ResponseWriter, r *http.Request, models *ModelManager) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/models/")
+	if !validModelName(name) {
+		writeJSONError(w, http.StatusNotFound, "Model not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		model, ok := models.Get(name)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Model not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, model)
+	case http.MethodDelete:
+		err := models.Delete(name)
+		switch {
+		case err == os.ErrNotExist:
+			writeJSONError(w, http.StatusNotFound, "Model not found")
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Deleting model failed: %s", err))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and DELETE supported")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+const mqttRetryDelay = 5 * time.Second
+
+// MQTTIngester transcribes audio published on the subscribed topics, e.g. by
+// ESP32 voice recorders, and publishes the result on the response topic. A
+// payload is either the audio itself or a streamRequest with a URL.
+//
+// The response topic is a template where {topic} is the request's topic, so
+// one agent can serve many devices through a wildcard subscription.
+type MQTTIngester struct {
+	pool   *WorkerPool
+	cfg    Config
+	topics []string
+	// slots bounds the messages handled at once to the pool's workers and
+	// queue slots, across reconnects.
+	slots chan struct{}
+}
+
+func NewMQTTIngester(pool *WorkerPool, cfg Config) *MQTTIngester {
+	ingester := &MQTTIngester{pool: pool, cfg: cfg, slots: make(chan struct{}, cfg.Workers+cfg.QueueSize)}
+	for _, topic := range strings.Split(cfg.MQTTTopics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			ingester.topics = append(ingester.topics, topic)
+		}
+	}
+	return ingester
+}
+
+// mqttMaxPacket is the largest packet read: a JSON request carrying audio of
+// --max-audio-size in base64, with room for the topic and other fields.
+func mqttMaxPacket(cfg Config) int {
+	return int((cfg.MaxAudioSize+2)/3*4) + 64<<10
+}
+
+func (m *MQTTIngester) Run() {
+	for {
+		err := m.session()
+		log.Printf("MQTT connection to %s lost: %v", redactURL(m.cfg.MQTTURL), err)
+		time.Sleep(mqttRetryDelay)
+	}
+}
+
+func (m *MQTTIngester) session() error {
+	conn, err := dialMQTT(m.cfg.MQTTURL, m.cfg.MQTTClientID, mqttMaxPacket(m.cfg))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Messages of the persistent session may arrive before the SUBACK. While
+	// all slots are taken, messages aren't read: the broker keeps the QoS 1
+	// ones not acked yet and stops sending more once its in-flight window is
+	// full, so a burst waits there instead of in memory.
+	go func() {
+		for message := range conn.Messages() {
+			select {
+			case m.slots <- struct{}{}:
+			case <-conn.Done():
+				return
+			}
+			go func(message mqttMessage) {
+				defer func() { <-m.slots }()
+				m.handleMessage(conn, message)
+			}(message)
+		}
+	}()
+	if err := conn.subscribe(m.topics); err != nil {
+		return err
+	}
+	log.Printf("MQTT subscribed to %s...", strings.Join(m.topics, ", "))
+
+	<-conn.Done()
+	return conn.Err()
+}
+
+// handleMessage acks the message only once the response is published, so a
+// QoS 1 request is redelivered if the agent goes away in between.
+func (m *MQTTIngester) handleMessage(conn *mqttConn, message mqttMessage) {
+	// Retained messages would be transcribed again on every reconnect, and
+	// with a wildcard subscription our own responses may come back.
+	if message.Retain || m.isResponse(message.Topic) {
+		conn.ack(message)
+		return
+	}
+
+	result := streamResult{Status: JobFailed}
+	request, err := parseStreamRequest(message.Payload, "", "")
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result = transcribeStreamRequest(m.pool, m.cfg, "mqtt", request)
+	}
+
+	data, _ := json.Marshal(result)
+	if err := conn.publish(m.responseTopic(message.Topic), data); err != nil {
+		log.Printf("MQTT publishing result for %s failed: %v", message.Topic, err)
+		return
+	}
+	conn.ack(message)
+}
+
+func (m *MQTTIngester) responseTopic(topic string) string {
+	return strings.ReplaceAll(m.cfg.MQTTResponseTopic, "{topic}", topic)
+}
+
+func (m *MQTTIngester) isResponse(topic string) bool {
+	prefix, suffix, templated := strings.Cut(m.cfg.MQTTResponseTopic, "{topic}")
+	if !templated {
+		return topic == m.cfg.MQTTResponseTopic
+	}
+	return len(topic) > len(prefix)+len(suffix) && strings.HasPrefix(topic, prefix) && strings.HasSuffix(topic, suffix)
+}
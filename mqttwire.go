@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttPingReq     = 12
+	mqttDisconnect  = 14
+	mqttKeepAlive   = 60 * time.Second
+	mqttTimeout     = 30 * time.Second
+	mqttSubAckError = 0x80
+)
+
+type mqttMessage struct {
+	Topic    string
+	QoS      byte
+	Retain   bool
+	PacketID uint16
+	Payload  []byte
+}
+
+// mqttConn is a minimal MQTT 3.1.1 client: QoS 0 and 1 publish and
+// subscribe with a persistent session, so QoS 1 messages not yet acked are
+// redelivered after a reconnect. A goroutine reads packets until the
+// connection fails; Done is closed then and Messages ends.
+type mqttConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// maxPacket bounds the packets read: the length field alone allows
+	// almost 256 MiB.
+	maxPacket int
+
+	writeMu  sync.Mutex
+	packetID uint16
+	messages chan mqttMessage
+	subAcks  chan []byte
+	err      error
+	done     chan struct{}
+}
+
+func dialMQTT(rawURL, clientID string, maxPacket int) (*mqttConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid MQTT url")
+	}
+	addr := u.Host
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	if u.Scheme == "mqtts" || u.Scheme == "ssl" {
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &mqttConn{conn: conn, reader: bufio.NewReader(conn), maxPacket: maxPacket, messages: make(chan mqttMessage, 16), subAcks: make(chan []byte, 1), done: make(chan struct{})}
+
+	// Flags: persistent session (clean session unset), plus credentials.
+	var connect []byte
+	connect = mqttAppendString(connect, "MQTT")
+	connect = append(connect, 4, 0)
+	connect = binary.BigEndian.AppendUint16(connect, uint16(mqttKeepAlive/time.Second))
+	connect = mqttAppendString(connect, clientID)
+	if u.User != nil {
+		connect[7] |= 0x80
+		connect = mqttAppendString(connect, u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			connect[7] |= 0x40
+			connect = mqttAppendString(connect, password)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if err := c.write(mqttConnect<<4, connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	packetType, body, err := c.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if packetType>>4 != mqttConnAck || len(body) < 2 {
+		conn.Close()
+		return nil, errors.New("unexpected MQTT response to CONNECT")
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, errors.Errorf("MQTT connection refused (code %d)", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	go c.keepAlive()
+	return c, nil
+}
+
+func (c *mqttConn) Messages() <-chan mqttMessage {
+	return c.messages
+}
+
+func (c *mqttConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *mqttConn) Err() error {
+	return c.err
+}
+
+func (c *mqttConn) Close() error {
+	c.write(mqttDisconnect<<4, nil)
+	return c.conn.Close()
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(packet)
+	return errors.Wrap(err, "MQTT write failed")
+}
+
+func (c *mqttConn) nextPacketID() uint16 {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	return c.packetID
+}
+
+// subscribe subscribes to the topic filters with QoS 1.
+func (c *mqttConn) subscribe(topics []string) error {
+	body := binary.BigEndian.AppendUint16(nil, c.nextPacketID())
+	for _, topic := range topics {
+		body = mqttAppendString(body, topic)
+		body = append(body, 1)
+	}
+	if err := c.write(mqttSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	select {
+	case codes := <-c.subAcks:
+		for i, code := range codes {
+			if code == mqttSubAckError && i < len(topics) {
+				return errors.Errorf("MQTT subscription to %s was refused", topics[i])
+			}
+		}
+		return nil
+	case <-c.done:
+		return c.err
+	case <-time.After(mqttTimeout):
+		return errors.New("MQTT subscribe timed out")
+	}
+}
+
+// publish sends a QoS 1 message. The broker's PUBACK isn't waited for.
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	body := mqttAppendString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, c.nextPacketID())
+	return c.write(mqttPublish<<4|0x02, append(body, payload...))
+}
+
+func (c *mqttConn) ack(message mqttMessage) error {
+	if message.QoS == 0 {
+		return nil
+	}
+	return c.write(mqttPubAck<<4, binary.BigEndian.AppendUint16(nil, message.PacketID))
+}
+
+func (c *mqttConn) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write(mqttPingReq<<4, nil)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "MQTT read failed")
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "MQTT read failed")
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+	}
+	if length > c.maxPacket {
+		return 0, nil, errors.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, errors.Wrap(err, "MQTT read failed")
+	}
+	return header, body, nil
+}
+
+func (c *mqttConn) readLoop() {
+	c.err = c.read()
+	c.conn.Close()
+	close(c.messages)
+	close(c.done)
+}
+
+func (c *mqttConn) read() error {
+	for {
+		// The broker answers a PINGREQ every half keep-alive, so silence
+		// for longer than that means the connection is gone.
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive))
+		header, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			message := mqttMessage{QoS: header >> 1 & 0x03, Retain: header&0x01 != 0}
+			if len(body) < 2 {
+				return errors.New("malformed MQTT publish")
+			}
+			topicLength := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+topicLength {
+				return errors.New("malformed MQTT publish")
+			}
+			message.Topic = string(body[2 : 2+topicLength])
+			body = body[2+topicLength:]
+			if message.QoS > 0 {
+				if len(body) < 2 {
+					return errors.New("malformed MQTT publish")
+				}
+				message.PacketID = binary.BigEndian.Uint16(body)
+				body = body[2:]
+			}
+			message.Payload = body
+			c.messages <- message
+		case mqttSubAck:
+			if len(body) >= 2 {
+				select {
+				case c.subAcks <- body[2:]:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
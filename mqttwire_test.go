@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestMQTTConn returns a connection reading the data, with a pipe for the
+// deadlines.
+func newTestMQTTConn(t *testing.T, data []byte) *mqttConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return &mqttConn{
+		conn:      client,
+		reader:    bufio.NewReader(bytes.NewReader(data)),
+		maxPacket: 1 << 22,
+		messages:  make(chan mqttMessage, 16),
+		subAcks:   make(chan []byte, 1),
+	}
+}
+
+// mqttWritten returns what write sends for the packet.
+func mqttWritten(t *testing.T, header byte, body []byte) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		c := &mqttConn{conn: client}
+		if err := c.write(header, body); err != nil {
+			t.Error(err)
+		}
+		client.Close()
+	}()
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	tests := []struct {
+		length  int
+		encoded string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "8001"},
+		{16383, "ff7f"},
+		{16384, "808001"},
+		{2097151, "ffff7f"},
+		{2097152, "80808001"},
+	}
+	for _, test := range tests {
+		body := bytes.Repeat([]byte{0xab}, test.length)
+		packet := mqttWritten(t, mqttPublish<<4, body)
+		want := append(fromHex(t, "30"+test.encoded), body...)
+		if !bytes.Equal(packet, want) {
+			t.Errorf("packet of %d bytes starts with %x, want %x", test.length, packet[:5], want[:5])
+			continue
+		}
+
+		header, read, err := newTestMQTTConn(t, packet).readPacket()
+		if err != nil {
+			t.Errorf("reading packet of %d bytes failed: %v", test.length, err)
+			continue
+		}
+		if header != mqttPublish<<4 || !bytes.Equal(read, body) {
+			t.Errorf("packet of %d bytes read back as header %x and %d bytes", test.length, header, len(read))
+		}
+	}
+}
+
+func TestMQTTMalformedPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		wantErr string
+	}{
+		{name: "five byte length", packet: "30 ffffffff01", wantErr: "malformed MQTT packet length"},
+		{name: "largest length", packet: "30 ffffff7f", wantErr: "too large"},
+		{name: "over the limit", packet: "30 81808002", wantErr: "too large"},
+		{name: "truncated length", packet: "30 80", wantErr: "MQTT read failed"},
+		{name: "truncated body", packet: "30 05 0003742f", wantErr: "MQTT read failed"},
+		{name: "empty", packet: "", wantErr: "MQTT read failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := newTestMQTTConn(t, fromHex(t, test.packet)).readPacket()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMQTTRead(t *testing.T) {
+	tests := []struct {
+		name         string
+		packets      string
+		wantMessages []mqttMessage
+		wantSubAck   []byte
+		wantErr      string
+	}{
+		{
+			name:         "QoS 1 publish",
+			packets:      "32 09 0003 742f31 0007 6869",
+			wantMessages: []mqttMessage{{Topic: "t/1", QoS: 1, PacketID: 7, Payload: []byte("hi")}},
+		},
+		{
+			name:         "retained QoS 0 publish",
+			packets:      "31 07 0003 742f31 6869",
+			wantMessages: []mqttMessage{{Topic: "t/1", Retain: true, Payload: []byte("hi")}},
+		},
+		{
+			name:       "suback",
+			packets:    "90 04 0001 01 80",
+			wantSubAck: []byte{0x01, mqttSubAckError},
+		},
+		{
+			name:    "ping response",
+			packets: "d0 00",
+		},
+		{
+			name:    "publish without topic",
+			packets: "30 01 00",
+			wantErr: "malformed MQTT publish",
+		},
+		{
+			name:    "topic past the end",
+			packets: "30 04 0005 742f",
+			wantErr: "malformed MQTT publish",
+		},
+		{
+			name:    "QoS 1 publish without packet id",
+			packets: "32 06 0003 742f31 00",
+			wantErr: "malformed MQTT publish",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestMQTTConn(t, fromHex(t, test.packets))
+			err := c.read()
+			wantErr := test.wantErr
+			if wantErr == "" {
+				wantErr = "MQTT read failed"
+			}
+			if err == nil || !strings.Contains(err.Error(), wantErr) {
+				t.Fatalf("err = %v, want %q", err, wantErr)
+			}
+
+			close(c.messages)
+			var messages []mqttMessage
+			for message := range c.messages {
+				messages = append(messages, message)
+			}
+			if !reflect.DeepEqual(messages, test.wantMessages) {
+				t.Errorf("messages = %+v, want %+v", messages, test.wantMessages)
+			}
+			var subAck []byte
+			select {
+			case subAck = <-c.subAcks:
+			default:
+			}
+			if !bytes.Equal(subAck, test.wantSubAck) {
+				t.Errorf("suback = %x, want %x", subAck, test.wantSubAck)
+			}
+		})
+	}
+}
+
+func TestMQTTMaxPacket(t *testing.T) {
+	request := `{"filename":"a.wav","audio":"` + strings.Repeat("A", 4<<20/3*4+4) + `"}`
+	if limit := mqttMaxPacket(Config{MaxAudioSize: 4 << 20}); len(request) > limit {
+		t.Errorf("request with %d bytes of audio is over the limit of %d", 4<<20, limit)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	natsRetryDelay   = 5 * time.Second
+	natsPullExpires  = 30 * time.Second
+	natsProgressTick = 10 * time.Second
+)
+
+// NATSIngester takes transcription requests (see streamRequest) over NATS in
+// two ways:
+//
+//   - request/reply on --nats-subject: the result is the reply. Subscribers
+//     share a queue group, so several agents split the requests.
+//   - JetStream: a durable pull consumer on --nats-stream. Each result is
+//     published to --nats-result-subject before the message is acked, so an
+//     agent dying mid-transcription leads to redelivery.
+type NATSIngester struct {
+	pool *WorkerPool
+	cfg  Config
+}
+
+func NewNATSIngester(pool *WorkerPool, cfg Config) *NATSIngester {
+	return &NATSIngester{pool: pool, cfg: cfg}
+}
+
+func (n *NATSIngester) Run() {
+	for {
+		err := n.session()
+		log.Printf("NATS connection to %s lost: %v", redactURL(n.cfg.NATSURL), err)
+		time.Sleep(natsRetryDelay)
+	}
+}
+
+// session serves one connection until it fails.
+func (n *NATSIngester) session() error {
+	conn, err := dialNATS(n.cfg.NATSURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if n.cfg.NATSSubject != "" {
+		_, requests, err := conn.subscribe(n.cfg.NATSSubject, n.cfg.NATSQueueGroup)
+		if err != nil {
+			return err
+		}
+		log.Printf("NATS listening for requests on %s...", n.cfg.NATSSubject)
+		go n.serveRequests(conn, requests)
+	}
+	if n.cfg.NATSStream != "" {
+		if err := n.ensureConsumer(conn); err != nil {
+			return err
+		}
+		log.Printf("NATS consuming JetStream stream %s as %s...", n.cfg.NATSStream, n.cfg.NATSConsumer)
+		go n.consumeStream(conn)
+	}
+
+	<-conn.Done()
+	return conn.Err()
+}
+
+// serveRequests handles up to as many requests at once as the pool has
+// workers and queue slots. Core NATS has no flow control and the connection
+// can't stop reading without missing pings, so once they're all taken, further
+// requests are failed with errQueueFull straight away for the client to retry.
+func (n *NATSIngester) serveRequests(conn *natsConn, requests <-chan natsMsg) {
+	slots := make(chan struct{}, n.cfg.Workers+n.cfg.QueueSize)
+	for msg := range requests {
+		select {
+		case slots <- struct{}{}:
+			go func(msg natsMsg) {
+				defer func() { <-slots }()
+				n.reply(conn, msg, n.transcribe(msg, msg.Header.Get("Nats-Msg-Id")))
+			}(msg)
+		default:
+			n.reply(conn, msg, streamResult{ID: msg.Header.Get("Nats-Msg-Id"), Status: JobFailed, Error: errQueueFull.Error()})
+		}
+	}
+}
+
+// reply sends the result of a request to its reply subject, or else to
+// --nats-result-subject.
+func (n *NATSIngester) reply(conn *natsConn, msg natsMsg, result streamResult) {
+	subject := msg.Reply
+	if subject == "" {
+		subject = n.cfg.NATSResultSubject
+	}
+	if subject == "" {
+		return
+	}
+	data, _ := json.Marshal(result)
+	if err := conn.publish(subject, "", data); err != nil {
+		log.Printf("NATS reply to %s failed: %v", msg.Subject, err)
+	}
+}
+
+// ensureConsumer creates the durable consumer, or leaves it alone if it
+// already exists with the same configuration.
+func (n *NATSIngester) ensureConsumer(conn *natsConn) error {
+	request, _ := json.Marshal(map[string]interface{}{
+		"stream_name": n.cfg.NATSStream,
+		"config": map[string]interface{}{
+			"durable_name":    n.cfg.NATSConsumer,
+			"ack_policy":      "explicit",
+			"ack_wait":        int64(3 * natsProgressTick),
+			"max_ack_pending": n.cfg.Workers,
+		},
+	})
+	reply, err := conn.request("$JS.API.CONSUMER.DURABLE.CREATE."+n.cfg.NATSStream+"."+n.cfg.NATSConsumer, request, natsTimeout)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(reply.Data, &response); err != nil {
+		return errors.Wrap(err, "invalid JetStream response")
+	}
+	if response.Error != nil {
+		return errors.Errorf("failed to create JetStream consumer %s: %s", n.cfg.NATSConsumer, response.Error.Description)
+	}
+	return nil
+}
+
+// consumeStream pulls one message at a time whenever fewer than Workers are
+// being transcribed, so the stream, not the pool's queue, holds the backlog.
+func (n *NATSIngester) consumeStream(conn *natsConn) {
+	inbox := newNATSInbox()
+	_, messages, err := conn.subscribe(inbox, "")
+	if err != nil {
+		return
+	}
+	next := "$JS.API.CONSUMER.MSG.NEXT." + n.cfg.NATSStream + "." + n.cfg.NATSConsumer
+	pull, _ := json.Marshal(map[string]interface{}{"batch": 1, "expires": int64(natsPullExpires)})
+
+	slots := make(chan struct{}, n.cfg.Workers)
+	for {
+		slots <- struct{}{}
+		if err := conn.publish(next, inbox, pull); err != nil {
+			return
+		}
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			// Status messages (404 no messages, 408 timeout, ...) end the pull.
+			if msg.Status != "" {
+				<-slots
+				continue
+			}
+			go func() {
+				defer func() { <-slots }()
+				n.handleStreamMessage(conn, msg)
+			}()
+		case <-time.After(natsPullExpires + natsTimeout):
+			<-slots
+		case <-conn.Done():
+			return
+		}
+	}
+}
+
+func (n *NATSIngester) handleStreamMessage(conn *natsConn, msg natsMsg) {
+	// Keep the message from being redelivered while it's being transcribed.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(natsProgressTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.publish(msg.Reply, "", []byte("+WPI"))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	id := msg.Header.Get("Nats-Msg-Id")
+	if id == "" {
+		id = natsStreamSequence(msg.Reply)
+	}
+	result := n.transcribe(msg, id)
+	close(done)
+
+	data, _ := json.Marshal(result)
+	if err := conn.publish(n.cfg.NATSResultSubject, "", data); err != nil {
+		log.Printf("NATS publishing result of %s failed: %v", id, err)
+		return
+	}
+	if err := conn.publish(msg.Reply, "", []byte("+ACK")); err != nil {
+		log.Printf("NATS ack of %s failed: %v", id, err)
+	}
+}
+
+func (n *NATSIngester) transcribe(msg natsMsg, id string) streamResult {
+	request, err := parseStreamRequest(msg.Data, id, msg.Header.Get("Filename"))
+	if err != nil {
+		return streamResult{ID: id, Status: JobFailed, Error: err.Error()}
+	}
+	return transcribeStreamRequest(n.pool, n.cfg, "nats", request)
+}
+
+// natsStreamSequence extracts "<stream>/<sequence>" from a JetStream ack
+// subject, either $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>... or,
+// on newer servers, $JS.ACK.<domain>.<account hash>.<stream>.<consumer>....
+func natsStreamSequence(ackSubject string) string {
+	tokens := strings.Split(ackSubject, ".")
+	switch {
+	case len(tokens) == 9:
+		return tokens[2] + "/" + tokens[5]
+	case len(tokens) >= 11:
+		return tokens[4] + "/" + tokens[7]
+	}
+	return ""
+}
+
+// redactURL drops the credentials (user and password, or token) from a URL
+// for logging.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
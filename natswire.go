@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const natsTimeout = 10 * time.Second
+
+type natsMsg struct {
+	Subject string
+	Reply   string
+	Header  textproto.MIMEHeader
+	Status  string
+	Data    []byte
+}
+
+// natsConn is a minimal NATS client: publish, (queue) subscribe and
+// request/reply, with headers. A goroutine reads from the server until the
+// connection fails; Done is closed then and all subscriptions end.
+type natsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+	subMu   sync.Mutex
+	subs    map[string]chan natsMsg
+	sid     int
+	err     error
+	done    chan struct{}
+}
+
+func dialNATS(rawURL string) (*natsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid NATS url")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", addr, natsTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &natsConn{conn: conn, reader: bufio.NewReader(conn), subs: make(map[string]chan natsMsg), done: make(chan struct{})}
+
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, errors.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	json.Unmarshal([]byte(line[len("INFO "):]), &info)
+	if info.TLSRequired || u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "NATS TLS handshake failed")
+		}
+		c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]interface{}{
+		"verbose": false, "pedantic": false, "lang": "go", "version": "1.0", "protocol": 1,
+		"name": "whisper-transcribe-agent", "headers": true, "no_responders": true,
+	}
+	if password, ok := u.User.Password(); ok {
+		options["user"], options["pass"] = u.User.Username(), password
+	} else if u.User != nil {
+		options["auth_token"] = u.User.Username()
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		c.conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	// The server answers the PING with PONG, or with -ERR if CONNECT failed.
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.conn.Close()
+			return nil, errors.Wrap(err, "NATS handshake failed")
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			c.conn.Close()
+			return nil, errors.Errorf("NATS connect failed: %s", strings.TrimSpace(line[4:]))
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+	if !info.Headers {
+		c.conn.Close()
+		return nil, errors.New("NATS server doesn't support headers (2.2+ required)")
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *natsConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *natsConn) Err() error {
+	return c.err
+}
+
+func (c *natsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *natsConn) write(format string, args ...interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	_, err := fmt.Fprintf(c.conn, format, args...)
+	return errors.Wrap(err, "NATS write failed")
+}
+
+func (c *natsConn) publish(subject, reply string, data []byte) error {
+	if reply != "" {
+		reply += " "
+	}
+	return c.write("PUB %s %s%d\r\n%s\r\n", subject, reply, len(data), data)
+}
+
+// subscribe delivers messages on subject to the returned channel, which is
+// closed when the connection ends. Messages are load-balanced within a
+// non-empty queue group.
+func (c *natsConn) subscribe(subject, queue string) (string, <-chan natsMsg, error) {
+	c.subMu.Lock()
+	c.sid++
+	sid := strconv.Itoa(c.sid)
+	messages := make(chan natsMsg, 256)
+	c.subs[sid] = messages
+	c.subMu.Unlock()
+
+	if queue != "" {
+		queue += " "
+	}
+	return sid, messages, c.write("SUB %s %s%s\r\n", subject, queue, sid)
+}
+
+func (c *natsConn) unsubscribe(sid string) {
+	c.subMu.Lock()
+	delete(c.subs, sid)
+	c.subMu.Unlock()
+	c.write("UNSUB %s\r\n", sid)
+}
+
+// request publishes data and waits for the first reply on a fresh inbox.
+func (c *natsConn) request(subject string, data []byte, timeout time.Duration) (natsMsg, error) {
+	inbox := newNATSInbox()
+	sid, replies, err := c.subscribe(inbox, "")
+	if err != nil {
+		return natsMsg{}, err
+	}
+	defer c.unsubscribe(sid)
+	if err := c.publish(subject, inbox, data); err != nil {
+		return natsMsg{}, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return natsMsg{}, errors.Wrap(c.err, "NATS connection lost")
+		}
+		if strings.HasPrefix(reply.Status, "503") {
+			return natsMsg{}, errors.Errorf("no responders on %s", subject)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return natsMsg{}, errors.Errorf("NATS request to %s timed out", subject)
+	}
+}
+
+func (c *natsConn) readLoop() {
+	err := c.read()
+	c.subMu.Lock()
+	c.err = err
+	for sid, messages := range c.subs {
+		close(messages)
+		delete(c.subs, sid)
+	}
+	c.subMu.Unlock()
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *natsConn) read() error {
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "NATS read failed")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			// Permission errors are reported but don't close the connection.
+			if !strings.Contains(strings.ToLower(line), "permissions violation") {
+				return errors.Errorf("NATS server error: %s", strings.TrimSpace(line[4:]))
+			}
+		case "MSG", "HMSG":
+			msg, sid, err := c.readMsg(fields)
+			if err != nil {
+				return err
+			}
+			c.subMu.Lock()
+			messages, ok := c.subs[sid]
+			c.subMu.Unlock()
+			if ok {
+				messages <- msg
+			}
+		}
+	}
+}
+
+// readMsg reads the payload of a "MSG subject sid [reply] size" or
+// "HMSG subject sid [reply] header-size total-size" line.
+func (c *natsConn) readMsg(fields []string) (natsMsg, string, error) {
+	withHeaders := strings.EqualFold(fields[0], "HMSG")
+	args := fields[1:]
+	sizes := 1
+	if withHeaders {
+		sizes = 2
+	}
+	if len(args) != 2+sizes && len(args) != 3+sizes {
+		return natsMsg{}, "", errors.Errorf("malformed NATS message line %q", strings.Join(fields, " "))
+	}
+	msg := natsMsg{Subject: args[0]}
+	if len(args) == 3+sizes {
+		msg.Reply = args[2]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return natsMsg{}, "", errors.WithStack(err)
+	}
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return natsMsg{}, "", errors.WithStack(err)
+	}
+	payload = payload[:total]
+
+	if withHeaders {
+		headerSize, err := strconv.Atoi(args[len(args)-2])
+		if err != nil || headerSize > total {
+			return natsMsg{}, "", errors.Errorf("malformed NATS header size %q", args[len(args)-2])
+		}
+		reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(payload[:headerSize])))
+		status, _ := reader.ReadLine()
+		msg.Status = strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0"))
+		msg.Header, _ = reader.ReadMIMEHeader()
+		payload = payload[headerSize:]
+	}
+	msg.Data = payload
+	return msg, args[1], nil
+}
+
+func newNATSInbox() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "_INBOX." + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Roles OIDC users can have, in the claim named by --oidc-roles-claim. Admins
+// have the other roles too.
+const (
+	roleUploader = "uploader"
+	roleReviewer = "reviewer"
+	roleAdmin    = "admin"
+)
+
+const (
+	// oidcLeeway tolerates clocks that are a bit off from the provider's.
+	oidcLeeway = time.Minute
+	// oidcKeysMinRefresh keeps tokens with made-up key IDs from making the
+	// agent fetch the provider's keys over and over.
+	oidcKeysMinRefresh = time.Minute
+	// oidcLoginTimeout is how long the user has to log in at the provider.
+	oidcLoginTimeout = 10 * time.Minute
+	// uiLoginTTL is how long a UI login lasts before the user is sent to the
+	// provider again, which logs them in right away while its own session
+	// lasts.
+	uiLoginTTL = 12 * time.Hour
+)
+
+// oidcUser is the user an ID or access token was issued to.
+type oidcUser struct {
+	Subject string   `json:"subject"`
+	Name    string   `json:"name"`
+	Roles   []string `json:"roles"`
+	Tenant  string   `json:"-"`
+}
+
+func (u *oidcUser) has(role string) bool {
+	for _, granted := range u.Roles {
+		if granted == role || granted == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type userContextKey struct{}
+
+// requestUser returns the OIDC user of the request, if it was authenticated
+// with OIDC.
+func requestUser(r *http.Request) *oidcUser {
+	user, _ := r.Context().Value(userContextKey{}).(*oidcUser)
+	return user
+}
+
+func withUser(r *http.Request, user *oidcUser) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+}
+
+// allowed reports whether the request's OIDC user has one of the roles.
+// Requests authenticated otherwise, with an API key or the admin token, keep
+// the access they have without OIDC.
+func allowed(r *http.Request, roles ...string) bool {
+	user := requestUser(r)
+	if user == nil {
+		return true
+	}
+	for _, role := range roles {
+		if user.has(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRole only lets OIDC users through that have one of the roles.
+func withRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r, roles...) {
+			writeForbidden(w, roles...)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeForbidden(w http.ResponseWriter, roles ...string) {
+	writeJSONError(w, http.StatusForbidden, "Requires the "+strings.Join(roles, " or ")+" role")
+}
+
+// OIDC authenticates users with an OpenID Connect provider like Keycloak or
+// Azure AD: the UI logs them in with the authorization code flow, and API
+// clients send the provider's access tokens as bearer tokens. Tokens are
+// verified with the provider's published keys, so the agent doesn't call the
+// provider per request.
+type OIDC struct {
+	cfg                   Config
+	client                *http.Client
+	issuer                string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	endSessionEndpoint    string
+	jwksURI               string
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+
+	loginMu sync.Mutex
+	logins  map[string]oidcLogin
+}
+
+// oidcLogin is a login in progress at the provider, by its state parameter.
+type oidcLogin struct {
+	session  string
+	verifier string
+	nonce    string
+	returnTo string
+	expires  time.Time
+}
+
+// NewOIDC discovers the endpoints of --oidc-issuer, or returns nil without
+// one.
+func NewOIDC(cfg Config) (*OIDC, error) {
+	if cfg.OIDCIssuer == "" {
+		return nil, nil
+	}
+	if cfg.OIDCClientID == "" {
+		return nil, errors.New("OIDC needs a client ID")
+	}
+	if cfg.OIDCRedirectURL == "" {
+		return nil, errors.New("OIDC needs the redirect URL of the UI, ending in /ui/auth/callback")
+	}
+	o := &OIDC{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		issuer: strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		logins: make(map[string]oidcLogin),
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, errors.Wrap(err, "OIDC discovery failed")
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return nil, errors.Errorf("the provider's issuer is %q, not %q", discovery.Issuer, cfg.OIDCIssuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("the provider's configuration lacks the authorization, token or keys endpoint")
+	}
+	o.authorizationEndpoint = discovery.AuthorizationEndpoint
+	o.tokenEndpoint = discovery.TokenEndpoint
+	o.endSessionEndpoint = discovery.EndSessionEndpoint
+	o.jwksURI = discovery.JWKSURI
+	return o, nil
+}
+
+func (o *OIDC) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+// publicKey returns the provider's signing key with the ID, fetching the
+// keys again if it's new, e.g. after the provider rotated them.
+func (o *OIDC) publicKey(id string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[id]; ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetched) < oidcKeysMinRefresh {
+		return nil, errors.Errorf("unknown signing key %q", id)
+	}
+	o.keysFetched = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(o.jwksURI, &set); err != nil {
+		return nil, errors.Wrap(err, "fetching the provider's keys failed")
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	o.keys = keys
+	if key, ok := o.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown signing key %q", id)
+}
+
+// verify checks the signature, issuer, expiry and, unless it's empty, the
+// audience of a JWT, and returns its claims.
+func (o *OIDC) verify(token, audience string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "invalid header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	key, err := o.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "invalid claims")
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != o.issuer {
+		return nil, errors.Errorf("issued by %q", issuer)
+	}
+	now := time.Now()
+	expires, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(expires), 0).Add(oidcLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(notBefore), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if audience != "" && !hasAudience(claims["aud"], audience) {
+		return nil, errors.Errorf("token isn't meant for %q", audience)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// names the audience.
+func hasAudience(claim interface{}, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []interface{}:
+		for _, value := range claim {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claim returns the claim at the dotted path, e.g. realm_access.roles for
+// Keycloak's realm roles.
+func claim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// roles returns the roles in the claims, a list or a space-separated string.
+func (o *OIDC) roles(claims map[string]interface{}) []string {
+	var roles []string
+	switch value := claim(claims, o.cfg.OIDCRolesClaim).(type) {
+	case string:
+		roles = strings.Fields(value)
+	case []interface{}:
+		for _, role := range value {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+func (o *OIDC) user(claims map[string]interface{}) (*oidcUser, error) {
+	user := &oidcUser{Roles: o.roles(claims)}
+	user.Subject, _ = claims["sub"].(string)
+	if user.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	for _, name := range []string{"preferred_username", "name", "email", "sub"} {
+		if user.Name, _ = claims[name].(string); user.Name != "" {
+			break
+		}
+	}
+	if o.cfg.OIDCTenantClaim != "" {
+		user.Tenant, _ = claim(claims, o.cfg.OIDCTenantClaim).(string)
+		if user.Tenant != "" && !validTenant.MatchString(user.Tenant) {
+			return nil, errors.Errorf("invalid tenant %q in the token", user.Tenant)
+		}
+	}
+	return user, nil
+}
+
+// authenticate returns the user of a bearer JWT in the request, or nil if
+// the request doesn't carry one, e.g. because it uses an API key.
+func (o *OIDC) authenticate(r *http.Request) (*oidcUser, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	audience := o.cfg.OIDCAudience
+	if audience == "" {
+		audience = o.cfg.OIDCClientID
+	}
+	claims, err := o.verify(token, audience)
+	if err != nil {
+		return nil, err
+	}
+	return o.user(claims)
+}
+
+// startLogin sends the browser to the provider's login page. The login is
+// bound to the UI session, so a callback can't log another browser in, and
+// uses PKCE, so an intercepted code is useless.
+func (o *OIDC) startLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("return")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	state, login := newRandomToken(), oidcLogin{
+		session:  requestUISession(r),
+		verifier: newRandomToken(),
+		nonce:    newRandomToken(),
+		returnTo: returnTo,
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	o.loginMu.Lock()
+	for pending, other := range o.logins {
+		if time.Now().After(other.expires) {
+			delete(o.logins, pending)
+		}
+	}
+	o.logins[state] = login
+	o.loginMu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.OIDCClientID},
+		"redirect_uri":          {o.cfg.OIDCRedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(o.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, o.authorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// finishLogin exchanges the code the provider sent the browser back with for
+// its tokens and returns the user of the ID token, and where to send the
+// browser next.
+func (o *OIDC) finishLogin(r *http.Request) (*oidcUser, string, error) {
+	query := r.URL.Query()
+	if failure := query.Get("error"); failure != "" {
+		return nil, "", errors.Errorf("the provider refused the login: %s %s", failure, query.Get("error_description"))
+	}
+	o.loginMu.Lock()
+	login, ok := o.logins[query.Get("state")]
+	delete(o.logins, query.Get("state"))
+	o.loginMu.Unlock()
+	if !ok || login.session != requestUISession(r) || time.Now().After(login.expires) {
+		return nil, "", errors.New("unknown or expired login, try again")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {o.cfg.OIDCRedirectURL},
+		"client_id":     {o.cfg.OIDCClientID},
+		"code_verifier": {login.verifier},
+	}
+	if o.cfg.OIDCClientSecret != "" {
+		form.Set("client_secret", o.cfg.OIDCClientSecret)
+	}
+	resp, err := o.client.PostForm(o.tokenEndpoint, form)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || resp.StatusCode != http.StatusOK {
+		return nil, "", errors.Errorf("token request returned %d %s", resp.StatusCode, tokens.Error)
+	}
+
+	claims, err := o.verify(tokens.IDToken, o.cfg.OIDCClientID)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "invalid ID token")
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return nil, "", errors.New("ID token for another login")
+	}
+	user, err := o.user(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	// Keycloak only puts roles into the access token by default.
+	if len(user.Roles) == 0 {
+		if access, err := o.verify(tokens.AccessToken, ""); err == nil {
+			user.Roles = o.roles(access)
+		}
+	}
+	log.Printf("UI login of %s with roles %v", user.Name, user.Roles)
+	return user, login.returnTo, nil
+}
+
+// logoutURL is where the browser logs out of the provider as well, if the
+// provider supports it.
+func (o *OIDC) logoutURL() string {
+	if o.endSessionEndpoint == "" {
+		return "/"
+	}
+	query := url.Values{"client_id": {o.cfg.OIDCClientID}}
+	if redirect, err := url.Parse(o.cfg.OIDCRedirectURL); err == nil {
+		query.Set("post_logout_redirect_uri", redirect.Scheme+"://"+redirect.Host+"/")
+	}
+	separator := "?"
+	if strings.Contains(o.endSessionEndpoint, "?") {
+		separator = "&"
+	}
+	return o.endSessionEndpoint + separator + query.Encode()
+}
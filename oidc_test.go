@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOIDC is a provider whose keys are known, so nothing is fetched.
+type testOIDC struct {
+	*OIDC
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestOIDC(t *testing.T) *testOIDC {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testOIDC{
+		OIDC: &OIDC{
+			cfg:         Config{OIDCClientID: "agent", OIDCRolesClaim: "roles"},
+			issuer:      "https://id.example.com/realms/test",
+			keys:        map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey},
+			keysFetched: time.Now(),
+		},
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+	}
+}
+
+// sign returns a JWT of the claims with the header, signed with the key
+// named by its kid, or with no signature for any other.
+func (o *testOIDC) sign(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch header["kid"] {
+	case "rsa":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, o.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ec":
+		r, s, err := ecdsa.Sign(rand.Reader, o.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (o *testOIDC) claims(change func(claims map[string]interface{})) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":   o.issuer,
+		"sub":   "user-1",
+		"aud":   "agent",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": []string{roleUploader},
+	}
+	if change != nil {
+		change(claims)
+	}
+	return claims
+}
+
+func TestOIDCVerify(t *testing.T) {
+	o := newTestOIDC(t)
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "ec"}
+	tests := []struct {
+		name    string
+		header  map[string]interface{}
+		claims  map[string]interface{}
+		wantErr string
+	}{
+		{name: "RS256", header: rs256, claims: o.claims(nil)},
+		{name: "ES256", header: es256, claims: o.claims(nil)},
+		{
+			name:   "audience in a list",
+			header: rs256,
+			claims: o.claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "agent"} }),
+		},
+		{
+			name:   "expired within the leeway",
+			header: rs256,
+			claims: o.claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-oidcLeeway / 2).Unix() }),
+		},
+		{
+			name:    "ES256 header with the RSA key",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "rsa"},
+			claims:  o.claims(nil),
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "RS256 header with the EC key",
+			header:  map[string]interface{}{"alg": "RS256", "kid": "ec"},
+			claims:  o.claims(nil),
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "HS256",
+			header:  map[string]interface{}{"alg": "HS256", "kid": "rsa"},
+			claims:  o.claims(nil),
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "none",
+			header:  map[string]interface{}{"alg": "none", "kid": "rsa"},
+			claims:  o.claims(nil),
+			wantErr: "invalid signature",
+		},
+		{
+			name:    "unknown key",
+			header:  map[string]interface{}{"alg": "RS256", "kid": "other"},
+			claims:  o.claims(nil),
+			wantErr: `unknown signing key "other"`,
+		},
+		{
+			name:    "expired",
+			header:  rs256,
+			claims:  o.claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * oidcLeeway).Unix() }),
+			wantErr: "token expired",
+		},
+		{
+			name:    "no expiry",
+			header:  rs256,
+			claims:  o.claims(func(c map[string]interface{}) { delete(c, "exp") }),
+			wantErr: "token expired",
+		},
+		{
+			name:    "not valid yet",
+			header:  es256,
+			claims:  o.claims(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(2 * oidcLeeway).Unix() }),
+			wantErr: "token not valid yet",
+		},
+		{
+			name:    "wrong audience",
+			header:  rs256,
+			claims:  o.claims(func(c map[string]interface{}) { c["aud"] = "other" }),
+			wantErr: `token isn't meant for "agent"`,
+		},
+		{
+			name:    "wrong audience in a list",
+			header:  es256,
+			claims:  o.claims(func(c map[string]interface{}) { c["aud"] = []string{"other"} }),
+			wantErr: `token isn't meant for "agent"`,
+		},
+		{
+			name:    "wrong issuer",
+			header:  rs256,
+			claims:  o.claims(func(c map[string]interface{}) { c["iss"] = "https://id.example.com/realms/other" }),
+			wantErr: "issued by",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := o.verify(o.sign(t, test.header, test.claims), "agent")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["sub"] != "user-1" {
+				t.Errorf("claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyTampered(t *testing.T) {
+	o := newTestOIDC(t)
+	for _, kid := range []string{"rsa", "ec"} {
+		token := o.sign(t, map[string]interface{}{"alg": map[string]string{"rsa": "RS256", "ec": "ES256"}[kid], "kid": kid}, o.claims(nil))
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(o.claims(func(c map[string]interface{}) { c["roles"] = []string{roleAdmin} }))
+		parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+		if _, err := o.verify(strings.Join(parts, "."), "agent"); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Errorf("%s: err = %v, want an invalid signature", kid, err)
+		}
+	}
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	o := newTestOIDC(t)
+	r := httptest.NewRequest("GET", "/v1/jobs", nil)
+	r.Header.Set("Authorization", "Bearer "+o.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, o.claims(nil)))
+	user, err := o.authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Subject != "user-1" || !user.has(roleUploader) || user.has(roleAdmin) {
+		t.Errorf("user = %+v", user)
+	}
+
+	// The audience defaults to the client ID.
+	o.cfg.OIDCAudience = "api"
+	if _, err := o.authenticate(r); err == nil {
+		t.Error("token for the client ID accepted for another audience")
+	}
+
+	// API keys aren't JWTs and are left to the other checks.
+	r.Header.Set("Authorization", "Bearer wta_0123456789")
+	if user, err := o.authenticate(r); user != nil || err != nil {
+		t.Errorf("API key authenticated as %+v (%v)", user, err)
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// object is a JSON object in the OpenAPI document.
+type object = map[string]interface{}
+
+// openAPISpec describes the API server's endpoints as OpenAPI 3. The schemas
+// of the response bodies are generated from the Go types, so they can't drift
+// from what's actually served. Webhook endpoints are only listed if enabled.
+func openAPISpec(cfg Config) object {
+	schemas := object{}
+	ref := func(v interface{}) object {
+		return schemaOf(reflect.TypeOf(v), schemas)
+	}
+	errorResponse := func(description string) object {
+		return object{"description": description, "content": jsonContent(ref(apiError{}))}
+	}
+	jobOptions := []object{
+		queryParam("summarize", "boolean", "Summarize the transcript with the LLM"),
+		queryParam("chapters", "boolean", "Split the transcript into titled chapters"),
+		queryParam("sentiment", "boolean", "Score the sentiment of every segment"),
+		queryParam("entities", "boolean", "Extract people, organizations, dates and amounts"),
+		queryParam("translate_to", "string", "Language code to translate the transcript into"),
+		queryParam("profanity", "string", "Profanity filter mode: mask, remove, flag or off"),
+		queryParam("vocabulary", "string", "Comma-separated domain terms whisper is prompted with"),
+		queryParam("priority", "string", "Scheduling priority: high, normal (default) or low"),
+		{"name": "metadata", "in": "query", "style": "form", "explode": true, "description": "Metadata stored with the job to filter listings by, as metadata.<key>=<value>", "schema": object{"type": "object", "additionalProperties": object{"type": "string"}}},
+	}
+	idempotencyKey := object{"name": "Idempotency-Key", "in": "header", "description": "Key identifying the submission; retries with the same key get the original job (Idempotent-Replayed: true) instead of transcribing again. The key is bound to the request's options and audio, so reusing it for a different request is rejected with 422", "schema": object{"type": "string", "maxLength": maxIdempotencyKeyLength}}
+	uploadID := object{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}
+	ifNoneMatch := object{"name": "If-None-Match", "in": "header", "description": "ETag of an earlier response, to get 304 Not Modified instead of the same body again", "schema": object{"type": "string"}}
+	rejected := object{
+		"400": errorResponse("Invalid request"),
+		"422": errorResponse("The Idempotency-Key was already used for a different request"),
+		"429": errorResponse("Queue is full; retry after the Retry-After header"),
+		"500": errorResponse("The job couldn't be queued or scheduled, e.g. saving it to --schedule-dir failed"),
+		"503": errorResponse("Server is draining, read-only, in maintenance or low on memory"),
+	}
+
+	deleteJob := func(operationID string) object {
+		return object{
+			"summary":     "Delete a finished job with its transcript and audio, e.g. for a GDPR erasure request; recorded in the audit log",
+			"operationId": operationID,
+			"parameters":  []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}},
+			"responses": object{
+				"204": object{"description": "Deleted"},
+				"404": errorResponse("Job not found"),
+				"409": errorResponse("Job is still queued or running"),
+			},
+		}
+	}
+
+	paths := object{
+		"/v1/chat/completions": object{"post": object{
+			"summary":     "Transcribe the audio URL in the last message, OpenAI chat completions style",
+			"operationId": "chatCompletions",
+			"parameters": []object{
+				queryParam("word_timestamps", "boolean", "Same as word_timestamps in the body"),
+				queryParam("response_format", "string", "Same as response_format in the body: an export format like srt for the assistant message"),
+				idempotencyKey,
+			},
+			"requestBody": object{"required": true, "content": jsonContent(ref(ChatCompletionRequest{}))},
+			"responses":   merge(object{"200": object{"description": "The transcript as the assistant message, in the response_format if given, or with word_timestamps a JSON document of the text and its words with start and end times", "content": jsonContent(object{"type": "object"})}}, rejected),
+		}},
+		"/v1/jobs": object{"get": object{
+			"summary":     "List the jobs of the tenant, newest first, without transcripts",
+			"operationId": "listJobs",
+			"parameters": []object{
+				queryParam("limit", "integer", "Jobs per page, 1 to 1000 (default 100)"),
+				queryParam("cursor", "string", "next_cursor of the previous page"),
+				queryParam("status", "string", "Only jobs with one of these comma-separated statuses: scheduled, pending, running, completed, failed, cancelled"),
+				queryParam("source", "string", "Only jobs from this source, e.g. api or telegram"),
+				queryParam("created_after", "string", "Only jobs created after this RFC 3339 time"),
+				queryParam("created_before", "string", "Only jobs created before this RFC 3339 time"),
+				{"name": "metadata", "in": "query", "style": "form", "explode": true, "description": "Only jobs with this metadata, given as metadata.<key>=<value>, e.g. metadata.customer_id=42", "schema": object{"type": "object", "additionalProperties": object{"type": "string"}}},
+			},
+			"responses": object{
+				"200": object{"description": "A page of jobs", "content": jsonContent(ref(jobsPage{}))},
+				"400": errorResponse("Invalid limit or cursor"),
+			},
+		}, "post": object{
+			"summary":     "Queue a transcription of an uploaded file or an audio URL, or schedule it for run_at",
+			"operationId": "submitJob",
+			"parameters":  append(append([]object{}, jobOptions...), queryParam("run_at", "string", "RFC 3339 time to defer the job until, e.g. off-peak hours; needs --schedule-dir, and an encryption key with download_headers"), idempotencyKey),
+			"requestBody": object{"required": true, "content": object{
+				"multipart/form-data": object{"schema": object{
+					"type":       "object",
+					"required":   []string{"file"},
+					"properties": object{"file": object{"type": "string", "format": "binary"}},
+				}},
+				"application/json": object{"schema": ref(jobRequest{})},
+			}},
+			"responses": merge(object{
+				"200": object{"description": "The job of an earlier submission with the same Idempotency-Key", "content": jsonContent(ref(Job{}))},
+				"202": object{"description": "The pending job, or the scheduled one with a run_at", "content": jsonContent(ref(Job{}))},
+			}, rejected),
+		}},
+		"/v1/jobs/{id}": object{"get": object{
+			"summary":     "Get a job with its transcript once completed",
+			"operationId": "getJob",
+			"parameters":  []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}, ifNoneMatch},
+			"responses": object{
+				"200": object{"description": "The job, with an ETag", "content": jsonContent(ref(Job{}))},
+				"304": object{"description": "The job didn't change since the ETag in If-None-Match"},
+				"404": errorResponse("Job not found"),
+			},
+		}, "delete": object{
+			"summary":     "Cancel a queued or running job, aborting its download or transcription; a finished job is deleted with its transcript and audio instead, recorded in the audit log",
+			"operationId": "cancelOrDeleteJob",
+			"parameters":  []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}},
+			"responses": object{
+				"200": object{"description": "The cancelled job, or the completed one if it finished first", "content": jsonContent(ref(Job{}))},
+				"204": object{"description": "Deleted"},
+				"404": errorResponse("Job not found"),
+			},
+		}},
+		"/v1/jobs/{id}/captioned": object{"get": object{
+			"summary":     "Get the uploaded video with the transcript burned in as subtitles, encoded by ffmpeg on request",
+			"operationId": "getCaptionedVideo",
+			"parameters":  []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}},
+			"responses": object{
+				"200": object{"description": "The captioned video", "content": object{"video/mp4": object{"schema": object{"type": "string", "format": "binary"}}}},
+				"404": errorResponse("Job not found"),
+				"409": errorResponse("Job has no transcript yet, no longer keeps its upload or it isn't a video"),
+				"500": errorResponse("ffmpeg failed"),
+			},
+		}},
+		"/v1/jobs/{id}/events": object{"get": object{
+			"summary":     "Stream the job's progress as server-sent events: a progress event (JobProgress) whenever it changes, then a done event with the finished job",
+			"operationId": "streamJobProgress",
+			"parameters":  []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}},
+			"responses": object{
+				"200": object{"description": "The event stream", "content": object{"text/event-stream": object{"schema": object{"oneOf": []object{ref(JobProgress{}), ref(Job{})}}}}},
+				"404": errorResponse("Job not found"),
+			},
+		}},
+		"/v1/audio/detect-language": object{"post": object{
+			"summary":     "Detect the language of an uploaded file or an audio URL from its first 30 seconds, without a full transcription",
+			"operationId": "detectLanguage",
+			"requestBody": object{"required": true, "content": object{
+				"multipart/form-data": object{"schema": object{
+					"type":       "object",
+					"required":   []string{"file"},
+					"properties": object{"file": object{"type": "string", "format": "binary"}},
+				}},
+				"application/json": object{"schema": object{
+					"type":     "object",
+					"required": []string{"url"},
+					"properties": object{
+						"url":              object{"type": "string"},
+						"download_headers": object{"type": "object", "additionalProperties": object{"type": "string"}},
+					},
+				}},
+			}},
+			"responses": merge(rejected, object{
+				"200": object{"description": "The detected language, with its probability if the backend reports one", "content": jsonContent(ref(detectedLanguage{}))},
+				"400": errorResponse("Missing file or url"),
+				"502": errorResponse("Download or backend failed"),
+			}),
+		}},
+		"/v1/uploads": object{"post": object{
+			"summary":     "Start a multipart upload of a big file, sent in parts with separate requests",
+			"operationId": "startUpload",
+			"requestBody": object{"required": true, "content": object{"application/json": object{"schema": object{
+				"type":       "object",
+				"required":   []string{"filename"},
+				"properties": object{"filename": object{"type": "string"}},
+			}}}},
+			"responses": object{
+				"201": object{"description": "The upload, with the ID its parts are uploaded to", "content": jsonContent(ref(multipartUpload{}))},
+				"400": errorResponse("Missing filename"),
+				"503": errorResponse("Too many uploads in progress, or the server is draining, read-only, in maintenance or low on memory"),
+			},
+		}},
+		"/v1/uploads/{id}": object{"get": object{
+			"summary":     "Get a multipart upload with the parts uploaded so far",
+			"operationId": "getUpload",
+			"parameters":  []object{uploadID},
+			"responses": object{
+				"200": object{"description": "The upload", "content": jsonContent(ref(multipartUpload{}))},
+				"404": errorResponse("Upload not found"),
+			},
+		}, "delete": object{
+			"summary":     "Abort a multipart upload, removing its parts",
+			"operationId": "abortUpload",
+			"parameters":  []object{uploadID},
+			"responses": object{
+				"204": object{"description": "Aborted"},
+				"404": errorResponse("Upload not found"),
+			},
+		}},
+		"/v1/uploads/{id}/parts/{number}": object{"put": object{
+			"summary":     "Upload a part, replacing an earlier upload of the same part",
+			"operationId": "uploadPart",
+			"parameters": []object{
+				uploadID,
+				{"name": "number", "in": "path", "required": true, "schema": object{"type": "integer", "minimum": 1, "maximum": maxUploadParts}},
+				{"name": "Content-MD5", "in": "header", "description": "Base64 MD5 of the part, checked if given", "schema": object{"type": "string"}},
+			},
+			"requestBody": object{"required": true, "content": object{"application/octet-stream": object{"schema": object{"type": "string", "format": "binary"}}}},
+			"responses": object{
+				"200": object{"description": "The part, with its ETag", "content": jsonContent(ref(uploadPart{}))},
+				"400": errorResponse("Invalid part number or Content-MD5 mismatch"),
+				"404": errorResponse("Upload not found"),
+				"413": errorResponse("The parts together exceed the maximum file size"),
+			},
+		}},
+		"/v1/uploads/{id}/complete": object{"post": object{
+			"summary":     "Assemble the parts of a multipart upload in order and queue the transcription, or schedule it for run_at",
+			"operationId": "completeUpload",
+			"parameters":  append(append([]object{uploadID}, jobOptions...), queryParam("run_at", "string", "RFC 3339 time to defer the job until; needs --schedule-dir"), idempotencyKey),
+			"requestBody": object{"content": object{"application/json": object{"schema": object{
+				"type":       "object",
+				"properties": object{"parts": object{"type": "array", "items": ref(uploadPart{}), "description": "If given, must list the uploaded parts"}},
+			}}}},
+			"responses": merge(rejected, object{
+				"200": object{"description": "The job of an earlier completion with the same Idempotency-Key", "content": jsonContent(ref(Job{}))},
+				"202": object{"description": "The pending job, or the scheduled one with a run_at", "content": jsonContent(ref(Job{}))},
+				"400": errorResponse("Invalid option, no parts or listed parts don't match"),
+				"404": errorResponse("Upload not found"),
+				"415": errorResponse("The assembled file isn't audio or video"),
+			}),
+		}},
+		"/v1/transcripts/{id}": object{"get": object{
+			"summary":     "Get the transcript of a job, or only the part between from and to",
+			"operationId": "getTranscript",
+			"parameters": []object{
+				{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}},
+				queryParam("from", "string", "Start of the part, as 00:10:00, seconds or a duration like 10m; segments overlapping it are included"),
+				queryParam("to", "string", "End of the part, in the same formats as from"),
+				queryParam("format", "string", "Export format instead of JSON: txt, srt, json, md, segments for the backend-independent SegmentsDocument schema..."),
+				queryParam("response_format", "string", "Same as format"),
+				ifNoneMatch,
+			},
+			"responses": object{
+				"200": object{"description": "The transcript, with an ETag", "content": jsonContent(object{"oneOf": []object{ref(Transcript{}), ref(segmentsDocument{})}})},
+				"304": object{"description": "The transcript didn't change since the ETag in If-None-Match"},
+				"400": errorResponse("Invalid time range or format"),
+				"404": errorResponse("Job not found"),
+				"409": errorResponse("Job has no transcript yet"),
+			},
+		}, "delete": deleteJob("deleteTranscript")},
+		"/healthz": object{"get": statusOperation("health", "Check that the transcription backend is reachable")},
+		"/livez":   object{"get": statusOperation("liveness", "Check that the server is running")},
+		"/readyz":  object{"get": statusOperation("readiness", "Check that the server accepts jobs")},
+		"/metrics": object{"get": object{
+			"summary":     "Prometheus metrics",
+			"operationId": "metrics",
+			"tags":        []string{"admin"},
+			"responses":   object{"200": object{"description": "Metrics in the Prometheus text format", "content": object{"text/plain": object{"schema": object{"type": "string"}}}}},
+		}},
+		"/version": object{"get": object{
+			"summary":     "Version, commit, build date and enabled features",
+			"operationId": "version",
+			"tags":        []string{"admin"},
+			"responses":   object{"200": object{"description": "Build info", "content": jsonContent(ref(BuildInfo{}))}},
+		}},
+		"/openapi.json": object{"get": object{
+			"summary":     "This document",
+			"operationId": "openAPI",
+			"responses":   object{"200": object{"description": "OpenAPI 3 document", "content": jsonContent(object{"type": "object"})}},
+		}},
+	}
+	securitySchemes := object{}
+	tenantPaths := []string{"/v1/chat/completions", "/v1/jobs", "/v1/jobs/{id}", "/v1/jobs/{id}/captioned", "/v1/jobs/{id}/events", "/v1/audio/detect-language",
+		"/v1/uploads", "/v1/uploads/{id}", "/v1/uploads/{id}/parts/{number}", "/v1/uploads/{id}/complete", "/v1/transcripts/{id}"}
+	if cfg.APIKeysFile != "" {
+		securitySchemes["apiKey"] = object{"type": "apiKey", "in": "header", "name": "X-API-Key"}
+		for _, path := range tenantPaths {
+			for method, operation := range paths[path].(object) {
+				operation := operation.(object)
+				operation["security"] = []object{{"apiKey": []string{}}}
+				operation["responses"].(object)["401"] = errorResponse("Missing or invalid API key")
+				if method == "post" && path != "/v1/audio/detect-language" && path != "/v1/uploads" {
+					operation["responses"].(object)["402"] = errorResponse("Monthly quota of the API key used up; retry after the Retry-After header")
+				}
+			}
+		}
+	} else if cfg.TenantHeader != "" && cfg.OIDCIssuer == "" {
+		tenant := object{"name": cfg.TenantHeader, "in": "header", "description": "Tenant the jobs belong to", "schema": object{"type": "string"}}
+		for _, path := range tenantPaths {
+			for _, operation := range paths[path].(object) {
+				operation := operation.(object)
+				parameters, _ := operation["parameters"].([]object)
+				operation["parameters"] = append(append([]object{}, parameters...), tenant)
+			}
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		securitySchemes["oidc"] = object{"type": "openIdConnect", "openIdConnectUrl": strings.TrimSuffix(cfg.OIDCIssuer, "/") + "/.well-known/openid-configuration"}
+		for _, path := range tenantPaths {
+			for _, operation := range paths[path].(object) {
+				operation := operation.(object)
+				security, _ := operation["security"].([]object)
+				operation["security"] = append(security, object{"oidc": []string{}})
+				operation["responses"].(object)["401"] = errorResponse("Missing or invalid access token or API key")
+				operation["responses"].(object)["403"] = errorResponse("The user lacks the role needed: uploader to submit, uploader or reviewer to read jobs, reviewer to list them, admin to delete them")
+			}
+		}
+	}
+	if cfg.PublicURL != "" {
+		paths["/v1/results/{id}"] = object{"get": object{
+			"summary":     "Get a job through a signed link from a webhook, email or broker result; no API key needed",
+			"operationId": "getResult",
+			"parameters": []object{
+				{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}},
+				queryParam("expires", "integer", "Expiry of the link as a Unix time"),
+				queryParam("sig", "string", "Signature of the link"),
+				queryParam("format", "string", "Export format of the transcript instead of the job as JSON: txt, srt, json, md..."),
+				ifNoneMatch,
+			},
+			"responses": object{
+				"304": object{"description": "The result didn't change since the ETag in If-None-Match"},
+				"200": object{"description": "The job, or the transcript in the export format", "content": jsonContent(ref(Job{}))},
+				"403": errorResponse("Invalid signature"),
+				"404": errorResponse("Job not found"),
+				"410": errorResponse("Link expired"),
+			},
+		}}
+	}
+	var admin []object
+	if cfg.AdminToken != "" {
+		securitySchemes["adminToken"] = object{"type": "http", "scheme": "bearer"}
+		admin = append(admin, object{"adminToken": []string{}})
+	}
+	if cfg.OIDCIssuer != "" {
+		admin = append(admin, object{"oidc": []string{}})
+	}
+	unauthorized := errorResponse("Missing or invalid admin token")
+	if len(admin) > 0 {
+		paths["/drain"] = object{"post": object{
+			"summary":     "Stop accepting jobs and wait for the running ones to finish",
+			"operationId": "drain",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"parameters":  []object{queryParam("wait", "boolean", "Wait for running jobs (default true)")},
+			"responses": object{
+				"200": object{"description": "Drained or still draining", "content": jsonContent(object{"type": "object"})},
+				"401": unauthorized,
+			},
+		}}
+		paths["/admin/usage"] = object{"get": object{
+			"summary":     "Transcribed minutes, bytes and requests per API key",
+			"operationId": "usage",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"parameters":  []object{queryParam("format", "string", "json (default) or csv"), queryParam("tenant", "string", "Only the usage of this tenant")},
+			"responses": object{
+				"200": object{"description": "The usage since the agent started", "content": merge(
+					jsonContent(object{"type": "object", "properties": object{
+						"since": object{"type": "string", "format": "date-time"},
+						"until": object{"type": "string", "format": "date-time"},
+						"keys":  object{"type": "array", "items": ref(KeyUsage{})},
+					}}),
+					object{"text/csv": object{"schema": object{"type": "string"}}},
+				)},
+				"401": unauthorized,
+			},
+		}}
+		paths["/admin/erasure"] = object{"post": object{
+			"summary":     "Delete all finished jobs matching a filter, e.g. everything of a tenant, mentioning a person or with a metadata value; recorded in the audit log",
+			"operationId": "erase",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"requestBody": object{"required": true, "content": jsonContent(ref(ErasureFilter{}))},
+			"responses": object{
+				"200": object{"description": "The IDs of the jobs deleted and of those skipped as still queued or running, or with dry_run those matched", "content": jsonContent(object{"type": "object", "properties": object{
+					"deleted": object{"type": "array", "items": object{"type": "string"}},
+					"skipped": object{"type": "array", "items": object{"type": "string"}},
+					"matched": object{"type": "array", "items": object{"type": "string"}},
+				}})},
+				"400": errorResponse("Invalid request"),
+				"401": unauthorized,
+			},
+		}}
+		maintenance := object{"description": "The maintenance mode", "content": jsonContent(ref(Maintenance{}))}
+		paths["/admin/maintenance"] = object{
+			"get": object{
+				"summary":     "Whether the agent is in maintenance mode",
+				"operationId": "getMaintenance",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"responses":   object{"200": maintenance, "401": unauthorized},
+			},
+			"post": object{
+				"summary":     "Put the agent into maintenance mode: new jobs are rejected with the message, jobs and transcripts are still served",
+				"operationId": "startMaintenance",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"requestBody": object{"content": jsonContent(object{"type": "object", "properties": object{
+					"message": object{"type": "string", "description": "Shown to rejected clients"},
+					"until":   object{"type": "string", "format": "date-time", "description": "When the maintenance is expected to be over, sent as Retry-After; it doesn't end it"},
+				}})},
+				"responses": object{"200": maintenance, "400": errorResponse("Invalid request"), "401": unauthorized},
+			},
+			"delete": object{
+				"summary":     "End the maintenance mode",
+				"operationId": "endMaintenance",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"responses":   object{"200": maintenance, "401": unauthorized},
+			},
+		}
+		queuedIDs := func(description string) object {
+			return object{"description": description, "content": jsonContent(object{"type": "object", "properties": object{
+				"cancelled": object{"type": "array", "items": object{"type": "string"}},
+				"moved":     object{"type": "array", "items": object{"type": "string"}},
+				"matched":   object{"type": "array", "items": object{"type": "string"}},
+			}})}
+		}
+		paths["/admin/queue"] = object{"get": object{
+			"summary":     "List the jobs waiting for a worker, in the order they're picked up",
+			"operationId": "listQueue",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"parameters":  []object{queryParam("tenant", "string", "Only jobs of this tenant"), queryParam("source", "string", "Only jobs from this source"), queryParam("priority", "string", "Only jobs of this priority")},
+			"responses": object{
+				"200": object{"description": "The queued jobs", "content": jsonContent(object{"type": "object", "properties": object{
+					"depth":     object{"type": "integer"},
+					"capacity":  object{"type": "integer"},
+					"busy":      object{"type": "integer", "description": "Workers processing a job"},
+					"in_flight": object{"type": "integer", "description": "Jobs queued or running"},
+					"jobs":      object{"type": "array", "items": ref(QueuedJob{})},
+				}})},
+				"400": errorResponse("Invalid request"),
+				"401": unauthorized,
+			},
+		}}
+		paths["/admin/queue/cancel"] = object{"post": object{
+			"summary":     "Cancel the queued jobs matching a filter, or purge the queue with all; running jobs aren't affected; recorded in the audit log",
+			"operationId": "cancelQueued",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"requestBody": object{"required": true, "content": jsonContent(ref(QueueFilter{}))},
+			"responses": object{
+				"200": queuedIDs("The IDs of the jobs cancelled, or with dry_run those matched"),
+				"400": errorResponse("Invalid request"),
+				"401": unauthorized,
+			},
+		}}
+		paths["/admin/queue/reprioritize"] = object{"post": object{
+			"summary":     "Move the queued jobs matching a filter to the end of another priority's queue",
+			"operationId": "reprioritizeQueued",
+			"tags":        []string{"admin"},
+			"security":    admin,
+			"requestBody": object{"required": true, "content": jsonContent(object{"allOf": []object{
+				ref(QueueFilter{}),
+				{"type": "object", "required": []string{"to"}, "properties": object{"to": object{"type": "string", "enum": priorities}}},
+			}})},
+			"responses": object{
+				"200": queuedIDs("The IDs of the jobs moved, or with dry_run those matched"),
+				"400": errorResponse("Invalid request"),
+				"401": unauthorized,
+			},
+		}}
+	}
+	if cfg.ModelsDir != "" {
+		nameParam := []object{{"name": "name", "in": "path", "required": true, "schema": object{"type": "string"}}}
+		paths["/admin/models"] = object{
+			"get": object{
+				"summary":     "List the model files and downloads",
+				"operationId": "listModels",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"responses": object{
+					"200": object{"description": "The models", "content": jsonContent(object{"type": "object", "properties": object{"models": object{"type": "array", "items": ref(Model{})}}})},
+					"401": unauthorized,
+				},
+			},
+			"post": object{
+				"summary":     "Start downloading a model; poll it for the progress",
+				"operationId": "downloadModel",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"requestBody": object{"required": true, "content": jsonContent(ref(modelRequest{}))},
+				"responses": object{
+					"202": object{"description": "The download", "content": jsonContent(ref(Model{}))},
+					"400": errorResponse("Invalid request"),
+					"401": unauthorized,
+					"409": errorResponse("Model exists or is being downloaded"),
+				},
+			},
+		}
+		paths["/admin/models/{name}"] = object{
+			"get": object{
+				"summary":     "Get a model or the progress of its download",
+				"operationId": "getModel",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"parameters":  nameParam,
+				"responses": object{
+					"200": object{"description": "The model", "content": jsonContent(ref(Model{}))},
+					"401": unauthorized,
+					"404": errorResponse("Model not found"),
+				},
+			},
+			"delete": object{
+				"summary":     "Delete a model or cancel its download",
+				"operationId": "deleteModel",
+				"tags":        []string{"admin"},
+				"security":    admin,
+				"parameters":  nameParam,
+				"responses": object{
+					"204": object{"description": "Deleted"},
+					"401": unauthorized,
+					"404": errorResponse("Model not found"),
+				},
+			},
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		for path, item := range paths {
+			if strings.HasPrefix(path, "/admin/") {
+				for _, operation := range item.(object) {
+					operation.(object)["responses"].(object)["403"] = errorResponse("The user lacks the admin role")
+				}
+			}
+		}
+	}
+	if cfg.ZoomWebhookSecret != "" {
+		paths["/v1/webhooks/zoom"] = webhookOperation("zoomWebhook", "Zoom recording.completed webhook")
+	}
+	if cfg.MeetWebhookSecret != "" {
+		paths["/v1/webhooks/meet"] = webhookOperation("meetWebhook", "Google Meet recording webhook")
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "whisper-transcribe-agent",
+			"description": "Transcription jobs on top of an OpenAI-compatible whisper backend.",
+			"version":     "1",
+		},
+		"paths":      paths,
+		"components": object{"schemas": schemas, "securitySchemes": securitySchemes},
+	}
+}
+
+// apiError documents the body of error responses.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request, cfg Config) {
+	writeJSON(w, http.StatusOK, openAPISpec(cfg))
+}
+
+func jsonContent(schema object) object {
+	return object{"application/json": object{"schema": schema}}
+}
+
+func queryParam(name, kind, description string) object {
+	return object{"name": name, "in": "query", "description": description, "schema": object{"type": kind}}
+}
+
+func merge(a, b object) object {
+	merged := object{}
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+func statusOperation(id, summary string) object {
+	return object{
+		"summary":     summary,
+		"operationId": id,
+		"tags":        []string{"health"},
+		"responses": object{
+			"200": object{"description": "OK", "content": jsonContent(object{"type": "object"})},
+			"503": object{"description": "Not OK", "content": jsonContent(object{"type": "object"})},
+		},
+	}
+}
+
+func webhookOperation(id, summary string) object {
+	return object{"post": object{
+		"summary":     summary,
+		"operationId": id,
+		"tags":        []string{"webhooks"},
+		"requestBody": object{"required": true, "content": jsonContent(object{"type": "object"})},
+		"responses":   object{"200": object{"description": "Accepted"}, "401": object{"description": "Invalid signature or token"}},
+	}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf generates the JSON schema of t from its json tags. Named structs go
+// into schemas and are referenced.
+func schemaOf(t reflect.Type, schemas object) object {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // placeholder, for recursive types
+			properties := object{}
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				property, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+				if property == "-" || !field.IsExported() {
+					continue
+				}
+				if property == "" {
+					property = field.Name
+				}
+				properties[property] = schemaOf(field.Type, schemas)
+			}
+			schemas[name] = object{"type": "object", "properties": properties}
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return object{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice:
+		return object{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Bool:
+		return object{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return object{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return object{"type": "number"}
+	case t.Kind() == reflect.String:
+		return object{"type": "string"}
+	}
+	return object{}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	opsAlertInterval = 30 * time.Second
+	// opsAlertMinJobs is how many transcriptions the window needs before the
+	// error rate means anything; one failure of the first job isn't an outage.
+	opsAlertMinJobs = 5
+)
+
+// pagerDutyEventsURL is PagerDuty's Events API v2.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// opsAlert is POSTed to --ops-alert-webhook-url when a threshold is crossed,
+// with status "firing", and again with "resolved" once it's back below.
+type opsAlert struct {
+	Alert     string    `json:"alert"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+}
+
+// opsRule is a threshold checked every opsAlertInterval. check returns the
+// current value and whether it's over the threshold.
+type opsRule struct {
+	name      string
+	threshold float64
+	check     func() (float64, bool)
+	message   func(value float64) string
+	resolved  string
+	firing    bool
+}
+
+// OpsAlerts watches the error rate, the queue depth and the backend, and
+// alerts a webhook, Slack and/or PagerDuty when they cross the configured
+// thresholds, for deployments without Prometheus and Alertmanager. An alert
+// is sent once when it starts firing and once when it resolves.
+type OpsAlerts struct {
+	pool     *WorkerPool
+	cfg      Config
+	instance string
+	rules    []*opsRule
+
+	mu          sync.Mutex
+	outcomes    []opsOutcome
+	backendDown time.Time
+}
+
+type opsOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// NewOpsAlerts returns nil unless a threshold and somewhere to send alerts
+// are configured.
+func NewOpsAlerts(pool *WorkerPool, cfg Config) *OpsAlerts {
+	if cfg.OpsAlertWebhookURL == "" && cfg.OpsAlertSlackURL == "" && cfg.OpsAlertPagerDutyKey == "" {
+		return nil
+	}
+	a := &OpsAlerts{pool: pool, cfg: cfg, instance: cfg.PublicURL}
+	if a.instance == "" {
+		a.instance, _ = os.Hostname()
+	}
+	if cfg.AlertErrorRate > 0 {
+		a.rules = append(a.rules, &opsRule{
+			name:      "error_rate",
+			threshold: cfg.AlertErrorRate,
+			check:     a.errorRate,
+			message: func(value float64) string {
+				return fmt.Sprintf("%.0f%% of transcriptions failed in the last %s", value*100, cfg.AlertWindow)
+			},
+			resolved: fmt.Sprintf("Error rate is back below %.0f%%", cfg.AlertErrorRate*100),
+		})
+	}
+	if cfg.AlertQueueDepth > 0 {
+		a.rules = append(a.rules, &opsRule{
+			name:      "queue_depth",
+			threshold: float64(cfg.AlertQueueDepth),
+			check: func() (float64, bool) {
+				depth := pool.QueueDepth()
+				return float64(depth), depth >= cfg.AlertQueueDepth
+			},
+			message: func(value float64) string {
+				return fmt.Sprintf("%.0f jobs are waiting for a worker", value)
+			},
+			resolved: fmt.Sprintf("Queue is back below %d jobs", cfg.AlertQueueDepth),
+		})
+	}
+	if cfg.AlertBackendDown > 0 {
+		a.rules = append(a.rules, &opsRule{
+			name:      "backend_down",
+			threshold: cfg.AlertBackendDown.Seconds(),
+			check:     a.backendDownFor,
+			message: func(value float64) string {
+				return fmt.Sprintf("Backend %s has been down for %s", cfg.WhisperURL, time.Duration(value)*time.Second)
+			},
+			resolved: fmt.Sprintf("Backend %s is back up", cfg.WhisperURL),
+		})
+	}
+	if len(a.rules) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Record counts a transcription towards the error rate.
+func (a *OpsAlerts) Record(failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.outcomes = append(a.outcomes, opsOutcome{at: time.Now(), failed: failed})
+}
+
+func (a *OpsAlerts) errorRate() (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	since := time.Now().Add(-a.cfg.AlertWindow)
+	kept := a.outcomes[:0]
+	failed := 0
+	for _, outcome := range a.outcomes {
+		if outcome.at.After(since) {
+			kept = append(kept, outcome)
+			if outcome.failed {
+				failed++
+			}
+		}
+	}
+	a.outcomes = kept
+	if len(kept) < opsAlertMinJobs {
+		return 0, false
+	}
+	rate := float64(failed) / float64(len(kept))
+	return rate, rate >= a.cfg.AlertErrorRate
+}
+
+func (a *OpsAlerts) backendDownFor() (float64, bool) {
+	if err := checkBackend(a.cfg.WhisperURL); err != nil {
+		if a.backendDown.IsZero() {
+			a.backendDown = time.Now()
+		}
+		down := time.Since(a.backendDown).Round(time.Second)
+		return down.Seconds(), down >= a.cfg.AlertBackendDown
+	}
+	a.backendDown = time.Time{}
+	return 0, false
+}
+
+// Run checks the rules until the process exits.
+func (a *OpsAlerts) Run() {
+	for range time.Tick(opsAlertInterval) {
+		for _, rule := range a.rules {
+			value, firing := rule.check()
+			if firing == rule.firing {
+				continue
+			}
+			rule.firing = firing
+			alert := opsAlert{Alert: rule.name, Status: "firing", Value: value, Threshold: rule.threshold, Instance: a.instance, Time: time.Now().UTC()}
+			alert.Message = rule.message(value)
+			if !firing {
+				alert.Status = "resolved"
+				alert.Message = rule.resolved
+			}
+			a.send(alert)
+		}
+	}
+}
+
+// send delivers the alert to every configured target. Failures are logged;
+// the alert is sent again on the next change.
+func (a *OpsAlerts) send(alert opsAlert) {
+	log.Printf("Ops alert %s %s: %s", alert.Alert, alert.Status, alert.Message)
+	if a.cfg.OpsAlertWebhookURL != "" {
+		if err := postJSON(a.cfg.OpsAlertWebhookURL, alert); err != nil {
+			log.Printf("Ops alert %s failed: %v", alert.Alert, err)
+		}
+	}
+	if a.cfg.OpsAlertSlackURL != "" {
+		icon := ":rotating_light:"
+		if alert.Status == "resolved" {
+			icon = ":white_check_mark:"
+		}
+		text := fmt.Sprintf("%s *%s* on %s: %s", icon, alert.Alert, alert.Instance, alert.Message)
+		if err := postJSON(a.cfg.OpsAlertSlackURL, map[string]string{"text": text}); err != nil {
+			log.Printf("Slack ops alert %s failed: %v", alert.Alert, err)
+		}
+	}
+	if a.cfg.OpsAlertPagerDutyKey != "" {
+		action := "trigger"
+		if alert.Status == "resolved" {
+			action = "resolve"
+		}
+		event := map[string]interface{}{
+			"routing_key":  a.cfg.OpsAlertPagerDutyKey,
+			"event_action": action,
+			"dedup_key":    "whisper-transcribe-agent/" + alert.Instance + "/" + alert.Alert,
+			"payload": map[string]interface{}{
+				"summary":        alert.Message,
+				"source":         alert.Instance,
+				"severity":       "error",
+				"component":      "whisper-transcribe-agent",
+				"custom_details": alert,
+			},
+		}
+		if err := postJSON(pagerDutyEventsURL, event); err != nil {
+			log.Printf("PagerDuty ops alert %s failed: %v", alert.Alert, err)
+		}
+	}
+}
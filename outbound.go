@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// outboundDialer connects over one IP family and from one source address if
+// they're configured, for hosts where a destination is only reachable over
+// a specific VLAN of a dual-stack network.
+type outboundDialer struct {
+	net.Dialer
+	family string
+}
+
+// newOutboundDialer returns a dialer for the family, "4", "6" or "" for both,
+// bound to bind, a source IP, the name of an interface to take the source
+// address from, or "" for the system's choice.
+func newOutboundDialer(family, bind string) (*outboundDialer, error) {
+	if family != "" && family != "4" && family != "6" {
+		return nil, errors.Errorf("IP family must be 4 or 6, not %q", family)
+	}
+	dialer := &outboundDialer{Dialer: net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, family: family}
+	if bind == "" {
+		return dialer, nil
+	}
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		var err error
+		if ip, err = interfaceAddress(bind, family); err != nil {
+			return nil, err
+		}
+	}
+	if family == "4" && ip.To4() == nil || family == "6" && ip.To4() != nil {
+		return nil, errors.Errorf("source address %s isn't IPv%s", ip, family)
+	}
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	return dialer, nil
+}
+
+// interfaceAddress returns the first address of the interface in the family,
+// preferring IPv4 if either will do. Link-local IPv6 addresses are skipped,
+// since they can't reach other networks.
+func interfaceAddress(name, family string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bind address %q is neither an IP nor an interface", name)
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var ipv6 net.IP
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil && family != "6" {
+			return ipNet.IP, nil
+		}
+		if ipNet.IP.To4() == nil && family != "4" && ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, errors.Errorf("interface %s has no usable address", name)
+	}
+	return ipv6, nil
+}
+
+// DialContext dials over the dialer's family: "tcp" becomes "tcp4" or "tcp6".
+func (d *outboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network == "tcp" || network == "udp" {
+		network += d.family
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPipeline is the order jobs go through unless --pipeline says
+// otherwise. Redaction comes before anything leaves for the LLM, DeepL or
+// webhooks.
+const defaultPipeline = "transcribe,diarize,redact,punctuate,keywords,profanity,chapters,sentiment,entities,summarize,translate"
+
+// pipelineStage post-processes a transcript. Stages that depend on
+// configuration (redact, diarize...) do nothing unless it's set, and stages
+// that depend on the request (summarize, chapters...) do nothing unless it
+// asks for them.
+type pipelineStage func(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, arg string)
+
+var pipelineStages = map[string]pipelineStage{
+	"diarize":   diarizeStage,
+	"punctuate": punctuateStage,
+	"redact":    redactStage,
+	"keywords":  keywordsStage,
+	"profanity": profanityStage,
+	"chapters":  chaptersStage,
+	"sentiment": sentimentStage,
+	"entities":  entitiesStage,
+	"summarize": summarizeStage,
+	"translate": translateStage,
+	"webhook":   webhookStage,
+	"exec":      execStage,
+	"hook":      hookStage,
+	"wasm":      wasmStage,
+}
+
+// pipelineArgs names the argument of the steps that need one.
+var (
+	pipelineArgs        = map[string]string{"webhook": "a URL", "hook": "a URL", "exec": "a command", "wasm": "a module"}
+	pipelineArgExamples = map[string]string{"webhook": "https://...", "hook": "https://...", "exec": "/path/to/plugin", "wasm": "/path/to/transform.wasm"}
+)
+
+// pipelineSendsText lists the steps that may send the transcript to an LLM,
+// DeepL, alert webhooks or another service, which must see it redacted. exec
+// plugins can do anything with what they're given; wasm modules run without
+// network or filesystem access, so they stay off the list.
+var pipelineSendsText = map[string]bool{
+	"punctuate": true,
+	"keywords":  true,
+	"chapters":  true,
+	"sentiment": true,
+	"entities":  true,
+	"summarize": true,
+	"translate": true,
+	"webhook":   true,
+	"hook":      true,
+	"exec":      true,
+}
+
+func pipelineStageNames() []string {
+	names := make([]string, 0, len(pipelineStages))
+	for name := range pipelineStages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// audioStage prepares the audio before it's transcribed, returning new audio
+// or the same.
+type audioStage func(cfg Config, task *TranscriptionTask, audio *AudioBuffer, arg string) (*AudioBuffer, error)
+
+var audioStages = map[string]audioStage{
+	"transcode": transcodeStage,
+	"exec":      execAudioStage,
+	"hook":      hookAudioStage,
+}
+
+type pipelineStep struct {
+	Name  string
+	Arg   string
+	Stage pipelineStage
+}
+
+type audioStep struct {
+	Name  string
+	Arg   string
+	Stage audioStage
+}
+
+// Pipeline is the ordered list of steps a job goes through: audio steps
+// before "transcribe", then post-processing stages, e.g.
+// "transcode,transcribe,redact,summarize,webhook:https://example.com/hook".
+// Plugins run as exec:command or hook:url on either side.
+type Pipeline struct {
+	Audio []audioStep
+	Steps []pipelineStep
+}
+
+// parsePipeline parses comma-separated steps. Steps taking an argument are
+// written as "name:arg". If there's a redact step, the steps sending the
+// transcript out must come after it. wasm steps need wasmRuntime installed.
+func parsePipeline(spec, wasmRuntime string) (Pipeline, error) {
+	var pipeline Pipeline
+	steps := strings.Split(spec, ",")
+	unredacted := false
+	for _, step := range steps {
+		unredacted = unredacted || strings.TrimSpace(step) == "redact"
+	}
+	transcribed := false
+	for _, step := range steps {
+		step = strings.TrimSpace(step)
+		name, arg, _ := strings.Cut(step, ":")
+		switch {
+		case step == "":
+			continue
+		case name == "transcribe":
+			transcribed = true
+		case transcribed && name == "redact":
+			unredacted = false
+			pipeline.Steps = append(pipeline.Steps, pipelineStep{Name: name, Stage: pipelineStages[name]})
+		case transcribed && unredacted && pipelineSendsText[name]:
+			return pipeline, errors.Errorf("%s sends the transcript out and must come after redact", name)
+		case pipelineArgs[name] != "" && arg == "":
+			return pipeline, errors.Errorf("%s step needs %s, as in %s:%s", name, pipelineArgs[name], name, pipelineArgExamples[name])
+		case !transcribed && audioStages[name] != nil:
+			pipeline.Audio = append(pipeline.Audio, audioStep{Name: name, Arg: arg, Stage: audioStages[name]})
+		case !transcribed && pipelineStages[name] != nil:
+			return pipeline, errors.Errorf("%s must come after transcribe", name)
+		case transcribed && name == "wasm":
+			if err := checkWASMModule(arg); err != nil {
+				return pipeline, err
+			}
+			if _, err := exec.LookPath(wasmRuntime); err != nil {
+				return pipeline, errors.Wrapf(err, "wasm steps need the --wasm-runtime %s", wasmRuntime)
+			}
+			pipeline.Steps = append(pipeline.Steps, pipelineStep{Name: name, Arg: arg, Stage: pipelineStages[name]})
+		case transcribed && pipelineStages[name] != nil:
+			pipeline.Steps = append(pipeline.Steps, pipelineStep{Name: name, Arg: arg, Stage: pipelineStages[name]})
+		case transcribed && audioStages[name] != nil:
+			return pipeline, errors.Errorf("%s must come before transcribe", name)
+		default:
+			return pipeline, errors.Errorf("unknown pipeline step %q", name)
+		}
+	}
+	if !transcribed {
+		return pipeline, errors.New("pipeline has no transcribe step")
+	}
+	return pipeline, nil
+}
+
+// loadPipelines parses the default pipeline and the per-route ones in
+// routesFile, one per line as "route steps", where the route is the job
+// source (api, upload, telegram, kafka...).
+func loadPipelines(spec, routesFile, wasmRuntime string) (Pipeline, map[string]Pipeline, error) {
+	pipeline, err := parsePipeline(spec, wasmRuntime)
+	if err != nil {
+		return pipeline, nil, errors.Wrap(err, "--pipeline")
+	}
+	routes := map[string]Pipeline{}
+	if routesFile == "" {
+		return pipeline, routes, nil
+	}
+	file, err := os.Open(routesFile)
+	if err != nil {
+		return pipeline, nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		route, steps, ok := strings.Cut(text, " ")
+		if !ok {
+			return pipeline, nil, errors.Errorf("%s:%d: expected \"route steps\"", routesFile, line)
+		}
+		routes[route], err = parsePipeline(steps, wasmRuntime)
+		if err != nil {
+			return pipeline, nil, errors.Wrapf(err, "%s:%d", routesFile, line)
+		}
+	}
+	return pipeline, routes, errors.WithStack(scanner.Err())
+}
+
+// redacts tells whether the pipeline has a redact step.
+func (p Pipeline) redacts() bool {
+	for _, step := range p.Steps {
+		if step.Name == "redact" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPipelinesRedact makes sure that, with redaction configured, the
+// default pipeline and every route pipeline have a redact step, which would
+// otherwise never mask anything.
+func checkPipelinesRedact(pipeline Pipeline, routes map[string]Pipeline) error {
+	if !pipeline.redacts() {
+		return errors.New("--redact is set but --pipeline has no redact step")
+	}
+	for route, routePipeline := range routes {
+		if !routePipeline.redacts() {
+			return errors.Errorf("--redact is set but the %s pipeline has no redact step", route)
+		}
+	}
+	return nil
+}
+
+func transcodeStage(cfg Config, task *TranscriptionTask, audio *AudioBuffer, _ string) (*AudioBuffer, error) {
+	transcoded, err := transcodeAudio(cfg, audio)
+	if err == nil {
+		task.Filename = renameAudio(task.Filename, ".wav")
+	}
+	return transcoded, err
+}
+
+// transcodeAudio converts the audio to 16 kHz mono WAV, what whisper works
+// on internally, which makes uploads smaller and sidesteps codecs the backend
+// can't decode.
+func transcodeAudio(cfg Config, audio *AudioBuffer) (*AudioBuffer, error) {
+	input, release, err := audio.Input()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer release()
+	cmd := exec.Command(cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-i", input,
+		"-vn", "-ac", "1", "-ar", "16000", "-f", "wav", "pipe:1")
+	transcoded := cfg.newAudioBuffer()
+	var stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = transcoded, &stderr
+	if err := cmd.Run(); err != nil {
+		transcoded.Close()
+		return nil, errors.Wrapf(err, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return transcoded, nil
+}
+
+func diarizeStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if p.cfg.DiarizationURL == "" || transcript.hasSpeakers() {
+		return
+	}
+	if err := diarize(p.cfg, transcript, task.Filename, task.Audio.Reader()); err != nil {
+		log.Printf("Diarizing job %s failed: %v", task.JobID, err)
+	}
+}
+
+func punctuateStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if p.cfg.RestorePunctuation == "" {
+		return
+	}
+	if err := restorePunctuation(p.cfg, transcript); err != nil {
+		log.Printf("Restoring punctuation of job %s with the LLM failed, used rules instead: %v", task.JobID, err)
+	}
+}
+
+func redactStage(p *WorkerPool, _ *TranscriptionTask, transcript *Transcript, _ string) {
+	if p.redactor.Enabled() {
+		p.redactor.Redact(transcript)
+	}
+}
+
+func keywordsStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if !p.keywords.Enabled() {
+		return
+	}
+	if matches := p.keywords.Match(transcript); len(matches) > 0 {
+		transcript.Keywords = matches
+		job, _ := p.store.Get(task.JobID)
+		go p.keywords.Alert(job, matches)
+	}
+}
+
+func profanityStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if p.profanity == nil {
+		return
+	}
+	mode := task.Profanity
+	if mode == "" {
+		mode = p.cfg.ProfanityFilter
+	}
+	transcript.Profanity = p.profanity.Apply(transcript, mode)
+}
+
+func chaptersStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if !task.Chapters {
+		return
+	}
+	chapters, err := chapterize(p.cfg, transcript)
+	if err != nil {
+		log.Printf("Titling the chapters of job %s with the LLM failed: %v", task.JobID, err)
+	}
+	transcript.Chapters = chapters
+}
+
+func sentimentStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if !task.Sentiment {
+		return
+	}
+	transcript.Sentiment = analyzeSentiment(p.cfg, transcript)
+	if transcript.Sentiment.Error != "" {
+		log.Printf("Scoring the sentiment of job %s with the LLM failed, used the word list instead: %s", task.JobID, transcript.Sentiment.Error)
+	}
+}
+
+func entitiesStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if !task.Entities {
+		return
+	}
+	transcript.Entities = extractEntities(p.cfg, transcript)
+	if transcript.Entities.Error != "" {
+		log.Printf("Extracting the entities of job %s with the LLM failed, used rules instead: %s", task.JobID, transcript.Entities.Error)
+	}
+}
+
+func summarizeStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if !task.Summarize {
+		return
+	}
+	summary, err := summarize(p.cfg, transcript)
+	if err != nil {
+		log.Printf("Summarizing job %s failed: %v", task.JobID, err)
+		summary = &Summary{Error: err.Error()}
+	}
+	transcript.Summary = summary
+}
+
+func translateStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, _ string) {
+	if task.TranslateTo == "" {
+		return
+	}
+	translation, err := translate(p.cfg, transcript, task.TranslateTo)
+	if err != nil {
+		log.Printf("Translating job %s failed: %v", task.JobID, err)
+		translation = &Translation{Language: task.TranslateTo, Error: err.Error()}
+	}
+	transcript.Translation = translation
+}
+
+// webhookStage POSTs the transcript as it is at this point of the pipeline
+// to the URL given as the step's argument.
+func webhookStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, url string) {
+	job, _ := p.store.Get(task.JobID)
+	result := streamResult{JobID: job.ID, Status: JobCompleted, Filename: job.Filename, Text: transcript.Text, Transcript: transcript, ResultURL: p.resultURL(job.ID)}
+	if err := postJSON(url, result); err != nil {
+		log.Printf("Posting job %s to the pipeline webhook failed: %v", task.JobID, err)
+	}
+}
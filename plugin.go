@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// pluginTimeout bounds how long an exec or hook plugin may take.
+	pluginTimeout = 5 * time.Minute
+	// maxPluginTranscript bounds the transcript a hook may return.
+	maxPluginTranscript = 64 << 20
+)
+
+// Plugins extend the pipeline without forking the agent. Before transcribe
+// they get the audio and return audio; after it they get the transcript as
+// JSON and return the modified transcript. exec plugins are commands that
+// read stdin and write stdout, with the job in WHISPER_JOB_ID,
+// WHISPER_JOB_SOURCE and WHISPER_FILENAME; hook plugins are URLs that are
+// POSTed to, with the job in X-Job-ID, X-Job-Source and X-Filename headers.
+// A failing audio plugin fails the job; a failing transcript plugin leaves the
+// transcript as it was.
+
+func execStage(_ *WorkerPool, task *TranscriptionTask, transcript *Transcript, command string) {
+	runTranscriptPlugin(task, transcript, "exec", func(input []byte) ([]byte, error) {
+		return runExecPlugin(task, command, bytes.NewReader(input))
+	})
+}
+
+func hookStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, url string) {
+	runTranscriptPlugin(task, transcript, "hook", func(input []byte) ([]byte, error) {
+		return runHookPlugin(task, url, "application/json", bytes.NewReader(input), maxPluginTranscript)
+	})
+}
+
+func runTranscriptPlugin(task *TranscriptionTask, transcript *Transcript, kind string, run func(input []byte) ([]byte, error)) {
+	input, err := json.Marshal(transcript)
+	if err != nil {
+		log.Printf("Encoding job %s for the %s plugin failed: %v", task.JobID, kind, err)
+		return
+	}
+	output, err := run(input)
+	if err != nil {
+		log.Printf("The %s plugin failed on job %s, kept the transcript as it was: %v", kind, task.JobID, err)
+		return
+	}
+	var modified Transcript
+	if err := json.Unmarshal(output, &modified); err != nil {
+		log.Printf("The %s plugin returned an invalid transcript for job %s, kept it as it was: %v", kind, task.JobID, err)
+		return
+	}
+	*transcript = modified
+}
+
+func execAudioStage(cfg Config, task *TranscriptionTask, audio *AudioBuffer, command string) (*AudioBuffer, error) {
+	output, err := runExecPlugin(task, command, audio.Reader())
+	if err != nil {
+		return nil, err
+	}
+	return pluginAudio(cfg, task, output)
+}
+
+func hookAudioStage(cfg Config, task *TranscriptionTask, audio *AudioBuffer, url string) (*AudioBuffer, error) {
+	output, err := runHookPlugin(task, url, "application/octet-stream", audio.Reader(), cfg.MaxAudioSize+1)
+	if err != nil {
+		return nil, err
+	}
+	return pluginAudio(cfg, task, output)
+}
+
+// pluginAudio buffers the audio a plugin returned, renaming the task's file
+// if the plugin changed the format.
+func pluginAudio(cfg Config, task *TranscriptionTask, output []byte) (*AudioBuffer, error) {
+	if len(output) == 0 {
+		return nil, errors.New("plugin returned no audio")
+	}
+	if int64(len(output)) > cfg.MaxAudioSize {
+		return nil, errors.Errorf("plugin returned more than %d MB of audio", cfg.MaxAudioSize>>20)
+	}
+	if extension, ok := sniffAudioExtension(output); ok {
+		task.Filename = renameAudio(task.Filename, extension)
+	}
+	buffer := cfg.newAudioBuffer()
+	if _, err := buffer.Write(output); err != nil {
+		buffer.Close()
+		return nil, errors.WithStack(err)
+	}
+	return buffer, nil
+}
+
+func renameAudio(filename, extension string) string {
+	return strings.TrimSuffix(path.Base(filename), path.Ext(filename)) + extension
+}
+
+func runExecPlugin(task *TranscriptionTask, command string, input io.Reader) ([]byte, error) {
+	args := strings.Fields(command)
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"WHISPER_JOB_ID="+task.JobID,
+		"WHISPER_JOB_SOURCE="+task.Source,
+		"WHISPER_FILENAME="+task.Filename,
+	)
+	var stdout bytes.Buffer
+	var stderr strings.Builder
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = input, &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func runHookPlugin(task *TranscriptionTask, url, contentType string, input io.Reader, limit int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, input)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Job-ID", task.JobID)
+	req.Header.Set("X-Job-Source", task.Source)
+	req.Header.Set("X-Filename", task.Filename)
+	client := &http.Client{Timeout: pluginTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("hook returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errQueueFull = errors.New("transcription queue is full")
+	errDraining  = errors.New("server is draining")
+	errReadOnly  = errors.New("server is read-only; existing jobs and transcripts can still be read")
+)
+
+// TranscriptionTask is a unit of work for the pool. Either Audio is set, or
+// AudioURL is downloaded by the worker. The pool takes ownership of Audio
+// (keeping it for playback or closing it) only if OwnsAudio is set.
+type TranscriptionTask struct {
+	Filename     string
+	AudioURL     string
+	Audio        *AudioBuffer
+	OwnsAudio    bool
+	ContentType  string
+	WhisperURL   string
+	WhisperModel string
+	Summarize    bool
+	Chapters     bool
+	Sentiment    bool
+	Entities     bool
+	TranslateTo  string
+	Profanity    string
+	Vocabulary   []string
+	Prompt       string
+	Priority     string
+	Tenant       string
+	Owner        string
+	Metadata     map[string]string
+	// RunAt defers the job until then, see Scheduler.
+	RunAt *time.Time
+	// Ephemeral tasks get a job only they see (see JobStore.CreateEphemeral),
+	// aren't counted in usage or metrics and only go through the redact
+	// step, like a live session's partial transcripts.
+	Ephemeral bool
+	// DownloadHeaders are sent when fetching AudioURL, e.g. Authorization.
+	// They're never stored with the job; a scheduled one keeps them in
+	// --schedule-dir, encrypted, until it's queued.
+	DownloadHeaders map[string]string
+
+	Source     string
+	JobID      string
+	Transcript *Transcript
+	Err        error
+	Done       chan struct{}
+
+	// ctx is cancelled, with the reason as its cause, to abort the job.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// seq orders the tasks of a priority queue, size is that of Audio when
+	// submitted (-1 for AudioURL) and started when a worker took the task.
+	seq     uint64
+	size    int64
+	started time.Time
+}
+
+// WorkerPool runs transcriptions on a fixed number of workers fed from a
+// bounded queue, so HTTP handlers never talk to the backend directly and the
+// backend never sees more than Workers concurrent requests. The queue is split
+// by priority, sharing QueueSize between them.
+type WorkerPool struct {
+	store   *JobStore
+	metrics *Metrics
+	memory  *MemoryGuard
+	cfg     Config
+	queues  []chan *TranscriptionTask
+	// ready holds a token for every task queued, or more once queued tasks
+	// are cancelled, so workers know when to look at the queues.
+	ready chan struct{}
+
+	redactor   *Redactor
+	profanity  *ProfanityFilter
+	keywords   *KeywordSpotter
+	vocabulary []string
+	pipeline   Pipeline
+	routes     map[string]Pipeline
+	usage      *Usage
+	results    *ResultSigner
+	opsAlerts  *OpsAlerts
+	warmup     *Warmup
+	shadow     *Shadow
+	scheduler  *Scheduler
+
+	idempotency *Idempotency
+	downloads   *http.Client
+
+	mu          sync.Mutex
+	busy        int
+	inFlight    int
+	tasks       map[string]*TranscriptionTask
+	seq         uint64
+	speeds      *Speeds
+	draining    bool
+	maintenance Maintenance
+	avgDuration time.Duration
+}
+
+func NewWorkerPool(store *JobStore, metrics *Metrics, memory *MemoryGuard, cfg Config) *WorkerPool {
+	pool := &WorkerPool{
+		store:   store,
+		metrics: metrics,
+		memory:  memory,
+		cfg:     cfg,
+		tasks:   make(map[string]*TranscriptionTask),
+		speeds:  NewSpeeds(),
+	}
+	pool.ready = make(chan struct{}, cfg.QueueSize)
+	pool.idempotency = NewIdempotency(store, cfg.IdempotencyTTL)
+	pool.downloads = newDownloadClient(cfg, nil, nil)
+	for range priorities {
+		pool.queues = append(pool.queues, make(chan *TranscriptionTask, cfg.QueueSize))
+	}
+	pool.pipeline, _ = parsePipeline(defaultPipeline, "")
+
+	metrics.GaugeFunc("whisper_agent_queue_depth", "Number of jobs waiting for a worker.", func() float64 {
+		return float64(pool.QueueDepth())
+	})
+	for rank, priority := range priorities {
+		queue := pool.queues[rank]
+		metrics.GaugeFunc("whisper_agent_queue_depth_"+priority, "Number of "+priority+" priority jobs waiting for a worker.", func() float64 {
+			return float64(len(queue))
+		})
+	}
+	metrics.GaugeFunc("whisper_agent_queue_capacity", "Maximum number of jobs waiting for a worker.", func() float64 {
+		return float64(cfg.QueueSize)
+	})
+	metrics.GaugeFunc("whisper_agent_queue_saturation", "Fraction of the queue capacity in use (1 means new jobs are rejected).", func() float64 {
+		if cfg.QueueSize == 0 {
+			return 1
+		}
+		return float64(pool.QueueDepth()) / float64(cfg.QueueSize)
+	})
+	metrics.GaugeFunc("whisper_agent_workers_busy", "Number of workers currently processing a job.", func() float64 {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return float64(pool.busy)
+	})
+	metrics.GaugeFunc("whisper_agent_workers", "Number of workers.", func() float64 {
+		return float64(cfg.Workers)
+	})
+	metrics.Counter("whisper_agent_rejected_total", "Requests rejected without being queued, by reason.")
+	metrics.Counter("whisper_agent_transcriptions_total", "Transcriptions by backend, model and status (completed or failed).")
+	metrics.Histogram("whisper_agent_transcription_duration_seconds", "Time the backend took to transcribe a job, by backend and model.", transcriptionDurationBuckets)
+	metrics.Counter("whisper_agent_audio_seconds_total", "Seconds of audio transcribed, by backend and model.")
+	metrics.Counter("whisper_agent_idempotent_replays_total", "Submissions answered with the job of an earlier one with the same Idempotency-Key.")
+
+	for i := 0; i < cfg.Workers; i++ {
+		go pool.run()
+	}
+	return pool
+}
+
+// UseRedactor makes the pool mask personal data in transcripts before they're
+// stored or passed on to other services.
+func (p *WorkerPool) UseRedactor(redactor *Redactor) {
+	p.redactor = redactor
+}
+
+// UseProfanityFilter makes the pool filter transcripts in the task's
+// profanity mode, or --profanity-filter if the task doesn't say.
+func (p *WorkerPool) UseProfanityFilter(filter *ProfanityFilter) {
+	p.profanity = filter
+}
+
+// UseKeywordSpotter makes the pool alert on watch phrases in transcripts.
+func (p *WorkerPool) UseKeywordSpotter(spotter *KeywordSpotter) {
+	p.keywords = spotter
+}
+
+// UseVocabulary makes the pool prompt whisper with the deployment's terms.
+func (p *WorkerPool) UseVocabulary(terms []string) {
+	p.vocabulary = terms
+}
+
+// UsePipelines sets the pipeline jobs go through, and the ones for the job
+// sources in routes.
+func (p *WorkerPool) UsePipelines(pipeline Pipeline, routes map[string]Pipeline) {
+	p.pipeline, p.routes = pipeline, routes
+}
+
+// UseUsage makes the pool account finished jobs to their API keys.
+func (p *WorkerPool) UseUsage(usage *Usage) {
+	p.usage = usage
+}
+
+// UseResultSigner makes the pool link to results in what it sends out.
+func (p *WorkerPool) UseResultSigner(signer *ResultSigner) {
+	p.results = signer
+}
+
+// UseOpsAlerts makes the pool report transcriptions to the error rate alert.
+func (p *WorkerPool) UseOpsAlerts(alerts *OpsAlerts) {
+	p.opsAlerts = alerts
+}
+
+// UseWarmup makes the pool report itself not ready until the backend is warm.
+func (p *WorkerPool) UseWarmup(warmup *Warmup) {
+	p.warmup = warmup
+}
+
+// UseShadow makes the pool compare a sample of jobs to a shadow backend.
+func (p *WorkerPool) UseShadow(shadow *Shadow) {
+	p.shadow = shadow
+}
+
+// UseScheduler makes the pool hand tasks with a RunAt to the scheduler.
+func (p *WorkerPool) UseScheduler(scheduler *Scheduler) {
+	p.scheduler = scheduler
+}
+
+// UseDownloadCredentials has audio URLs fetched with the headers configured
+// for their host and the cookies of the session, if there is one.
+func (p *WorkerPool) UseDownloadCredentials(headers []downloadHeader, session *downloadSession) {
+	p.downloads = newDownloadClient(p.cfg, headers, session)
+}
+
+// resultURL returns a signed link to the job's result, or "" without
+// --public-url.
+func (p *WorkerPool) resultURL(jobID string) string {
+	if p.results == nil {
+		return ""
+	}
+	return p.results.URL(jobID)
+}
+
+// pipelineFor picks the pipeline of the job's tenant, routed as
+// "tenant:name", else of its source; sources with a suffix, like
+// "compare:large-v3", fall back to the route of their prefix.
+func (p *WorkerPool) pipelineFor(source, tenant string) Pipeline {
+	if pipeline, ok := p.routes["tenant:"+tenant]; ok && tenant != "" {
+		return pipeline
+	}
+	if pipeline, ok := p.routes[source]; ok {
+		return pipeline
+	}
+	prefix, _, _ := strings.Cut(source, ":")
+	if pipeline, ok := p.routes[prefix]; ok {
+		return pipeline
+	}
+	return p.pipeline
+}
+
+// Admit reports whether new work is accepted right now, so handlers can reject
+// an upload before reading its body. Rejections are counted in the metrics.
+func (p *WorkerPool) Admit() error {
+	if p.cfg.ReadOnly {
+		p.metrics.Inc("whisper_agent_rejected_total", "reason", "read_only")
+		return errReadOnly
+	}
+	if p.Draining() {
+		p.metrics.Inc("whisper_agent_rejected_total", "reason", "draining")
+		return errDraining
+	}
+	if maintenance := p.Maintenance(); maintenance.Enabled {
+		p.metrics.Inc("whisper_agent_rejected_total", "reason", "maintenance")
+		return &maintenanceError{maintenance}
+	}
+	if p.memory.Level() == memoryHard {
+		p.metrics.Inc("whisper_agent_rejected_total", "reason", "memory_pressure")
+		return errMemoryPressure
+	}
+	return nil
+}
+
+// Submit creates a pending job for the task and queues it behind the jobs of
+// the same or higher priority, or a scheduled one if the task has a RunAt. If
+// the queue is full, memory is above the hard limit, the pool is draining,
+// read-only or in maintenance or the task's API key is over its quota, no job
+// is created and the reason is returned. A task with a JobID is that of a
+// scheduled job whose time came, which keeps its ID.
+func (p *WorkerPool) Submit(source string, task *TranscriptionTask) (Job, error) {
+	if err := p.Admit(); err != nil {
+		return Job{}, err
+	}
+	if p.usage != nil && task.Tenant != "" {
+		if err := p.usage.CheckQuota(task.Tenant); err != nil {
+			p.metrics.Inc("whisper_agent_rejected_total", "reason", "quota")
+			return Job{}, err
+		}
+	}
+	if task.RunAt != nil {
+		if p.scheduler == nil {
+			return Job{}, errSchedulingDisabled
+		}
+		return p.scheduler.Schedule(source, task)
+	}
+	if task.WhisperURL == "" && task.WhisperModel == "" {
+		task.WhisperURL, task.WhisperModel = p.routeBackend()
+	}
+	if task.WhisperURL == "" {
+		task.WhisperURL = p.cfg.WhisperURL
+	}
+	if task.WhisperModel == "" {
+		task.WhisperModel = p.cfg.WhisperModel
+	}
+	task.Prompt = whisperPrompt(p.vocabulary, task.Vocabulary)
+	task.Source = source
+	if task.Priority == "" {
+		task.Priority = priorityNormal
+	}
+	task.Done = make(chan struct{})
+	task.ctx, task.cancel = context.WithCancelCause(context.Background())
+	task.size = -1
+	if task.Audio != nil {
+		task.size = task.Audio.Size()
+	}
+
+	// Checking the depth and queueing under the lock keeps concurrent
+	// submissions from overfilling the queues together.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.QueueDepth() >= p.cfg.QueueSize {
+		p.metrics.Inc("whisper_agent_rejected_total", "reason", "queue_full")
+		return Job{}, errQueueFull
+	}
+	var job Job
+	if task.JobID != "" {
+		var ok bool
+		if job, ok = p.store.Enqueue(task.JobID); !ok {
+			return Job{}, errNotScheduled
+		}
+	} else if task.Ephemeral {
+		job = p.store.CreateEphemeral(source, task.Filename, task.Tenant, task.Owner)
+		task.JobID = job.ID
+	} else {
+		job = p.store.Create(source, task.Filename, task.Priority, task.Tenant, task.Owner, task.Metadata)
+		task.JobID = job.ID
+	}
+	p.inFlight++
+	p.tasks[job.ID] = task
+	p.seq++
+	task.seq = p.seq
+	p.queues[priorityRank(task.Priority)] <- task
+	// A full ready means there is already a token for every queued task.
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (p *WorkerPool) QueueDepth() int {
+	depth := 0
+	for _, queue := range p.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// Drain stops the pool from admitting new jobs; queued and running jobs still
+// finish.
+func (p *WorkerPool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.draining {
+		log.Printf("Draining: no longer accepting new jobs, %d in flight", p.inFlight)
+	}
+	p.draining = true
+}
+
+func (p *WorkerPool) Draining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+// StartMaintenance rejects new jobs with the message until EndMaintenance.
+// Calling it again during maintenance changes the message and end.
+func (p *WorkerPool) StartMaintenance(message string, until *time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	since := p.maintenance.Since
+	if since == nil {
+		now := time.Now()
+		since = &now
+	}
+	p.maintenance = Maintenance{Enabled: true, Message: message, Since: since, Until: until}
+}
+
+// EndMaintenance accepts new jobs again, reporting whether the pool was in
+// maintenance.
+func (p *WorkerPool) EndMaintenance() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	enabled := p.maintenance.Enabled
+	p.maintenance = Maintenance{}
+	return enabled
+}
+
+func (p *WorkerPool) Maintenance() Maintenance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maintenance
+}
+
+// InFlight returns the number of jobs queued or running.
+func (p *WorkerPool) InFlight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight
+}
+
+// RetryAfter estimates how long until the queue has room again, based on the
+// average job duration so far.
+func (p *WorkerPool) RetryAfter() time.Duration {
+	p.mu.Lock()
+	avg := p.avgDuration
+	p.mu.Unlock()
+	if avg == 0 {
+		avg = 10 * time.Second
+	}
+	wait := time.Duration(math.Ceil(float64(avg) * float64(p.QueueDepth()+1) / float64(p.cfg.Workers) / float64(time.Second)))
+	return wait * time.Second
+}
+
+func (p *WorkerPool) run() {
+	for {
+		p.memory.WaitForHeadroom()
+		task := p.next()
+		started := task.started
+
+		p.process(task)
+
+		p.mu.Lock()
+		p.busy--
+		p.inFlight--
+		delete(p.tasks, task.JobID)
+		if p.avgDuration == 0 {
+			p.avgDuration = time.Since(started)
+		} else {
+			p.avgDuration = (p.avgDuration*4 + time.Since(started)) / 5
+		}
+		p.mu.Unlock()
+	}
+}
+
+// next takes the oldest task of the highest priority queued, waiting for one
+// if there's none, and marks it started. Taking it under the lock keeps the
+// task from being listed as queued, or cancelled as such, once a worker has
+// it. A token may be left over from a task cancelled while queued, so the
+// queues can be empty even so.
+func (p *WorkerPool) next() *TranscriptionTask {
+	for {
+		<-p.ready
+		p.mu.Lock()
+		for _, queue := range p.queues {
+			select {
+			case task := <-queue:
+				p.busy++
+				task.started = time.Now()
+				p.mu.Unlock()
+				return task
+			default:
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *WorkerPool) process(task *TranscriptionTask) {
+	defer close(task.Done)
+	defer task.cancel(nil)
+
+	if context.Cause(task.ctx) != nil {
+		task.Err = p.fail(task, errCancelled)
+		if task.OwnsAudio {
+			task.Audio.Close()
+		}
+		return
+	}
+	if task.Audio == nil {
+		p.store.Start(task.JobID)
+		audio, err := p.download(task.ctx, task.AudioURL, task.DownloadHeaders)
+		if err != nil {
+			task.Err = p.fail(task, errors.Wrap(err, "failed to download audio"))
+			p.recordUsage(task)
+			return
+		}
+		task.Audio = audio
+		task.OwnsAudio = true
+	}
+
+	// Only jobs on the primary backend are shadowed, not compare or canary
+	// ones, and only if the audio stays open until the shadow is done.
+	var compareShadow func(*Transcript, error)
+	if p.shadow != nil && task.OwnsAudio && task.WhisperURL == p.cfg.WhisperURL && task.WhisperModel == p.cfg.WhisperModel {
+		compareShadow = p.shadow.Start(task)
+	}
+
+	task.Transcript, task.Err = p.transcribe(task)
+	p.recordUsage(task)
+	if !task.OwnsAudio {
+		return
+	}
+	handOff := func(err error) {
+		if err == nil {
+			p.store.SetAudio(task.JobID, task.Audio, task.ContentType)
+		} else {
+			task.Audio.Close()
+		}
+	}
+	if compareShadow != nil {
+		transcript, err := task.Transcript, task.Err
+		go func() {
+			compareShadow(transcript, err)
+			handOff(err)
+		}()
+		return
+	}
+	handOff(task.Err)
+}
+
+// fail marks the task's job failed with err, or cancelled if the task was
+// cancelled, returning the error for the task.
+func (p *WorkerPool) fail(task *TranscriptionTask, err error) error {
+	if cause := context.Cause(task.ctx); cause != nil {
+		p.store.Cancel(task.JobID, cause.Error())
+		return errCancelled
+	}
+	p.store.Fail(task.JobID, err)
+	return err
+}
+
+func (p *WorkerPool) recordUsage(task *TranscriptionTask) {
+	if p.usage == nil || task.Ephemeral {
+		return
+	}
+	var bytes int64
+	if task.Audio != nil {
+		bytes = task.Audio.Size()
+	}
+	p.usage.Record(task.Tenant, bytes, task.Transcript, task.Err)
+}
+
+// transcribe runs the task's audio through the backend and the transcript
+// through the post-processing stages of the pipeline for the job's source,
+// before marking the job completed.
+func (p *WorkerPool) transcribe(task *TranscriptionTask) (*Transcript, error) {
+	p.store.Start(task.JobID)
+	pipeline := p.pipelineFor(task.Source, task.Tenant)
+	started := time.Now()
+	transcript, err := p.transcribeAudio(task, pipeline.Audio)
+	if err != nil {
+		err = p.fail(task, err)
+	}
+	if err != errCancelled && !task.Ephemeral {
+		p.recordTranscription(task, transcript, time.Since(started), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range pipeline.Steps {
+		if task.Ephemeral && step.Name != "redact" {
+			continue
+		}
+		step.Stage(p, task, transcript, step.Arg)
+	}
+	p.store.Complete(task.JobID, transcript)
+	return transcript, nil
+}
+
+var transcriptionDurationBuckets = []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// recordTranscription counts a transcription in the metrics by the backend's
+// host and the model, to tell which of several is slow or failing.
+func (p *WorkerPool) recordTranscription(task *TranscriptionTask, transcript *Transcript, took time.Duration, err error) {
+	backend := task.WhisperURL
+	if u, parseErr := url.Parse(task.WhisperURL); parseErr == nil && u.Host != "" {
+		backend = u.Host
+	}
+	labels := []string{"backend", backend, "model", task.WhisperModel}
+	if p.opsAlerts != nil {
+		p.opsAlerts.Record(err != nil)
+	}
+	if err != nil {
+		p.metrics.Inc("whisper_agent_transcriptions_total", append(labels, "status", string(JobFailed))...)
+		return
+	}
+	p.metrics.Inc("whisper_agent_transcriptions_total", append(labels, "status", string(JobCompleted))...)
+	size := int64(-1)
+	if task.Audio != nil {
+		size = task.Audio.Size()
+	}
+	p.speeds.Record(task.WhisperURL, task.WhisperModel, size, took)
+	p.metrics.Observe("whisper_agent_transcription_duration_seconds", took.Seconds(), labels...)
+	p.metrics.Add("whisper_agent_audio_seconds_total", transcriptDuration(transcript), labels...)
+}
+
+// transcribeAudio sends the task's audio to the backend after running it
+// through the audio steps. The task keeps the original audio; what the steps
+// produce is closed when done.
+func (p *WorkerPool) transcribeAudio(task *TranscriptionTask, steps []audioStep) (*Transcript, error) {
+	if len(steps) > 0 {
+		prepared := *task
+		for _, step := range steps {
+			audio, err := step.Stage(p.cfg, &prepared, prepared.Audio, step.Arg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s step failed", step.Name)
+			}
+			if audio != prepared.Audio {
+				if prepared.Audio != task.Audio {
+					prepared.Audio.Close()
+				}
+				prepared.Audio = audio
+			}
+		}
+		if prepared.Audio != task.Audio {
+			defer prepared.Audio.Close()
+		}
+		task = &prepared
+	}
+	if p.cfg.ChunkDuration > 0 {
+		transcript, chunked, err := p.transcribeChunked(task)
+		if err != nil || chunked {
+			return transcript, err
+		}
+	}
+	return transcribeJob(task.ctx, p.store, task.JobID, task.WhisperURL, task.WhisperModel, task.Prompt, task.Filename, task.Audio.Reader(), task.Audio.Size())
+}
+
+func (p *WorkerPool) download(ctx context.Context, url string, headers map[string]string) (*AudioBuffer, error) {
+	if p.cfg.DownloadParallelism > 1 {
+		if file, ok := probeRanges(ctx, p.downloads, url, headers, p.cfg.DownloadParallelMinSize); ok {
+			return p.downloadRanges(ctx, url, headers, file)
+		}
+	}
+	body, _, err := downloadFileWithLimit(ctx, p.downloads, url, headers, p.cfg.MaxAudioSize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buffer := p.cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, body); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	if err := sniffAudio(buffer.Head(sniffLength)); err != nil {
+		buffer.Close()
+		return nil, errors.Wrap(err, "downloaded file")
+	}
+	return buffer, nil
+}
+
+// downloadRanges downloads a large file in parallel byte ranges.
+func (p *WorkerPool) downloadRanges(ctx context.Context, url string, headers map[string]string, file rangedFile) (*AudioBuffer, error) {
+	if file.size > p.cfg.MaxAudioSize {
+		return nil, &sizeLimitError{limit: p.cfg.MaxAudioSize, size: file.size, announced: true}
+	}
+	buffer := p.cfg.newAudioBuffer()
+	if err := downloadRanges(ctx, p.downloads, url, headers, file, p.cfg.DownloadParallelism, p.cfg.newAudioBuffer, buffer); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	if err := sniffAudio(buffer.Head(sniffLength)); err != nil {
+		buffer.Close()
+		return nil, errors.Wrap(err, "downloaded file")
+	}
+	return buffer, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Job priorities, in the order workers pick up queued jobs. Scheduling is
+// strict: a low-priority backfill only starts while no high or normal job is
+// waiting.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+var errInvalidPriority = errors.New("priority must be high, normal or low")
+
+// priorityParam reads the priority=high|normal|low request parameter.
+func priorityParam(r *http.Request) string {
+	return r.URL.Query().Get("priority")
+}
+
+func checkPriority(priority string) error {
+	if priority != "" && priorityRank(priority) < 0 {
+		return errInvalidPriority
+	}
+	return nil
+}
+
+// priorityRank is the index of the priority's queue; no priority is normal.
+func priorityRank(priority string) int {
+	if priority == "" {
+		priority = priorityNormal
+	}
+	for rank, p := range priorities {
+		if p == priority {
+			return rank
+		}
+	}
+	return -1
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	profanityOff    = "off"
+	profanityMask   = "mask"
+	profanityRemove = "remove"
+	profanityFlag   = "flag"
+)
+
+var errInvalidProfanityMode = errors.New("profanity must be mask, remove, flag or off")
+
+// defaultProfanity is used unless --profanity-words names a list of its own.
+// A trailing * matches any ending.
+var defaultProfanity = []string{
+	"arse", "arsehole*", "ass", "asshole*", "bastard*", "bitch*", "bollocks", "bullshit*", "cock", "cocks",
+	"cunt*", "damn", "dick", "dickhead*", "fuck*", "motherfuck*", "piss", "pissed", "prick", "pricks", "shit*",
+	"slut*", "twat*", "wank*", "whore*",
+}
+
+var profanityWordPattern = regexp.MustCompile(`[\p{L}\p{N}']+`)
+
+// Profanity lists the profane words found in a transcript.
+type Profanity struct {
+	Count int      `json:"count"`
+	Words []string `json:"words"`
+}
+
+// ProfanityFilter finds profane words in transcripts and masks ("f***"),
+// removes or only reports them.
+type ProfanityFilter struct {
+	words    map[string]bool
+	prefixes []string
+}
+
+// NewProfanityFilter loads the word list from wordsFile, one word per line,
+// or uses the built-in list if wordsFile is empty.
+func NewProfanityFilter(wordsFile string) (*ProfanityFilter, error) {
+	words := defaultProfanity
+	if wordsFile != "" {
+		file, err := os.Open(wordsFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer file.Close()
+		words = nil
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if word := strings.TrimSpace(scanner.Text()); word != "" && !strings.HasPrefix(word, "#") {
+				words = append(words, word)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	filter := &ProfanityFilter{words: make(map[string]bool)}
+	for _, word := range words {
+		word = strings.ToLower(word)
+		if prefix, ok := strings.CutSuffix(word, "*"); ok {
+			filter.prefixes = append(filter.prefixes, prefix)
+		} else {
+			filter.words[word] = true
+		}
+	}
+	return filter, nil
+}
+
+// profanityMode reads the profanity request parameter.
+func profanityMode(r *http.Request) string {
+	return r.URL.Query().Get("profanity")
+}
+
+func checkProfanityMode(mode string) error {
+	switch mode {
+	case "", profanityOff, profanityMask, profanityRemove, profanityFlag:
+		return nil
+	}
+	return errInvalidProfanityMode
+}
+
+func (f *ProfanityFilter) profane(word string) bool {
+	word = strings.ToLower(strings.Trim(word, "'"))
+	if f.words[word] {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply filters the transcript's text, segments and words in the given mode
+// and returns what was found, or nil if nothing was.
+func (f *ProfanityFilter) Apply(transcript *Transcript, mode string) *Profanity {
+	if mode == "" || mode == profanityOff {
+		return nil
+	}
+	found := map[string]bool{}
+	count := 0
+	replace := func(text string, counting bool) string {
+		return profanityWordPattern.ReplaceAllStringFunc(text, func(word string) string {
+			if !f.profane(word) {
+				return word
+			}
+			if counting {
+				count++
+				found[strings.ToLower(word)] = true
+			}
+			switch mode {
+			case profanityMask:
+				_, size := utf8.DecodeRuneInString(word)
+				return word[:size] + strings.Repeat("*", utf8.RuneCountInString(word)-1)
+			case profanityRemove:
+				return ""
+			}
+			return word
+		})
+	}
+
+	transcript.Text = cleanRemoved(replace(transcript.Text, true), mode)
+	for i := range transcript.Segments {
+		segment := &transcript.Segments[i]
+		segment.Text = cleanRemoved(replace(segment.Text, false), mode)
+		segment.Words = filterWords(segment.Words, replace, mode)
+	}
+	transcript.Words = filterWords(transcript.Words, replace, mode)
+
+	if count == 0 {
+		return nil
+	}
+	profanity := &Profanity{Count: count}
+	for word := range found {
+		profanity.Words = append(profanity.Words, word)
+	}
+	sort.Strings(profanity.Words)
+	return profanity
+}
+
+func filterWords(words []Word, replace func(string, bool) string, mode string) []Word {
+	filtered := words[:0]
+	for _, word := range words {
+		word.Word = replace(word.Word, false)
+		if mode == profanityRemove && strings.Trim(word.Word, " .,!?") == "" {
+			continue
+		}
+		filtered = append(filtered, word)
+	}
+	return filtered
+}
+
+var (
+	doubleSpaces  = regexp.MustCompile(`  +`)
+	orphanedComma = regexp.MustCompile(`,(\s*[,.!?])`)
+)
+
+// cleanRemoved collapses the gaps removed words leave behind.
+func cleanRemoved(text, mode string) string {
+	if mode != profanityRemove {
+		return text
+	}
+	leading := strings.HasPrefix(text, " ")
+	text = strings.TrimSpace(doubleSpaces.ReplaceAllString(text, " "))
+	text = strings.NewReplacer(" ,", ",", " .", ".", " !", "!", " ?", "?").Replace(text)
+	text = strings.TrimLeft(orphanedComma.ReplaceAllString(text, "$1"), ", ")
+	if leading {
+		text = " " + text
+	}
+	return text
+}
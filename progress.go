@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// JobProgress is what a progress event reports of a job.
+type JobProgress struct {
+	ID       string     `json:"id"`
+	Status   JobStatus  `json:"status"`
+	Progress float64    `json:"progress"`
+	Percent  int        `json:"percent"`
+	Chunks   *JobChunks `json:"chunks,omitempty"`
+}
+
+// jobProgressHandler streams a job's progress as server-sent events, for GET
+// /v1/jobs/{id}/events: a progress event whenever its status or progress
+// changes and, once it finished, a done event with the whole job before the
+// stream ends.
+func jobProgressHandler(w http.ResponseWriter, r *http.Request, store *JobStore, id string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	if job, ok := store.Get(id); !ok || job.Tenant != requestTenant(r) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	updates, unsubscribe := store.Subscribe()
+	defer unsubscribe()
+
+	var last *JobProgress
+	for {
+		job, ok := store.Get(id)
+		if !ok {
+			return
+		}
+		event, payload := "progress", interface{}(nil)
+		progress := JobProgress{ID: job.ID, Status: job.Status, Progress: job.Progress, Percent: job.Percent, Chunks: job.Chunks}
+		switch {
+		case job.finished():
+			event, payload = "done", job
+		case last == nil || progress.Status != last.Status || progress.Percent != last.Percent || progress.Chunks != last.Chunks:
+			payload = progress
+			last = &progress
+		}
+		if payload != nil {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("event: " + event + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if job.finished() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+		}
+	}
+}
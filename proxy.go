@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// directProxy is the proxy setting for connecting without a proxy even if
+// HTTP_PROXY or HTTPS_PROXY are set.
+const directProxy = "direct"
+
+// backendClient sends requests to the whisper backend, through
+// --backend-proxy if set.
+var backendClient = &http.Client{}
+
+// checkProxy validates a proxy setting: empty for the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment, "direct", or the URL of an HTTP, HTTPS or SOCKS5
+// proxy, with credentials if it needs them.
+func checkProxy(setting string) error {
+	if setting == "" || setting == directProxy {
+		return nil
+	}
+	proxy, err := url.Parse(setting)
+	if err != nil {
+		return errors.Errorf("invalid proxy URL %q", setting)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.Errorf("unsupported proxy scheme %q, expected http, https, socks5 or socks5h", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return errors.Errorf("proxy URL %s has no host", proxy.Redacted())
+	}
+	return nil
+}
+
+// proxied tells whether requests go through a proxy with the setting, which
+// for "" depends on the environment. NO_PROXY isn't considered: some hosts
+// going through the proxy is enough.
+func proxied(setting string) bool {
+	switch setting {
+	case "":
+		env := httpproxy.FromEnvironment()
+		return env.HTTPProxy != "" || env.HTTPSProxy != ""
+	case directProxy:
+		return false
+	}
+	return true
+}
+
+// proxyFunc returns the Transport.Proxy for a setting checked by checkProxy.
+func proxyFunc(setting string) func(*http.Request) (*url.URL, error) {
+	switch setting {
+	case "":
+		return http.ProxyFromEnvironment
+	case directProxy:
+		return nil
+	}
+	proxy, err := url.Parse(setting)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, errors.WithStack(err) }
+	}
+	return http.ProxyURL(proxy)
+}
+
+// proxiedTransport returns a copy of the default transport using the proxy
+// setting.
+func proxiedTransport(setting string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc(setting)
+	return transport
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sentencePause is how long a pause between segments has to be for the rules
+// to end a sentence there.
+const sentencePause = 0.7
+
+const punctuationPrompt = `You restore punctuation and capitalization in transcript segments that were transcribed without them. Don't add, remove or change any words.
+You get a JSON array of strings and reply with a JSON array of the restored strings, in the same order and with the same number of elements.
+Reply with the JSON array only.`
+
+// needsPunctuation reports whether text looks like it came from a backend that
+// doesn't punctuate: letters, but neither capitals nor sentence punctuation.
+func needsPunctuation(text string) bool {
+	hasLetters := false
+	for _, r := range text {
+		if unicode.IsUpper(r) || strings.ContainsRune(".?!", r) {
+			return false
+		}
+		hasLetters = hasLetters || unicode.IsLetter(r)
+	}
+	return hasLetters
+}
+
+// restorePunctuation punctuates and capitalizes an unpunctuated transcript,
+// with the LLM at --llm-url if --restore-punctuation is "llm", else with
+// simple rules. If the LLM fails the rules are applied and the error is
+// returned for logging. Punctuated transcripts are left alone.
+func restorePunctuation(cfg Config, transcript *Transcript) error {
+	if !needsPunctuation(transcript.Text) {
+		return nil
+	}
+	if cfg.RestorePunctuation == "llm" {
+		err := restorePunctuationLLM(cfg, transcript)
+		if err == nil {
+			return nil
+		}
+		restorePunctuationRules(transcript)
+		return err
+	}
+	restorePunctuationRules(transcript)
+	return nil
+}
+
+func restorePunctuationLLM(cfg Config, transcript *Transcript) error {
+	texts := []string{strings.TrimSpace(transcript.Text)}
+	if len(transcript.Segments) > 0 {
+		texts = texts[:0]
+		for _, segment := range transcript.Segments {
+			texts = append(texts, strings.TrimSpace(segment.Text))
+		}
+	}
+
+	restored := make([]string, 0, len(texts))
+	for start := 0; start < len(texts); start += rewriteBatch {
+		batch, err := rewriteLLM(cfg, punctuationPrompt, texts[start:min(start+rewriteBatch, len(texts))])
+		if err != nil {
+			return err
+		}
+		restored = append(restored, batch...)
+	}
+
+	if len(transcript.Segments) == 0 {
+		transcript.Text = restored[0]
+		return nil
+	}
+	for i := range transcript.Segments {
+		transcript.Segments[i].Text = " " + restored[i]
+	}
+	transcript.Text = strings.Join(restored, " ")
+	return nil
+}
+
+// restorePunctuationRules capitalizes the start of sentences and ends them
+// with a period. Without segments the whole text is one sentence; with them,
+// a sentence ends at every pause of at least sentencePause.
+func restorePunctuationRules(transcript *Transcript) {
+	english := strings.HasPrefix(strings.ToLower(transcript.Language), "en")
+	if len(transcript.Segments) == 0 {
+		transcript.Text = punctuateSentence(strings.TrimSpace(transcript.Text), true, true, english)
+		return
+	}
+
+	texts := make([]string, 0, len(transcript.Segments))
+	sentenceStart := true
+	for i := range transcript.Segments {
+		segment := &transcript.Segments[i]
+		last := i == len(transcript.Segments)-1
+		sentenceEnd := last || transcript.Segments[i+1].Start-segment.End >= sentencePause
+		text := punctuateSentence(strings.TrimSpace(segment.Text), sentenceStart, sentenceEnd, english)
+		segment.Text = " " + text
+		texts = append(texts, text)
+		sentenceStart = sentenceEnd
+	}
+	transcript.Text = strings.Join(texts, " ")
+}
+
+func punctuateSentence(text string, start, end, english bool) string {
+	if text == "" {
+		return text
+	}
+	if english {
+		words := strings.Fields(text)
+		for i, word := range words {
+			if word == "i" || strings.HasPrefix(word, "i'") {
+				words[i] = "I" + word[1:]
+			}
+		}
+		text = strings.Join(words, " ")
+	}
+	if start {
+		first, size := utf8.DecodeRuneInString(text)
+		text = string(unicode.ToUpper(first)) + text[size:]
+	}
+	if end && !strings.ContainsRune(".?!,;:", rune(text[len(text)-1])) {
+		text += "."
+	}
+	return text
+}
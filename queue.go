@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errCancelled = errors.New("job was cancelled")
+
+// QueueFilter selects queued jobs for the admin queue endpoints. All criteria
+// that are set must match; IDs matches any of the listed jobs. All selects
+// the whole queue, to purge it after a flood of accidental submissions.
+type QueueFilter struct {
+	IDs      []string   `json:"ids,omitempty"`
+	Tenant   string     `json:"tenant,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	Priority string     `json:"priority,omitempty"`
+	Before   *time.Time `json:"before,omitempty"`
+	After    *time.Time `json:"after,omitempty"`
+	All      bool       `json:"all,omitempty"`
+	DryRun   bool       `json:"dry_run,omitempty"`
+}
+
+func (f QueueFilter) empty() bool {
+	return len(f.IDs) == 0 && f.Tenant == "" && f.Source == "" && f.Priority == "" && f.Before == nil && f.After == nil && !f.All
+}
+
+func (f QueueFilter) matches(job QueuedJob) bool {
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			found = found || id == job.ID
+		}
+		if !found {
+			return false
+		}
+	}
+	switch {
+	case f.Tenant != "" && job.Tenant != f.Tenant,
+		f.Source != "" && job.Source != f.Source,
+		f.Priority != "" && job.Priority != f.Priority,
+		f.Before != nil && !job.CreatedAt.Before(*f.Before),
+		f.After != nil && !job.CreatedAt.After(*f.After):
+		return false
+	}
+	return true
+}
+
+// QueuedJob is a job waiting for a worker. Position 1 is picked up next.
+type QueuedJob struct {
+	Position  int       `json:"position"`
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Filename  string    `json:"filename"`
+	Priority  string    `json:"priority"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	EstimatedCompletionAt *time.Time `json:"estimated_completion_at,omitempty"`
+}
+
+// editQueue takes every task off the queues, lets edit pick the queue each
+// one goes back to (or -1 to leave it off), and queues them again in the
+// order of their seq, so a task edit gave a new one goes to the end. Holding
+// the lock keeps Submit and the workers out meanwhile, so there's always room
+// to put them back.
+func (p *WorkerPool) editQueue(edit func(job QueuedJob, task *TranscriptionTask) int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := make([][]*TranscriptionTask, len(p.queues))
+	for rank, queue := range p.queues {
+	drain:
+		for {
+			select {
+			case task := <-queue:
+				tasks[rank] = append(tasks[rank], task)
+			default:
+				break drain
+			}
+		}
+	}
+	requeued := make([][]*TranscriptionTask, len(p.queues))
+	position := 0
+	for _, queued := range tasks {
+		for _, task := range queued {
+			position++
+			if rank := edit(p.queuedJob(position, task), task); rank >= 0 {
+				requeued[rank] = append(requeued[rank], task)
+			}
+		}
+	}
+	for rank, queued := range requeued {
+		sort.Slice(queued, func(i, j int) bool { return queued[i].seq < queued[j].seq })
+		for _, task := range queued {
+			p.queues[rank] <- task
+		}
+	}
+}
+
+func (p *WorkerPool) queuedJob(position int, task *TranscriptionTask) QueuedJob {
+	job := QueuedJob{Position: position, ID: task.JobID, Source: task.Source, Filename: task.Filename, Priority: task.Priority, Tenant: task.Tenant}
+	if stored, ok := p.store.Get(task.JobID); ok {
+		job.CreatedAt = stored.CreatedAt
+	}
+	return job
+}
+
+// Queued lists the queued jobs matching the filter in the order workers pick
+// them up: by priority, then by seq. It only reads the pool's tasks, leaving
+// the queues alone; workers mark the tasks they take as started under the
+// same lock.
+func (p *WorkerPool) Queued(filter QueueFilter) []QueuedJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued := []*TranscriptionTask{}
+	for _, task := range p.tasks {
+		if task.started.IsZero() {
+			queued = append(queued, task)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if a, b := priorityRank(queued[i].Priority), priorityRank(queued[j].Priority); a != b {
+			return a < b
+		}
+		return queued[i].seq < queued[j].seq
+	})
+	jobs := []QueuedJob{}
+	for i, task := range queued {
+		if job := p.queuedJob(i+1, task); filter.matches(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// CancelQueued takes the queued jobs matching the filter off the queue and
+// fails their tasks with errCancelled, returning their IDs. With DryRun it
+// only returns them.
+func (p *WorkerPool) CancelQueued(filter QueueFilter, reason string) []string {
+	cancelled := []*TranscriptionTask{}
+	p.editQueue(func(job QueuedJob, task *TranscriptionTask) int {
+		if !filter.matches(job) {
+			return priorityRank(task.Priority)
+		}
+		cancelled = append(cancelled, task)
+		if filter.DryRun {
+			return priorityRank(task.Priority)
+		}
+		p.inFlight--
+		delete(p.tasks, task.JobID)
+		return -1
+	})
+	ids := []string{}
+	for _, task := range cancelled {
+		ids = append(ids, task.JobID)
+		if filter.DryRun {
+			continue
+		}
+		task.cancel(errors.New(reason))
+		p.store.Cancel(task.JobID, reason)
+		if task.OwnsAudio && task.Audio != nil {
+			task.Audio.Close()
+		}
+		task.Err = errCancelled
+		close(task.Done)
+	}
+	return ids
+}
+
+// Cancel aborts a scheduled, queued or running job: a scheduled one is
+// dropped, a queued one is taken off the queue, a running one has its
+// download or backend request cancelled, which frees the worker. It returns
+// false if the job is none of them.
+func (p *WorkerPool) Cancel(id, reason string) bool {
+	if p.scheduler != nil && p.scheduler.Cancel(id, reason) {
+		return true
+	}
+	p.mu.Lock()
+	task, ok := p.tasks[id]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	task.cancel(errors.New(reason))
+	p.CancelQueued(QueueFilter{IDs: []string{id}}, reason)
+	return true
+}
+
+// cancelJob cancels a queued or running job and waits for it to stop,
+// returning the job as it ended: completed, if it finished first. It returns
+// false if the job is gone. It stops waiting once ctx is done.
+func cancelJob(ctx context.Context, store *JobStore, pool *WorkerPool, id, reason string) (Job, bool) {
+	if !pool.Cancel(id, reason) {
+		return store.Get(id)
+	}
+	return waitForJob(ctx, store, id)
+}
+
+// cancelJobHandler cancels a queued or running job of the request's tenant,
+// for DELETE /v1/jobs/{id}, and responds with the job once it stopped.
+// Finished jobs are deleted by deleteJobHandler instead.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool, audit *AuditLog, id string) {
+	if job, ok := store.Get(id); !ok || job.Tenant != requestTenant(r) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	job, ok := cancelJob(r.Context(), store, pool, id, "cancelled")
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if job.Status == JobCancelled {
+		audit.Record(r, "cancel", apiActor(r), nil, []string{id})
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Reprioritize moves the queued jobs matching the filter to the end of the
+// queue of the priority, returning their IDs. With DryRun it only returns
+// them.
+func (p *WorkerPool) Reprioritize(filter QueueFilter, priority string) []string {
+	ids := []string{}
+	p.editQueue(func(job QueuedJob, task *TranscriptionTask) int {
+		if !filter.matches(job) {
+			return priorityRank(task.Priority)
+		}
+		ids = append(ids, job.ID)
+		if filter.DryRun {
+			return priorityRank(task.Priority)
+		}
+		task.Priority = priority
+		p.seq++
+		task.seq = p.seq
+		p.store.SetPriority(task.JobID, priority)
+		return priorityRank(priority)
+	})
+	return ids
+}
+
+// queueHandler lists the queued jobs, optionally only those of a tenant,
+// source or priority, with how busy the pool is.
+func queueHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	query := r.URL.Query()
+	filter := QueueFilter{Tenant: query.Get("tenant"), Source: query.Get("source"), Priority: query.Get("priority")}
+	if err := checkPriority(filter.Priority); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	jobs := pool.Queued(filter)
+	for i, job := range jobs {
+		if eta, ok := pool.EstimatedCompletion(job.ID); ok {
+			jobs[i].EstimatedCompletionAt = &eta
+		}
+	}
+	pool.mu.Lock()
+	busy, inFlight := pool.busy, pool.inFlight
+	pool.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"depth":     pool.QueueDepth(),
+		"capacity":  pool.cfg.QueueSize,
+		"busy":      busy,
+		"in_flight": inFlight,
+		"jobs":      jobs,
+	})
+}
+
+// queueCancelHandler cancels the queued jobs matching the filter in the body,
+// or with dry_run only lists them. Running jobs aren't affected.
+func queueCancelHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, audit *AuditLog) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var filter QueueFilter
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&filter); err != nil || filter.empty() {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with at least one of ids, tenant, source, priority, before, after and all")
+		return
+	}
+	if err := checkPriority(filter.Priority); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ids := pool.CancelQueued(filter, "cancelled by an admin")
+	if filter.DryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"matched": ids})
+		return
+	}
+	audit.Record(r, "cancel", "admin", nil, ids)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cancelled": ids})
+}
+
+// queueReprioritizeHandler moves the queued jobs matching the filter in the
+// body to the priority in "to", or with dry_run only lists them.
+func queueReprioritizeHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var body struct {
+		QueueFilter
+		To string `json:"to"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || body.empty() || body.To == "" {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with to and at least one of ids, tenant, source, priority, before, after and all")
+		return
+	}
+	for _, priority := range []string{body.Priority, body.To} {
+		if err := checkPriority(priority); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ids := pool.Reprioritize(body.QueueFilter, body.To)
+	if body.DryRun {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"matched": ids})
+		return
+	}
+	if len(ids) > 0 {
+		log.Printf("Moved %d queued jobs to %s priority", len(ids), body.To)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"moved": ids})
+}
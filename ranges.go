@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// downloadPartSize is the size of the ranges large files are downloaded in
+// with --download-parallelism. Parts are buffered until the ones before them
+// are written, at most twice the parallelism of them at once.
+const downloadPartSize = 16 << 20
+
+// rangedFile is what probeRanges found out about a file that can be
+// downloaded in ranges.
+type rangedFile struct {
+	size      int64
+	validator string
+}
+
+// probeRanges asks with a HEAD request whether the server can send the file
+// in ranges. Files that can't be, aren't large enough to be worth it or
+// don't answer HEAD (like URLs presigned for GET only) are downloaded in one
+// request as usual.
+func probeRanges(ctx context.Context, client *http.Client, url string, headers map[string]string, minSize int64) (rangedFile, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return rangedFile{}, false
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return rangedFile{}, false
+	}
+	resp.Body.Close()
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || validator == "" ||
+		resp.ContentLength < minSize {
+		return rangedFile{}, false
+	}
+	return rangedFile{size: resp.ContentLength, validator: validator}, true
+}
+
+// rangePart is a downloaded part, or why it couldn't be.
+type rangePart struct {
+	buffer *AudioBuffer
+	err    error
+}
+
+// downloadRanges downloads the file in downloadPartSize ranges, parallelism
+// of them at once, and writes them to the buffer in order. A part that fails
+// is fetched again, up to maxDownloadResumes times; if it still fails, the
+// other parts are cancelled.
+func downloadRanges(ctx context.Context, client *http.Client, url string, headers map[string]string, file rangedFile, parallelism int, newBuffer func() *AudioBuffer, buffer *AudioBuffer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	parts := make([]chan rangePart, (file.size+downloadPartSize-1)/downloadPartSize)
+	for i := range parts {
+		parts[i] = make(chan rangePart, 1)
+	}
+	// pending bounds the parts downloading or waiting to be written,
+	// running the ones downloading.
+	pending := make(chan struct{}, 2*parallelism)
+	running := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range parts {
+			select {
+			case pending <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			running <- struct{}{}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-running }()
+				start := int64(i) * downloadPartSize
+				end := min(start+downloadPartSize, file.size) - 1
+				part, err := downloadRange(ctx, client, url, headers, file, start, end, newBuffer)
+				parts[i] <- rangePart{part, err}
+			}(i)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+		for _, results := range parts {
+			select {
+			case part := <-results:
+				if part.buffer != nil {
+					part.buffer.Close()
+				}
+			default:
+			}
+		}
+	}()
+
+	for _, results := range parts {
+		part := <-results
+		if part.err != nil {
+			return part.err
+		}
+		_, err := io.Copy(buffer, part.buffer.Reader())
+		part.buffer.Close()
+		<-pending
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// downloadRange fetches bytes start to end of the file into a buffer of its
+// own, retrying if the request fails or breaks off.
+func downloadRange(ctx context.Context, client *http.Client, url string, headers map[string]string, file rangedFile, start, end int64, newBuffer func() *AudioBuffer) (*AudioBuffer, error) {
+	var err error
+	for attempt := 0; attempt <= maxDownloadResumes; attempt++ {
+		if attempt > 0 {
+			log.Printf("Downloading bytes %d-%d of %s failed, retrying (%d/%d): %v", start, end, url, attempt, maxDownloadResumes, err)
+			select {
+			case <-time.After(downloadResumeDelay):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+		var part *AudioBuffer
+		if part, err = fetchRange(ctx, client, url, headers, file, start, end, newBuffer); err == nil {
+			return part, nil
+		}
+		if errors.Is(err, errRangeChanged) || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+var errRangeChanged = errors.New("file changed during the download or the server ignored the range")
+
+func fetchRange(ctx context.Context, client *http.Client, url string, headers map[string]string, file rangedFile, start, end int64, newBuffer func() *AudioBuffer) (*AudioBuffer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Set("If-Range", file.validator)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, errors.Errorf("server returned %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes %d-%d/%d", start, end, file.size) {
+		return nil, errRangeChanged
+	}
+	part := newBuffer()
+	if _, err := io.Copy(part, io.LimitReader(resp.Body, end-start+1)); err != nil {
+		part.Close()
+		return nil, errors.WithStack(err)
+	}
+	if part.Size() != end-start+1 {
+		part.Close()
+		return nil, errors.Errorf("got %d of %d bytes", part.Size(), end-start+1)
+	}
+	return part, nil
+}
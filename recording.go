@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	recordingWebhookMaxBody = 1 << 20
+	zoomSignatureMaxAge     = 5 * time.Minute
+)
+
+// recordingMeeting identifies the meeting a recording belongs to.
+type recordingMeeting struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic,omitempty"`
+	StartTime string `json:"start_time,omitempty"`
+}
+
+// recordingResult is POSTed to --recording-result-url once a meeting
+// recording has been transcribed, or has failed to.
+type recordingResult struct {
+	Source  string           `json:"source"`
+	Meeting recordingMeeting `json:"meeting"`
+	streamResult
+}
+
+// zoomWebhook is the part of Zoom's webhook events we use. download_token is
+// only present if the app's subscription includes it.
+type zoomWebhook struct {
+	Event   string `json:"event"`
+	EventTS int64  `json:"event_ts"`
+	Payload struct {
+		PlainToken string `json:"plainToken"`
+		Object     struct {
+			UUID           string      `json:"uuid"`
+			ID             json.Number `json:"id"`
+			Topic          string      `json:"topic"`
+			StartTime      string      `json:"start_time"`
+			RecordingFiles []struct {
+				FileType      string `json:"file_type"`
+				FileExtension string `json:"file_extension"`
+				RecordingType string `json:"recording_type"`
+				DownloadURL   string `json:"download_url"`
+				Status        string `json:"status"`
+			} `json:"recording_files"`
+		} `json:"object"`
+	} `json:"payload"`
+	DownloadToken string `json:"download_token"`
+}
+
+// zoomWebhookHandler accepts Zoom's recording.completed events and transcribes
+// the meeting's audio-only file, or the video if there is none. Events are
+// authenticated with the app's secret token, which also answers Zoom's
+// endpoint validation challenge.
+func zoomWebhookHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, recordingWebhookMaxBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	if !validZoomSignature(r, body, cfg.ZoomWebhookSecret) {
+		writeJSONError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
+	var event zoomWebhook
+	if err := json.Unmarshal(body, &event); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	switch event.Event {
+	case "endpoint.url_validation":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"plainToken":     event.Payload.PlainToken,
+			"encryptedToken": zoomHMAC(cfg.ZoomWebhookSecret, event.Payload.PlainToken),
+		})
+		return
+	case "recording.completed":
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	object := event.Payload.Object
+	meeting := recordingMeeting{ID: object.UUID, Topic: object.Topic, StartTime: object.StartTime}
+	if meeting.ID == "" {
+		meeting.ID = object.ID.String()
+	}
+	downloadURL, extension := "", ""
+	for _, file := range object.RecordingFiles {
+		if file.Status != "" && file.Status != "completed" {
+			continue
+		}
+		audioOnly := file.RecordingType == "audio_only" || file.FileType == "M4A"
+		if audioOnly || (downloadURL == "" && file.FileType == "MP4") {
+			downloadURL, extension = file.DownloadURL, "."+strings.ToLower(file.FileExtension)
+			if audioOnly {
+				break
+			}
+		}
+	}
+	if downloadURL == "" {
+		log.Printf("Zoom recording of %s has no audio or video file", meeting.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if event.DownloadToken != "" {
+		downloadURL = withQuery(downloadURL, "access_token", event.DownloadToken)
+	}
+
+	// Zoom retries webhooks that take longer than a few seconds, so the
+	// recording is queued for the pool to fetch after answering. Retries of an event that did get
+	// through are recognized by its event timestamp.
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = "zoom:" + meeting.ID + ":" + strconv.FormatInt(event.EventTS, 10)
+	}
+	acceptRecording(w, pool, cfg, key, "zoom", meeting, recordingFilename(meeting.Topic, extension), downloadURL, nil)
+}
+
+func validZoomSignature(r *http.Request, body []byte, secret string) bool {
+	timestamp := r.Header.Get("X-Zm-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > zoomSignatureMaxAge {
+		return false
+	}
+	expected := "v0=" + zoomHMAC(secret, "v0:"+timestamp+":"+string(body))
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Zm-Signature")), []byte(expected)) == 1
+}
+
+func zoomHMAC(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// meetWebhook announces a Google Meet recording saved to Drive. Google has no
+// recording webhook of its own, so this is posted by whatever watches the
+// Meet Recordings folder (an Apps Script trigger, a Drive push notification
+// handler), together with an OAuth token that can read the file.
+type meetWebhook struct {
+	FileID      string           `json:"file_id"`
+	Name        string           `json:"name"`
+	AccessToken string           `json:"access_token"`
+	Meeting     recordingMeeting `json:"meeting"`
+}
+
+// meetWebhookHandler accepts meetWebhook notifications, authenticated with
+// --meet-webhook-secret as a bearer token.
+func meetWebhookHandler(w http.ResponseWriter, r *http.Request, pool *WorkerPool, cfg Config) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MeetWebhookSecret)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	var event meetWebhook
+	if err := json.NewDecoder(io.LimitReader(r.Body, recordingWebhookMaxBody)).Decode(&event); err != nil || event.FileID == "" || event.AccessToken == "" {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with file_id and access_token")
+		return
+	}
+	if event.Meeting.ID == "" {
+		event.Meeting.ID = event.FileID
+	}
+
+	filename := recordingFilename(event.Meeting.Topic, ".mp4")
+	if event.Name != "" {
+		filename = recordingFilename(event.Name, "")
+	}
+	// Meet records MP4, which Drive names without the extension.
+	if !isAudioFile(filename) {
+		filename += ".mp4"
+	}
+	downloadURL := strings.TrimSuffix(cfg.DriveAPIURL, "/") + "/files/" + url.PathEscape(event.FileID) + "?alt=media"
+	headers := map[string]string{"Authorization": "Bearer " + event.AccessToken}
+	acceptRecording(w, pool, cfg, r.Header.Get("Idempotency-Key"), "meet", event.Meeting, filename, downloadURL, headers)
+}
+
+// acceptRecording queues the download and transcription of a recording,
+// unless a webhook with the same idempotency key already did, and delivers
+// the result in the background. A rejected recording is answered like any
+// rejected job, so the webhook is retried later.
+func acceptRecording(w http.ResponseWriter, pool *WorkerPool, cfg Config, key, source string, meeting recordingMeeting, filename, downloadURL string, headers map[string]string) {
+	task := &TranscriptionTask{Filename: filename, AudioURL: downloadURL, DownloadHeaders: headers}
+	submit := func() (string, error) {
+		job, err := pool.Submit(source, task)
+		if err != nil {
+			return "", err
+		}
+		result := streamResult{ID: meeting.ID, JobID: job.ID, Status: JobFailed, Filename: filename}
+		go deliverRecording(pool, cfg, source, meeting, task, result)
+		return job.ID, nil
+	}
+	var repeated bool
+	var err error
+	if key == "" {
+		_, err = submit()
+	} else {
+		// The download URL and headers may carry tokens that change between
+		// retries, so the meeting is what identifies a recording.
+		_, repeated, err = pool.idempotency.Do("", key, source+":"+meeting.ID, submit)
+	}
+	if err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+	if repeated {
+		pool.metrics.Inc("whisper_agent_idempotent_replays_total")
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func recordingFilename(topic, extension string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(topic))
+	if name == "" {
+		name = "meeting"
+	}
+	return name + extension
+}
+
+func withQuery(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// deliverRecording waits for the transcription of a meeting recording and
+// delivers the result to --recording-result-url, if set. The transcript is
+// kept in the job store either way.
+func deliverRecording(pool *WorkerPool, cfg Config, source string, meeting recordingMeeting, task *TranscriptionTask, result streamResult) {
+	result = streamTaskResult(pool, task, result)
+	if result.Status == JobCompleted {
+		log.Printf("Recording of %s meeting %s transcribed as job %s", source, meeting.ID, result.JobID)
+	} else {
+		log.Printf("Recording of %s meeting %s failed: %s", source, meeting.ID, result.Error)
+	}
+	if cfg.RecordingResultURL != "" {
+		if err := postJSON(cfg.RecordingResultURL, recordingResult{Source: source, Meeting: meeting, streamResult: result}); err != nil {
+			log.Printf("Delivering transcript of %s meeting %s failed: %v", source, meeting.ID, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// redactionRule masks every match of Pattern with "[Name]". Valid, if set,
+// can veto a match, e.g. digit runs that fail the card checksum.
+type redactionRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Valid   func(match string) bool
+}
+
+var builtinRedactionRules = map[string]redactionRule{
+	"email": {Name: "EMAIL", Pattern: regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`)},
+	"card":  {Name: "CARD", Pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), Valid: luhnValid},
+	"phone": {Name: "PHONE", Pattern: regexp.MustCompile(`(?:\+|\b)\d(?:[ ().-]{0,2}\d){6,14}\b`)},
+	"iban":  {Name: "IBAN", Pattern: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)},
+}
+
+// Cards go before phones so a card number isn't masked as a phone number.
+var builtinRedactionOrder = []string{"email", "card", "iban", "phone"}
+
+// Redactor masks personal data in transcripts. It's regex based: names and
+// addresses need NER, which can be approximated with custom patterns for the
+// formats a deployment cares about (customer numbers, license plates).
+type Redactor struct {
+	rules []redactionRule
+}
+
+// NewRedactor builds the rules for the comma-separated built-in categories
+// (email, card, iban, phone) plus the patterns in patternsFile, one per line
+// as "NAME regex".
+func NewRedactor(categories, patternsFile string) (*Redactor, error) {
+	redactor := &Redactor{}
+	enabled := map[string]bool{}
+	for _, category := range strings.Split(categories, ",") {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" {
+			continue
+		}
+		if _, ok := builtinRedactionRules[category]; !ok {
+			return nil, errors.Errorf("unknown redaction category %q", category)
+		}
+		enabled[category] = true
+	}
+	for _, category := range builtinRedactionOrder {
+		if enabled[category] {
+			redactor.rules = append(redactor.rules, builtinRedactionRules[category])
+		}
+	}
+
+	if patternsFile == "" {
+		return redactor, nil
+	}
+	file, err := os.Open(patternsFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, expr, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, errors.Errorf("%s:%d: expected \"NAME regex\"", patternsFile, line)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(expr))
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", patternsFile, line)
+		}
+		redactor.rules = append(redactor.rules, redactionRule{Name: strings.ToUpper(name), Pattern: pattern})
+	}
+	return redactor, errors.WithStack(scanner.Err())
+}
+
+func (r *Redactor) Enabled() bool {
+	return r != nil && len(r.rules) > 0
+}
+
+// Redact masks the transcript's text and segments. Words are timed tokens of
+// the same text, so a word is masked if it was part of a masked span of its
+// segment.
+func (r *Redactor) Redact(transcript *Transcript) {
+	transcript.Text, _ = r.redactText(transcript.Text)
+	for i := range transcript.Segments {
+		segment := &transcript.Segments[i]
+		var masked []string
+		segment.Text, masked = r.redactText(segment.Text)
+		if len(masked) == 0 {
+			continue
+		}
+		redactWords(segment.Words, masked)
+		for j := range transcript.Words {
+			word := &transcript.Words[j]
+			if word.Start >= segment.Start && word.End <= segment.End {
+				redactWords(transcript.Words[j:j+1], masked)
+			}
+		}
+	}
+	if len(transcript.Segments) == 0 && len(transcript.Words) > 0 {
+		_, masked := r.redactText(transcript.Text)
+		redactWords(transcript.Words, masked)
+	}
+}
+
+// redactText returns the masked text and the original text of each masked
+// span.
+func (r *Redactor) redactText(text string) (string, []string) {
+	var masked []string
+	for _, rule := range r.rules {
+		text = rule.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.Valid != nil && !rule.Valid(match) {
+				return match
+			}
+			masked = append(masked, match)
+			return "[" + rule.Name + "]"
+		})
+	}
+	return text, masked
+}
+
+func redactWords(words []Word, masked []string) {
+	for i := range words {
+		token := strings.TrimFunc(words[i].Word, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsPunct(r) && r != '@'
+		})
+		if token != "" && maskedToken(token, masked) {
+			words[i].Word = "[REDACTED]"
+		}
+	}
+}
+
+// maskedToken reports whether token is one of the words of a masked span, or
+// contains a whole span.
+func maskedToken(token string, masked []string) bool {
+	for _, span := range masked {
+		if strings.Contains(token, span) {
+			return true
+		}
+		for _, field := range strings.Fields(span) {
+			if strings.Trim(field, "().-,") == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// luhnValid checks the card number checksum, ignoring separators.
+func luhnValid(number string) bool {
+	sum, digits := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
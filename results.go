@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResultSigner makes links to job results that work without an API key until
+// they expire, for webhooks, emails and broker results to point people at.
+// A link is the job ID and expiry signed with HMAC-SHA256, so nothing needs
+// to be stored, and a link can't be turned into one for another job or a
+// later expiry.
+type ResultSigner struct {
+	secret  []byte
+	ttl     time.Duration
+	baseURL string
+}
+
+// NewResultSigner signs with --result-url-secret, or a random secret if it's
+// not set, in which case links stop working when the agent restarts.
+func NewResultSigner(cfg Config) *ResultSigner {
+	secret := []byte(cfg.ResultURLSecret)
+	if len(secret) == 0 {
+		log.Printf("No --result-url-secret set, result links won't survive a restart")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &ResultSigner{secret: secret, ttl: cfg.ResultURLTTL, baseURL: strings.TrimSuffix(cfg.PublicURL, "/")}
+}
+
+// URL returns a signed link to the job's result.
+func (s *ResultSigner) URL(jobID string) string {
+	expires := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	query := url.Values{"expires": {expires}, "sig": {s.sign(jobID, expires)}}
+	return s.baseURL + "/v1/results/" + url.PathEscape(jobID) + "?" + query.Encode()
+}
+
+func (s *ResultSigner) sign(jobID, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(jobID + "." + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resultHandler serves a job through a signed link: the job as JSON, or its
+// transcript in an export format with format=.
+func resultHandler(w http.ResponseWriter, r *http.Request, store *JobStore, signer *ResultSigner) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/results/")
+	expires := r.URL.Query().Get("expires")
+	sig := r.URL.Query().Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(signer.sign(id, expires))) {
+		writeJSONError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+	if unix, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > unix {
+		writeJSONError(w, http.StatusGone, "Link expired")
+		return
+	}
+	if r.URL.Query().Get("format") != "" {
+		jobExportHandler(w, r, store, id)
+		return
+	}
+	job, ok := store.Get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeJSONWithETag(w, r, job)
+}
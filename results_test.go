@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResultSigner(t *testing.T) {
+	store := NewJobStore(10, 0)
+	job := store.Create("api", "a.wav", priorityNormal, "", "", nil)
+	other := store.Create("api", "b.wav", priorityNormal, "", "", nil)
+	signer := NewResultSigner(Config{ResultURLSecret: "secret", ResultURLTTL: time.Hour, PublicURL: "https://agent.example.com/"})
+
+	link, err := url.Parse(signer.URL(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "agent.example.com" || link.Path != "/v1/results/"+job.ID {
+		t.Fatalf("link = %s", link)
+	}
+	expires, sig := link.Query().Get("expires"), link.Query().Get("sig")
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	later := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+	tampered := []byte(sig)
+	tampered[0] ^= 1
+	tests := []struct {
+		name       string
+		id         string
+		expires    string
+		sig        string
+		wantStatus int
+	}{
+		{name: "signed", id: job.ID, expires: expires, sig: sig, wantStatus: http.StatusOK},
+		{name: "tampered signature", id: job.ID, expires: expires, sig: string(tampered), wantStatus: http.StatusForbidden},
+		{name: "no signature", id: job.ID, expires: expires, wantStatus: http.StatusForbidden},
+		{name: "another job", id: other.ID, expires: expires, sig: sig, wantStatus: http.StatusForbidden},
+		{name: "later expiry", id: job.ID, expires: later, sig: sig, wantStatus: http.StatusForbidden},
+		{name: "other secret", id: job.ID, expires: expires, sig: (&ResultSigner{secret: []byte("other")}).sign(job.ID, expires), wantStatus: http.StatusForbidden},
+		{name: "expired", id: job.ID, expires: past, sig: signer.sign(job.ID, past), wantStatus: http.StatusGone},
+		{name: "invalid expiry", id: job.ID, expires: "soon", sig: signer.sign(job.ID, "soon"), wantStatus: http.StatusGone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{"expires": {test.expires}, "sig": {test.sig}}
+			r := httptest.NewRequest(http.MethodGet, "/v1/results/"+test.id+"?"+query.Encode(), nil)
+			w := httptest.NewRecorder()
+			resultHandler(w, r, store, signer)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			var got Job
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.ID != job.ID {
+				t.Errorf("job = %+v (%v), want %s", got, err, job.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3PutExpiry is how long the browser has to upload the file once it
+	// got the URL.
+	s3PutExpiry = time.Hour
+	// s3GetExpiry is how long the worker has to fetch the object, which
+	// includes the time the job waits in the queue.
+	s3GetExpiry = 24 * time.Hour
+	// s3SubmitWindow is how long an object key can be submitted after it was
+	// handed out, the upload included.
+	s3SubmitWindow = 6 * time.Hour
+)
+
+// unsafeKeyChars are replaced in file names put into object keys.
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// S3Uploads lets the UI upload files straight to an S3 bucket instead of
+// through the agent: the browser gets a presigned PUT URL, uploads the file
+// and submits the object key, which the worker then fetches with a presigned
+// GET URL. Only keys handed out here are accepted, each once. The bucket
+// needs a CORS rule allowing PUT from the UI's origin, and a lifecycle rule
+// if uploads shouldn't be kept.
+type S3Uploads struct {
+	cfg      Config
+	endpoint *url.URL
+	mu       sync.Mutex
+	issued   map[string]s3Upload
+}
+
+type s3Upload struct {
+	filename string
+	owner    string
+	expires  time.Time
+}
+
+// NewS3Uploads returns the S3 uploads of --s3-bucket, or nil without one.
+func NewS3Uploads(cfg Config) (*S3Uploads, error) {
+	if cfg.S3Bucket == "" {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.Errorf("invalid S3 endpoint %q", cfg.S3Endpoint)
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, errors.New("S3 uploads need an access key and a secret key")
+	}
+	return &S3Uploads{cfg: cfg, endpoint: endpoint, issued: make(map[string]s3Upload)}, nil
+}
+
+// origin is the scheme and host the browser uploads to, for the UI's
+// Content-Security-Policy.
+func (s *S3Uploads) origin() string {
+	return s.endpoint.Scheme + "://" + s.endpoint.Host
+}
+
+// objectURL returns the path-style URL of the object, which works with
+// AWS as well as MinIO and other S3-compatible stores.
+func (s *S3Uploads) objectURL(key string) *url.URL {
+	object := *s.endpoint
+	object.Path = strings.TrimSuffix(object.Path, "/") + "/" + s.cfg.S3Bucket + "/" + key
+	object.RawQuery = ""
+	return &object
+}
+
+// presign returns the object URL signed with AWS Signature Version 4 in the
+// query string, valid for expires. Headers, like Content-Length, are signed
+// as well, so the request must send them with these values.
+func (s *S3Uploads) presign(method string, object *url.URL, headers map[string]string, expires time.Duration, now time.Time) string {
+	date := now.UTC().Format("20060102T150405Z")
+	scope := date[:8] + "/" + s.cfg.S3Region + "/s3/aws4_request"
+
+	signed := map[string]string{"host": object.Host}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.cfg.S3AccessKey + "/" + scope},
+		"X-Amz-Date":          {date},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {signedHeaders},
+	}
+	canonicalQuery := awsQuery(query)
+	canonicalRequest := strings.Join([]string{method, awsEscape(object.Path, false), canonicalQuery,
+		canonicalHeaders.String(), signedHeaders, "UNSIGNED-PAYLOAD"}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key4 := hmacSHA256([]byte("AWS4"+s.cfg.S3SecretKey), date[:8])
+	key4 = hmacSHA256(key4, s.cfg.S3Region)
+	key4 = hmacSHA256(key4, "s3")
+	key4 = hmacSHA256(key4, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key4, stringToSign))
+
+	object.RawPath = awsEscape(object.Path, false)
+	object.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return object.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsQuery encodes the query sorted by name, escaped the way SigV4 expects.
+func awsQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes unless they're escaped too, as in query values.
+func awsEscape(value string, slashes bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !slashes:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3PresignHandler hands out an object key and a URL the browser PUTs the
+// file to. The declared size is signed, so the upload can't be bigger.
+func s3PresignHandler(w http.ResponseWriter, r *http.Request, uploads *S3Uploads, pool *WorkerPool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var body struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Filename == "" || body.Size <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with the filename and size")
+		return
+	}
+	if body.Size > uploads.cfg.MaxAudioSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "File too large")
+		return
+	}
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+
+	name := unsafeKeyChars.ReplaceAllString(path.Base(body.Filename), "_")
+	key := uploads.cfg.S3Prefix + newJobID() + "/" + name
+	now := time.Now()
+	uploads.mu.Lock()
+	for issued, upload := range uploads.issued {
+		if now.After(upload.expires) {
+			delete(uploads.issued, issued)
+		}
+	}
+	uploads.issued[key] = s3Upload{filename: body.Filename, owner: requestOwner(r), expires: now.Add(s3SubmitWindow)}
+	uploads.mu.Unlock()
+
+	headers := map[string]string{"content-length": strconv.FormatInt(body.Size, 10)}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"key": key,
+		"url": uploads.presign(http.MethodPut, uploads.objectURL(key), headers, s3PutExpiry, now),
+	})
+}
+
+// s3SubmitHandler queues the transcription of an uploaded object, with the
+// options of a UI upload as query parameters.
+func s3SubmitHandler(w http.ResponseWriter, r *http.Request, uploads *S3Uploads, pool *WorkerPool, cfg Config) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Key == "" {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with the object key")
+		return
+	}
+	task := &TranscriptionTask{Owner: requestOwner(r)}
+	applyQueryOptions(task, r)
+	task.Summarize = task.Summarize && cfg.summarizeEnabled()
+	// Someone is waiting on the page, as with uploads through the agent.
+	if task.Priority == "" {
+		task.Priority = priorityHigh
+	}
+	if err := checkTaskOptions(cfg, task); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+
+	uploads.mu.Lock()
+	upload, ok := uploads.issued[body.Key]
+	if ok && upload.owner == task.Owner && time.Now().Before(upload.expires) {
+		delete(uploads.issued, body.Key)
+	} else {
+		ok = false
+	}
+	uploads.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Unknown or expired upload")
+		return
+	}
+
+	task.Filename = upload.filename
+	task.AudioURL = uploads.presign(http.MethodGet, uploads.objectURL(body.Key), nil, s3GetExpiry, time.Now())
+	job, err := pool.Submit("upload", task)
+	if err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scheduleRetryDelay is how long a job whose time came waits before being
+// queued again when the pool rejected it, e.g. because the queue was full.
+const scheduleRetryDelay = time.Minute
+
+var (
+	errSchedulingDisabled = errors.New("scheduling jobs with run_at requires --schedule-dir")
+	errNotScheduled       = errors.New("job is no longer scheduled")
+	errScheduledHeaders   = errors.New("scheduling jobs with download_headers requires an encryption key, since they're kept on disk until run_at")
+)
+
+// Scheduler defers jobs submitted with a run_at, e.g. heavy batches to the
+// off-peak hours when the GPUs are idle, and queues them once their time
+// comes. Every scheduled job is kept in --schedule-dir as a JSON file with its
+// options and, for uploads, a file with the audio, encrypted if there's a
+// key, so schedules survive restarts. Both are removed once the job is queued
+// or cancelled.
+type Scheduler struct {
+	cfg   Config
+	store *JobStore
+	pool  *WorkerPool
+	mu    sync.Mutex
+	jobs  map[string]*scheduledJob
+	wake  chan struct{}
+}
+
+// scheduledJob is what's kept on disk of a scheduled job: the job itself and
+// the options of its task.
+type scheduledJob struct {
+	Job             Job               `json:"job"`
+	Owner           string            `json:"owner,omitempty"`
+	AudioURL        string            `json:"audio_url,omitempty"`
+	DownloadHeaders map[string]string `json:"download_headers,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"`
+	Summarize       bool              `json:"summarize,omitempty"`
+	Chapters        bool              `json:"chapters,omitempty"`
+	Sentiment       bool              `json:"sentiment,omitempty"`
+	Entities        bool              `json:"entities,omitempty"`
+	TranslateTo     string            `json:"translate_to,omitempty"`
+	Profanity       string            `json:"profanity,omitempty"`
+	Vocabulary      []string          `json:"vocabulary,omitempty"`
+
+	// due is when to queue the job next: its run_at, or later after the
+	// pool rejected it.
+	due time.Time
+}
+
+// NewScheduler restores the jobs scheduled in --schedule-dir to the store;
+// Run queues them once their time comes, right away for those missed while
+// the agent was down.
+func NewScheduler(store *JobStore, pool *WorkerPool, cfg Config) (*Scheduler, error) {
+	if err := os.MkdirAll(cfg.ScheduleDir, 0o700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &Scheduler{cfg: cfg, store: store, pool: pool, jobs: make(map[string]*scheduledJob), wake: make(chan struct{}, 1)}
+	paths, err := filepath.Glob(filepath.Join(cfg.ScheduleDir, "*.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	restored := []*scheduledJob{}
+	for _, path := range paths {
+		var data bytes.Buffer
+		if err := readScheduledFile(path, cfg.encryptionKey, &data); err != nil {
+			return nil, err
+		}
+		scheduled := &scheduledJob{}
+		if err := json.Unmarshal(data.Bytes(), scheduled); err != nil || scheduled.Job.RunAt == nil {
+			return nil, errors.Errorf("invalid scheduled job %s", path)
+		}
+		scheduled.due = *scheduled.Job.RunAt
+		restored = append(restored, scheduled)
+	}
+	sort.Slice(restored, func(i, j int) bool {
+		return restored[i].Job.CreatedAt.Before(restored[j].Job.CreatedAt)
+	})
+	for _, scheduled := range restored {
+		scheduled.Job.Owner = scheduled.Owner
+		store.Restore(scheduled.Job)
+		s.jobs[scheduled.Job.ID] = scheduled
+	}
+	if len(restored) > 0 {
+		log.Printf("Restored %d scheduled jobs", len(restored))
+	}
+	return s, nil
+}
+
+func (s *Scheduler) path(id, ext string) string {
+	return filepath.Join(s.cfg.ScheduleDir, id+ext)
+}
+
+// Schedule creates a scheduled job for the task and keeps it on disk until
+// the task's RunAt. The scheduler takes over the task's audio. Download
+// headers are only kept encrypted, so they're refused without a key.
+func (s *Scheduler) Schedule(source string, task *TranscriptionTask) (Job, error) {
+	if len(task.DownloadHeaders) > 0 && s.cfg.encryptionKey == nil {
+		return Job{}, errScheduledHeaders
+	}
+	job := s.store.Create(source, task.Filename, task.Priority, task.Tenant, task.Owner, task.Metadata)
+	s.store.Schedule(job.ID, *task.RunAt)
+	job, _ = s.store.Get(job.ID)
+	scheduled := &scheduledJob{
+		Job:             job,
+		Owner:           task.Owner,
+		AudioURL:        task.AudioURL,
+		DownloadHeaders: task.DownloadHeaders,
+		ContentType:     task.ContentType,
+		Summarize:       task.Summarize,
+		Chapters:        task.Chapters,
+		Sentiment:       task.Sentiment,
+		Entities:        task.Entities,
+		TranslateTo:     task.TranslateTo,
+		Profanity:       task.Profanity,
+		Vocabulary:      task.Vocabulary,
+		due:             *task.RunAt,
+	}
+	if err := s.save(scheduled, task.Audio); err != nil {
+		s.remove(job.ID)
+		s.store.Remove(job.ID)
+		return Job{}, err
+	}
+	if task.Audio != nil {
+		task.Audio.Close()
+	}
+
+	s.mu.Lock()
+	s.jobs[job.ID] = scheduled
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	log.Printf("Scheduled job %s for %s", job.ID, task.RunAt.Format(time.RFC3339))
+	return job, nil
+}
+
+// save writes the job and its audio, if any, to the schedule dir, both
+// encrypted if there's a key: the JSON holds the metadata and the download
+// headers, which may carry credentials and so are only scheduled with a key. It's written last, so a crash in
+// between leaves no job without audio.
+func (s *Scheduler) save(scheduled *scheduledJob, audio *AudioBuffer) error {
+	if audio != nil {
+		if err := writeScheduledFile(s.path(scheduled.Job.ID, ".audio"), audio.Reader(), s.cfg.encryptionKey); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(scheduled)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	temp := s.path(scheduled.Job.ID, ".json.tmp")
+	if err := writeScheduledFile(temp, bytes.NewReader(data), s.cfg.encryptionKey); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Rename(temp, s.path(scheduled.Job.ID, ".json")))
+}
+
+func (s *Scheduler) remove(id string) {
+	for _, ext := range []string{".json", ".json.tmp", ".audio"} {
+		if err := os.Remove(s.path(id, ext)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Removing scheduled job %s failed: %v", id, err)
+		}
+	}
+}
+
+// Cancel cancels a scheduled job, returning false if it isn't scheduled.
+func (s *Scheduler) Cancel(id, reason string) bool {
+	s.mu.Lock()
+	_, ok := s.jobs[id]
+	delete(s.jobs, id)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	s.remove(id)
+	s.store.Cancel(id, reason)
+	return true
+}
+
+// Run queues the scheduled jobs once their time comes.
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		var next time.Time
+		for _, scheduled := range s.jobs {
+			if next.IsZero() || scheduled.due.Before(next) {
+				next = scheduled.due
+			}
+		}
+		s.mu.Unlock()
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+		s.queueDue()
+	}
+}
+
+// queueDue submits the jobs whose time came to the pool, trying again later
+// for those it rejects.
+func (s *Scheduler) queueDue() {
+	now := time.Now()
+	s.mu.Lock()
+	due := []*scheduledJob{}
+	for _, scheduled := range s.jobs {
+		if !scheduled.due.After(now) {
+			due = append(due, scheduled)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Job.RunAt.Before(*due[j].Job.RunAt)
+	})
+
+	for _, scheduled := range due {
+		id := scheduled.Job.ID
+		task, err := s.task(scheduled)
+		if err == nil {
+			_, err = s.pool.Submit(scheduled.Job.Source, task)
+			if err != nil && task.Audio != nil {
+				task.Audio.Close()
+			}
+		}
+		switch {
+		case err == nil:
+			log.Printf("Queued scheduled job %s", id)
+		case err == errNotScheduled:
+			// Cancelled meanwhile.
+		case errors.Is(err, errQueueFull), errors.Is(err, errDraining), errors.Is(err, errMemoryPressure), errors.Is(err, errReadOnly), isMaintenance(err):
+			log.Printf("Queueing scheduled job %s failed, retrying in %s: %v", id, scheduleRetryDelay, err)
+			s.mu.Lock()
+			scheduled.due = now.Add(scheduleRetryDelay)
+			s.mu.Unlock()
+			continue
+		default:
+			log.Printf("Queueing scheduled job %s failed: %v", id, err)
+			s.store.Fail(id, err)
+		}
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+		s.remove(id)
+	}
+}
+
+func isMaintenance(err error) bool {
+	_, ok := err.(*maintenanceError)
+	return ok
+}
+
+// task rebuilds the task of the scheduled job, loading its audio.
+func (s *Scheduler) task(scheduled *scheduledJob) (*TranscriptionTask, error) {
+	job := scheduled.Job
+	task := &TranscriptionTask{
+		Filename:        job.Filename,
+		AudioURL:        scheduled.AudioURL,
+		ContentType:     scheduled.ContentType,
+		Summarize:       scheduled.Summarize,
+		Chapters:        scheduled.Chapters,
+		Sentiment:       scheduled.Sentiment,
+		Entities:        scheduled.Entities,
+		TranslateTo:     scheduled.TranslateTo,
+		Profanity:       scheduled.Profanity,
+		Vocabulary:      scheduled.Vocabulary,
+		Priority:        job.Priority,
+		Tenant:          job.Tenant,
+		Owner:           scheduled.Owner,
+		Metadata:        job.Metadata,
+		DownloadHeaders: scheduled.DownloadHeaders,
+		JobID:           job.ID,
+	}
+	if scheduled.AudioURL == "" {
+		audio, err := readScheduledAudio(s.path(job.ID, ".audio"), s.cfg)
+		if err != nil {
+			return nil, err
+		}
+		task.Audio, task.OwnsAudio = audio, true
+	}
+	return task, nil
+}
+
+// writeScheduledFile copies r to path, encrypted if there's a key, with the
+// nonce in front.
+func writeScheduledFile(path string, r io.Reader, key []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	var cipher *fileCipher
+	if key != nil {
+		if cipher, err = newFileCipher(key); err != nil {
+			return err
+		}
+		if _, err := file.Write(cipher.nonce[:]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	buf := make([]byte, 64<<10)
+	var offset int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if cipher != nil {
+				cipher.xorAt(buf[:n], offset)
+			}
+			if _, err := file.Write(buf[:n]); err != nil {
+				return errors.WithStack(err)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(file.Sync())
+}
+
+// readScheduledFile copies a file written by writeScheduledFile to w.
+func readScheduledFile(path string, key []byte, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	var cipher *fileCipher
+	if key != nil {
+		if cipher, err = newFileCipher(key); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(file, cipher.nonce[:]); err != nil {
+			return errors.Wrapf(err, "reading the nonce of %s", path)
+		}
+	}
+	buf := make([]byte, 64<<10)
+	var offset int64
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if cipher != nil {
+				cipher.xorAt(buf[:n], offset)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return errors.WithStack(err)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// readScheduledAudio loads the audio of a scheduled job into a buffer.
+func readScheduledAudio(path string, cfg Config) (*AudioBuffer, error) {
+	buffer := cfg.newAudioBuffer()
+	if err := readScheduledFile(path, cfg.encryptionKey, buffer); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// runAtParam reads the run_at=<RFC 3339 time> request parameter; times that
+// already passed are treated as none.
+func runAtParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	runAt, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.New("run_at must be an RFC 3339 time like 2024-01-02T01:00:00Z")
+	}
+	if !runAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &runAt, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestPool returns a pool without workers, so queued jobs stay queued.
+func newTestPool(cfg Config) (*JobStore, *WorkerPool) {
+	metrics := NewMetrics()
+	store := NewJobStore(100, 0)
+	return store, NewWorkerPool(store, metrics, NewMemoryGuard(metrics, cfg), cfg)
+}
+
+func TestSchedulerRestore(t *testing.T) {
+	cfg := Config{
+		ScheduleDir:    t.TempDir(),
+		SpillDir:       t.TempDir(),
+		SpillThreshold: 1 << 20,
+		QueueSize:      10,
+		encryptionKey:  bytes.Repeat([]byte{4}, 32),
+	}
+	audio := testAudio()
+	store, pool := newTestPool(cfg)
+	scheduler, err := NewScheduler(store, pool, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.UseScheduler(scheduler)
+
+	// The upload's time comes while the agent is down, the download's after
+	// it's back.
+	buffer := cfg.newAudioBuffer()
+	buffer.Write(audio)
+	missed := time.Now().Add(-time.Minute)
+	upload, err := pool.Submit("api", &TranscriptionTask{
+		Filename: "a.wav", Audio: buffer, OwnsAudio: true, RunAt: &missed,
+		Priority: priorityHigh, Tenant: "acme", Owner: "alice", Summarize: true, Vocabulary: []string{"Kubernetes"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	download, err := pool.Submit("api", &TranscriptionTask{
+		Filename: "b.wav", AudioURL: "https://example.com/b.wav", DownloadHeaders: map[string]string{"Authorization": "Bearer secret"},
+		RunAt: &later, Tenant: "acme",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is kept on disk in the clear.
+	paths, _ := filepath.Glob(filepath.Join(cfg.ScheduleDir, "*"))
+	if len(paths) != 3 {
+		t.Fatalf("schedule dir holds %v, want the two jobs and an audio file", paths)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("alice")) || bytes.Contains(data, audio[:64]) {
+			t.Errorf("%s isn't encrypted", path)
+		}
+	}
+
+	// A restart restores both to a new store.
+	store, pool = newTestPool(cfg)
+	scheduler, err = NewScheduler(store, pool, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.UseScheduler(scheduler)
+	for _, want := range []Job{upload, download} {
+		job, ok := store.Get(want.ID)
+		if !ok || job.Status != JobScheduled || job.Tenant != "acme" || job.Owner != want.Owner || !job.RunAt.Equal(*want.RunAt) {
+			t.Errorf("restored %+v (%v), want %+v", job, ok, want)
+		}
+	}
+
+	// The missed one is queued right away with its audio and options.
+	scheduler.queueDue()
+	queued := pool.Queued(QueueFilter{})
+	if len(queued) != 1 || queued[0].ID != upload.ID || queued[0].Priority != priorityHigh {
+		t.Fatalf("queued = %+v, want %s", queued, upload.ID)
+	}
+	if job, _ := store.Get(upload.ID); job.Status != JobPending {
+		t.Errorf("status = %s, want pending", job.Status)
+	}
+	task := pool.tasks[upload.ID]
+	if task.Owner != "alice" || !task.Summarize || len(task.Vocabulary) != 1 || task.Vocabulary[0] != "Kubernetes" {
+		t.Errorf("task = %+v", task)
+	}
+	if read, err := io.ReadAll(task.Audio.Reader()); err != nil || !bytes.Equal(read, audio) {
+		t.Errorf("audio restored as %d bytes (%v)", len(read), err)
+	}
+	task.Audio.Close()
+	for _, ext := range []string{".json", ".audio"} {
+		if _, err := os.Stat(scheduler.path(upload.ID, ext)); !os.IsNotExist(err) {
+			t.Errorf("%s of the queued job left behind: %v", ext, err)
+		}
+	}
+
+	// The other one waits for its time, and can still be cancelled.
+	scheduler.mu.Lock()
+	scheduled := scheduler.jobs[download.ID]
+	scheduler.mu.Unlock()
+	if scheduled == nil || scheduled.DownloadHeaders["Authorization"] != "Bearer secret" || !scheduled.due.Equal(later) {
+		t.Fatalf("scheduled = %+v", scheduled)
+	}
+	if !pool.Cancel(download.ID, "cancelled") {
+		t.Fatal("scheduled job not cancelled")
+	}
+	if job, _ := store.Get(download.ID); job.Status != JobCancelled {
+		t.Errorf("status = %s, want cancelled", job.Status)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(cfg.ScheduleDir, "*")); len(paths) != 0 {
+		t.Errorf("schedule dir still holds %v", paths)
+	}
+}
+
+func TestSchedulerRestoreWrongKey(t *testing.T) {
+	cfg := Config{ScheduleDir: t.TempDir(), QueueSize: 10, encryptionKey: bytes.Repeat([]byte{5}, 32)}
+	store, pool := newTestPool(cfg)
+	scheduler, err := NewScheduler(store, pool, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAt := time.Now().Add(time.Hour)
+	if _, err := scheduler.Schedule("api", &TranscriptionTask{Filename: "a.wav", AudioURL: "https://example.com/a.wav", RunAt: &runAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.encryptionKey = bytes.Repeat([]byte{6}, 32)
+	store, pool = newTestPool(cfg)
+	if _, err := NewScheduler(store, pool, cfg); err == nil {
+		t.Error("jobs restored with another key")
+	}
+}
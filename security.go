@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// withUISecurity adds standard security headers to every UI response and
+// enforces double-submit CSRF protection: every browser gets a random token in
+// a cookie, and state-changing requests must echo it back in the X-CSRF-Token
+// header. Another origin can make the browser send the cookie but can't read
+// it, so it can't forge the echo. The pages may connect to the connectSrc
+// origin besides their own, e.g. the bucket of direct S3 uploads.
+func withUISecurity(next http.Handler, connectSrc string) http.Handler {
+	policy := "default-src 'self'; media-src 'self' blob:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+	if connectSrc != "" {
+		policy += "; connect-src 'self' " + connectSrc
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", policy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "same-origin")
+
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token = newRandomToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !validCSRFToken(r, token) {
+				writeJSONError(w, http.StatusForbidden, "Missing or invalid CSRF token")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validCSRFToken(r *http.Request, expected string) bool {
+	if _, err := r.Cookie(csrfCookieName); err != nil {
+		return false
+	}
+	sent := r.Header.Get(csrfHeaderName)
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
+
+// withAdminToken only lets requests through that carry token as a bearer
+// token or, with OIDC, an access token of a user with the admin role.
+func withAdminToken(token string, oidc *OIDC, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidc != nil {
+			user, err := oidc.authenticate(r)
+			if err != nil {
+				writeJSONError(w, http.StatusUnauthorized, "Invalid access token: "+err.Error())
+				return
+			}
+			if user != nil {
+				if !user.has(roleAdmin) {
+					writeForbidden(w, roleAdmin)
+					return
+				}
+				next(w, withUser(r, user))
+				return
+			}
+		}
+		sent := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func newRandomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
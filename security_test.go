@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUISecurityCSRF(t *testing.T) {
+	handler := withUISecurity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "")
+	const token = "0123456789abcdef"
+	tests := []struct {
+		name       string
+		method     string
+		cookie     string
+		header     string
+		wantStatus int
+	}{
+		{name: "GET without a token", method: http.MethodGet, wantStatus: http.StatusNoContent},
+		{name: "POST with the token", method: http.MethodPost, cookie: token, header: token, wantStatus: http.StatusNoContent},
+		{name: "DELETE with the token", method: http.MethodDelete, cookie: token, header: token, wantStatus: http.StatusNoContent},
+		{name: "POST with another token", method: http.MethodPost, cookie: token, header: "fedcba9876543210", wantStatus: http.StatusForbidden},
+		{name: "POST with a prefix of the token", method: http.MethodPost, cookie: token, header: token[:8], wantStatus: http.StatusForbidden},
+		{name: "POST without the header", method: http.MethodPost, cookie: token, wantStatus: http.StatusForbidden},
+		{name: "POST without the cookie", method: http.MethodPost, header: token, wantStatus: http.StatusForbidden},
+		{name: "PUT without either", method: http.MethodPut, wantStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/ui/jobs", nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: test.cookie})
+			}
+			if test.header != "" {
+				r.Header.Set(csrfHeaderName, test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+
+			// Browsers without a token get a new one, others keep theirs.
+			var issued *http.Cookie
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == csrfCookieName {
+					issued = cookie
+				}
+			}
+			if test.cookie == "" && (issued == nil || issued.Value == "" || issued.Value == test.header) {
+				t.Errorf("issued token = %+v", issued)
+			}
+			if test.cookie != "" && issued != nil {
+				t.Errorf("token %q replaced with %q", test.cookie, issued.Value)
+			}
+			if w.Header().Get("X-Frame-Options") != "DENY" {
+				t.Error("security headers missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// segmentsSchema identifies the version of the segments format. Fields may be
+// added to it; anything else gets a new version.
+const segmentsSchema = "whisper-transcribe-agent/segments/v1"
+
+// segmentsDocument is the "segments" export format: a schema of our own that
+// is the same whichever backend produced the transcript, so consumers don't
+// have to handle the variations of verbose_json between whisper servers.
+// Every field is always present; what the backend didn't report is null.
+type segmentsDocument struct {
+	Schema   string              `json:"schema"`
+	Text     string              `json:"text"`
+	Language *string             `json:"language"`
+	Duration *float64            `json:"duration"`
+	Segments []structuredSegment `json:"segments"`
+}
+
+type structuredSegment struct {
+	ID         int              `json:"id"`
+	Start      float64          `json:"start"`
+	End        float64          `json:"end"`
+	Text       string           `json:"text"`
+	Speaker    *string          `json:"speaker"`
+	Confidence *float64         `json:"confidence"`
+	Words      []structuredWord `json:"words"`
+}
+
+type structuredWord struct {
+	Word       string   `json:"word"`
+	Start      float64  `json:"start"`
+	End        float64  `json:"end"`
+	Confidence *float64 `json:"confidence"`
+}
+
+// structureSegments converts the transcript to a segmentsDocument. Words are
+// attributed to the segment they start in. A transcript without segments,
+// from a backend that only returns text, becomes a single segment.
+func structureSegments(transcript *Transcript) segmentsDocument {
+	doc := segmentsDocument{Schema: segmentsSchema, Text: strings.TrimSpace(transcript.Text), Segments: []structuredSegment{}}
+	if transcript.Language != "" {
+		doc.Language = &transcript.Language
+	}
+	if transcript.Duration > 0 {
+		doc.Duration = &transcript.Duration
+	}
+
+	segments := transcript.Segments
+	if len(segments) == 0 && doc.Text != "" {
+		segments = []Segment{{Start: 0, End: transcript.Duration, Text: transcript.Text}}
+	}
+	words := transcript.Words
+	for i, segment := range segments {
+		structured := structuredSegment{
+			ID:         i,
+			Start:      segment.Start,
+			End:        segment.End,
+			Text:       strings.TrimSpace(segment.Text),
+			Confidence: segment.Confidence,
+			Words:      []structuredWord{},
+		}
+		if segment.Speaker != "" {
+			speaker := string(segment.Speaker)
+			structured.Speaker = &speaker
+		}
+		last := i == len(segments)-1
+		for len(words) > 0 && (last || words[0].Start < segments[i+1].Start) {
+			structured.Words = append(structured.Words, structuredWord{
+				Word:       words[0].Word,
+				Start:      words[0].Start,
+				End:        words[0].End,
+				Confidence: words[0].Probability,
+			})
+			words = words[1:]
+		}
+		doc.Segments = append(doc.Segments, structured)
+	}
+	return doc
+}
+
+func renderSegments(transcript *Transcript) ([]byte, error) {
+	return json.MarshalIndent(structureSegments(transcript), "", "  ")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sentimentThreshold is how far from 0 a score has to be to count as
+	// positive or negative rather than neutral.
+	sentimentThreshold = 0.25
+	// sentimentNegationSpan is how many words after "not" a positive or
+	// negative word has its polarity flipped.
+	sentimentNegationSpan = 3
+)
+
+const sentimentPrompt = `You rate the sentiment of transcript segments, e.g. of customer calls.
+You get a JSON array of strings and reply with a JSON array of numbers from -1 (very negative) through 0 (neutral) to 1 (very positive), one per string, in the same order.
+Reply with the JSON array only.`
+
+var positiveWords = wordSet(`amazing appreciate awesome beautiful best better brilliant excellent fantastic fine glad good great happy
+helpful impressed like love loved lovely nice perfect pleased recommend resolved satisfied super thank thanks wonderful`)
+
+var negativeWords = wordSet(`angry annoyed annoying awful bad broken cancel complain complaint disappointed disappointing frustrated
+frustrating hate horrible issue terrible unacceptable unhappy upset useless waste worse worst wrong ridiculous problem`)
+
+var negations = wordSet(`not no never don't doesn't didn't isn't wasn't aren't won't can't cannot nothing`)
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// Sentiment aggregates the segment scores of a transcript. Average weighs
+// segments by their duration.
+type Sentiment struct {
+	Average  float64 `json:"average"`
+	Label    string  `json:"label"`
+	Positive int     `json:"positive"`
+	Neutral  int     `json:"neutral"`
+	Negative int     `json:"negative"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// wantsSentiment reads the sentiment=true request parameter.
+func wantsSentiment(r *http.Request) bool {
+	sentiment, _ := strconv.ParseBool(r.URL.Query().Get("sentiment"))
+	return sentiment
+}
+
+// analyzeSentiment scores every segment from -1 to 1 with the LLM at
+// --llm-url if it's set, else with a small English word list, and returns the
+// aggregate. If the LLM fails the word list is used and the error is recorded.
+func analyzeSentiment(cfg Config, transcript *Transcript) *Sentiment {
+	segments := transcript.Segments
+	if len(segments) == 0 {
+		segments = []Segment{{Start: 0, End: transcript.Duration, Text: transcript.Text}}
+	}
+
+	var scores []float64
+	var llmErr error
+	if cfg.summarizeEnabled() {
+		scores, llmErr = sentimentLLM(cfg, segments)
+	}
+	if scores == nil {
+		for _, segment := range segments {
+			scores = append(scores, sentimentLexicon(segment.Text))
+		}
+	}
+
+	sentiment := &Sentiment{}
+	if llmErr != nil {
+		sentiment.Error = llmErr.Error()
+	}
+	var weighted, total float64
+	for i, score := range scores {
+		score := math.Round(score*100) / 100
+		if i < len(transcript.Segments) {
+			transcript.Segments[i].Sentiment = &score
+		}
+		switch {
+		case score >= sentimentThreshold:
+			sentiment.Positive++
+		case score <= -sentimentThreshold:
+			sentiment.Negative++
+		default:
+			sentiment.Neutral++
+		}
+		duration := math.Max(segments[i].End-segments[i].Start, 0.1)
+		weighted += score * duration
+		total += duration
+	}
+	sentiment.Average = math.Round(weighted/total*100) / 100
+	sentiment.Label = sentimentLabel(sentiment.Average)
+	return sentiment
+}
+
+func sentimentLLM(cfg Config, segments []Segment) ([]float64, error) {
+	scores := make([]float64, 0, len(segments))
+	for start := 0; start < len(segments); start += rewriteBatch {
+		var texts []string
+		for _, segment := range segments[start:min(start+rewriteBatch, len(segments))] {
+			texts = append(texts, strings.TrimSpace(segment.Text))
+		}
+		var batch []float64
+		if err := completeLLMJSON(cfg, sentimentPrompt, texts, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) != len(texts) {
+			return nil, errors.New("LLM returned a different number of scores")
+		}
+		for _, score := range batch {
+			scores = append(scores, math.Max(-1, math.Min(1, score)))
+		}
+	}
+	return scores, nil
+}
+
+// sentimentLexicon counts positive and negative words, flipping the first one
+// shortly after a negation ("not really good"), and squashes the sum into
+// -1..1.
+func sentimentLexicon(text string) float64 {
+	sum, negated := 0.0, 0
+	for _, word := range profanityWordPattern.FindAllString(strings.ToLower(text), -1) {
+		polarity := 0.0
+		switch {
+		case negations[word]:
+			negated = sentimentNegationSpan
+			continue
+		case positiveWords[word]:
+			polarity = 1
+		case negativeWords[word]:
+			polarity = -1
+		}
+		if negated > 0 && polarity != 0 {
+			polarity, negated = -polarity, 0
+		} else if negated > 0 {
+			negated--
+		}
+		sum += polarity
+	}
+	return sum / math.Sqrt(sum*sum+4)
+}
+
+func sentimentLabel(score float64) string {
+	switch {
+	case score >= sentimentThreshold:
+		return "positive"
+	case score <= -sentimentThreshold:
+		return "negative"
+	}
+	return "neutral"
+}
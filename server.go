@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newServer builds a listener for the handler. With TLS configured, HTTP/2 is
+// negotiated automatically via ALPN; enableH2C additionally accepts cleartext
+// HTTP/2, which is only safe behind a trusted proxy that terminates TLS.
+func newServer(addr string, handler http.Handler, enableH2C bool) *http.Server {
+	if enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return &http.Server{Addr: addr, Handler: handler}
+}
+
+// listen returns the socket-activated listener with the given name, falling
+// back to listening on addr.
+func listen(activated map[string]net.Listener, name, addr string) (net.Listener, error) {
+	if listener, ok := activated[name]; ok {
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serve(server *http.Server, listener net.Listener, cfg Config) error {
+	if cfg.TLSCert != "" {
+		return server.ServeTLS(listener, cfg.TLSCert, cfg.TLSKey)
+	}
+	return server.Serve(listener)
+}
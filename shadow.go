@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+// shadowSampleLength caps the diff logged for a divergent job.
+const shadowSampleLength = 1000
+
+var shadowWERBuckets = []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.3, 0.5, 1}
+
+// Shadow sends a sample of jobs to a second backend as well and compares its
+// transcript to the primary's by word error rate, to evaluate a backend or
+// model on real traffic before switching to it. Users only ever get the
+// primary's transcript. The shadow gets the original audio, without the
+// pipeline's audio steps or chunking.
+type Shadow struct {
+	cfg     Config
+	metrics *Metrics
+	// slots bounds the shadow transcriptions running at once to the number of
+	// workers; jobs sampled while all are taken are skipped.
+	slots chan struct{}
+}
+
+type shadowResult struct {
+	transcript *Transcript
+	err        error
+}
+
+func NewShadow(metrics *Metrics, cfg Config) *Shadow {
+	metrics.Counter("whisper_agent_shadow_total", "Jobs sampled for the shadow backend, by outcome: compared, failed, primary_failed or skipped when busy.")
+	metrics.Histogram("whisper_agent_shadow_wer", "Word error rate of the shadow backend's transcripts against the primary's.", shadowWERBuckets)
+	metrics.Counter("whisper_agent_shadow_diverged_total", "Shadow transcripts with a word error rate of at least --shadow-log-wer, logged with a sample diff.")
+	return &Shadow{cfg: cfg, metrics: metrics, slots: make(chan struct{}, cfg.Workers)}
+}
+
+// Start samples the task and, if picked, starts transcribing its audio on the
+// shadow backend. It returns nil if the task isn't shadowed, else a function
+// comparing the shadow's transcript to the primary's once both are done. The
+// task's audio must stay open until that function returns.
+func (s *Shadow) Start(task *TranscriptionTask) func(primary *Transcript, err error) {
+	if rand.Float64() >= s.cfg.ShadowFraction {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.metrics.Inc("whisper_agent_shadow_total", "outcome", "skipped")
+		return nil
+	}
+
+	model := s.cfg.ShadowModel
+	if model == "" {
+		model = s.cfg.WhisperModel
+	}
+	done := make(chan shadowResult, 1)
+	go func() {
+		defer func() { <-s.slots }()
+		transcript, err := transcribe(context.Background(), s.cfg.ShadowURL, model, task.Prompt, task.Filename, task.Audio.Reader(), task.Audio.Size())
+		done <- shadowResult{transcript, err}
+	}()
+
+	jobID := task.JobID
+	return func(primary *Transcript, err error) {
+		shadow := <-done
+		switch {
+		case err != nil:
+			s.metrics.Inc("whisper_agent_shadow_total", "outcome", "primary_failed")
+			return
+		case shadow.err != nil:
+			s.metrics.Inc("whisper_agent_shadow_total", "outcome", "failed")
+			log.Printf("Shadow transcription of job %s failed: %v", jobID, shadow.err)
+			return
+		}
+		s.metrics.Inc("whisper_agent_shadow_total", "outcome", "compared")
+		wer := wordErrorRate(primary.Text, shadow.transcript.Text)
+		s.metrics.Observe("whisper_agent_shadow_wer", wer)
+		if wer >= s.cfg.ShadowLogWER {
+			s.metrics.Inc("whisper_agent_shadow_diverged_total")
+			log.Printf("Shadow transcript of job %s diverged with WER %.2f: %s", jobID, wer, formatDiffSample(diffTranscripts(primary.Text, shadow.transcript.Text)))
+		}
+	}
+}
+
+// formatDiffSample renders the changes of a diff as "-removed +added", with
+// a few words of context, cut off at shadowSampleLength.
+func formatDiffSample(ops []DiffOp) string {
+	var b strings.Builder
+	for _, op := range ops {
+		switch op.Op {
+		case diffDelete:
+			fmt.Fprintf(&b, "-[%s] ", op.Text)
+		case diffInsert:
+			fmt.Fprintf(&b, "+[%s] ", op.Text)
+		default:
+			words := strings.Fields(op.Text)
+			if len(words) > 6 {
+				words = append(append(words[:3:3], "…"), words[len(words)-3:]...)
+			}
+			b.WriteString(strings.Join(words, " ") + " ")
+		}
+	}
+	sample := strings.TrimSpace(b.String())
+	if len(sample) > shadowSampleLength {
+		sample = sample[:shadowSampleLength] + "…"
+	}
+	return sample
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sipSampleRate  = 8000
+	sipRTPTimeout  = 30 * time.Second
+	sipMaxMessage  = 65535
+	sipMaxRTPGap   = 5 * sipSampleRate
+	sipAllowHeader = "Allow: INVITE, ACK, BYE, CANCEL, OPTIONS"
+)
+
+// SIPListener answers SIP calls over UDP, records the G.711 audio the caller
+// sends over RTP and transcribes the call once it ends. A PBX can fork call
+// audio to it, e.g. from Asterisk with a Dial() or ChanSpy() to
+// SIP/agent-host. Transcripts show up as "sip" jobs like any other.
+//
+// Calls are answered immediately and never send audio back. There is no
+// registration or authentication: put the listener where only the PBX can
+// reach it.
+type SIPListener struct {
+	pool *WorkerPool
+	cfg  Config
+	conn net.PacketConn
+
+	mu    sync.Mutex
+	calls map[string]*sipCall
+}
+
+type sipCall struct {
+	id     string
+	from   string
+	to     string
+	toTag  string
+	answer []byte
+	rtp    net.PacketConn
+	format int
+	ended  chan struct{}
+	once   sync.Once
+}
+
+func NewSIPListener(pool *WorkerPool, cfg Config) (*SIPListener, error) {
+	conn, err := net.ListenPacket("udp", cfg.SIPAddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &SIPListener{pool: pool, cfg: cfg, conn: conn, calls: make(map[string]*sipCall)}, nil
+}
+
+func (s *SIPListener) Run() {
+	log.Printf("SIP listening on udp %s...", s.conn.LocalAddr())
+	buf := make([]byte, sipMaxMessage)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("SIP read failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		message, err := parseSIPMessage(buf[:n])
+		if err != nil || message.Method == "" {
+			// Keep-alive CRLFs, responses and garbage need no answer.
+			continue
+		}
+		s.handleRequest(message, addr)
+	}
+}
+
+func (s *SIPListener) reply(request *sipMessage, addr net.Addr, code int, reason, toTag string, extra []string, body []byte) {
+	if _, err := s.conn.WriteTo(sipResponse(request, code, reason, toTag, extra, body), addr); err != nil {
+		log.Printf("SIP reply to %s failed: %v", addr, err)
+	}
+}
+
+func (s *SIPListener) handleRequest(request *sipMessage, addr net.Addr) {
+	callID := request.Header.Get("Call-Id")
+	s.mu.Lock()
+	call := s.calls[callID]
+	s.mu.Unlock()
+
+	switch request.Method {
+	case "INVITE":
+		if call != nil {
+			// A retransmission or re-INVITE: the answer stays the same.
+			s.reply(request, addr, 200, "OK", call.toTag, s.answerHeaders(request, addr), call.answer)
+			return
+		}
+		s.invite(request, addr)
+	case "ACK":
+	case "BYE":
+		s.reply(request, addr, 200, "OK", "", nil, nil)
+		if call != nil {
+			call.end()
+		}
+	case "CANCEL":
+		// Calls are answered right away, so there's nothing left to cancel.
+		s.reply(request, addr, 200, "OK", "", nil, nil)
+	case "OPTIONS":
+		s.reply(request, addr, 200, "OK", newJobID(), []string{sipAllowHeader}, nil)
+	default:
+		s.reply(request, addr, 405, "Method Not Allowed", newJobID(), []string{sipAllowHeader}, nil)
+	}
+}
+
+func (s *SIPListener) answerHeaders(request *sipMessage, addr net.Addr) []string {
+	return []string{
+		"Contact: <sip:agent@" + net.JoinHostPort(s.advertisedIP(addr), sipPort(s.conn.LocalAddr())) + ">",
+		sipAllowHeader,
+		"Content-Type: application/sdp",
+	}
+}
+
+func (s *SIPListener) invite(request *sipMessage, addr net.Addr) {
+	offer, err := parseSDP(request.Body)
+	if err != nil {
+		s.reply(request, addr, 488, "Not Acceptable Here", newJobID(), nil, nil)
+		return
+	}
+	format := -1
+	for _, offered := range offer.Formats {
+		if offered == rtpPCMU || offered == rtpPCMA {
+			format = offered
+			break
+		}
+	}
+	if format < 0 {
+		log.Printf("SIP call %s offers no G.711 codec", request.Header.Get("Call-Id"))
+		s.reply(request, addr, 488, "Not Acceptable Here", newJobID(), nil, nil)
+		return
+	}
+	if err := s.pool.Admit(); err != nil {
+		s.reply(request, addr, 503, "Service Unavailable", newJobID(), []string{"Retry-After: 30"}, nil)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	rtp, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Printf("SIP opening RTP port failed: %v", err)
+		s.reply(request, addr, 500, "Server Internal Error", newJobID(), nil, nil)
+		return
+	}
+	ip := s.advertisedIP(addr)
+	call := &sipCall{
+		id:     request.Header.Get("Call-Id"),
+		from:   sipUser(request.Header.Get("From")),
+		to:     sipUser(request.Header.Get("To")),
+		toTag:  newJobID(),
+		rtp:    rtp,
+		format: format,
+		ended:  make(chan struct{}),
+	}
+	call.answer = sdpAnswer(ip, rtp.LocalAddr().(*net.UDPAddr).Port, format, time.Now().Unix())
+
+	s.mu.Lock()
+	s.calls[call.id] = call
+	s.mu.Unlock()
+	log.Printf("SIP call %s from %s to %s answered", call.id, call.from, call.to)
+	s.reply(request, addr, 200, "OK", call.toTag, s.answerHeaders(request, addr), call.answer)
+
+	go func() {
+		s.record(call)
+		s.mu.Lock()
+		delete(s.calls, call.id)
+		s.mu.Unlock()
+	}()
+}
+
+// advertisedIP is the address put in SDP and Contact: --sip-public-ip if set,
+// else the local address the caller's packets are routed to.
+func (s *SIPListener) advertisedIP(peer net.Addr) string {
+	if s.cfg.SIPPublicIP != "" {
+		return s.cfg.SIPPublicIP
+	}
+	if conn, err := net.Dial("udp", peer.String()); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	return "127.0.0.1"
+}
+
+func sipPort(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+// sipFilenamePart keeps a SIP user name safe to put in a filename.
+func sipFilenamePart(user string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '+' || r == '.' || r == '_' {
+			return r
+		}
+		return -1
+	}, user)
+}
+
+func (c *sipCall) end() {
+	c.once.Do(func() {
+		close(c.ended)
+		c.rtp.Close()
+	})
+}
+
+// record collects the call's audio until it ends, by BYE or by RTP going
+// quiet, and then transcribes it. Samples are placed by RTP timestamp, so
+// reordered packets land in the right spot and lost ones become silence.
+func (s *SIPListener) record(call *sipCall) {
+	maxSamples := int(s.cfg.MaxAudioSize-44) / 2
+	var samples []int16
+	var first uint32
+	started := false
+	buf := make([]byte, 2048)
+	for {
+		call.rtp.SetReadDeadline(time.Now().Add(sipRTPTimeout))
+		n, _, err := call.rtp.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-call.ended:
+			default:
+				log.Printf("SIP call %s: no audio for %v, ending it", call.id, sipRTPTimeout)
+			}
+			break
+		}
+		packet, err := parseRTPPacket(buf[:n])
+		if err != nil || int(packet.PayloadType) != call.format {
+			continue
+		}
+		if !started {
+			first, started = packet.Timestamp, true
+		}
+		offset := int(int32(packet.Timestamp - first))
+		// A timestamp far off is a new stream after a transfer or
+		// hold, so rebase onto the end of what's there.
+		if offset < -sipMaxRTPGap || offset > len(samples)+sipMaxRTPGap {
+			first = packet.Timestamp - uint32(len(samples))
+			offset = len(samples)
+		}
+		if offset < 0 {
+			continue
+		}
+		end := offset + len(packet.Payload)
+		if end > maxSamples {
+			log.Printf("SIP call %s reached the maximum audio size, ending it", call.id)
+			break
+		}
+		if end > len(samples) {
+			samples = append(samples, make([]int16, end-len(samples))...)
+		}
+		decodeG711(call.format, packet.Payload, samples[offset:end])
+	}
+	call.end()
+
+	if len(samples) == 0 {
+		log.Printf("SIP call %s ended without audio", call.id)
+		return
+	}
+	audio := wavHeader(sipSampleRate, len(samples))
+	for _, sample := range samples {
+		audio = append(audio, byte(sample), byte(sample>>8))
+	}
+	filename := "call-" + strings.Trim(sipFilenamePart(call.from)+"-"+sipFilenamePart(call.to), "-") + "-" + time.Now().Format("2006-01-02-150405") + ".wav"
+	result := transcribeStreamRequest(s.pool, s.cfg, "sip", streamRequest{ID: call.id, Audio: audio, Filename: filename})
+	if result.Status != JobCompleted {
+		log.Printf("SIP call %s transcription failed: %s", call.id, result.Error)
+		return
+	}
+	log.Printf("SIP call %s transcribed as job %s", call.id, result.JobID)
+}
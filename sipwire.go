@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// sipCompactHeaders maps the single-letter header forms to the full names.
+var sipCompactHeaders = map[string]string{
+	"v": "Via", "f": "From", "t": "To", "i": "Call-Id", "m": "Contact",
+	"l": "Content-Length", "c": "Content-Type",
+}
+
+// sipMessage is a SIP request or response. Header names are canonicalized
+// like HTTP's, so "Call-ID" is looked up as "Call-Id".
+type sipMessage struct {
+	Method     string
+	URI        string
+	StatusCode int
+	Reason     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+func parseSIPMessage(data []byte) (*sipMessage, error) {
+	head, body, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("malformed SIP start line %q", lines[0])
+	}
+
+	message := &sipMessage{Header: make(textproto.MIMEHeader)}
+	if strings.HasPrefix(parts[0], "SIP/") {
+		code, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed SIP status line %q", lines[0])
+		}
+		message.StatusCode, message.Reason = code, parts[2]
+	} else if parts[2] == "SIP/2.0" {
+		message.Method, message.URI = parts[0], parts[1]
+	} else {
+		return nil, fmt.Errorf("malformed SIP request line %q", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		// Folded continuation lines belong to the previous header.
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if full, ok := sipCompactHeaders[strings.ToLower(name)]; ok {
+			name = full
+		}
+		message.Header.Add(name, strings.TrimSpace(value))
+	}
+
+	if length, err := strconv.Atoi(message.Header.Get("Content-Length")); err == nil && length < len(body) {
+		body = body[:length]
+	}
+	message.Body = body
+	return message, nil
+}
+
+// sipResponse builds a response to request, echoing the headers that tie it
+// to the transaction. A To tag is added so the response establishes a dialog.
+func sipResponse(request *sipMessage, code int, reason, toTag string, extra []string, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", code, reason)
+	for _, via := range request.Header.Values("Via") {
+		fmt.Fprintf(&b, "Via: %s\r\n", via)
+	}
+	to := request.Header.Get("To")
+	if toTag != "" && !strings.Contains(to, ";tag=") {
+		to += ";tag=" + toTag
+	}
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\n", request.Header.Get("From"), to)
+	fmt.Fprintf(&b, "Call-ID: %s\r\nCSeq: %s\r\n", request.Header.Get("Call-Id"), request.Header.Get("Cseq"))
+	b.WriteString("Server: whisper-transcribe-agent\r\n")
+	for _, header := range extra {
+		b.WriteString(header + "\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// sipUser extracts the user part of a From or To header, e.g. "1001" from
+// `"Alice" <sip:1001@pbx.local>;tag=abc`.
+func sipUser(header string) string {
+	if start := strings.Index(header, "<"); start >= 0 {
+		header = header[start+1:]
+		if end := strings.Index(header, ">"); end >= 0 {
+			header = header[:end]
+		}
+	}
+	header, _, _ = strings.Cut(header, ";")
+	header = strings.TrimPrefix(strings.TrimPrefix(header, "sips:"), "sip:")
+	user, _, _ := strings.Cut(header, "@")
+	return user
+}
+
+const (
+	rtpPCMU = 0
+	rtpPCMA = 8
+)
+
+// sdpOffer is what the caller's SDP says about its audio stream.
+type sdpOffer struct {
+	Address string
+	Port    int
+	Formats []int
+}
+
+func parseSDP(body []byte) (sdpOffer, error) {
+	var offer sdpOffer
+	inAudio := false
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "m":
+			fields := strings.Fields(value)
+			inAudio = len(fields) >= 3 && fields[0] == "audio" && offer.Port == 0
+			if !inAudio {
+				continue
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return offer, fmt.Errorf("malformed SDP media line %q", line)
+			}
+			offer.Port = port
+			for _, format := range fields[3:] {
+				if n, err := strconv.Atoi(format); err == nil {
+					offer.Formats = append(offer.Formats, n)
+				}
+			}
+		case "c":
+			// Session-level connection data applies unless the audio
+			// media overrides it.
+			if fields := strings.Fields(value); len(fields) == 3 && (offer.Address == "" || inAudio) {
+				offer.Address = fields[2]
+			}
+		}
+	}
+	if offer.Port == 0 {
+		return offer, fmt.Errorf("SDP offer has no audio stream")
+	}
+	return offer, nil
+}
+
+// sdpAnswer accepts one G.711 format plus DTMF events, receive-only since the
+// agent only listens.
+func sdpAnswer(address string, port, format int, sessionID int64) []byte {
+	codec := "PCMU"
+	if format == rtpPCMA {
+		codec = "PCMA"
+	}
+	return []byte(fmt.Sprintf("v=0\r\n"+
+		"o=whisper-transcribe-agent %d %d IN IP4 %s\r\n"+
+		"s=transcription\r\n"+
+		"c=IN IP4 %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP %d 101\r\n"+
+		"a=rtpmap:%d %s/8000\r\n"+
+		"a=rtpmap:101 telephone-event/8000\r\n"+
+		"a=recvonly\r\n",
+		sessionID, sessionID, address, address, port, format, format, codec))
+}
+
+type rtpPacket struct {
+	PayloadType byte
+	Sequence    uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte
+}
+
+func parseRTPPacket(data []byte) (rtpPacket, error) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return rtpPacket{}, fmt.Errorf("not an RTP packet")
+	}
+	packet := rtpPacket{
+		PayloadType: data[1] & 0x7F,
+		Sequence:    binary.BigEndian.Uint16(data[2:]),
+		Timestamp:   binary.BigEndian.Uint32(data[4:]),
+		SSRC:        binary.BigEndian.Uint32(data[8:]),
+	}
+	offset := 12 + 4*int(data[0]&0x0F)
+	if data[0]&0x10 != 0 {
+		if len(data) < offset+4 {
+			return packet, fmt.Errorf("truncated RTP extension")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(data[offset+2:]))
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 && end > 0 {
+		end -= int(data[end-1])
+	}
+	if offset > end {
+		return packet, fmt.Errorf("truncated RTP packet")
+	}
+	packet.Payload = data[offset:end]
+	return packet, nil
+}
+
+// decodeG711 converts μ-law or A-law samples to 16-bit linear PCM.
+func decodeG711(format int, payload []byte, samples []int16) {
+	for i, b := range payload {
+		if format == rtpPCMA {
+			samples[i] = alawToLinear(b)
+		} else {
+			samples[i] = ulawToLinear(b)
+		}
+	}
+}
+
+func ulawToLinear(b byte) int16 {
+	b = ^b
+	t := (int16(b&0x0F) << 3) + 0x84
+	t <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+func alawToLinear(b byte) int16 {
+	b ^= 0x55
+	t := int16(b&0x0F) << 4
+	segment := (b & 0x70) >> 4
+	switch segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if b&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+// wavHeader is the 44-byte header of a mono 16-bit PCM WAV file.
+func wavHeader(sampleRate, samples int) []byte {
+	dataSize := samples * 2
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+dataSize))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) // PCM
+	header = binary.LittleEndian.AppendUint16(header, 1) // mono
+	header = binary.LittleEndian.AppendUint32(header, uint32(sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(sampleRate*2))
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(dataSize))
+	return header
+}
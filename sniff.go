@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// sniffLength is how much of the start of a file sniffing looks at: enough
+// for two MPEG transport stream packets.
+const sniffLength = 512
+
+// mpegTSPacket is the size of an MPEG transport stream packet, each of which
+// starts with the sync byte 0x47.
+const mpegTSPacket = 188
+
+// audioSignatures are the magic bytes of the audio and video containers the
+// backends decode, at the offset they appear at.
+var audioSignatures = []struct {
+	offset int
+	magic  []byte
+}{
+	{0, []byte("RIFF")},                 // WAV, also AVI
+	{0, []byte("RF64")},                 // WAV over 4 GB
+	{0, []byte("ID3")},                  // MP3 with tags
+	{0, []byte("OggS")},                 // Ogg Vorbis and Opus
+	{0, []byte("fLaC")},                 // FLAC
+	{4, []byte("ftyp")},                 // MP4, M4A, MOV, 3GP
+	{0, []byte{0x1A, 0x45, 0xDF, 0xA3}}, // Matroska and WebM
+	{0, []byte("FORM")},                 // AIFF
+	{0, []byte("caff")},                 // Core Audio
+	{0, []byte("#!AMR")},                // AMR
+	{0, []byte{0x30, 0x26, 0xB2, 0x75}}, // ASF: WMA and WMV
+	{0, []byte{0x00, 0x00, 0x01, 0xBA}}, // MPEG program stream
+	{0, []byte("FLV")},                  // Flash video
+	{0, []byte(".snd")},                 // Sun/NeXT au
+	{0, []byte("MAC ")},                 // Monkey's Audio
+	{0, []byte("wvpk")},                 // WavPack
+	{0, []byte{0x06, 0x0E, 0x2B, 0x34}}, // MXF, from broadcast cameras
+	{0, []byte{0x0B, 0x77}},             // AC-3
+}
+
+var errNotAudio = errors.New("not an audio or video file")
+
+// sniffAudio checks the start of a file for the magic bytes of an audio or
+// video container, the frame sync of raw MPEG audio (MP3 without tags and
+// AAC in ADTS) or MPEG transport stream packets. If it's none of them, the
+// error says what the file looks like instead where that's recognizable,
+// e.g. "an HTML page" for the error page of a download behind a login.
+func sniffAudio(head []byte) error {
+	for _, signature := range audioSignatures {
+		end := signature.offset + len(signature.magic)
+		if len(head) >= end && bytes.Equal(head[signature.offset:end], signature.magic) {
+			return nil
+		}
+	}
+	if len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0 {
+		return nil
+	}
+	if len(head) > mpegTSPacket && head[0] == 0x47 && head[mpegTSPacket] == 0x47 {
+		return nil
+	}
+	if kind := describeContent(head); kind != "" {
+		return errors.Wrapf(errNotAudio, "looks like %s", kind)
+	}
+	return errNotAudio
+}
+
+// describeContent names the common things that get passed off as audio.
+func describeContent(head []byte) string {
+	text := bytes.ToLower(bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf"))
+	switch {
+	case len(head) == 0:
+		return "an empty file"
+	case bytes.HasPrefix(head, []byte("MZ")), bytes.HasPrefix(head, []byte("\x7fELF")),
+		bytes.HasPrefix(head, []byte{0xCF, 0xFA, 0xED, 0xFE}), bytes.HasPrefix(head, []byte{0xCA, 0xFE, 0xBA, 0xBE}):
+		return "an executable"
+	case bytes.HasPrefix(text, []byte("<!doctype html")), bytes.HasPrefix(text, []byte("<html")), bytes.HasPrefix(text, []byte("<head")):
+		return "an HTML page"
+	case bytes.HasPrefix(text, []byte("<?xml")):
+		return "an XML document"
+	case bytes.HasPrefix(text, []byte("{")), bytes.HasPrefix(text, []byte("[")):
+		return "JSON"
+	case bytes.HasPrefix(head, []byte("%PDF")):
+		return "a PDF"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return "a ZIP archive"
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AudioBuffer holds audio in memory until it grows past the threshold, then
+// moves it to a temp file so concurrent large uploads don't exhaust RAM. The
+// temp file is encrypted if there's a key. Close must be called to remove the
+// temp file. Once written, a buffer may be read from several goroutines.
+type AudioBuffer struct {
+	mu        sync.Mutex
+	dir       string
+	threshold int64
+	key       []byte
+	mem       bytes.Buffer
+	file      *os.File
+	cipher    *fileCipher
+	size      int64
+}
+
+func newAudioBuffer(dir string, threshold int64, key []byte) *AudioBuffer {
+	return &AudioBuffer{dir: dir, threshold: threshold, key: key}
+}
+
+func (b *AudioBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(b.mem.Len()+len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	switch {
+	case b.cipher != nil:
+		n, err = b.cipher.writeAt(b.file, p, b.size)
+	case b.file != nil:
+		n, err = b.file.Write(p)
+	default:
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *AudioBuffer) spill() error {
+	var fileCipher *fileCipher
+	if b.key != nil {
+		var err error
+		if fileCipher, err = newFileCipher(b.key); err != nil {
+			return err
+		}
+	}
+	file, err := os.CreateTemp(b.dir, "whisper-audio-*")
+	if err != nil {
+		return err
+	}
+	if fileCipher != nil {
+		_, err = fileCipher.writeAt(file, b.mem.Bytes(), 0)
+	} else {
+		_, err = file.Write(b.mem.Bytes())
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	b.file, b.cipher = file, fileCipher
+	b.mem = bytes.Buffer{}
+	return nil
+}
+
+func (b *AudioBuffer) Size() int64 {
+	return b.size
+}
+
+// Reader returns an independent reader over the buffered audio; several
+// readers can be used concurrently.
+func (b *AudioBuffer) Reader() io.ReadSeeker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.cipher != nil:
+		return io.NewSectionReader(&decryptingReader{file: b.file, cipher: b.cipher}, 0, b.size)
+	case b.file != nil:
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+// Head returns up to n bytes from the start of the audio.
+func (b *AudioBuffer) Head(n int) []byte {
+	head := make([]byte, n)
+	read, _ := io.ReadFull(b.Reader(), head)
+	return head[:read]
+}
+
+// Input returns what to give ffmpeg or ffprobe as -i, and a func to call
+// once the tool is done with it. Without a key that's the temp file, moved to
+// disk first if the audio was still in memory. With one, the audio is never
+// written to disk in the clear: it's served decrypted on a loopback URL with
+// a random path, which the tool can seek in with range requests, as MP4s
+// with their index at the end need.
+func (b *AudioBuffer) Input() (input string, release func(), err error) {
+	if b.key != nil {
+		return b.serveLoopback()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		if err := b.spill(); err != nil {
+			return "", nil, err
+		}
+	}
+	return b.file.Name(), func() {}, nil
+}
+
+// serveLoopback serves the audio on 127.0.0.1 until release is called. Each
+// request gets its own reader, since ffmpeg opens a new connection to seek.
+func (b *AudioBuffer) serveLoopback() (url string, release func(), err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	path := "/" + hex.EncodeToString(token)
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, b.Reader())
+		}),
+	}
+	go server.Serve(listener)
+	return "http://" + listener.Addr().String() + path, func() { server.Close() }, nil
+}
+
+func (b *AudioBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
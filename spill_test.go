@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// writeInPieces writes the audio in pieces of odd sizes, the way uploads
+// arrive.
+func writeInPieces(t *testing.T, b *AudioBuffer, audio []byte) {
+	t.Helper()
+	for start, size := 0, 1; start < len(audio); start, size = start+size, size+13 {
+		end := min(start+size, len(audio))
+		if n, err := b.Write(audio[start:end]); err != nil || n != end-start {
+			t.Fatalf("wrote %d of %d bytes: %v", n, end-start, err)
+		}
+	}
+}
+
+func TestAudioBufferSpill(t *testing.T) {
+	audio := testAudio()
+	tests := []struct {
+		name      string
+		key       []byte
+		threshold int64
+	}{
+		{name: "in memory", threshold: 1 << 20},
+		{name: "spilled", threshold: 100},
+		{name: "spilled encrypted", key: bytes.Repeat([]byte{2}, 32), threshold: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newAudioBuffer(t.TempDir(), test.threshold, test.key)
+			writeInPieces(t, b, audio)
+			if b.Size() != int64(len(audio)) {
+				t.Fatalf("size = %d, want %d", b.Size(), len(audio))
+			}
+
+			if b.file != nil {
+				onDisk, err := os.ReadFile(b.file.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if encrypted := test.key != nil; encrypted == bytes.Equal(onDisk, audio) {
+					t.Errorf("audio on disk encrypted: %v, want %v", !encrypted, encrypted)
+				}
+			} else if test.threshold < int64(len(audio)) {
+				t.Fatal("audio not spilled")
+			}
+
+			read, err := io.ReadAll(b.Reader())
+			if err != nil || !bytes.Equal(read, audio) {
+				t.Fatalf("read back %d bytes (%v)", len(read), err)
+			}
+			reader := b.Reader()
+			if _, err := reader.Seek(123, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			part := make([]byte, 50)
+			if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, audio[123:173]) {
+				t.Errorf("read %x at 123 (%v)", part, err)
+			}
+			if head := b.Head(10); !bytes.Equal(head, audio[:10]) {
+				t.Errorf("head = %x", head)
+			}
+
+			file := b.file
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if file != nil {
+				if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+					t.Errorf("temp file left behind: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAudioBufferLoopback(t *testing.T) {
+	audio := testAudio()
+	b := newAudioBuffer(t.TempDir(), 100, bytes.Repeat([]byte{3}, 32))
+	defer b.Close()
+	writeInPieces(t, b, audio)
+
+	input, release, err := b.Input()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	request, err := http.NewRequest(http.MethodGet, input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Range", "bytes=500-")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	read, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(read, audio[500:]) {
+		t.Errorf("status %d with %d bytes (%v), want the audio from 500 on", resp.StatusCode, len(read), err)
+	}
+
+	resp, err = http.Get(input + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d for another path, want 404", resp.StatusCode)
+	}
+}
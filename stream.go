@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// streamRequest is a transcription request read from a message broker. The
+// audio is either referenced by URL or carried in the message: base64 in the
+// JSON "audio" field, or as the whole message body if it isn't JSON.
+type streamRequest struct {
+	ID          string            `json:"id"`
+	URL         string            `json:"url"`
+	Audio       []byte            `json:"audio"`
+	Filename    string            `json:"filename"`
+	Summarize   bool              `json:"summarize"`
+	Chapters    bool              `json:"chapters"`
+	Sentiment   bool              `json:"sentiment"`
+	Entities    bool              `json:"entities"`
+	TranslateTo string            `json:"translate_to"`
+	Profanity   string            `json:"profanity"`
+	Vocabulary  []string          `json:"vocabulary"`
+	Priority    string            `json:"priority"`
+	Metadata    map[string]string `json:"metadata"`
+
+	DownloadHeaders map[string]string `json:"download_headers"`
+}
+
+// streamResult is published back to the broker for every request, whether it
+// succeeded or not, so the pipeline never waits on a request that was dropped.
+type streamResult struct {
+	ID         string      `json:"id,omitempty"`
+	JobID      string      `json:"job_id,omitempty"`
+	Status     JobStatus   `json:"status"`
+	Filename   string      `json:"filename,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Transcript *Transcript `json:"transcript,omitempty"`
+	ResultURL  string      `json:"result_url,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// parseStreamRequest decodes a message body. Bodies that don't look like JSON
+// are taken to be the audio itself.
+func parseStreamRequest(body []byte, id, filename string) (streamRequest, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return streamRequest{ID: id, Audio: body, Filename: filename}, nil
+	}
+	request := streamRequest{ID: id, Filename: filename}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return request, errors.Wrap(err, "invalid request")
+	}
+	if request.URL == "" && len(request.Audio) == 0 {
+		return request, errors.New("request has neither a url nor audio")
+	}
+	return request, nil
+}
+
+func (r streamRequest) task(cfg Config) (*TranscriptionTask, error) {
+	if r.Summarize && !cfg.summarizeEnabled() {
+		return nil, errSummarizeDisabled
+	}
+	if err := checkTranslateTo(cfg, r.TranslateTo); err != nil {
+		return nil, err
+	}
+	if err := checkProfanityMode(r.Profanity); err != nil {
+		return nil, err
+	}
+	if err := checkVocabulary(r.Vocabulary); err != nil {
+		return nil, err
+	}
+	if err := checkPriority(r.Priority); err != nil {
+		return nil, err
+	}
+	if err := checkMetadata(r.Metadata); err != nil {
+		return nil, err
+	}
+	if err := checkDownloadHeaders(r.DownloadHeaders); err != nil {
+		return nil, err
+	}
+	if r.URL != "" {
+		return &TranscriptionTask{Filename: r.URL, AudioURL: r.URL, Summarize: r.Summarize, Chapters: r.Chapters, Sentiment: r.Sentiment, Entities: r.Entities, TranslateTo: r.TranslateTo, Profanity: r.Profanity, Vocabulary: r.Vocabulary, Priority: r.Priority, Metadata: r.Metadata, DownloadHeaders: r.DownloadHeaders}, nil
+	}
+	if int64(len(r.Audio)) > cfg.MaxAudioSize {
+		return nil, errors.Errorf("audio exceeds maximum size of %d MB", cfg.MaxAudioSize>>20)
+	}
+
+	filename := r.Filename
+	if !isAudioFile(filename) {
+		extension, ok := sniffAudioExtension(r.Audio)
+		if !ok {
+			return nil, errors.New("unrecognized audio format, set a filename with an audio extension")
+		}
+		filename = "audio" + extension
+	}
+	buffer := cfg.newAudioBuffer()
+	if _, err := buffer.Write(r.Audio); err != nil {
+		buffer.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &TranscriptionTask{Filename: filename, Audio: buffer, OwnsAudio: true, Summarize: r.Summarize, Chapters: r.Chapters, Sentiment: r.Sentiment, Entities: r.Entities, TranslateTo: r.TranslateTo, Profanity: r.Profanity, Vocabulary: r.Vocabulary, Priority: r.Priority, Metadata: r.Metadata}, nil
+}
+
+// transcribeStreamRequest runs a request through the pool and waits for it.
+// Rejections are waited out rather than reported: stalling the consumer is
+// how backpressure reaches the broker.
+func transcribeStreamRequest(pool *WorkerPool, cfg Config, source string, request streamRequest) streamResult {
+	result := streamResult{ID: request.ID, Status: JobFailed, Filename: request.Filename}
+	task, err := request.task(cfg)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if result.Filename == "" {
+		result.Filename = task.Filename
+	}
+	return transcribeStreamTask(pool, source, task, result)
+}
+
+// transcribeStreamTask submits a prepared task, waiting out rejections that
+// pass, and fills in result once it's done. Once the server is draining it
+// gives up, so the broker can hand the request to another instance.
+func transcribeStreamTask(pool *WorkerPool, source string, task *TranscriptionTask, result streamResult) streamResult {
+	for {
+		job, err := pool.Submit(source, task)
+		if err == nil {
+			result.JobID = job.ID
+			break
+		}
+		if !isTransientRejection(err) || pool.Draining() {
+			if task.OwnsAudio && task.Audio != nil {
+				task.Audio.Close()
+			}
+			result.Error = err.Error()
+			return result
+		}
+		time.Sleep(pool.RetryAfter())
+	}
+	return streamTaskResult(pool, task, result)
+}
+
+// streamTaskResult waits for a submitted task and fills in result.
+func streamTaskResult(pool *WorkerPool, task *TranscriptionTask, result streamResult) streamResult {
+	<-task.Done
+	if task.Err != nil {
+		result.Error = task.Err.Error()
+		return result
+	}
+
+	text, err := renderText(task.Transcript)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = JobCompleted
+	result.Text = strings.TrimSpace(string(text))
+	result.Transcript = task.Transcript
+	result.ResultURL = pool.resultURL(result.JobID)
+	return result
+}
+
+// isTransientRejection tells whether the pool rejected a job for a reason
+// that passes by itself, so submitting it again later makes sense.
+func isTransientRejection(err error) bool {
+	return errors.Is(err, errQueueFull) || errors.Is(err, errMemoryPressure) || errors.Is(err, errReadOnly) || isMaintenance(err)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// maxCueLength is how many characters a subtitle cue may hold: two lines
+	// of maxLineLength, the usual limit for readability.
+	maxCueLength  = 84
+	maxLineLength = 42
+	// cuePause is how long a pause between words has to be to start a new cue
+	// when there are no segments.
+	cuePause = 1.0
+	// secondsPerWord paces cues of a transcript with neither timestamps nor
+	// duration, at a typical speaking rate of 150 words per minute.
+	secondsPerWord = 0.4
+)
+
+// subtitleCue is a caption of the subtitle formats, with the words spoken in
+// it if the backend reported word timings.
+type subtitleCue struct {
+	Start   float64
+	End     float64
+	Speaker string
+	Text    string
+	Words   []Word
+}
+
+// subtitleCues splits the transcript into cues for the subtitle formats,
+// whatever the backend returned: one per segment if there are segments, else
+// the words grouped at pauses, sentence ends and maxCueLength, and for plain
+// text the sentences, timed in proportion to their length over the duration.
+func subtitleCues(transcript *Transcript) []subtitleCue {
+	switch {
+	case len(transcript.Segments) > 0:
+		return segmentCues(transcript)
+	case len(transcript.Words) > 0:
+		return wordCues(transcript.Words)
+	default:
+		return textCues(transcript)
+	}
+}
+
+func segmentCues(transcript *Transcript) []subtitleCue {
+	words := transcript.Words
+	cues := make([]subtitleCue, 0, len(transcript.Segments))
+	for i, segment := range transcript.Segments {
+		text := strings.TrimSpace(segment.Text)
+		if text == "" {
+			continue
+		}
+		cue := subtitleCue{Start: segment.Start, End: segment.End, Speaker: string(segment.Speaker), Text: text}
+		last := i == len(transcript.Segments)-1
+		for len(words) > 0 && (last || words[0].Start < transcript.Segments[i+1].Start) {
+			cue.Words = append(cue.Words, words[0])
+			words = words[1:]
+		}
+		cues = append(cues, cue)
+	}
+	return cues
+}
+
+func wordCues(words []Word) []subtitleCue {
+	var cues []subtitleCue
+	for i, word := range words {
+		if len(cues) > 0 {
+			cue := &cues[len(cues)-1]
+			if word.Speaker == cue.Speaker && word.Start-words[i-1].End < cuePause &&
+				!endsSentence(words[i-1].Word) && len(cue.Text)+1+len(word.Word) <= maxCueLength {
+				cue.Text += " " + word.Word
+				cue.End = word.End
+				cue.Words = append(cue.Words, word)
+				continue
+			}
+		}
+		cues = append(cues, subtitleCue{Start: word.Start, End: word.End, Speaker: word.Speaker, Text: word.Word, Words: []Word{word}})
+	}
+	return cues
+}
+
+func textCues(transcript *Transcript) []subtitleCue {
+	var texts []string
+	var current []string
+	length := 0
+	for _, word := range strings.Fields(transcript.Text) {
+		if len(current) > 0 && length+1+len(word) > maxCueLength {
+			texts = append(texts, strings.Join(current, " "))
+			current, length = nil, 0
+		}
+		if len(current) > 0 {
+			length++
+		}
+		current = append(current, word)
+		length += len(word)
+		if endsSentence(word) {
+			texts = append(texts, strings.Join(current, " "))
+			current, length = nil, 0
+		}
+	}
+	if len(current) > 0 {
+		texts = append(texts, strings.Join(current, " "))
+	}
+
+	characters := 0
+	for _, text := range texts {
+		characters += len(text)
+	}
+	duration := transcriptDuration(transcript)
+	if duration <= 0 {
+		duration = float64(len(strings.Fields(transcript.Text))) * secondsPerWord
+	}
+	cues := make([]subtitleCue, 0, len(texts))
+	start := 0.0
+	for _, text := range texts {
+		end := start + duration*float64(len(text))/float64(characters)
+		cues = append(cues, subtitleCue{Start: start, End: end, Text: text})
+		start = end
+	}
+	return cues
+}
+
+// wrapCue breaks a cue longer than maxLineLength into two lines at the space
+// closest to its middle.
+func wrapCue(text string) string {
+	if len(text) <= maxLineLength {
+		return text
+	}
+	split := -1
+	for i, c := range text {
+		if c == ' ' && (split < 0 || abs(i-len(text)/2) < abs(split-len(text)/2)) {
+			split = i
+		}
+	}
+	if split < 0 {
+		return text
+	}
+	return text[:split] + "\n" + text[split+1:]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// renderVTT produces WebVTT for HTML5 players, with the speaker as a voice tag
+// and, if the backend reported word timings that line up with the cue text, a
+// timestamp before every word for karaoke-style highlighting.
+func renderVTT(transcript *Transcript) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i, cue := range subtitleCues(transcript) {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n", i+1, vttTimestamp(cue.Start), vttTimestamp(cue.End))
+		if cue.Speaker != "" {
+			fmt.Fprintf(&b, "<v %s>", vttEscaper.Replace(cue.Speaker))
+		}
+		b.WriteString(vttCueText(cue) + "\n\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// vttCueText wraps the cue like wrapCue, with the words' timestamps in between
+// if there's a timed word for every word of the text.
+func vttCueText(cue subtitleCue) string {
+	wrapped := wrapCue(cue.Text)
+	if len(cue.Words) != len(strings.Fields(wrapped)) {
+		return vttEscaper.Replace(wrapped)
+	}
+	var b strings.Builder
+	word := 0
+	for i, line := range strings.Split(wrapped, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for j, text := range strings.Fields(line) {
+			if j > 0 {
+				b.WriteString(" ")
+			}
+			if start := cue.Words[word].Start; word > 0 && start > cue.Start && start < cue.End {
+				b.WriteString("<" + vttTimestamp(start) + ">")
+			}
+			b.WriteString(vttEscaper.Replace(text))
+			word++
+		}
+	}
+	return b.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
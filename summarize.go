@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const summarizeTimeout = 5 * time.Minute
+
+var errSummarizeDisabled = errors.New("summarization is not configured, set --llm-url")
+
+const summarizePrompt = `You summarize transcripts of recordings. Reply with a JSON object with two fields:
+"summary": a short summary of what was said, in the language of the transcript;
+"action_items": a list of tasks or follow-ups that were agreed on, each a short sentence (empty if there are none).
+Reply with the JSON object only.`
+
+// Summary is produced by an LLM from the transcript text when a request asks
+// for it. A failed summary doesn't fail the job; Error says what went wrong.
+type Summary struct {
+	Text        string   `json:"text,omitempty"`
+	ActionItems []string `json:"action_items,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// wantsSummary reads the summarize=true request parameter.
+func wantsSummary(r *http.Request) bool {
+	summarize, _ := strconv.ParseBool(r.URL.Query().Get("summarize"))
+	return summarize
+}
+
+// summarize asks the OpenAI-compatible chat completions endpoint at
+// --llm-url for a summary and action items.
+func summarize(cfg Config, transcript *Transcript) (*Summary, error) {
+	if !cfg.summarizeEnabled() {
+		return nil, errSummarizeDisabled
+	}
+	text, err := renderText(transcript)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{
+		"model": cfg.LLMModel,
+		"messages": []ChatMessage{
+			{Role: "system", Content: summarizePrompt},
+			{Role: "user", Content: string(text)},
+		},
+		"temperature": 0.2,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.LLMURL, "/")+"/v1/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.LLMAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.LLMAPIKey)
+	}
+	client := &http.Client{Timeout: summarizeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "LLM request failed")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "LLM request failed")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("LLM returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message ChatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil || len(completion.Choices) == 0 {
+		return nil, errors.New("invalid LLM response")
+	}
+	return parseSummary(completion.Choices[0].Message.Content), nil
+}
+
+// parseSummary takes the JSON the prompt asks for, tolerating a code fence
+// around it. Models that answer in prose get their answer as the summary.
+func parseSummary(content string) *Summary {
+	content = strings.TrimSpace(content)
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```"), "```")
+
+	var reply struct {
+		Summary     string   `json:"summary"`
+		ActionItems []string `json:"action_items"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(trimmed)), &reply); err != nil || reply.Summary == "" {
+		return &Summary{Text: content}
+	}
+	return &Summary{Text: reply.Summary, ActionItems: reply.ActionItems}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName= ("api" or "ui"). Unnamed sockets are
+// taken in order: the first is the API, the second the UI.
+func systemdListeners() (map[string]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LISTEN_FDS")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < count; i++ {
+		name := ""
+		if len(names) == count && names[i] != "unknown" {
+			name = names[i]
+		}
+		if name == "" && i == 0 {
+			name = "api"
+		} else if name == "" {
+			name = "ui"
+		}
+
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid socket %q from systemd", name)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state like "READY=1" to systemd. It does nothing when not
+// running under a Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return errors.WithStack(err)
+}
+
+// startWatchdog pings systemd at half the WatchdogSec= interval, if one is set.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		for range time.Tick(interval) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("systemd watchdog notification failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	telegramPollTimeout  = 50 * time.Second
+	telegramRetryDelay   = 5 * time.Second
+	telegramMessageLimit = 4096
+)
+
+type telegramFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+}
+
+type telegramMessage struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Voice    *telegramFile `json:"voice"`
+	Audio    *telegramFile `json:"audio"`
+	Document *telegramFile `json:"document"`
+}
+
+type telegramUpdate struct {
+	UpdateID int              `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// TelegramBot long-polls the Bot API for voice notes and audio files and
+// replies to each with its transcript.
+type TelegramBot struct {
+	token  string
+	apiURL string
+	chats  map[int64]bool
+	pool   *WorkerPool
+	cfg    Config
+	client *http.Client
+}
+
+func NewTelegramBot(pool *WorkerPool, cfg Config) (*TelegramBot, error) {
+	bot := &TelegramBot{
+		token:  cfg.TelegramToken,
+		apiURL: strings.TrimSuffix(cfg.TelegramAPIURL, "/"),
+		chats:  make(map[int64]bool),
+		pool:   pool,
+		cfg:    cfg,
+		client: &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+	}
+	for _, chat := range strings.Split(cfg.TelegramChats, ",") {
+		if chat = strings.TrimSpace(chat); chat == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(chat, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid Telegram chat id %q", chat)
+		}
+		bot.chats[id] = true
+	}
+	return bot, nil
+}
+
+func (b *TelegramBot) Run() {
+	log.Printf("Telegram bot polling for messages...")
+	offset := 0
+	for {
+		var updates []telegramUpdate
+		err := b.call("getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			log.Printf("Telegram getUpdates failed: %v", err)
+			time.Sleep(telegramRetryDelay)
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				go b.handleMessage(update.Message)
+			}
+		}
+	}
+}
+
+func (b *TelegramBot) handleMessage(message *telegramMessage) {
+	if len(b.chats) > 0 && !b.chats[message.Chat.ID] {
+		return
+	}
+
+	file, filename := message.Voice, "voice.ogg"
+	if message.Audio != nil {
+		file, filename = message.Audio, message.Audio.FileName
+	}
+	if message.Document != nil && strings.HasPrefix(message.Document.MimeType, "audio/") {
+		file, filename = message.Document, message.Document.FileName
+	}
+	if file == nil {
+		return
+	}
+
+	text, err := b.transcribe(file, filename)
+	if err != nil {
+		log.Printf("Telegram transcription for chat %d failed: %+v", message.Chat.ID, err)
+		text = "Transcription failed: " + err.Error()
+	}
+	for _, chunk := range splitMessage(text, telegramMessageLimit) {
+		err := b.call("sendMessage", map[string]interface{}{
+			"chat_id":             message.Chat.ID,
+			"text":                chunk,
+			"reply_to_message_id": message.MessageID,
+		}, nil)
+		if err != nil {
+			log.Printf("Telegram sendMessage to chat %d failed: %v", message.Chat.ID, err)
+			return
+		}
+	}
+}
+
+func (b *TelegramBot) transcribe(file *telegramFile, filename string) (string, error) {
+	if file.FileSize > b.cfg.MaxAudioSize {
+		return "", errors.Errorf("file exceeds maximum size of %d MB", b.cfg.MaxAudioSize>>20)
+	}
+
+	var info struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := b.call("getFile", map[string]string{"file_id": file.FileID}, &info); err != nil {
+		return "", err
+	}
+	if filename == "" {
+		filename = path.Base(info.FilePath)
+	}
+
+	// Downloaded here rather than by the pool so the token in the URL doesn't
+	// end up in the job list.
+	body, _, err := downloadFileWithLimit(context.Background(), http.DefaultClient, b.apiURL+"/file/bot"+b.token+"/"+info.FilePath, nil, b.cfg.MaxAudioSize)
+	if err != nil {
+		return "", errors.New(redactToken(err.Error(), b.token))
+	}
+	defer body.Close()
+	buffer := b.cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, body); err != nil {
+		buffer.Close()
+		return "", errors.Wrap(err, "failed to download audio")
+	}
+
+	task := &TranscriptionTask{Filename: filename, Audio: buffer, OwnsAudio: true, ContentType: file.MimeType}
+	if _, err := b.pool.Submit("telegram", task); err != nil {
+		buffer.Close()
+		return "", err
+	}
+	<-task.Done
+	if task.Err != nil {
+		return "", task.Err
+	}
+
+	text, err := renderText(task.Transcript)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(text)) == "" {
+		return "(no speech detected)", nil
+	}
+	return string(text), nil
+}
+
+// call invokes a Bot API method and decodes its result into result, if given.
+func (b *TelegramBot) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := b.client.Post(b.apiURL+"/bot"+b.token+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return errors.Errorf("telegram %s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return errors.Wrapf(err, "invalid telegram %s response", method)
+	}
+	if !response.OK {
+		return errors.Errorf("telegram %s failed: %s", method, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.WithStack(json.Unmarshal(response.Result, result))
+}
+
+func redactToken(message, token string) string {
+	return strings.ReplaceAll(message, token, "<token>")
+}
+
+// splitMessage breaks text into pieces of at most limit characters,
+// preferring to break at line ends.
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	runes := []rune(text)
+	for len(runes) > limit {
+		cut := limit
+		if newline := strings.LastIndex(string(runes[:limit]), "\n"); newline > 0 {
+			cut = len([]rune(string(runes[:limit])[:newline])) + 1
+		}
+		chunks = append(chunks, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	return append(chunks, string(runes))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Thresholds below which whisper itself distrusts a segment: it retries at a
+// higher temperature under lowConfidenceLogprob, and treats the segment as
+// silence if noSpeechThreshold is exceeded as well.
+const (
+	lowConfidenceLogprob = -1.0
+	noSpeechThreshold    = 0.6
+)
+
+// Word has the probability the backend gave it, if it reports one
+// (whisper.cpp and faster-whisper do, OpenAI doesn't).
+type Word struct {
+	Word        string   `json:"word"`
+	Start       float64  `json:"start"`
+	End         float64  `json:"end"`
+	Speaker     string   `json:"speaker,omitempty"`
+	Probability *float64 `json:"probability,omitempty"`
+}
+
+// Segment carries the backend's avg_logprob and no_speech_prob where
+// verbose_json has them, with Confidence derived from them for people who
+// don't think in log probabilities.
+type Segment struct {
+	ID            int          `json:"id"`
+	Start         float64      `json:"start"`
+	End           float64      `json:"end"`
+	Text          string       `json:"text"`
+	Speaker       speakerLabel `json:"speaker,omitempty"`
+	Words         []Word       `json:"words,omitempty"`
+	Sentiment     *float64     `json:"sentiment,omitempty"`
+	AvgLogprob    *float64     `json:"avg_logprob,omitempty"`
+	NoSpeechProb  *float64     `json:"no_speech_prob,omitempty"`
+	Confidence    *float64     `json:"confidence,omitempty"`
+	LowConfidence bool         `json:"low_confidence,omitempty"`
+}
+
+// speakerLabel accepts both string ("SPEAKER_00") and numeric (0) speaker ids
+// since backends and diarization tools disagree on the format.
+type speakerLabel string
+
+func (l *speakerLabel) UnmarshalJSON(data []byte) error {
+	var label interface{}
+	if err := json.Unmarshal(data, &label); err != nil {
+		return err
+	}
+	switch v := label.(type) {
+	case nil:
+		*l = ""
+	case string:
+		*l = speakerLabel(v)
+	default:
+		*l = speakerLabel(fmt.Sprint(v))
+	}
+	return nil
+}
+
+// Transcript has the probability of the detected language if the backend
+// reports it, like faster-whisper does.
+type Transcript struct {
+	Text                string         `json:"text"`
+	Language            string         `json:"language,omitempty"`
+	LanguageProbability *float64       `json:"language_probability,omitempty"`
+	Duration            float64        `json:"duration,omitempty"`
+	Segments            []Segment      `json:"segments,omitempty"`
+	Words               []Word         `json:"words,omitempty"`
+	Summary             *Summary       `json:"summary,omitempty"`
+	Translation         *Translation   `json:"translation,omitempty"`
+	Profanity           *Profanity     `json:"profanity,omitempty"`
+	Keywords            []KeywordMatch `json:"keywords,omitempty"`
+	Chapters            []Chapter      `json:"chapters,omitempty"`
+	Sentiment           *Sentiment     `json:"sentiment,omitempty"`
+	Entities            *Entities      `json:"entities,omitempty"`
+}
+
+// parseTranscript accepts both plain json and verbose_json responses. Some
+// backends put words at the top level (OpenAI), others only inside segments.
+func parseTranscript(data []byte) (*Transcript, error) {
+	var transcript Transcript
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		return nil, err
+	}
+
+	if len(transcript.Words) == 0 {
+		for _, segment := range transcript.Segments {
+			transcript.Words = append(transcript.Words, segment.Words...)
+		}
+	}
+	for i := range transcript.Segments {
+		transcript.Segments[i].Words = nil
+	}
+	for i := range transcript.Words {
+		transcript.Words[i].Word = strings.TrimSpace(transcript.Words[i].Word)
+	}
+	scoreConfidence(&transcript)
+	labelSpeakers(&transcript)
+
+	return &transcript, nil
+}
+
+// scoreConfidence turns the segments' average log probability into a 0-1
+// confidence, discounted by the probability there's no speech at all, and
+// flags the segments whisper would distrust, for reviewers to check.
+func scoreConfidence(transcript *Transcript) {
+	for i, segment := range transcript.Segments {
+		if segment.AvgLogprob == nil {
+			continue
+		}
+		confidence := math.Exp(*segment.AvgLogprob)
+		if segment.NoSpeechProb != nil {
+			confidence *= 1 - *segment.NoSpeechProb
+		}
+		confidence = math.Round(confidence*1000) / 1000
+		transcript.Segments[i].Confidence = &confidence
+		transcript.Segments[i].LowConfidence = *segment.AvgLogprob < lowConfidenceLogprob ||
+			(segment.NoSpeechProb != nil && *segment.NoSpeechProb > noSpeechThreshold)
+	}
+}
+
+// labelSpeakers renames raw speaker ids to "Speaker 1", "Speaker 2"... in order
+// of first appearance and attributes words to the segment they fall into.
+func labelSpeakers(transcript *Transcript) {
+	names := make(map[speakerLabel]speakerLabel)
+	for i, segment := range transcript.Segments {
+		if segment.Speaker == "" {
+			continue
+		}
+		name, ok := names[segment.Speaker]
+		if !ok {
+			name = speakerLabel(fmt.Sprintf("Speaker %d", len(names)+1))
+			names[segment.Speaker] = name
+		}
+		transcript.Segments[i].Speaker = name
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	for i, word := range transcript.Words {
+		middle := (word.Start + word.End) / 2
+		for _, segment := range transcript.Segments {
+			if middle >= segment.Start && middle <= segment.End {
+				transcript.Words[i].Speaker = string(segment.Speaker)
+				break
+			}
+		}
+	}
+}
+
+type SpeakerTurn struct {
+	Speaker string
+	Start   float64
+	End     float64
+	Text    string
+}
+
+// speakerTurns merges consecutive segments of the same speaker into turns.
+func speakerTurns(transcript *Transcript) []SpeakerTurn {
+	var turns []SpeakerTurn
+	for _, segment := range transcript.Segments {
+		text := strings.TrimSpace(segment.Text)
+		last := len(turns) - 1
+		if last >= 0 && turns[last].Speaker == string(segment.Speaker) {
+			turns[last].End = segment.End
+			turns[last].Text += " " + text
+			continue
+		}
+		turns = append(turns, SpeakerTurn{
+			Speaker: string(segment.Speaker),
+			Start:   segment.Start,
+			End:     segment.End,
+			Text:    text,
+		})
+	}
+	return turns
+}
+
+func (t *Transcript) hasSpeakers() bool {
+	for _, segment := range t.Segments {
+		if segment.Speaker != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeTranscripts joins transcripts of consecutive chunks, shifting their
+// timestamps by the offset at which each chunk starts.
+func mergeTranscripts(parts []*Transcript, offsets []float64) *Transcript {
+	merged := &Transcript{}
+	var texts []string
+	for i, part := range parts {
+		if merged.Language == "" {
+			merged.Language, merged.LanguageProbability = part.Language, part.LanguageProbability
+		}
+		if text := strings.TrimSpace(part.Text); text != "" {
+			texts = append(texts, text)
+		}
+		for _, segment := range part.Segments {
+			segment.ID = len(merged.Segments)
+			segment.Start += offsets[i]
+			segment.End += offsets[i]
+			merged.Segments = append(merged.Segments, segment)
+		}
+		for _, word := range part.Words {
+			word.Start += offsets[i]
+			word.End += offsets[i]
+			merged.Words = append(merged.Words, word)
+		}
+		if part.Duration > 0 {
+			merged.Duration = offsets[i] + part.Duration
+		}
+	}
+	merged.Text = strings.Join(texts, " ")
+	return merged
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// transcriptsHandler serves /v1/transcripts/{id}: GET returns the transcript
+// of a job of the request's tenant, or only the part between from= and to=,
+// as JSON or in an export format with format= (or response_format=, as in
+// OpenAI's API); DELETE erases the job.
+func transcriptsHandler(w http.ResponseWriter, r *http.Request, store *JobStore, audit *AuditLog) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/transcripts/")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		deleteJobHandler(w, r, store, audit, id)
+		return
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and DELETE supported")
+		return
+	}
+
+	job, ok := store.Get(id)
+	if !ok || job.Tenant != requestTenant(r) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if job.Transcript == nil {
+		writeJSONError(w, http.StatusConflict, "Job has no transcript")
+		return
+	}
+	from, err := timeOffsetParam(r, "from")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := timeOffsetParam(r, "to")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	transcript := job.Transcript
+	if from != nil || to != nil {
+		if from != nil && to != nil && *to <= *from {
+			writeJSONError(w, http.StatusBadRequest, "to must be after from")
+			return
+		}
+		transcript = transcriptWindow(transcript, from, to)
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = r.URL.Query().Get("response_format")
+	}
+	if name == "" {
+		writeJSONWithETag(w, r, transcript)
+		return
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Unsupported export format")
+		return
+	}
+	data, err := format.Render(transcript)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeWithETag(w, r, format.ContentType, data)
+}
+
+// timeOffsetParam reads a position in the audio as "1:02:03", "2:03",
+// seconds or a duration like "10m", or nil if the parameter isn't set.
+func timeOffsetParam(r *http.Request, name string) (*float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return &seconds, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		seconds := duration.Seconds()
+		return &seconds, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) <= 3 {
+		seconds := 0.0
+		for i, part := range parts {
+			number, err := strconv.ParseFloat(part, 64)
+			if err != nil || number < 0 || (i > 0 && number >= 60) {
+				return nil, errors.Errorf("%s must be a time like 00:10:00, seconds or a duration like 10m", name)
+			}
+			seconds = seconds*60 + number
+		}
+		return &seconds, nil
+	}
+	return nil, errors.Errorf("%s must be a time like 00:10:00, seconds or a duration like 10m", name)
+}
+
+// transcriptWindow returns the part of the transcript between from and to,
+// either of which may be nil for the start or end: the segments, words,
+// chapters and keyword matches overlapping the window, with the text of those
+// segments. Analyses of the whole recording, like the summary, translation,
+// profanity count and entities, are left out since they don't apply to the
+// part.
+func transcriptWindow(transcript *Transcript, from, to *float64) *Transcript {
+	overlaps := func(start, end float64) bool {
+		return (from == nil || end > *from) && (to == nil || start < *to)
+	}
+	window := &Transcript{Language: transcript.Language, LanguageProbability: transcript.LanguageProbability, Duration: transcript.Duration}
+	var text []string
+	for _, segment := range transcript.Segments {
+		if overlaps(segment.Start, segment.End) {
+			window.Segments = append(window.Segments, segment)
+			text = append(text, strings.TrimSpace(segment.Text))
+		}
+	}
+	window.Text = strings.Join(text, " ")
+	for _, word := range transcript.Words {
+		if overlaps(word.Start, word.End) {
+			window.Words = append(window.Words, word)
+		}
+	}
+	for _, chapter := range transcript.Chapters {
+		if overlaps(chapter.Start, chapter.End) {
+			window.Chapters = append(window.Chapters, chapter)
+		}
+	}
+	for _, match := range transcript.Keywords {
+		if overlaps(match.Start, match.End) {
+			window.Keywords = append(window.Keywords, match)
+		}
+	}
+	return window
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	translateTimeout = 5 * time.Minute
+	rewriteBatch     = 50
+)
+
+var (
+	errTranslateDisabled = errors.New("translation is not configured, set --deepl-api-key or --llm-url")
+	errInvalidLanguage   = errors.New("translate_to must be a language code like de or pt-BR")
+	languageCodePattern  = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z]{2,4})?$`)
+)
+
+const translatePrompt = `You translate transcript segments into the language with the code %s.
+You get a JSON array of strings and reply with a JSON array of their translations, in the same order and with the same number of elements.
+Reply with the JSON array only.`
+
+// Translation is the transcript in another language. Segments keep the
+// timings of the original ones. A failed translation doesn't fail the job;
+// Error says what went wrong.
+type Translation struct {
+	Language string    `json:"language"`
+	Text     string    `json:"text,omitempty"`
+	Segments []Segment `json:"segments,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// translateTo reads the translate_to request parameter.
+func translateTo(r *http.Request) string {
+	return r.URL.Query().Get("translate_to")
+}
+
+// checkTranslateTo validates a requested target language; empty means no
+// translation.
+func checkTranslateTo(cfg Config, language string) error {
+	if language == "" {
+		return nil
+	}
+	if !cfg.translateEnabled() {
+		return errTranslateDisabled
+	}
+	if !languageCodePattern.MatchString(language) {
+		return errInvalidLanguage
+	}
+	return nil
+}
+
+// translate translates the transcript segment by segment through DeepL if
+// --deepl-api-key is set, else through the LLM at --llm-url.
+func translate(cfg Config, transcript *Transcript, language string) (*Translation, error) {
+	if !cfg.translateEnabled() {
+		return nil, errTranslateDisabled
+	}
+	texts := []string{transcript.Text}
+	if len(transcript.Segments) > 0 {
+		texts = texts[:0]
+		for _, segment := range transcript.Segments {
+			texts = append(texts, strings.TrimSpace(segment.Text))
+		}
+	}
+
+	translated := make([]string, 0, len(texts))
+	for start := 0; start < len(texts); start += rewriteBatch {
+		batch := texts[start:min(start+rewriteBatch, len(texts))]
+		var result []string
+		var err error
+		if cfg.DeepLAPIKey != "" {
+			result, err = translateDeepL(cfg, batch, language)
+		} else {
+			result, err = translateLLM(cfg, batch, language)
+		}
+		if err != nil {
+			return nil, err
+		}
+		translated = append(translated, result...)
+	}
+
+	translation := &Translation{Language: language}
+	if len(transcript.Segments) == 0 {
+		translation.Text = translated[0]
+		return translation, nil
+	}
+	for i, segment := range transcript.Segments {
+		translation.Segments = append(translation.Segments, Segment{
+			ID: segment.ID, Start: segment.Start, End: segment.End, Text: translated[i], Speaker: segment.Speaker,
+		})
+	}
+	translation.Text = strings.Join(translated, " ")
+	return translation, nil
+}
+
+func translateDeepL(cfg Config, texts []string, language string) ([]string, error) {
+	form := url.Values{"target_lang": {strings.ToUpper(language)}}
+	for _, text := range texts {
+		form.Add("text", text)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.deepLURL(), "/")+"/v2/translate", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+cfg.DeepLAPIKey)
+
+	var response struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := doTranslateRequest(req, "DeepL", &response); err != nil {
+		return nil, err
+	}
+	if len(response.Translations) != len(texts) {
+		return nil, errors.New("DeepL returned a different number of translations")
+	}
+	translated := make([]string, len(texts))
+	for i, translation := range response.Translations {
+		translated[i] = translation.Text
+	}
+	return translated, nil
+}
+
+func translateLLM(cfg Config, texts []string, language string) ([]string, error) {
+	return rewriteLLM(cfg, fmt.Sprintf(translatePrompt, language), texts)
+}
+
+// rewriteLLM has the LLM at --llm-url rewrite each of the texts as the prompt
+// says, passing them as a JSON array and expecting one back.
+func rewriteLLM(cfg Config, prompt string, texts []string) ([]string, error) {
+	var rewritten []string
+	if err := completeLLMJSON(cfg, prompt, texts, &rewritten); err != nil {
+		return nil, err
+	}
+	if len(rewritten) != len(texts) {
+		return nil, errors.New("LLM returned a different number of texts")
+	}
+	return rewritten, nil
+}
+
+// completeLLMJSON sends input to the LLM at --llm-url as JSON and decodes the
+// JSON reply into output.
+func completeLLMJSON(cfg Config, prompt string, input, output interface{}) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data, err = json.Marshal(map[string]interface{}{
+		"model": cfg.LLMModel,
+		"messages": []ChatMessage{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: string(data)},
+		},
+		"temperature": 0,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.LLMURL, "/")+"/v1/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.LLMAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.LLMAPIKey)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message ChatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := doTranslateRequest(req, "LLM", &completion); err != nil {
+		return err
+	}
+	if len(completion.Choices) == 0 {
+		return errors.New("invalid LLM response")
+	}
+	content := strings.TrimSpace(completion.Choices[0].Message.Content)
+	content = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```"), "```"))
+
+	if err := json.Unmarshal([]byte(content), output); err != nil {
+		return errors.New("LLM didn't reply with valid JSON")
+	}
+	return nil
+}
+
+func doTranslateRequest(req *http.Request, backend string, response interface{}) error {
+	client := &http.Client{Timeout: translateTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s request failed", backend)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return errors.Wrapf(err, "%s request failed", backend)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s returned %d: %s", backend, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return errors.Errorf("invalid %s response", backend)
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+func newUIMux(store *JobStore, pool *WorkerPool, s3 *S3Uploads, oidc *OIDC, cfg Config) http.Handler {
+	static, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	assets, err := loadUIAssets(static)
+	if err != nil {
+		panic(err)
+	}
+
+	sessions := NewUISessions(cfg.AdminToken, oidc)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", assets)
+	mux.HandleFunc("/ui/api/config", func(w http.ResponseWriter, r *http.Request) {
+		configHandler(w, r, sessions, pool, cfg)
+	})
+	mux.HandleFunc("/ui/api/upload", withRole(func(w http.ResponseWriter, r *http.Request) {
+		uploadHandler(w, r, store, pool, cfg)
+	}, roleUploader))
+	mux.HandleFunc("/ui/api/compare", withRole(func(w http.ResponseWriter, r *http.Request) {
+		compareHandler(w, r, store, pool, cfg)
+	}, roleUploader))
+	mux.HandleFunc("/ui/api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		jobsHandler(w, r, store, sessions)
+	})
+	mux.HandleFunc("/ui/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		jobHandler(w, r, store, pool, sessions, cfg)
+	})
+	mux.HandleFunc("/ui/api/jobs/events", func(w http.ResponseWriter, r *http.Request) {
+		jobEventsHandler(w, r, store, sessions)
+	})
+	mux.HandleFunc("/ui/api/admin", func(w http.ResponseWriter, r *http.Request) {
+		uiAdminHandler(w, r, sessions)
+	})
+	live, err := NewLiveSessions(store, pool, cfg)
+	if err != nil {
+		panic(err)
+	}
+	mux.HandleFunc("/ui/api/live", withRole(func(w http.ResponseWriter, r *http.Request) {
+		liveHandler(w, r, live)
+	}, roleUploader))
+	mux.HandleFunc("/ui/api/live/", withRole(func(w http.ResponseWriter, r *http.Request) {
+		liveHandler(w, r, live)
+	}, roleUploader))
+	if oidc != nil {
+		mux.HandleFunc("/ui/auth/login", func(w http.ResponseWriter, r *http.Request) {
+			uiLoginHandler(w, r, sessions)
+		})
+		mux.HandleFunc("/ui/auth/callback", func(w http.ResponseWriter, r *http.Request) {
+			uiCallbackHandler(w, r, sessions)
+		})
+		mux.HandleFunc("/ui/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+			uiLogoutHandler(w, r, sessions)
+		})
+	}
+	connectSrc := ""
+	if s3 != nil {
+		mux.HandleFunc("/ui/api/s3/presign", withRole(func(w http.ResponseWriter, r *http.Request) {
+			s3PresignHandler(w, r, s3, pool)
+		}, roleUploader))
+		mux.HandleFunc("/ui/api/s3/submit", withRole(func(w http.ResponseWriter, r *http.Request) {
+			s3SubmitHandler(w, r, s3, pool, cfg)
+		}, roleUploader))
+		connectSrc = s3.origin()
+	}
+	return withUISecurity(sessions.wrap(mux), connectSrc)
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request, sessions *UISessions, pool *WorkerPool, cfg Config) {
+	response := map[string]interface{}{
+		"model":      cfg.WhisperModel,
+		"compare":    cfg.compareEnabled(),
+		"summarize":  cfg.summarizeEnabled(),
+		"translate":  cfg.translateEnabled(),
+		"s3_uploads": cfg.S3Bucket != "",
+		"admin_view": sessions.adminToken != "",
+		"read_only":  cfg.ReadOnly,
+		"live_stun":  cfg.liveSTUNServers(),
+	}
+	if user := requestUser(r); user != nil {
+		response["user"] = user
+	}
+	if maintenance := pool.Maintenance(); maintenance.Enabled {
+		response["maintenance"] = maintenance.Message
+	}
+	if cfg.compareEnabled() {
+		response["compare_model"] = cfg.CompareModel
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// readUploadedFile buffers the "file" field of a multipart upload into a task,
+// spilling to disk past the configured threshold, and rejects files that
+// aren't audio or video by their magic bytes. On failure it writes the
+// error response itself and returns ok=false.
+func readUploadedFile(w http.ResponseWriter, r *http.Request, cfg Config) (*TranscriptionTask, bool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return nil, false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxAudioSize)
+	part, err := nextFilePart(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing file")
+		return nil, false
+	}
+	defer part.Close()
+
+	buffer := cfg.newAudioBuffer()
+	if _, err := io.Copy(buffer, part); err != nil {
+		buffer.Close()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "File too large")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "Failed to read file")
+		}
+		return nil, false
+	}
+	if err := sniffAudio(buffer.Head(sniffLength)); err != nil {
+		buffer.Close()
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Unsupported file: "+err.Error())
+		return nil, false
+	}
+
+	return &TranscriptionTask{
+		Filename:    part.FileName(),
+		Audio:       buffer,
+		OwnsAudio:   true,
+		ContentType: part.Header.Get("Content-Type"),
+	}, true
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool, cfg Config) {
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+	if err := checkTranslateTo(cfg, translateTo(r)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkProfanityMode(profanityMode(r)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkVocabulary(vocabularyParam(r)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkPriority(priorityParam(r)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkMetadata(metadataParam(r)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	task, ok := readUploadedFile(w, r, cfg)
+	if !ok {
+		return
+	}
+	task.Summarize = wantsSummary(r) && cfg.summarizeEnabled()
+	task.Chapters = wantsChapters(r)
+	task.Sentiment = wantsSentiment(r)
+	task.Entities = wantsEntities(r)
+	task.TranslateTo = translateTo(r)
+	task.Profanity = profanityMode(r)
+	task.Vocabulary = vocabularyParam(r)
+	// Someone is waiting on the page, so uploads go ahead of batch work
+	// unless they say otherwise.
+	task.Priority = priorityParam(r)
+	if task.Priority == "" {
+		task.Priority = priorityHigh
+	}
+	task.Metadata = metadataParam(r)
+	task.Owner = requestOwner(r)
+
+	job, err := pool.Submit("upload", task)
+	if err != nil {
+		task.Audio.Close()
+		writeRejected(w, pool, err)
+		return
+	}
+	<-task.Done
+
+	status := http.StatusOK
+	if task.Err != nil {
+		log.Printf("upload %s failed: %+v", task.Filename, task.Err)
+		status = http.StatusBadGateway
+	}
+
+	job, _ = store.Get(job.ID)
+	writeJSON(w, status, job)
+}
+
+// nextFilePart skips ahead to the "file" field of a multipart request.
+func nextFilePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// compareHandler runs the same upload through the primary and the comparison
+// backend concurrently and returns both jobs with a word diff of the results.
+func compareHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool, cfg Config) {
+	if !cfg.compareEnabled() {
+		writeJSONError(w, http.StatusNotFound, "Compare mode is not configured")
+		return
+	}
+
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+	upload, ok := readUploadedFile(w, r, cfg)
+	if !ok {
+		return
+	}
+	defer upload.Audio.Close()
+
+	tasks := []*TranscriptionTask{
+		{Filename: upload.Filename, Audio: upload.Audio, WhisperURL: cfg.WhisperURL, WhisperModel: cfg.WhisperModel, Priority: priorityHigh, Owner: requestOwner(r)},
+		{Filename: upload.Filename, Audio: upload.Audio, WhisperURL: cfg.CompareURL, WhisperModel: cfg.CompareModel, Priority: priorityHigh, Owner: requestOwner(r)},
+	}
+	for i, task := range tasks {
+		if _, err := pool.Submit("compare:"+task.WhisperModel, task); err != nil {
+			for _, submitted := range tasks[:i] {
+				<-submitted.Done
+			}
+			writeRejected(w, pool, err)
+			return
+		}
+	}
+
+	jobs := make([]Job, len(tasks))
+	for i, task := range tasks {
+		<-task.Done
+		if task.Err != nil {
+			log.Printf("compare %s with %s failed: %+v", task.Filename, task.WhisperModel, task.Err)
+		}
+		jobs[i], _ = store.Get(task.JobID)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"left":  jobs[0],
+		"right": jobs[1],
+		"diff":  diffTranscripts(jobs[0].Text, jobs[1].Text),
+	})
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request, store *JobStore, sessions *UISessions) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleJobs(r, store, sessions))
+}
+
+// visibleJobs lists the jobs the request owns, or all of them in the admin
+// view and for reviewers.
+func visibleJobs(r *http.Request, store *JobStore, sessions *UISessions) []Job {
+	owner, all := requestOwner(r), sessions.seesAll(r)
+	jobs := []Job{}
+	for _, job := range store.List() {
+		if all || job.Owner == owner {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool, sessions *UISessions, cfg Config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET and DELETE supported")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/ui/api/jobs/")
+	// Other sessions' jobs are reported as missing rather than forbidden, so
+	// their IDs can't be probed.
+	if job, ok := store.Get(strings.Split(id, "/")[0]); !ok || !sessions.canSee(r, job) {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		cancelUIJobHandler(w, r, store, pool, id)
+		return
+	}
+	if strings.HasSuffix(id, "/audio") {
+		jobAudioHandler(w, r, store, strings.TrimSuffix(id, "/audio"))
+		return
+	}
+	if strings.HasSuffix(id, "/export") {
+		jobExportHandler(w, r, store, strings.TrimSuffix(id, "/export"))
+		return
+	}
+	if strings.HasSuffix(id, "/captioned") {
+		captionedVideoHandler(w, r, store, cfg, strings.TrimSuffix(id, "/captioned"))
+		return
+	}
+
+	job, ok := store.Get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeJSONWithETag(w, r, job)
+}
+
+// cancelUIJobHandler cancels a queued or running job the session can see and
+// responds with the job once it stopped.
+func cancelUIJobHandler(w http.ResponseWriter, r *http.Request, store *JobStore, pool *WorkerPool, id string) {
+	if !allowed(r, roleUploader) {
+		writeForbidden(w, roleUploader)
+		return
+	}
+	if job, _ := store.Get(id); job.finished() {
+		writeJSONError(w, http.StatusConflict, "Job already "+string(job.Status))
+		return
+	}
+	job, ok := cancelJob(r.Context(), store, pool, id, "cancelled")
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func jobAudioHandler(w http.ResponseWriter, r *http.Request, store *JobStore, id string) {
+	job, ok := store.Get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	audio, ok := store.Audio(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Audio is no longer available")
+		return
+	}
+
+	contentType := audio.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(audio.Buffer.Head(512))
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(job.Filename)); contentType == "application/octet-stream" && byExtension != "" {
+		contentType = byExtension
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, job.Filename, job.CreatedAt, audio.Buffer.Reader())
+}
+
+func jobExportHandler(w http.ResponseWriter, r *http.Request, store *JobStore, id string) {
+	job, ok := store.Get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if job.Transcript == nil {
+		writeJSONError(w, http.StatusConflict, "Job has no transcript")
+		return
+	}
+
+	format, ok := exportFormats[r.URL.Query().Get("format")]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Unsupported export format")
+		return
+	}
+	data, err := format.Render(job.Transcript)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := strings.TrimSuffix(path.Base(job.Filename), path.Ext(job.Filename)) + "." + format.Extension
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	writeWithETag(w, r, format.ContentType, data)
+}
+
+func jobEventsHandler(w http.ResponseWriter, r *http.Request, store *JobStore, sessions *UISessions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	updates, unsubscribe := store.Subscribe()
+	defer unsubscribe()
+
+	for {
+		data, err := json.Marshal(visibleJobs(r, store, sessions))
+		if err != nil {
+			return
+		}
+		if _, err := w.Write([]byte("data: " + string(data) + "\n\n")); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,693 @@
+"use strict";
+
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+  return match ? match[1] : "";
+}
+
+function post(url, body) {
+  return fetch(url, { method: "POST", body: body, headers: { "X-CSRF-Token": csrfToken() } });
+}
+
+// Set from /ui/api/config once the page has loaded.
+let uiConfig = {};
+
+const api = {
+  async upload(file, options) {
+    const params = new URLSearchParams();
+    if (options.summarize) params.set("summarize", "true");
+    if (options.chapters) params.set("chapters", "true");
+    if (options.sentiment) params.set("sentiment", "true");
+    if (options.entities) params.set("entities", "true");
+    if (options.translateTo) params.set("translate_to", options.translateTo);
+    if (options.vocabulary) params.set("vocabulary", options.vocabulary);
+    const query = params.toString();
+    if (uiConfig.s3_uploads) {
+      return api.uploadToS3(file, query);
+    }
+    const data = new FormData();
+    data.append("file", file);
+    const resp = await post("/ui/api/upload" + (query ? "?" + query : ""), data);
+    const body = await resp.json();
+    if (!resp.ok && !body.id) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  // uploadToS3 puts the file straight into the bucket with a presigned URL
+  // and then submits its key, so the file never passes through the agent.
+  async uploadToS3(file, query) {
+    let resp = await post("/ui/api/s3/presign", JSON.stringify({ filename: file.name, size: file.size }));
+    const presigned = await resp.json();
+    if (!resp.ok) {
+      throw new Error(presigned.error || resp.statusText);
+    }
+    resp = await fetch(presigned.url, { method: "PUT", body: file });
+    if (!resp.ok) {
+      throw new Error("Upload to S3 failed: " + resp.status + " " + resp.statusText);
+    }
+    resp = await post("/ui/api/s3/submit" + (query ? "?" + query : ""), JSON.stringify({ key: presigned.key }));
+    const body = await resp.json();
+    if (!resp.ok && !body.id) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  async config() {
+    const resp = await fetch("/ui/api/config");
+    if (resp.status === 401) {
+      // The OIDC login expired; log in again and come back.
+      location.href = "/ui/auth/login?return=" + encodeURIComponent(location.pathname + location.hash);
+    }
+    return resp.json();
+  },
+
+  async logout() {
+    const resp = await post("/ui/auth/logout");
+    const body = await resp.json();
+    location.href = body.redirect || "/";
+  },
+
+  async compare(file) {
+    const data = new FormData();
+    data.append("file", file);
+    const resp = await post("/ui/api/compare", data);
+    const body = await resp.json();
+    if (!resp.ok) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  // liveStart sends the WebRTC offer and returns the session's id and the
+  // server's answer.
+  async liveStart(offer) {
+    const resp = await post("/ui/api/live", JSON.stringify({ type: offer.type, sdp: offer.sdp }));
+    const body = await resp.json();
+    if (!resp.ok) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  async liveStop(id) {
+    const resp = await post("/ui/api/live/" + encodeURIComponent(id) + "/stop");
+    const body = await resp.json();
+    if (!resp.ok && !body.id) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  async admin(method, token) {
+    const resp = await fetch("/ui/api/admin", {
+      method: method,
+      body: token === undefined ? undefined : JSON.stringify({ token: token }),
+      headers: { "X-CSRF-Token": csrfToken() },
+    });
+    const body = await resp.json();
+    if (!resp.ok) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body.admin;
+  },
+
+  async cancel(id) {
+    const resp = await fetch("/ui/api/jobs/" + encodeURIComponent(id), {
+      method: "DELETE",
+      headers: { "X-CSRF-Token": csrfToken() },
+    });
+    const body = await resp.json();
+    if (!resp.ok) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+
+  async job(id) {
+    const resp = await fetch("/ui/api/jobs/" + encodeURIComponent(id));
+    const body = await resp.json();
+    if (!resp.ok) {
+      throw new Error(body.error || resp.statusText);
+    }
+    return body;
+  },
+};
+
+let queueEvents = null;
+
+function show(name) {
+  for (const view of document.querySelectorAll(".view")) {
+    view.classList.toggle("active", view.id === "view-" + name);
+  }
+  if (name !== "queue" && queueEvents) {
+    queueEvents.close();
+    queueEvents = null;
+  }
+}
+
+function cell(row, text, className) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (className) td.className = className;
+  row.appendChild(td);
+  return td;
+}
+
+function renderQueue(jobs) {
+  const body = document.getElementById("jobs");
+  body.innerHTML = "";
+  for (const job of jobs) {
+    const row = document.createElement("tr");
+    cell(row, new Date(job.created_at).toLocaleTimeString());
+    cell(row, job.source);
+    cell(row, job.priority, "priority-" + job.priority);
+    cell(row, job.tenant || "");
+    const file = cell(row, "");
+    const link = document.createElement("a");
+    link.href = "#/jobs/" + job.id;
+    link.textContent = job.filename;
+    file.appendChild(link);
+    const status = cell(row, job.status, "status-" + job.status);
+    if (job.status === "running") {
+      const bar = document.createElement("progress");
+      bar.max = 1;
+      bar.value = job.progress;
+      bar.title = job.percent + "%";
+      status.appendChild(document.createElement("br"));
+      status.appendChild(bar);
+      if (job.chunks) {
+        status.appendChild(document.createTextNode(" " + job.chunks.done + "/" + job.chunks.total + " chunks"));
+      }
+    }
+    if (job.status === "scheduled" || job.status === "pending" || job.status === "running") {
+      const cancel = document.createElement("button");
+      cancel.className = "cancel";
+      cancel.textContent = "Cancel";
+      cancel.onclick = () => cancelJob(job.id, cancel);
+      status.appendChild(document.createElement("br"));
+      status.appendChild(cancel);
+    }
+    cell(row, job.error || "");
+    body.appendChild(row);
+  }
+  document.getElementById("empty").style.display = jobs.length ? "none" : "block";
+}
+
+// cancelJob stops a queued or running job; the queue updates from the events.
+async function cancelJob(id, button) {
+  button.disabled = true;
+  try {
+    await api.cancel(id);
+  } catch (err) {
+    button.disabled = false;
+    alert("Cancelling failed: " + err.message);
+  }
+}
+
+// renderAdmin switches the queue between the session's own jobs and, with
+// the admin token, everyone's.
+function renderAdmin(admin) {
+  const form = document.getElementById("admin-form");
+  form.dataset.admin = admin ? "true" : "";
+  form.token.classList.toggle("hidden", admin);
+  form.token.value = "";
+  document.getElementById("admin-status").textContent = admin ? "Admin view: showing all jobs." : "Showing your jobs.";
+  document.getElementById("admin-toggle").value = admin ? "Show only mine" : "Show all jobs";
+}
+
+async function toggleAdmin(e) {
+  e.preventDefault();
+  const form = e.target;
+  const error = document.getElementById("admin-error");
+  error.textContent = "";
+  try {
+    renderAdmin(form.dataset.admin ? await api.admin("DELETE") : await api.admin("POST", form.token.value));
+  } catch (err) {
+    error.textContent = err.message;
+    return;
+  }
+  // Reopen the event stream to get the list of the new view right away.
+  if (queueEvents) {
+    queueEvents.close();
+    queueEvents = null;
+  }
+  showQueue();
+}
+
+function showQueue() {
+  show("queue");
+  if (queueEvents) return;
+  const connection = document.getElementById("connection");
+  queueEvents = new EventSource("/ui/api/jobs/events");
+  queueEvents.onopen = () => connection.textContent = "Live";
+  queueEvents.onerror = () => connection.textContent = "Reconnecting...";
+  queueEvents.onmessage = (e) => renderQueue(JSON.parse(e.data));
+}
+
+// Each rendered word/segment remembers its time range so the player can
+// highlight whatever is being spoken and clicking text seeks the audio.
+let timedElements = [];
+
+function timedSpan(text, start, end, className) {
+  const span = document.createElement("span");
+  span.className = className;
+  span.textContent = text;
+  span.addEventListener("click", () => {
+    const player = document.getElementById("player");
+    player.currentTime = start;
+    player.play();
+  });
+  timedElements.push({ element: span, start: start, end: end });
+  return span;
+}
+
+// speakerTurns groups consecutive segments of the same speaker, attaching the
+// words spoken within each turn. Without speakers everything is one turn.
+function speakerTurns(transcript) {
+  const segments = transcript.segments || [];
+  const words = transcript.words || [];
+  const turns = [];
+  for (const segment of segments) {
+    const speaker = segment.speaker || "";
+    let turn = turns[turns.length - 1];
+    if (!turn || turn.speaker !== speaker) {
+      turn = { speaker: speaker, segments: [], words: [] };
+      turns.push(turn);
+    }
+    turn.segments.push(segment);
+  }
+  if (turns.length <= 1) {
+    return [{ speaker: turns.length ? turns[0].speaker : "", segments: segments, words: words }];
+  }
+  for (const word of words) {
+    const middle = (word.start + word.end) / 2;
+    const turn = turns.find((t) => middle <= t.segments[t.segments.length - 1].end) || turns[turns.length - 1];
+    turn.words.push(word);
+  }
+  return turns;
+}
+
+// Words below this probability are flagged for review like the segments the
+// server flags as low confidence.
+const lowWordProbability = 0.5;
+
+function flagConfidence(span, low, confidence) {
+  if (low) span.classList.add("low-confidence");
+  if (confidence !== undefined) span.title = "Confidence " + Math.round(confidence * 100) + "%";
+}
+
+function segmentAt(segments, time) {
+  return segments.find((segment) => time >= segment.start && time <= segment.end);
+}
+
+function renderTranscript(container, job) {
+  container.innerHTML = "";
+  timedElements = [];
+  const transcript = job.transcript || {};
+  if (!transcript.segments && !transcript.words) {
+    container.textContent = job.text || "";
+    document.getElementById("confidence-hint").classList.add("hidden");
+    return;
+  }
+  for (const turn of speakerTurns(transcript)) {
+    const block = document.createElement("div");
+    block.className = "turn";
+    if (turn.speaker) {
+      const label = document.createElement("span");
+      label.className = "speaker";
+      label.textContent = turn.speaker;
+      block.appendChild(label);
+    }
+    if (turn.words.length) {
+      for (const word of turn.words) {
+        const span = timedSpan(word.word, word.start, word.end, "word");
+        const segment = segmentAt(turn.segments, (word.start + word.end) / 2) || {};
+        const confidence = word.probability !== undefined ? word.probability : segment.confidence;
+        flagConfidence(span, segment.low_confidence || word.probability < lowWordProbability, confidence);
+        block.appendChild(span);
+        block.appendChild(document.createTextNode(" "));
+      }
+    } else {
+      for (const segment of turn.segments) {
+        const span = timedSpan(segment.text.trim(), segment.start, segment.end, "segment");
+        flagConfidence(span, segment.low_confidence, segment.confidence);
+        block.appendChild(span);
+        block.appendChild(document.createTextNode(" "));
+      }
+    }
+    container.appendChild(block);
+  }
+  const flagged = (transcript.segments || []).filter((segment) => segment.low_confidence).length;
+  const hint = document.getElementById("confidence-hint");
+  hint.classList.toggle("hidden", !flagged);
+  hint.textContent = flagged + " low-confidence " + (flagged === 1 ? "segment is" : "segments are") + " underlined; check them against the audio.";
+}
+
+function highlight(time) {
+  for (const timed of timedElements) {
+    timed.element.classList.toggle("current", time >= timed.start && time < timed.end);
+  }
+}
+
+function renderSummary(summary) {
+  document.getElementById("summary").classList.toggle("hidden", !summary);
+  if (!summary) return;
+  document.getElementById("summary-error").textContent = summary.error || "";
+  document.getElementById("summary-text").textContent = summary.text || "";
+  const actions = document.getElementById("summary-actions");
+  actions.innerHTML = "";
+  for (const item of summary.action_items || []) {
+    const li = document.createElement("li");
+    li.textContent = item;
+    actions.appendChild(li);
+  }
+}
+
+function formatTime(seconds) {
+  const total = Math.floor(seconds);
+  const minutes = String(Math.floor(total / 60) % 60).padStart(2, "0") + ":" + String(total % 60).padStart(2, "0");
+  return total >= 3600 ? Math.floor(total / 3600) + ":" + minutes : minutes;
+}
+
+function renderSentiment(sentiment) {
+  const element = document.getElementById("sentiment");
+  element.classList.toggle("hidden", !sentiment);
+  if (!sentiment) return;
+  element.textContent = "Sentiment: " + sentiment.label + " (" + sentiment.average.toFixed(2) + "), " +
+    sentiment.positive + " positive, " + sentiment.neutral + " neutral, " + sentiment.negative + " negative segments";
+}
+
+function renderEntities(entities) {
+  document.getElementById("entities").classList.toggle("hidden", !entities);
+  const list = document.getElementById("entity-list");
+  list.innerHTML = "";
+  if (!entities) return;
+  const kinds = { people: "People", organizations: "Organizations", dates: "Dates", amounts: "Amounts" };
+  for (const [kind, title] of Object.entries(kinds)) {
+    if (!(entities[kind] || []).length) continue;
+    const dt = document.createElement("dt");
+    dt.textContent = title;
+    const dd = document.createElement("dd");
+    dd.textContent = entities[kind].join(", ");
+    list.append(dt, dd);
+  }
+}
+
+// renderChapters lists the chapters; clicking one plays from its start.
+function renderChapters(chapters) {
+  document.getElementById("chapters").classList.toggle("hidden", !chapters);
+  const list = document.getElementById("chapter-list");
+  list.innerHTML = "";
+  for (const chapter of chapters || []) {
+    const li = document.createElement("li");
+    li.appendChild(timedSpan(formatTime(chapter.start) + " " + chapter.title, chapter.start, chapter.end, "chapter"));
+    list.appendChild(li);
+  }
+}
+
+function renderTranslation(translation) {
+  document.getElementById("translation").classList.toggle("hidden", !translation);
+  if (!translation) return;
+  document.getElementById("translation-title").textContent = "Translation (" + translation.language + ")";
+  document.getElementById("translation-error").textContent = translation.error || "";
+  const segments = translation.segments || [];
+  document.getElementById("translation-text").textContent = segments.length
+    ? segments.map((segment) => segment.text).join("\n")
+    : translation.text || "";
+}
+
+// Uploads the server can burn the subtitles into.
+const videoFile = /\.(mp4|m4v|mov|mkv|webm|avi)$/i;
+
+function renderResult(job) {
+  document.getElementById("result-file").textContent = job.filename + " (" + job.status + ")";
+  document.getElementById("result-error").textContent = job.error || "";
+  renderTranscript(document.getElementById("transcription"), job);
+  renderSummary((job.transcript || {}).summary);
+  renderChapters((job.transcript || {}).chapters);
+  renderSentiment((job.transcript || {}).sentiment);
+  renderEntities((job.transcript || {}).entities);
+  renderTranslation((job.transcript || {}).translation);
+
+  for (const format of ["txt", "json", "md", "srt", "vtt", "ttml", "ebu-stl"]) {
+    const link = document.getElementById("export-" + format);
+    link.href = "/ui/api/jobs/" + encodeURIComponent(job.id) + "/export?format=" + format;
+    link.classList.toggle("hidden", !job.transcript);
+  }
+  const captioned = document.getElementById("export-captioned");
+  captioned.href = "/ui/api/jobs/" + encodeURIComponent(job.id) + "/captioned";
+  captioned.classList.toggle("hidden", !job.transcript || !job.has_audio || !videoFile.test(job.filename));
+
+  const player = document.getElementById("player");
+  if (job.has_audio) {
+    player.src = "/ui/api/jobs/" + encodeURIComponent(job.id) + "/audio";
+    player.style.display = "block";
+  } else {
+    player.removeAttribute("src");
+    player.style.display = "none";
+  }
+}
+
+async function showResult(id) {
+  show("result");
+  renderResult({ filename: "", status: "loading" });
+  try {
+    renderResult(await api.job(id));
+  } catch (err) {
+    renderResult({ filename: id, status: "unknown", error: err.message });
+  }
+}
+
+// renderDiff shows one side of a word diff: the left side keeps deletions,
+// the right side keeps insertions, and both keep the common words.
+function renderDiff(container, diff, side) {
+  container.innerHTML = "";
+  const skip = side === "left" ? "insert" : "delete";
+  for (const op of diff) {
+    if (op.op === skip) continue;
+    const span = document.createElement("span");
+    if (op.op !== "equal") span.className = "diff-" + op.op;
+    span.textContent = op.text;
+    container.appendChild(span);
+    container.appendChild(document.createTextNode(" "));
+  }
+}
+
+function renderComparison(result) {
+  for (const side of ["left", "right"]) {
+    const job = result[side];
+    document.getElementById("compare-" + side + "-title").textContent = job.source.replace(/^compare:/, "");
+    document.getElementById("compare-" + side + "-error").textContent = job.error || "";
+    renderDiff(document.getElementById("compare-" + side), result.diff, side);
+  }
+  document.getElementById("compare-result").classList.remove("hidden");
+}
+
+// A live session streams the microphone over WebRTC; the server sends back a
+// rolling transcript of everything so far on a data channel.
+let live = null;
+
+// iceGathered resolves once the peer has all its ICE candidates, so they go
+// in the offer and nothing needs trickling.
+function iceGathered(peer) {
+  return new Promise((resolve) => {
+    if (peer.iceGatheringState === "complete") return resolve();
+    peer.addEventListener("icegatheringstatechange", () => {
+      if (peer.iceGatheringState === "complete") resolve();
+    });
+  });
+}
+
+async function startLive() {
+  const status = document.getElementById("live-status");
+  const error = document.getElementById("live-error");
+  const text = document.getElementById("live-text");
+  error.textContent = "";
+  text.textContent = "";
+  if (!navigator.mediaDevices || !window.RTCPeerConnection) {
+    error.textContent = "Live transcription needs a browser with WebRTC over HTTPS or on localhost.";
+    return;
+  }
+
+  let stream;
+  try {
+    stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+  } catch (err) {
+    error.textContent = "Microphone not available: " + err.message;
+    return;
+  }
+  const stun = uiConfig.live_stun || [];
+  const peer = new RTCPeerConnection({ iceServers: stun.map((url) => ({ urls: url })) });
+  const session = { stream: stream, peer: peer };
+  stream.getTracks().forEach((track) => peer.addTrack(track, stream));
+  const channel = peer.createDataChannel("transcript");
+  channel.onmessage = (e) => {
+    const update = JSON.parse(e.data);
+    if (update.text) text.textContent = update.text;
+    if (update.error) error.textContent = update.error;
+  };
+  peer.onconnectionstatechange = () => {
+    if (peer.connectionState === "failed" && live === session) {
+      error.textContent = "Lost the connection to the server.";
+      stopLive();
+    }
+  };
+
+  try {
+    await peer.setLocalDescription(await peer.createOffer());
+    await iceGathered(peer);
+    const started = await api.liveStart(peer.localDescription);
+    session.id = started.id;
+    await peer.setRemoteDescription(started.answer);
+  } catch (err) {
+    peer.close();
+    stream.getTracks().forEach((track) => track.stop());
+    error.textContent = err.message;
+    return;
+  }
+  live = session;
+
+  status.textContent = "Recording...";
+  document.getElementById("live-start").disabled = true;
+  document.getElementById("live-stop").disabled = false;
+}
+
+async function stopLive() {
+  const session = live;
+  if (!session) return;
+  live = null;
+  const status = document.getElementById("live-status");
+  document.getElementById("live-stop").disabled = true;
+
+  // The server hangs up once it has stopped recording, so nothing sent before
+  // the stop is lost.
+  session.stream.getTracks().forEach((track) => track.stop());
+
+  status.textContent = "Transcribing the recording...";
+  try {
+    const job = await api.liveStop(session.id);
+    status.textContent = "";
+    location.hash = "#/jobs/" + job.id;
+  } catch (err) {
+    status.textContent = "";
+    document.getElementById("live-error").textContent = err.message;
+  } finally {
+    session.peer.close();
+    document.getElementById("live-start").disabled = false;
+  }
+}
+
+function route() {
+  document.getElementById("player").pause();
+  const hash = location.hash.replace(/^#/, "") || "/";
+  if (hash === "/queue") {
+    showQueue();
+  } else if (hash === "/live") {
+    show("live");
+  } else if (hash === "/compare") {
+    show("compare");
+  } else if (hash.startsWith("/jobs/")) {
+    showResult(hash.substring("/jobs/".length));
+  } else {
+    show("upload");
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  const form = document.getElementById("upload-form");
+  const processing = document.getElementById("processing");
+  const uploadError = document.getElementById("upload-error");
+
+  form.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    processing.style.display = "block";
+    uploadError.textContent = "";
+    try {
+      const job = await api.upload(form.elements.file.files[0], {
+        summarize: form.elements.summarize.checked,
+        chapters: form.elements.chapters.checked,
+        sentiment: form.elements.sentiment.checked,
+        entities: form.elements.entities.checked,
+        translateTo: form.elements.translate_to.value.trim(),
+        vocabulary: form.elements.vocabulary.value.trim(),
+      });
+      form.reset();
+      location.hash = "#/jobs/" + job.id;
+    } catch (err) {
+      uploadError.textContent = err.message;
+    } finally {
+      processing.style.display = "none";
+    }
+  });
+
+  const compareForm = document.getElementById("compare-form");
+  const compareProcessing = document.getElementById("compare-processing");
+  const compareError = document.getElementById("compare-error");
+
+  compareForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    compareProcessing.style.display = "block";
+    compareError.textContent = "";
+    document.getElementById("compare-result").classList.add("hidden");
+    try {
+      renderComparison(await api.compare(compareForm.elements.file.files[0]));
+    } catch (err) {
+      compareError.textContent = err.message;
+    } finally {
+      compareProcessing.style.display = "none";
+    }
+  });
+
+  api.config().then((config) => {
+    uiConfig = config;
+    const paused = config.read_only ? "New uploads are paused on this server. Transcripts, history and exports are still available." : config.maintenance;
+    if (paused) {
+      const notice = document.getElementById("notice");
+      notice.textContent = paused;
+      notice.classList.remove("hidden");
+      for (const input of document.querySelectorAll("#upload-form input, #compare-form input, #live-start")) {
+        input.disabled = true;
+      }
+    }
+    if (config.user) {
+      document.getElementById("user-name").textContent = config.user.name + " (" + (config.user.roles || []).join(", ") + ")";
+      document.getElementById("user").classList.remove("hidden");
+    }
+    if (config.admin_view) {
+      document.getElementById("admin-form").classList.remove("hidden");
+      api.admin("GET").then(renderAdmin);
+    }
+    document.getElementById("summarize-option").classList.toggle("hidden", !config.summarize);
+    document.getElementById("translate-option").classList.toggle("hidden", !config.translate);
+    if (config.compare) {
+      document.getElementById("nav-compare").classList.remove("hidden");
+      document.getElementById("compare-models").textContent = config.model + " vs. " + config.compare_model;
+    }
+  });
+
+  document.getElementById("copy").addEventListener("click", () => {
+    const text = document.getElementById("transcription").innerText.trim();
+    navigator.clipboard.writeText(text).then(() => {
+      alert("Copied to clipboard!");
+    }, () => {
+      alert("Failed to copy text.");
+    });
+  });
+  document.getElementById("admin-form").addEventListener("submit", toggleAdmin);
+  document.getElementById("logout").addEventListener("click", (e) => {
+    e.preventDefault();
+    api.logout();
+  });
+  document.getElementById("live-start").addEventListener("click", startLive);
+  document.getElementById("live-stop").addEventListener("click", stopLive);
+  document.getElementById("back").addEventListener("click", () => history.back());
+
+  const player = document.getElementById("player");
+  player.addEventListener("timeupdate", () => highlight(player.currentTime));
+
+  window.addEventListener("hashchange", route);
+  route();
+});
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	uiSessionCookieName = "ui_session"
+	// uiSessionMaxAge keeps a browser's history across restarts of the
+	// browser, not just for the tab.
+	uiSessionMaxAge = 365 * 24 * time.Hour
+	// uiAdminTTL is how long the admin view lasts before the token has to be
+	// entered again.
+	uiAdminTTL = 12 * time.Hour
+)
+
+type uiSessionContextKey struct{}
+
+// UISessions scope the UI to the browser using it: every browser gets a
+// random session ID in an HttpOnly cookie, jobs submitted through the UI are
+// owned by it, and the queue, results, audio and exports only show the
+// session's own jobs. A session becomes an admin session, which sees every
+// job including those submitted through the API and integrations, by
+// entering the --admin-token.
+//
+// With OIDC, sessions have to log in, jobs are owned by the user rather than
+// the browser, and reviewers and admins see every job instead.
+type UISessions struct {
+	adminToken string
+	oidc       *OIDC
+	mu         sync.Mutex
+	admins     map[string]time.Time
+	users      map[string]uiLogin
+}
+
+type uiLogin struct {
+	user    *oidcUser
+	expires time.Time
+}
+
+func NewUISessions(adminToken string, oidc *OIDC) *UISessions {
+	// Roles decide who sees everything with OIDC, not the token.
+	if oidc != nil {
+		adminToken = ""
+	}
+	return &UISessions{adminToken: adminToken, oidc: oidc, admins: make(map[string]time.Time), users: make(map[string]uiLogin)}
+}
+
+// wrap passes the session of the request on to next, starting one if the
+// browser has none yet. With OIDC, it passes on the user logged in with the
+// session too, and sends sessions without one to log in.
+func (s *UISessions) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := ""
+		if cookie, err := r.Cookie(uiSessionCookieName); err == nil && len(cookie.Value) == 64 {
+			session = cookie.Value
+		} else {
+			session = newRandomToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     uiSessionCookieName,
+				Value:    session,
+				Path:     "/",
+				MaxAge:   int(uiSessionMaxAge.Seconds()),
+				HttpOnly: true,
+				// Lax, so the session comes along when the OIDC provider
+				// sends the browser back after logging in.
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), uiSessionContextKey{}, session))
+		if s.oidc == nil || strings.HasPrefix(r.URL.Path, "/ui/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.mu.Lock()
+		login, ok := s.users[session]
+		s.mu.Unlock()
+		switch {
+		case ok && time.Now().Before(login.expires):
+			next.ServeHTTP(w, withUser(r, login.user))
+		case strings.HasPrefix(r.URL.Path, "/ui/api/"):
+			writeJSONError(w, http.StatusUnauthorized, "Login required")
+		default:
+			http.Redirect(w, r, "/ui/auth/login", http.StatusFound)
+		}
+	})
+}
+
+// requestUISession returns the UI session of the request, if any.
+func requestUISession(r *http.Request) string {
+	session, _ := r.Context().Value(uiSessionContextKey{}).(string)
+	return session
+}
+
+// requestOwner returns who owns the jobs the request submits: the OIDC user
+// if there is one, or else the UI session.
+func requestOwner(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return "oidc:" + user.Subject
+	}
+	return requestUISession(r)
+}
+
+func (s *UISessions) isAdmin(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.admins[requestUISession(r)]
+	return ok && time.Now().Before(expires)
+}
+
+// seesAll reports whether the request may see every job, not just its own.
+func (s *UISessions) seesAll(r *http.Request) bool {
+	if user := requestUser(r); user != nil {
+		return user.has(roleReviewer)
+	}
+	return s.isAdmin(r)
+}
+
+// canSee reports whether the request may see the job.
+func (s *UISessions) canSee(r *http.Request, job Job) bool {
+	return job.Owner == requestOwner(r) || s.seesAll(r)
+}
+
+// uiAdminHandler reports whether the session has the admin view (GET),
+// switches to it with the admin token (POST {"token": ...}) and leaves it
+// (DELETE).
+func uiAdminHandler(w http.ResponseWriter, r *http.Request, sessions *UISessions) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if sessions.adminToken == "" || body.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(body.Token), []byte(sessions.adminToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+		now := time.Now()
+		sessions.mu.Lock()
+		for session, expires := range sessions.admins {
+			if now.After(expires) {
+				delete(sessions.admins, session)
+			}
+		}
+		sessions.admins[requestUISession(r)] = now.Add(uiAdminTTL)
+		sessions.mu.Unlock()
+	case http.MethodDelete:
+		sessions.mu.Lock()
+		delete(sessions.admins, requestUISession(r))
+		sessions.mu.Unlock()
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET, POST and DELETE supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"admin": sessions.isAdmin(r)})
+}
+
+// uiLoginHandler sends the browser to log in at the OIDC provider.
+func uiLoginHandler(w http.ResponseWriter, r *http.Request, sessions *UISessions) {
+	sessions.oidc.startLogin(w, r)
+}
+
+// uiCallbackHandler logs the session in when the provider sends the browser
+// back.
+func uiCallbackHandler(w http.ResponseWriter, r *http.Request, sessions *UISessions) {
+	user, returnTo, err := sessions.oidc.finishLogin(r)
+	if err != nil {
+		log.Printf("UI login failed: %v", err)
+		http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	sessions.mu.Lock()
+	for session, login := range sessions.users {
+		if now.After(login.expires) {
+			delete(sessions.users, session)
+		}
+	}
+	sessions.users[requestUISession(r)] = uiLogin{user: user, expires: now.Add(uiLoginTTL)}
+	sessions.mu.Unlock()
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// uiLogoutHandler logs the session out and returns where to send the browser
+// to log out of the provider too.
+func uiLogoutHandler(w http.ResponseWriter, r *http.Request, sessions *UISessions) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+		return
+	}
+	sessions.mu.Lock()
+	delete(sessions.users, requestUISession(r))
+	sessions.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": sessions.oidc.logoutURL()})
+}
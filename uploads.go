@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxUploadParts is the highest part number, as in S3.
+	maxUploadParts = 10000
+	// maxPendingUploads bounds the multipart uploads of a tenant started and
+	// neither completed nor aborted yet, whose parts take up disk space.
+	maxPendingUploads = 1000
+)
+
+// Uploads holds multipart uploads: big files sent in parts with separate
+// requests, S3-style, by clients that can't send them in one. Parts are kept
+// on disk, encrypted if there's a key, until the upload is completed, which
+// assembles them in order and queues the job, or aborted. Uploads neither
+// are forgotten and their parts removed after the TTL.
+type Uploads struct {
+	mu      sync.Mutex
+	cfg     Config
+	uploads map[string]*multipartUpload
+}
+
+// multipartUpload is an upload in progress, as returned by the API.
+type multipartUpload struct {
+	ID        string       `json:"upload_id"`
+	Filename  string       `json:"filename"`
+	Parts     []uploadPart `json:"parts"`
+	Size      int64        `json:"size"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+
+	tenant  string
+	buffers map[int]*AudioBuffer
+}
+
+type uploadPart struct {
+	PartNumber int    `json:"part_number"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag"`
+}
+
+func NewUploads(cfg Config) *Uploads {
+	return &Uploads{cfg: cfg, uploads: make(map[string]*multipartUpload)}
+}
+
+// sweep removes the expired uploads. The caller holds the lock.
+func (u *Uploads) sweep() {
+	now := time.Now()
+	for id, upload := range u.uploads {
+		if now.After(upload.ExpiresAt) {
+			upload.close()
+			delete(u.uploads, id)
+		}
+	}
+}
+
+// get returns the tenant's upload. The caller holds the lock.
+func (u *Uploads) get(tenant, id string) (*multipartUpload, bool) {
+	u.sweep()
+	upload, ok := u.uploads[id]
+	if !ok || upload.tenant != tenant {
+		return nil, false
+	}
+	return upload, true
+}
+
+func (upload *multipartUpload) close() {
+	for _, buffer := range upload.buffers {
+		buffer.Close()
+	}
+}
+
+// view returns a copy of the upload for responses, with the parts listed in
+// order.
+func (upload *multipartUpload) view() multipartUpload {
+	view := *upload
+	view.Parts = append([]uploadPart{}, upload.Parts...)
+	sort.Slice(view.Parts, func(i, j int) bool { return view.Parts[i].PartNumber < view.Parts[j].PartNumber })
+	return view
+}
+
+// uploadsHandler serves the multipart upload API:
+//
+//	POST   /v1/uploads                 starts an upload, {"filename": "..."}
+//	GET    /v1/uploads/{id}            lists the parts uploaded so far
+//	PUT    /v1/uploads/{id}/parts/{n}  uploads part n as the body, replacing
+//	                                   an earlier one
+//	POST   /v1/uploads/{id}/complete   assembles the parts and queues the job,
+//	                                   with the options as query parameters
+//	DELETE /v1/uploads/{id}            aborts the upload
+func uploadsHandler(w http.ResponseWriter, r *http.Request, uploads *Uploads, pool *WorkerPool, cfg Config) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/uploads"), "/")
+	if path == "" {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+			return
+		}
+		if err := pool.Admit(); err != nil {
+			writeRejected(w, pool, err)
+			return
+		}
+		startUploadHandler(w, r, uploads)
+		return
+	}
+	id, rest, _ := strings.Cut(path, "/")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		uploads.mu.Lock()
+		upload, ok := uploads.get(requestTenant(r), id)
+		var view multipartUpload
+		if ok {
+			view = upload.view()
+		}
+		uploads.mu.Unlock()
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Upload not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	case rest == "" && r.Method == http.MethodDelete:
+		uploads.mu.Lock()
+		upload, ok := uploads.get(requestTenant(r), id)
+		if ok {
+			upload.close()
+			delete(uploads.uploads, id)
+		}
+		uploads.mu.Unlock()
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Upload not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(rest, "parts/"):
+		if r.Method != http.MethodPut {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Only PUT supported")
+			return
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(rest, "parts/"))
+		if err != nil || number < 1 || number > maxUploadParts {
+			writeJSONError(w, http.StatusBadRequest, "Part number must be between 1 and 10000")
+			return
+		}
+		// Parts fill the disk like jobs do, so they're turned away alike.
+		if err := pool.Admit(); err != nil {
+			writeRejected(w, pool, err)
+			return
+		}
+		uploadPartHandler(w, r, uploads, id, number)
+	case rest == "complete":
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Only POST supported")
+			return
+		}
+		completeUploadHandler(w, r, uploads, pool, cfg, id)
+	default:
+		writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func startUploadHandler(w http.ResponseWriter, r *http.Request, uploads *Uploads) {
+	var body struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Filename == "" {
+		writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with a filename")
+		return
+	}
+	now := time.Now()
+	upload := &multipartUpload{
+		ID:        newJobID(),
+		Filename:  body.Filename,
+		Parts:     []uploadPart{},
+		CreatedAt: now,
+		ExpiresAt: now.Add(uploads.cfg.UploadTTL),
+		tenant:    requestTenant(r),
+		buffers:   make(map[int]*AudioBuffer),
+	}
+	uploads.mu.Lock()
+	uploads.sweep()
+	pending := 0
+	for _, other := range uploads.uploads {
+		if other.tenant == upload.tenant {
+			pending++
+		}
+	}
+	if pending >= maxPendingUploads {
+		uploads.mu.Unlock()
+		writeJSONError(w, http.StatusServiceUnavailable, "Too many uploads in progress")
+		return
+	}
+	uploads.uploads[upload.ID] = upload
+	view := upload.view()
+	uploads.mu.Unlock()
+	writeJSON(w, http.StatusCreated, view)
+}
+
+// uploadPartHandler stores the body as a part of the upload. The parts
+// together can't exceed the maximum audio size. A Content-MD5 header is
+// checked against the part, like S3 does.
+func uploadPartHandler(w http.ResponseWriter, r *http.Request, uploads *Uploads, id string, number int) {
+	uploads.mu.Lock()
+	upload, ok := uploads.get(requestTenant(r), id)
+	var remaining int64
+	if ok {
+		remaining = uploads.cfg.MaxAudioSize - upload.Size
+		if previous, ok := upload.buffers[number]; ok {
+			remaining += previous.Size()
+		}
+	}
+	uploads.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	// Parts always go to disk: together they're as big as the file.
+	buffer := newAudioBuffer(uploads.cfg.SpillDir, 0, uploads.cfg.encryptionKey)
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(buffer, hash), http.MaxBytesReader(w, r.Body, remaining)); err != nil {
+		buffer.Close()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Upload exceeds the maximum file size")
+		} else {
+			writeJSONError(w, http.StatusBadRequest, "Failed to read part")
+		}
+		return
+	}
+	sum := hash.Sum(nil)
+	if digest := r.Header.Get("Content-MD5"); digest != "" && digest != base64.StdEncoding.EncodeToString(sum) {
+		buffer.Close()
+		writeJSONError(w, http.StatusBadRequest, "Content-MD5 doesn't match the part")
+		return
+	}
+	part := uploadPart{PartNumber: number, Size: buffer.Size(), ETag: `"` + hex.EncodeToString(sum) + `"`}
+
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+	// The upload may have been completed or aborted meanwhile, and other
+	// parts uploaded at the same time count towards the size as well.
+	if current, ok := uploads.uploads[id]; !ok || current != upload {
+		buffer.Close()
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	size := upload.Size + part.Size
+	if previous, ok := upload.buffers[number]; ok {
+		size -= previous.Size()
+	}
+	if size > uploads.cfg.MaxAudioSize {
+		buffer.Close()
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Upload exceeds the maximum file size")
+		return
+	}
+	if previous, ok := upload.buffers[number]; ok {
+		previous.Close()
+		for i := range upload.Parts {
+			if upload.Parts[i].PartNumber == number {
+				upload.Parts = append(upload.Parts[:i], upload.Parts[i+1:]...)
+				break
+			}
+		}
+	}
+	upload.buffers[number] = buffer
+	upload.Parts = append(upload.Parts, part)
+	upload.Size = size
+	w.Header().Set("ETag", part.ETag)
+	writeJSON(w, http.StatusOK, part)
+}
+
+// completeUploadHandler assembles the parts in the order of their numbers
+// and queues the job. If the body lists the parts, as S3 clients send it, the
+// list must match the uploaded parts, so a client whose part upload got lost
+// finds out instead of transcribing a file with a gap. The upload is kept
+// until the job is queued, so a client turned away can retry; one that
+// retries after it was queued gets the job back if it sent an
+// Idempotency-Key. As when submitting a job, run_at schedules it.
+func completeUploadHandler(w http.ResponseWriter, r *http.Request, uploads *Uploads, pool *WorkerPool, cfg Config, id string) {
+	var body struct {
+		Parts []uploadPart `json:"parts"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "Expected a JSON body with the parts")
+			return
+		}
+	}
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	task := &TranscriptionTask{OwnsAudio: true, Tenant: requestTenant(r)}
+	applyQueryOptions(task, r)
+	var err error
+	if task.RunAt, err = runAtParam(r.URL.Query().Get("run_at")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkTaskOptions(cfg, task); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := pool.Admit(); err != nil {
+		writeRejected(w, pool, err)
+		return
+	}
+
+	uploads.mu.Lock()
+	upload, ok := uploads.get(task.Tenant, id)
+	if !ok {
+		uploads.mu.Unlock()
+		if key != "" {
+			// Without audio to read, the fingerprint can't fail.
+			fingerprint, _ := requestFingerprint(task, "upload:"+id)
+			jobID, ok, err := pool.idempotency.Replay(task.Tenant, key, fingerprint)
+			if err != nil {
+				writeRejected(w, pool, err)
+				return
+			}
+			if ok {
+				job, _ := pool.store.Get(jobID)
+				w.Header().Set("Idempotent-Replayed", "true")
+				writeJSON(w, http.StatusOK, withEstimate(pool, job))
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	parts := upload.view().Parts
+	if len(parts) == 0 {
+		uploads.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, "Upload has no parts")
+		return
+	}
+	if body.Parts != nil && !sameParts(body.Parts, parts) {
+		uploads.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, "Listed parts don't match the uploaded parts")
+		return
+	}
+	// Taken out while it's assembled, so parts can't change underneath and
+	// a concurrent complete doesn't queue it twice.
+	delete(uploads.uploads, id)
+	uploads.mu.Unlock()
+	restore := func() {
+		uploads.mu.Lock()
+		uploads.uploads[id] = upload
+		uploads.mu.Unlock()
+	}
+
+	audio := cfg.newAudioBuffer()
+	for _, part := range parts {
+		if _, err := io.Copy(audio, upload.buffers[part.PartNumber].Reader()); err != nil {
+			audio.Close()
+			restore()
+			writeJSONError(w, http.StatusInternalServerError, "Failed to assemble the upload")
+			return
+		}
+	}
+	if err := sniffAudio(audio.Head(sniffLength)); err != nil {
+		audio.Close()
+		restore()
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Unsupported file: "+err.Error())
+		return
+	}
+	task.Filename, task.Audio = upload.Filename, audio
+	job, repeated, err := pool.submitOnce("api", key, "upload:"+id, task)
+	if err != nil {
+		audio.Close()
+		restore()
+		writeRejected(w, pool, err)
+		return
+	}
+	if repeated {
+		// The key was used for another submission; this upload is untouched.
+		restore()
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeJSON(w, http.StatusOK, withEstimate(pool, job))
+		return
+	}
+	upload.close()
+	writeJSON(w, http.StatusAccepted, withEstimate(pool, job))
+}
+
+// sameParts reports whether the listed parts are the uploaded ones, matched
+// by number and, where given, ETag.
+func sameParts(listed, uploaded []uploadPart) bool {
+	if len(listed) != len(uploaded) {
+		return false
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].PartNumber < listed[j].PartNumber })
+	for i, part := range listed {
+		if part.PartNumber != uploaded[i].PartNumber || (part.ETag != "" && part.ETag != uploaded[i].ETag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// anonymousUsage is what jobs without an API key are accounted under: the UI,
+// chat bots, brokers, and the API when it's open.
+const anonymousUsage = "anonymous"
+
+var errQuotaExceeded = errors.New("monthly transcription quota exceeded")
+
+// KeyUsage is what one API key used since the agent started. Minutes are of
+// audio transcribed by completed jobs; bytes are of the audio of all jobs.
+// PeriodMinutes are the minutes of this month, counted against the key's
+// QuotaMinutes if it has a quota.
+type KeyUsage struct {
+	Key           string     `json:"key"`
+	Requests      int64      `json:"requests"`
+	Failed        int64      `json:"failed"`
+	Minutes       float64    `json:"minutes"`
+	Bytes         int64      `json:"bytes"`
+	LastUsed      *time.Time `json:"last_used,omitempty"`
+	PeriodMinutes float64    `json:"period_minutes"`
+	QuotaMinutes  float64    `json:"quota_minutes,omitempty"`
+}
+
+// Usage accounts jobs per API key for chargeback and quotas. Like the
+// metrics, the totals only grow, and start over when the agent restarts;
+// whoever bills takes the difference between two exports. The minutes
+// counted against quotas start over at the beginning of every month (UTC).
+type Usage struct {
+	mu     sync.Mutex
+	since  time.Time
+	keys   map[string]*KeyUsage
+	period time.Time
+}
+
+// NewUsage accounts usage against the quotas, in minutes per month by key
+// name.
+func NewUsage(quotas map[string]float64) *Usage {
+	now := time.Now()
+	usage := &Usage{since: now, keys: map[string]*KeyUsage{}, period: quotaPeriod(now)}
+	for key, quota := range quotas {
+		usage.keys[key] = &KeyUsage{Key: key, QuotaMinutes: quota}
+	}
+	return usage
+}
+
+// quotaPeriod is the start of the month t is in.
+func quotaPeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// QuotaReset is when the current period ends and quotas start over.
+func (u *Usage) QuotaReset() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollPeriod()
+	return u.period.AddDate(0, 1, 0)
+}
+
+// rollPeriod starts a new period if the month is over. It must be called
+// with u.mu held.
+func (u *Usage) rollPeriod() {
+	if period := quotaPeriod(time.Now()); !period.Equal(u.period) {
+		u.period = period
+		for _, usage := range u.keys {
+			usage.PeriodMinutes = 0
+		}
+	}
+}
+
+// CheckQuota returns errQuotaExceeded if the key used up its minutes for the
+// month. A job is only counted once done, so the last one admitted can take a
+// key over its quota.
+func (u *Usage) CheckQuota(key string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollPeriod()
+	usage, ok := u.keys[key]
+	if ok && usage.QuotaMinutes > 0 && usage.PeriodMinutes >= usage.QuotaMinutes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Record accounts a finished job to the key.
+func (u *Usage) Record(key string, bytes int64, transcript *Transcript, err error) {
+	if key == "" {
+		key = anonymousUsage
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollPeriod()
+	usage, ok := u.keys[key]
+	if !ok {
+		usage = &KeyUsage{Key: key}
+		u.keys[key] = usage
+	}
+	usage.Requests++
+	usage.Bytes += bytes
+	now := time.Now()
+	usage.LastUsed = &now
+	if err != nil {
+		usage.Failed++
+		return
+	}
+	minutes := transcriptDuration(transcript) / 60
+	usage.Minutes += minutes
+	usage.PeriodMinutes += minutes
+}
+
+// Snapshot returns the usage of every key that was used or has a quota, by
+// key.
+func (u *Usage) Snapshot() []KeyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollPeriod()
+	snapshot := make([]KeyUsage, 0, len(u.keys))
+	for _, usage := range u.keys {
+		snapshot = append(snapshot, *usage)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Key < snapshot[j].Key })
+	return snapshot
+}
+
+// transcriptDuration is the length of the audio, or of the speech in it for
+// backends that don't report the duration.
+func transcriptDuration(transcript *Transcript) float64 {
+	if transcript.Duration > 0 {
+		return transcript.Duration
+	}
+	if len(transcript.Segments) > 0 {
+		return transcript.Segments[len(transcript.Segments)-1].End
+	}
+	return 0
+}
+
+// usageHandler exports the usage as JSON, or as CSV with format=csv, of all
+// tenants or the one given as tenant=.
+func usageHandler(w http.ResponseWriter, r *http.Request, usage *Usage) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only GET supported")
+		return
+	}
+	now := time.Now().UTC()
+	snapshot := usage.Snapshot()
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		filtered := []KeyUsage{}
+		for _, key := range snapshot {
+			if key.Key == tenant {
+				filtered = append(filtered, key)
+			}
+		}
+		snapshot = filtered
+	}
+	period := usage.QuotaReset().AddDate(0, -1, 0)
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"since": usage.since.UTC(), "until": now, "period": period, "keys": snapshot})
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, now.Format("20060102-150405")))
+		out := csv.NewWriter(w)
+		out.Write([]string{"key", "requests", "failed", "minutes", "bytes", "last_used", "since", "until", "period", "period_minutes", "quota_minutes"})
+		for _, key := range snapshot {
+			lastUsed := ""
+			if key.LastUsed != nil {
+				lastUsed = key.LastUsed.UTC().Format(time.RFC3339)
+			}
+			out.Write([]string{
+				key.Key,
+				strconv.FormatInt(key.Requests, 10),
+				strconv.FormatInt(key.Failed, 10),
+				strconv.FormatFloat(key.Minutes, 'f', 2, 64),
+				strconv.FormatInt(key.Bytes, 10),
+				lastUsed,
+				usage.since.UTC().Format(time.RFC3339),
+				now.Format(time.RFC3339),
+				period.Format("2006-01"),
+				strconv.FormatFloat(key.PeriodMinutes, 'f', 2, 64),
+				strconv.FormatFloat(key.QuotaMinutes, 'f', 2, 64),
+			})
+		}
+		out.Flush()
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
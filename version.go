@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Without them the commit and date come from the VCS stamp go build embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo identifies the running binary, for checking what a rollout
+// actually deployed.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features,omitempty"`
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			case setting.Key == "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	return info
+}
+
+// enabledFeatures lists the optional integrations and processing steps the
+// configuration turns on.
+func enabledFeatures(cfg Config) []string {
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"tls", cfg.TLSCert != ""},
+		{"h2c", cfg.H2C},
+		{"compare", cfg.compareEnabled()},
+		{"canary", cfg.canaryEnabled()},
+		{"shadow", cfg.ShadowURL != ""},
+		{"chunking", cfg.ChunkDuration > 0},
+		{"summarize", cfg.summarizeEnabled()},
+		{"translate", cfg.translateEnabled()},
+		{"punctuation", cfg.RestorePunctuation != ""},
+		{"redaction", cfg.Redact != "" || cfg.RedactPatterns != ""},
+		{"profanity-filter", cfg.ProfanityFilter != "" && cfg.ProfanityFilter != profanityOff},
+		{"keyword-alerts", cfg.WatchPhrases != "" || cfg.WatchPhrasesFile != ""},
+		{"diarization", cfg.DiarizationURL != ""},
+		{"vocabulary", cfg.Vocabulary != "" || cfg.VocabularyFile != ""},
+		{"custom-pipeline", cfg.Pipeline != defaultPipeline || cfg.PipelinesFile != ""},
+		{"model-management", cfg.ModelsDir != ""},
+		{"api-keys", cfg.APIKeysFile != ""},
+		{"result-links", cfg.PublicURL != ""},
+		{"encryption-at-rest", cfg.EncryptionKeyFile != "" || cfg.EncryptionKeyCommand != ""},
+		{"tenants", cfg.APIKeysFile != "" || cfg.TenantHeader != ""},
+		{"audit-log", cfg.AuditLog != ""},
+		{"warm-up", cfg.WarmUp},
+		{"download-restrictions", cfg.DownloadAllowedHosts != "" || cfg.DownloadBlockPrivate},
+		{"proxies", cfg.DownloadProxy != "" || cfg.BackendProxy != ""},
+		{"parallel-downloads", cfg.DownloadParallelism > 1},
+		{"download-dns-cache", cfg.DownloadDNSTTL > 0},
+		{"download-sessions", cfg.DownloadCookiesFile != "" || cfg.DownloadLoginURL != ""},
+		{"s3-uploads", cfg.S3Bucket != ""},
+		{"oidc", cfg.OIDCIssuer != ""},
+		{"read-only", cfg.ReadOnly},
+		{"scheduling", cfg.ScheduleDir != ""},
+		{"outbound-binding", cfg.DownloadIPFamily != "" || cfg.DownloadBind != "" || cfg.BackendIPFamily != "" || cfg.BackendBind != ""},
+		{"ops-alerts", cfg.OpsAlertWebhookURL != "" || cfg.OpsAlertSlackURL != "" || cfg.OpsAlertPagerDutyKey != ""},
+		{"telegram", cfg.TelegramToken != ""},
+		{"discord", cfg.DiscordToken != ""},
+		{"matrix", cfg.MatrixToken != ""},
+		{"email", cfg.IMAPAddr != ""},
+		{"kafka", cfg.KafkaBrokers != ""},
+		{"nats", cfg.NATSURL != ""},
+		{"amqp", cfg.AMQPURL != ""},
+		{"mqtt", cfg.MQTTURL != ""},
+		{"sip", cfg.SIPAddr != ""},
+		{"zoom", cfg.ZoomWebhookSecret != ""},
+		{"meet", cfg.MeetWebhookSecret != ""},
+	}
+	var enabled []string
+	for _, feature := range features {
+		if feature.enabled {
+			enabled = append(enabled, feature.name)
+		}
+	}
+	return enabled
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request, cfg Config) {
+	info := buildInfo()
+	info.Features = enabledFeatures(cfg)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func printVersion() {
+	info := buildInfo()
+	fields := []string{"whisper-transcribe-agent " + info.Version}
+	if info.Commit != "" {
+		fields = append(fields, "commit "+info.Commit)
+	}
+	if info.BuildDate != "" {
+		fields = append(fields, "built "+info.BuildDate)
+	}
+	fmt.Println(strings.Join(append(fields, info.GoVersion), ", "))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxRequestVocabulary caps the terms a request may add, in bytes. Whisper
+// only looks at the last 224 tokens of the prompt anyway.
+const maxRequestVocabulary = 1000
+
+var errVocabularyTooLong = errors.Errorf("vocabulary must be at most %d characters", maxRequestVocabulary)
+
+// loadVocabulary reads the deployment's domain terms: the comma-separated
+// terms plus those in termsFile, one per line.
+func loadVocabulary(terms, termsFile string) ([]string, error) {
+	vocabulary := splitTerms(terms)
+	if termsFile == "" {
+		return vocabulary, nil
+	}
+	file, err := os.Open(termsFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if term := strings.TrimSpace(scanner.Text()); term != "" && !strings.HasPrefix(term, "#") {
+			vocabulary = append(vocabulary, term)
+		}
+	}
+	return vocabulary, errors.WithStack(scanner.Err())
+}
+
+func splitTerms(terms string) []string {
+	var split []string
+	for _, term := range strings.Split(terms, ",") {
+		if term = strings.TrimSpace(term); term != "" {
+			split = append(split, term)
+		}
+	}
+	return split
+}
+
+// vocabularyParam reads the comma-separated vocabulary request parameter.
+func vocabularyParam(r *http.Request) []string {
+	return splitTerms(r.URL.Query().Get("vocabulary"))
+}
+
+func checkVocabulary(terms []string) error {
+	if len(strings.Join(terms, ", ")) > maxRequestVocabulary {
+		return errVocabularyTooLong
+	}
+	return nil
+}
+
+// whisperPrompt turns the deployment's and the request's terms into the
+// prompt whisper is primed with, so it spells them the way they're listed.
+// The request's terms go last: if the prompt is too long, whisper drops the
+// start.
+func whisperPrompt(deployment, request []string) string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, term := range append(append([]string(nil), deployment...), request...) {
+		if !seen[strings.ToLower(term)] {
+			seen[strings.ToLower(term)] = true
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	return strings.Join(terms, ", ") + "."
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	warmupCheckInterval = 15 * time.Second
+	warmupSampleRate    = 16000
+)
+
+// Warm-up states, as reported by /readyz.
+const (
+	warmupPending = "pending"
+	warmupWarm    = "warm"
+	warmupFailed  = "failed"
+)
+
+// Warmup transcribes a second of silence when the agent starts and whenever
+// the backend comes back after being down, so the model is loaded before the
+// first real job instead of that job paying for the cold start. Until the
+// backend is warm, the agent reports itself not ready.
+type Warmup struct {
+	cfg Config
+
+	mu      sync.Mutex
+	state   string
+	err     error
+	backend bool
+}
+
+func NewWarmup(metrics *Metrics, cfg Config) *Warmup {
+	w := &Warmup{cfg: cfg, state: warmupPending}
+	metrics.GaugeFunc("whisper_agent_backend_warm", "1 once the backend has transcribed the warm-up clip since it last came up, else 0.", func() float64 {
+		if w.Ready() {
+			return 1
+		}
+		return 0
+	})
+	return w
+}
+
+// warmupClip is a second of silence as a 16 kHz WAV file.
+func warmupClip() []byte {
+	samples := warmupSampleRate
+	return append(wavHeader(warmupSampleRate, samples), make([]byte, samples*2)...)
+}
+
+// Run warms the backend up, then watches it and warms it up again after it
+// was down, e.g. restarted and lost its model, until the process exits.
+func (w *Warmup) Run() {
+	w.warm()
+	for range time.Tick(warmupCheckInterval) {
+		up := checkBackend(w.cfg.WhisperURL) == nil
+		w.mu.Lock()
+		reconnected := up && !w.backend
+		w.backend = up
+		retry := up && w.state == warmupFailed
+		if !up {
+			w.state = warmupPending
+		}
+		w.mu.Unlock()
+		if reconnected || retry {
+			w.warm()
+		}
+	}
+}
+
+func (w *Warmup) warm() {
+	started := time.Now()
+	clip := warmupClip()
+	_, err := transcribe(context.Background(), w.cfg.WhisperURL, w.cfg.WhisperModel, "", "warmup.wav", bytes.NewReader(clip), int64(len(clip)))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+	if err != nil {
+		w.state = warmupFailed
+		log.Printf("Warming up the backend failed: %v", err)
+		return
+	}
+	w.state, w.backend = warmupWarm, true
+	log.Printf("Backend warmed up in %s", time.Since(started).Round(time.Millisecond))
+}
+
+// Ready reports whether the backend is warm.
+func (w *Warmup) Ready() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state == warmupWarm
+}
+
+// Status returns the warm-up state and, if it failed, why.
+func (w *Warmup) Status() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state, w.err
+}
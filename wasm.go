@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var wasmMagic = []byte("\x00asm")
+
+// wasmStage runs a transcript transform compiled to a WASI module. The module
+// reads the transcript JSON on stdin and writes the transformed one to
+// stdout. It runs in the external runtime at --wasm-runtime, invoked like
+// wasmtime, without preopened directories, environment or network, with its
+// memory capped at --wasm-max-memory and its instructions at --wasm-fuel, and
+// killed after pluginTimeout. The isolation is the runtime's, not the
+// agent's: only use a runtime that enforces those options for modules of
+// tenants.
+func wasmStage(p *WorkerPool, task *TranscriptionTask, transcript *Transcript, module string) {
+	runTranscriptPlugin(task, transcript, "wasm", func(input []byte) ([]byte, error) {
+		return runWASM(p.cfg, module, bytes.NewReader(input))
+	})
+}
+
+// checkWASMModule makes sure a module named in a pipeline exists and is WASM,
+// so a typo fails at startup rather than on every job.
+func checkWASMModule(module string) error {
+	file, err := os.Open(module)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	magic := make([]byte, len(wasmMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, wasmMagic) {
+		return errors.Errorf("%s is not a WASM module", module)
+	}
+	return nil
+}
+
+func runWASM(cfg Config, module string, input io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg.WASMRuntime, "run",
+		"-W", "max-memory-size="+strconv.FormatInt(cfg.WASMMaxMemory, 10),
+		"-W", "fuel="+strconv.FormatInt(cfg.WASMFuel, 10),
+		module)
+	cmd.Env = []string{}
+	cmd.Dir = os.TempDir()
+	var stdout bytes.Buffer
+	var stderr strings.Builder
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = input, &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", module, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
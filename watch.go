@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runWatch implements the watch subcommand: a daemon that transcribes audio
+// files as they appear in the watched directories, e.g. recordings exported by
+// a PBX. Files already present at startup are transcribed too, unless their
+// transcript exists.
+func runWatch(args []string) {
+	var cfg Config
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	bindBackendFlags(flags, &cfg)
+	format := flags.String("format", "txt", "Output format: "+strings.Join(exportFormatNames(), ", "))
+	out := flags.String("out", "", "Directory the transcripts are written to")
+	parallel := flags.Int("parallel", 1, "Number of files transcribed concurrently")
+	dirs := parseInterspersed(flags, args)
+
+	if len(dirs) == 0 || *out == "" {
+		log.Fatal("Usage: whisper-transcribe-agent watch --out <dir> [flags] <dir>...")
+	}
+	if cfg.WhisperURL == "" || cfg.WhisperModel == "" {
+		log.Fatal("Flags --whisper-server-url and --whisper-model must be set")
+	}
+	if *parallel < 1 {
+		log.Fatal("--parallel must be at least 1")
+	}
+	exporter, ok := exportFormats[*format]
+	if !ok {
+		log.Fatalf("Unsupported format %q", *format)
+	}
+
+	cfg.Workers, cfg.QueueSize = *parallel, *parallel
+	pool := newLocalPool(cfg)
+
+	paths := make(chan string)
+	for i := 0; i < *parallel; i++ {
+		go func() {
+			for path := range paths {
+				started := time.Now()
+				output := outputPath(filepath.Dir(path), *out, path, exporter.Extension)
+				status, err := transcribeToFile(pool, cfg, exporter, path, output, false)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				} else if status != "skipped" {
+					fmt.Fprintf(os.Stderr, "%s: %s in %s\n", path, status, time.Since(started).Round(time.Millisecond))
+				}
+			}
+		}()
+	}
+
+	found := make(chan string)
+	go func() {
+		log.Fatal(watchDirs(dirs, found))
+	}()
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && isAudioFile(entry.Name()) {
+				paths <- filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+
+	log.Printf("Watching %s for new audio...", strings.Join(dirs, ", "))
+	for path := range found {
+		if isAudioFile(path) {
+			paths <- path
+		}
+	}
+}
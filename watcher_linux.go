@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchDirs reports files in the given directories once they are completely
+// written (closed after writing, or moved in). It only returns on error.
+func watchDirs(dirs []string, found chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	defer syscall.Close(fd)
+
+	watches := make(map[int32]string)
+	for _, dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch "+dir, err)
+		}
+		watches[int32(wd)] = dir
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("read inotify", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00")
+			offset = nameStart + int(event.Len)
+
+			if dir, ok := watches[event.Wd]; ok && len(name) > 0 && event.Mask&syscall.IN_ISDIR == 0 {
+				found <- filepath.Join(dir, string(name))
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const watchPollInterval = 2 * time.Second
+
+type watchedFile struct {
+	size     int64
+	modified time.Time
+	reported bool
+}
+
+// watchDirs polls the directories where inotify isn't available. A file is
+// reported once its size and modification time stop changing between polls.
+func watchDirs(dirs []string, found chan<- string) error {
+	files := make(map[string]*watchedFile)
+	for first := true; ; first = false {
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil || info.IsDir() {
+					continue
+				}
+
+				path := filepath.Join(dir, entry.Name())
+				file, ok := files[path]
+				if !ok {
+					// Files present on the first poll are handled by the initial scan.
+					files[path] = &watchedFile{size: info.Size(), modified: info.ModTime(), reported: first}
+					continue
+				}
+				if file.size != info.Size() || !file.modified.Equal(info.ModTime()) {
+					file.size, file.modified, file.reported = info.Size(), info.ModTime(), false
+					continue
+				}
+				if !file.reported {
+					file.reported = true
+					found <- path
+				}
+			}
+		}
+		time.Sleep(watchPollInterval)
+	}
+}
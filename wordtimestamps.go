@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// wordTimestamps is the assistant message content of a chat completion with
+// word_timestamps, for voice agent frontends that align the words to the
+// audio themselves. Words is empty if the backend doesn't report word timings.
+type wordTimestamps struct {
+	Text     string  `json:"text"`
+	Language string  `json:"language,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Words    []Word  `json:"words"`
+}
+
+func wantsWordTimestamps(r *http.Request) bool {
+	timestamps, _ := strconv.ParseBool(r.URL.Query().Get("word_timestamps"))
+	return timestamps
+}
+
+// wordTimestampsContent renders the transcript as a wordTimestamps document.
+func wordTimestampsContent(transcript *Transcript) string {
+	content := wordTimestamps{
+		Text:     transcript.Text,
+		Language: transcript.Language,
+		Duration: transcript.Duration,
+		Words:    transcript.Words,
+	}
+	if content.Words == nil {
+		content.Words = []Word{}
+	}
+	data, _ := json.Marshal(content)
+	return string(data)
+}